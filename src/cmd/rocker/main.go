@@ -17,19 +17,34 @@
 package main
 
 import (
+	"bytes"
+	"crypto/md5"
+	"encoding/json"
+	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
+	"os/exec"
+	"os/signal"
+	"os/user"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"rocker/build"
 	"rocker/debugtrap"
 	"rocker/dockerclient"
+	"rocker/imagename"
 	"rocker/template"
 	"rocker/textformatter"
 	"rocker/util"
 
 	"github.com/codegangsta/cli"
+	"github.com/docker/docker/pkg/term"
 	"github.com/docker/docker/pkg/units"
 	"github.com/fatih/color"
 	"github.com/fsouza/go-dockerclient"
@@ -72,7 +87,81 @@ func main() {
 		{"Stas Levental", "stas.levental@grammarly.com"},
 	}
 
-	app.Flags = append([]cli.Flag{
+	app.Flags = globalFlags()
+
+	app.Commands = []cli.Command{
+		{
+			Name:   "build",
+			Usage:  "launches a build for the specified Rockerfile",
+			Action: buildCommand,
+			Flags:  buildFlags(),
+			Before: globalBefore,
+		},
+		{
+			Name:   "warm",
+			Usage:  "builds the Rockerfile up to the cache checkpoint to fill the cache, nothing is tagged or pushed",
+			Action: buildCommand,
+			Flags:  warmFlags(),
+			Before: globalBefore,
+		},
+		{
+			Name:   "gc-images",
+			Usage:  "removes rocker-produced images older than a given threshold",
+			Action: gcImagesCommand,
+			Flags: []cli.Flag{
+				cli.DurationFlag{
+					Name:  "older-than",
+					Value: 72 * time.Hour,
+					Usage: "remove images created earlier than this duration ago",
+				},
+				cli.BoolFlag{
+					Name:  "dangling",
+					Usage: "remove untagged images",
+				},
+				cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "only list images that would be removed",
+				},
+			},
+			Before: globalBefore,
+		},
+		{
+			Name:   "inspect",
+			Usage:  "prints the metadata of IMAGE built with --meta",
+			Action: inspectCommand,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "format",
+					Value: "text",
+					Usage: "output format, either text or json",
+				},
+			},
+			Before: globalBefore,
+		},
+		{
+			Name:   "serve",
+			Usage:  "runs the HTTP API triggering builds and exposing their metrics",
+			Action: serveCommand,
+			Flags:  serveFlags(),
+			Before: globalBefore,
+		},
+		dockerclient.InfoCommandSpec(),
+	}
+
+	app.CommandNotFound = func(ctx *cli.Context, command string) {
+		fmt.Printf("Command not found: %v\n", command)
+		os.Exit(1)
+	}
+
+	if err := app.Run(os.Args); err != nil {
+		fmt.Printf(err.Error())
+		os.Exit(1)
+	}
+}
+
+// globalFlags returns the flags shared by all commands
+func globalFlags() []cli.Flag {
+	return append([]cli.Flag{
 		cli.BoolFlag{
 			Name: "verbose, vv, D",
 		},
@@ -82,31 +171,92 @@ func main() {
 		cli.BoolTFlag{
 			Name: "colors",
 		},
+		cli.StringFlag{
+			Name:   "color-theme",
+			Usage:  "palette of log colors: default, dark, light or colorblind; colors of particular levels can be overridden with ROCKER_COLOR_<LEVEL> env variables, e.g. ROCKER_COLOR_INFO=cyan",
+			EnvVar: "ROCKER_COLOR_THEME",
+		},
+		cli.StringFlag{
+			Name:  "log-timestamps",
+			Value: "relative",
+			Usage: "timestamps of log lines: relative (seconds since start), rfc3339 or none",
+		},
 		cli.BoolFlag{
 			Name: "cmd, C",
 		},
 	}, dockerclient.GlobalCliParams()...)
+}
 
-	buildFlags := []cli.Flag{
+// warmFlags are the flags of rocker warm, which builds with the flags of
+// rocker build
+func warmFlags() []cli.Flag {
+	return append(buildFlags(),
+		cli.StringFlag{
+			Name:  "until",
+			Usage: "the number of the last instruction to build, by default the build stops at the \"# rocker:cache-checkpoint\" comment",
+		},
+	)
+}
+
+// buildFlags returns the flags of the build command
+func buildFlags() []cli.Flag {
+	return []cli.Flag{
 		cli.StringFlag{
 			Name:  "file, f",
 			Value: "Rockerfile",
-			Usage: "rocker build file to execute",
+			Usage: "rocker build file to execute, \"-\" reads it from stdin; ATTACH then reads from the terminal",
 		},
 		cli.StringFlag{
 			Name:  "auth, a",
 			Value: "",
-			Usage: "Username and password in user:password format",
+			Usage: "Username and password in user:password format, deprecated in favor of --auth-file",
+		},
+		cli.StringFlag{
+			Name:   "auth-file",
+			Usage:  "File with username and password in user:password format, it should not be readable by others",
+			EnvVar: "ROCKER_AUTH_FILE",
 		},
 		cli.StringSliceFlag{
 			Name:  "var",
 			Value: &cli.StringSlice{},
-			Usage: "set variables to pass to build tasks, value is like \"key=value\"",
+			Usage: "set variables to pass to build tasks, value is like \"key=value\", \"true\", \"false\" and a \"key\" without value are booleans; overrides the variables of --vars",
 		},
 		cli.StringSliceFlag{
 			Name:  "vars",
 			Value: &cli.StringSlice{},
-			Usage: "Load variables form a file, either JSON or YAML. Can pass multiple of this.",
+			Usage: "Load variables form a file, either JSON, YAML or TOML, \"-\" reads them from stdin. Can pass multiple of this, lists of the files are appended to each other, the other values are overridden.",
+		},
+		cli.StringFlag{
+			Name:  "vars-merge",
+			Value: string(template.MergeAppend),
+			Usage: "how lists of the same type from several --vars are merged: \"append\" them to each other or \"override\" them as the other values",
+		},
+		cli.StringFlag{
+			Name:  "vars-format",
+			Usage: "format of the --vars read from stdin, either json, yaml or toml; detected by the content if not set",
+		},
+		cli.StringFlag{
+			Name:  "vars-consul",
+			Usage: "Load variables from the Consul KV store, value is like \"addr/prefix\"; variables of --vars and --var take precedence",
+		},
+		cli.BoolFlag{
+			Name:  "strict-templates",
+			Usage: "fail the rendering of the Rockerfile on references to variables that are not set, instead of rendering them as \"<no value>\"",
+		},
+		cli.BoolFlag{
+			Name:  "allow-template-network",
+			Usage: "allow template functions that query the network, e.g. resolveDigest pinning images to the digests from the registry",
+		},
+		cli.StringSliceFlag{
+			Name:  "mask",
+			Value: &cli.StringSlice{},
+			Usage: "hide the value from the log output, e.g. a password or a token. Can pass multiple of this.",
+		},
+		cli.StringFlag{
+			Name:   "cache-backend",
+			Value:  "fs",
+			Usage:  "where to keep the cache: fs keeps it in --cache-dir, memory keeps it for the lifetime of the process, e.g. for single-shot CI builds",
+			EnvVar: "ROCKER_CACHE_BACKEND",
 		},
 		cli.BoolFlag{
 			Name:  "no-cache",
@@ -117,13 +267,19 @@ func main() {
 			Usage: "removes any cache that hit and save the new one",
 		},
 		cli.StringFlag{
-			Name:  "cache-dir",
-			Value: "~/.rocker_cache",
-			Usage: "Set the directory where the cache will be stored",
+			Name:   "cache-dir",
+			Value:  "~/.rocker_cache",
+			Usage:  "Set the directory where the cache will be stored",
+			EnvVar: "ROCKER_CACHE_DIR",
+		},
+		cli.StringFlag{
+			Name:  "export-transport",
+			Value: build.ExportTransportAuto,
+			Usage: "how EXPORT and IMPORT copy files: \"tar\" streams them through the docker API, \"rsync\" runs rsync in a container, \"auto\" uses tar for the files up to 1MB and rsync for larger ones",
 		},
 		cli.BoolFlag{
 			Name:  "no-reuse",
-			Usage: "suppresses reuse for all the volumes in the build",
+			Usage: "suppresses reuse for all the MOUNT volumes in the build, they are made fresh and removed after the build; MOUNT --no-reuse=false keeps the reuse of a volume",
 		},
 		cli.BoolFlag{
 			Name:  "push",
@@ -133,6 +289,10 @@ func main() {
 			Name:  "pull",
 			Usage: "always attempt to pull a newer version of the FROM images",
 		},
+		cli.StringFlag{
+			Name:  "from-override",
+			Usage: "build the first FROM from the given image instead of the one of the Rockerfile",
+		},
 		cli.BoolFlag{
 			Name:  "attach",
 			Usage: "attach to a container in place of ATTACH command",
@@ -145,6 +305,10 @@ func main() {
 			Name:  "print",
 			Usage: "just print the Rockerfile after template processing and stop",
 		},
+		cli.BoolFlag{
+			Name:  "validate",
+			Usage: "parse the Rockerfile after template processing, validate arguments of every command and stop",
+		},
 		cli.BoolFlag{
 			Name:  "demand-artifacts",
 			Usage: "fail if artifacts not found for {{ image }} helpers",
@@ -153,35 +317,257 @@ func main() {
 			Name:  "id",
 			Usage: "override the default id generation strategy for current build",
 		},
+		cli.StringSliceFlag{
+			Name:  "id-component",
+			Value: &cli.StringSlice{},
+			Usage: "add a key=value component to the id of the build, e.g. os=linux for a matrix build; the components are sorted by the keys",
+		},
+		cli.StringFlag{
+			Name:   "artifacts-path",
+			Usage:  "put artifacts (files with pushed images description) to the directory",
+			EnvVar: "ROCKER_ARTIFACTS_PATH",
+		},
+		cli.StringFlag{
+			Name:  "dump-states",
+			Usage: "write the build state after every step to JSON files in the directory, useful for cache debugging",
+		},
+		cli.StringSliceFlag{
+			Name:  "add-context",
+			Value: &cli.StringSlice{},
+			Usage: "add a named build context to COPY files from with --from-context, value is like \"name=docker-image://image:tag\"",
+		},
+		cli.StringFlag{
+			Name:  "manifest",
+			Usage: "write the list of files injected by COPY/ADD with their sizes and sha256 checksums to a JSON file",
+		},
 		cli.StringFlag{
-			Name:  "artifacts-path",
-			Usage: "put artifacts (files with pushed images description) to the directory",
+			Name:  "provenance",
+			Usage: "write base images, produced images and layers of pulled and pushed images to a JSON file, see build.Provenance for the schema",
+		},
+		cli.StringFlag{
+			Name:  "output-config",
+			Usage: "write the config of the resulting image, e.g. env, cmd, entrypoint, labels and exposed ports, to a JSON file",
 		},
 		cli.BoolFlag{
 			Name:  "no-garbage",
 			Usage: "remove the images from the tail if not tagged",
 		},
-	}
-
-	app.Commands = []cli.Command{
-		{
-			Name:   "build",
-			Usage:  "launches a build for the specified Rockerfile",
-			Action: buildCommand,
-			Flags:  buildFlags,
-			Before: globalBefore,
+		cli.BoolFlag{
+			Name:  "print-context-checksum",
+			Usage: "calculate the checksum of the build context and the rendered Rockerfile, print it and save to the artifacts",
+		},
+		cli.BoolFlag{
+			Name:  "empty-layers",
+			Usage: "commit metadata-only steps (ENV, LABEL, WORKDIR, etc.) as empty layers for reproducible images",
+		},
+		cli.BoolFlag{
+			Name:  "reproducible",
+			Usage: "commit layers with normalized timestamps and metadata instead of `docker commit`, so the same build produces the same image digests",
+		},
+		cli.StringFlag{
+			Name:   "source-date-epoch",
+			Usage:  "set the created time of the committed images to the given unix time, e.g. the time of the source commit",
+			EnvVar: "SOURCE_DATE_EPOCH",
+		},
+		cli.BoolFlag{
+			Name:  "log-steps",
+			Usage: "prefix every log line with the number of the build step, e.g. [3/10]",
+		},
+		cli.BoolFlag{
+			Name:  "print-image-id",
+			Usage: "print only the ID of the built image to stdout, like `docker build -q`; the log goes to stderr",
+		},
+		cli.BoolFlag{
+			Name:  "events-json",
+			Usage: "write build events (step start/end, cache hits, pulls, pushes, errors) to stdout as JSON, one object per line; the log goes to stderr",
+		},
+		cli.BoolFlag{
+			Name:  "merge-output",
+			Usage: "log stdout and stderr of RUN steps through a single stream preserving the order of lines",
+		},
+		cli.StringFlag{
+			Name:  "upload-chunk-size",
+			Usage: "upload files of COPY/ADD to the container by chunks of a given size, e.g. 512MB, so a failed upload does not restart from zero",
+		},
+		cli.StringFlag{
+			Name:  "max-size",
+			Usage: "fail the build if the resulting image is larger than the given size, e.g. 500MB, and report its largest layers",
+		},
+		cli.IntFlag{
+			Name:  "upload-retries",
+			Value: 3,
+			Usage: "number of retries of a failed chunk upload, used with --upload-chunk-size",
+		},
+		cli.BoolFlag{
+			Name:  "allow-privileged",
+			Usage: "allow RUN --privileged steps to run containers in privileged mode",
+		},
+		cli.BoolFlag{
+			Name:  "push-best-effort",
+			Usage: "continue the build if a PUSH fails and report the failed pushes at the end, see --push-fail-on",
+		},
+		cli.StringFlag{
+			Name:  "push-fail-on",
+			Value: build.PushFailOnAll,
+			Usage: "when --push-best-effort fails the build: \"all\" if all pushes of an image failed, \"any\" if any push failed, \"none\" never",
+		},
+		cli.BoolFlag{
+			Name:  "sign",
+			Usage: "sign the pushed images by their digests with cosign, keyless unless --sign-key is given",
+		},
+		cli.StringFlag{
+			Name:  "sign-key",
+			Usage: "path or KMS URI of the cosign key to sign the pushed images with, implies --sign; the key password is taken from COSIGN_PASSWORD",
+		},
+		cli.BoolFlag{
+			Name:  "verify-base-signatures",
+			Usage: "verify the signatures of the FROM images with cosign following --trust-policy, fail the build on unsigned or untrusted ones",
+		},
+		cli.StringFlag{
+			Name:  "trust-policy",
+			Usage: "YAML file telling whom the base images should be signed by: either key, or identity and issuer for keyless signatures; skip lists the images not verified",
+		},
+		cli.BoolFlag{
+			Name:  "push-changed",
+			Usage: "skip the pushes of the tags already referring to the built image in the registry, report the pushed and skipped images at the end",
+		},
+		cli.StringSliceFlag{
+			Name:  "set",
+			Value: &cli.StringSlice{},
+			Usage: "override a field of the builder config, value is like \"NoGarbage=true\"; for experiments, the dedicated flags are preferred",
+		},
+		cli.StringSliceFlag{
+			Name:  "annotation",
+			Value: &cli.StringSlice{},
+			Usage: "set an annotation of the image manifest, value is like \"key=value\"; overrides ANNOTATION of the Rockerfile, see --oci-layout",
+		},
+		cli.StringFlag{
+			Name:  "oci-layout",
+			Usage: "export the built image with its annotations to the directory as an OCI image layout",
+		},
+		cli.StringFlag{
+			Name:  "context-tar",
+			Usage: "take the context from a tar archive, \"-\" reads it from stdin; ATTACH then reads from the terminal",
+		},
+		cli.StringFlag{
+			Name:  "context-from-git",
+			Usage: "take the context from the git tree-ish, e.g. a commit or a tag, instead of the working tree of the context directory",
+		},
+		cli.StringFlag{
+			Name:  "plan",
+			Usage: "build the plan made by --print-plan instead of the Rockerfile, the templates are not rendered",
+		},
+		cli.BoolFlag{
+			Name:  "print-plan",
+			Usage: "print the resolved build plan as JSON and exit",
+		},
+		cli.BoolFlag{
+			Name:  "watch",
+			Usage: "watch the Rockerfile, the context directory and the vars files, and rebuild on changes until interrupted",
+		},
+		cli.DurationFlag{
+			Name:  "watch-interval",
+			Value: 500 * time.Millisecond,
+			Usage: "how often --watch checks the files for changes",
+		},
+		cli.DurationFlag{
+			Name:  "watch-debounce",
+			Value: time.Second,
+			Usage: "--watch rebuilds once files have not changed for this long",
+		},
+		cli.BoolFlag{
+			Name:  "explain",
+			Usage: "print for every step why it was executed or skipped, e.g. a cache hit or a cache busted by a previous step",
+		},
+		cli.BoolFlag{
+			Name:  "compare-history",
+			Usage: "compare the history of the built image with the plan and report where they diverge, to debug unexpected cache hits",
+		},
+		cli.BoolFlag{
+			Name:  "incremental-context",
+			Usage: "upload only the files changed since the last whole upload of a COPY/ADD step, on top of its image; such images are not cached; always on with --watch",
+		},
+		cli.BoolFlag{
+			Name:  "attach-on-error",
+			Usage: "when a RUN step fails, attach to a shell in a container of its state to investigate; requires stdin to be a terminal",
+		},
+		cli.BoolFlag{
+			Name:  "verify-push",
+			Usage: "pull every pushed image back from the registry by its digest to make sure it is retrievable, fail the build otherwise",
+		},
+		cli.StringFlag{
+			Name:  "post-run",
+			Usage: "after a successful build, run the shell command in a container of the resulting image, e.g. 'app --version'; the build fails if it exits non-zero",
+		},
+		cli.DurationFlag{
+			Name:  "rate-limit-max-wait",
+			Value: imagename.RateLimitMaxWait,
+			Usage: "how long to retry pulls and registry requests rate limited with 429 Too Many Requests, 0 fails them immediately",
+		},
+		cli.IntFlag{
+			Name:  "registry-concurrency",
+			Value: imagename.RegistryConcurrency,
+			Usage: "how many requests listing tags and resolving digests may be sent to registries at once, 0 removes the limit",
+		},
+		cli.DurationFlag{
+			Name:  "commit-inspect-timeout",
+			Value: 10 * time.Second,
+			Usage: "how long to wait for a committed image to appear on a busy daemon before the step fails",
+		},
+		cli.DurationFlag{
+			Name:  "lock-timeout",
+			Usage: "how long to wait for another build of the same Rockerfile or --id on this host to finish, forever by default",
+		},
+		cli.BoolFlag{
+			Name:  "no-wait",
+			Usage: "fail immediately if another build of the same Rockerfile or --id is running on this host",
+		},
+		cli.BoolFlag{
+			Name:  "forbid-latest",
+			Usage: "fail the build if a FROM image is not pinned, i.e. has the latest tag or no tag at all",
+		},
+		cli.StringSliceFlag{
+			Name:  "allow-latest",
+			Value: &cli.StringSlice{},
+			Usage: "image that is allowed to be used with the latest tag by --forbid-latest, e.g. ubuntu",
+		},
+		cli.StringSliceFlag{
+			Name:  "cap-add",
+			Value: &cli.StringSlice{},
+			Usage: "add a Linux capability to containers of all RUN steps, e.g. NET_ADMIN",
+		},
+		cli.StringSliceFlag{
+			Name:  "cap-drop",
+			Value: &cli.StringSlice{},
+			Usage: "drop a Linux capability from containers of all RUN steps, e.g. MKNOD",
+		},
+		cli.StringSliceFlag{
+			Name:  "device",
+			Value: &cli.StringSlice{},
+			Usage: "add a host device to containers of all RUN steps, value is like \"/dev/fuse[:/dev/fuse[:rwm]]\"",
+		},
+		cli.StringFlag{
+			Name:  "gpus",
+			Usage: "GPUs to expose to containers of all RUN steps, e.g. all, 2 or device=0",
+		},
+		cli.StringSliceFlag{
+			Name:  "sysctl",
+			Value: &cli.StringSlice{},
+			Usage: "set a kernel parameter for containers of all RUN steps, value is like \"net.core.somaxconn=1024\"",
+		},
+		cli.BoolFlag{
+			Name:  "read-only",
+			Usage: "run the containers of all RUN steps with read-only root filesystem, they can write to tmpfs given with RUN --mount only",
+		},
+		cli.StringSliceFlag{
+			Name:  "security-opt",
+			Value: &cli.StringSlice{},
+			Usage: "security option for containers of all RUN steps, e.g. \"seccomp=profile.json\" or \"no-new-privileges\", same as for docker run",
+		},
+		cli.BoolFlag{
+			Name:  "build-proxy",
+			Usage: "pass the proxy variables of the host, e.g. http_proxy, to RUN steps without committing them to the image",
 		},
-		dockerclient.InfoCommandSpec(),
-	}
-
-	app.CommandNotFound = func(ctx *cli.Context, command string) {
-		fmt.Printf("Command not found: %v\n", command)
-		os.Exit(1)
-	}
-
-	if err := app.Run(os.Args); err != nil {
-		fmt.Printf(err.Error())
-		os.Exit(1)
 	}
 }
 
@@ -193,151 +579,883 @@ func globalBefore(c *cli.Context) error {
 }
 
 func buildCommand(c *cli.Context) {
+	initLogs(c)
+
+	// The deferred cleanup of runBuildCommand, e.g. of the extracted
+	// context and of the lock, is done before we exit
+	if err := runBuildCommand(c); err != nil {
+		// Let scripts tell the exit code of the --post-run smoke test
+		if postRunErr, ok := err.(*postRunError); ok {
+			log.Error(err)
+			if exitErr, ok := postRunErr.err.(*build.ContainerExitError); ok {
+				os.Exit(exitErr.ExitCode)
+			}
+			os.Exit(1)
+		}
+		log.Fatal(err)
+	}
+}
+
+// postRunError is the failure of the --post-run command, rocker exits with
+// the exit code of its container
+type postRunError struct {
+	err error
+}
+
+// Error implements error
+func (e *postRunError) Error() string {
+	return e.err.Error()
+}
 
+// runBuildCommand runs rocker build or rocker warm, the errors are returned
+// rather than fatal, so that the deferred cleanup is never skipped
+func runBuildCommand(c *cli.Context) error {
 	var (
 		rockerfile *build.Rockerfile
 		err        error
 	)
 
-	initLogs(c)
+	// Templates query registries too, e.g. resolveDigest
+	imagename.RateLimitMaxWait = c.Duration("rate-limit-max-wait")
+	imagename.RegistryConcurrency = c.Int("registry-concurrency")
 
-	// We don't want info level for 'print' mode
-	// So log only errors unless 'debug' is on
-	if c.Bool("print") && log.StandardLogger().Level != log.DebugLevel {
-		log.StandardLogger().Level = log.ErrorLevel
-	}
+	template.StdinVarsFormat = c.String("vars-format")
 
-	vars, err := template.VarsFromFileMulti(c.StringSlice("vars"))
-	if err != nil {
-		log.Fatal(err)
-		os.Exit(1)
+	if template.SliceMergeMode, err = template.ParseMergeMode(c.String("vars-merge")); err != nil {
+		return err
 	}
 
-	cliVars, err := template.VarsFromStrings(c.StringSlice("var"))
-	if err != nil {
-		log.Fatal(err)
+	var observer build.Observer
+	if c.Bool("events-json") {
+		observer = build.NewJSONEventWriter(os.Stdout)
 	}
 
-	vars = vars.Merge(cliVars)
+	// We don't want info level for 'print' modes
+	// So log only errors unless 'debug' is on
+	if (c.Bool("print") || c.Bool("print-plan")) && log.StandardLogger().Level != log.DebugLevel {
+		log.StandardLogger().Level = log.ErrorLevel
+	}
 
-	if c.Bool("demand-artifacts") {
-		vars["DemandArtifacts"] = true
+	// The order of providers defines the precedence, see template.LoadVars
+	varsProviders := []template.VarsProvider{}
+	if spec := c.String("vars-consul"); spec != "" {
+		consul, err := template.NewConsulVarsProvider(spec)
+		if err != nil {
+			return err
+		}
+		consul.Token = os.Getenv("CONSUL_HTTP_TOKEN")
+		varsProviders = append(varsProviders, consul)
 	}
+	varsProviders = append(varsProviders,
+		template.FileVarsProvider(c.StringSlice("vars")),
+		template.StringVarsProvider(c.StringSlice("var")),
+	)
 
 	wd, err := os.Getwd()
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
 	configFilename := c.String("file")
 	contextDir := wd
+	watch := c.Bool("watch")
 
-	if configFilename == "-" {
+	// rocker warm builds a part of the Rockerfile only to fill the cache
+	warm := c.Command.Name == "warm"
+	if warm && watch {
+		return fmt.Errorf("Cannot --watch with rocker warm")
+	}
 
-		rockerfile, err = build.NewRockerfile(filepath.Base(wd), os.Stdin, vars, template.Funs{})
-		if err != nil {
-			log.Fatal(err)
+	// The pre-rendered plan stands for the Rockerfile
+	planFilename := c.String("plan")
+	if planFilename != "" {
+		if watch {
+			return fmt.Errorf("Cannot --watch a pre-rendered --plan")
 		}
-
-	} else {
-
-		if !filepath.IsAbs(configFilename) {
-			configFilename = filepath.Join(wd, configFilename)
+		if warm {
+			return fmt.Errorf("Cannot warm the cache with a pre-rendered --plan, the checkpoint is in the Rockerfile")
 		}
+		configFilename = planFilename
+	}
 
-		rockerfile, err = build.NewRockerfileFromFile(configFilename, vars, template.Funs{})
-		if err != nil {
-			log.Fatal(err)
+	if configFilename != "-" {
+		if configFilename, err = util.MakeAbsolute(configFilename); err != nil {
+			return err
 		}
-
 		// Initialize context dir
 		contextDir = filepath.Dir(configFilename)
+	} else if watch {
+		return fmt.Errorf("Cannot --watch the Rockerfile read from stdin")
 	}
 
-	args := c.Args()
-	if len(args) > 0 {
-		contextDir = args[0]
-		if !filepath.IsAbs(contextDir) {
-			contextDir = filepath.Join(wd, args[0])
+	varsFromStdin := false
+	for _, f := range c.StringSlice("vars") {
+		varsFromStdin = varsFromStdin || f == "-"
+	}
+	if varsFromStdin {
+		if configFilename == "-" {
+			return fmt.Errorf("Cannot read both the Rockerfile and --vars from stdin")
+		}
+		if watch {
+			return fmt.Errorf("Cannot --watch the --vars read from stdin")
 		}
 	}
 
-	log.Debugf("Context directory: %s", contextDir)
+	// loadRockerfile renders the Rockerfile with fresh vars, in --watch
+	// mode it is called again on every change
+	loadRockerfile := func() (*build.Rockerfile, error) {
+		vars, err := template.LoadVars(varsProviders...)
+		if err != nil {
+			return nil, err
+		}
 
-	if c.Bool("print") {
-		fmt.Print(rockerfile.Content)
-		os.Exit(0)
-	}
+		// Hide values that look like credentials from the log output
+		for _, v := range append(vars.SensitiveValues(), c.StringSlice("mask")...) {
+			textformatter.DefaultMasker.Add(v)
+		}
 
-	dockerignore := []string{}
+		if c.Bool("demand-artifacts") {
+			vars["DemandArtifacts"] = true
+		}
 
-	dockerignoreFilename := filepath.Join(contextDir, ".dockerignore")
-	if _, err := os.Stat(dockerignoreFilename); err == nil {
-		if dockerignore, err = build.ReadDockerignoreFile(dockerignoreFilename); err != nil {
-			log.Fatal(err)
+		// Values of resolved secrets should never appear in the log output
+		funs := template.Funs{
+			"secret": template.SecretHelper(template.NewEnvSecretProvider(template.SecretsEnvPrefix), textformatter.DefaultMasker.Add),
 		}
+		if c.Bool("allow-template-network") {
+			funs["resolveDigest"] = template.DigestHelper(imagename.RegistryDigest)
+		}
+
+		opts := template.Options{Strict: c.Bool("strict-templates")}
+
+		if configFilename == "-" {
+			return build.NewRockerfileWithOptions(filepath.Base(wd), os.Stdin, vars, funs, opts)
+		}
+
+		fd, err := os.Open(configFilename)
+		if err != nil {
+			return nil, err
+		}
+		defer fd.Close()
+
+		return build.NewRockerfileWithOptions(configFilename, fd, vars, funs, opts)
 	}
 
-	dockerClient, err := dockerclient.NewFromCli(c)
+	var plan build.Plan
+	if planFilename != "" {
+		if rockerfile, plan, err = readPlan(configFilename); err != nil {
+			return err
+		}
+		if c, err = withFlagsDirectives(c, rockerfile.Flags); err != nil {
+			return err
+		}
+	} else {
+		if rockerfile, err = loadRockerfile(); err != nil {
+			return err
+		}
+		// The rest of the flags may come from the directives
+		if c, err = withFlagsDirectives(c, rockerfile.Flags); err != nil {
+			return err
+		}
+		if warm {
+			plan, err = build.WarmPlan(rockerfile, c.String("until"))
+		} else {
+			plan, err = build.NewPlan(rockerfile.Commands(), true)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	args := c.Args()
+	if len(args) > 0 {
+		contextDir = args[0]
+		if !filepath.IsAbs(contextDir) {
+			contextDir = filepath.Join(wd, args[0])
+		}
+	}
+
+	log.Debugf("Context directory: %s", contextDir)
+
+	if c.Bool("print") {
+		if err := rockerfile.Render(os.Stdout); err != nil {
+			return err
+		}
+		return nil
+	}
+
+	if c.Bool("print-plan") {
+		data, err := json.MarshalIndent(plan, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(data))
+		return nil
+	}
+
+	if c.Bool("validate") {
+		// The plan is validated by reading it
+		if planFilename == "" {
+			if err := rockerfile.Validate(); err != nil {
+				return err
+			}
+		}
+		log.Infof("Rockerfile %s is valid", configFilename)
+		return nil
+	}
+
+	// Stdin can be read to the end only once, either for the Rockerfile or for the context
+	stdinTaken := configFilename == "-" || varsFromStdin
+
+	if ref := c.String("context-from-git"); ref != "" {
+		if c.String("context-tar") != "" {
+			return fmt.Errorf("Cannot use both --context-tar and --context-from-git")
+		}
+		if watch {
+			return fmt.Errorf("Cannot --watch the context of --context-from-git")
+		}
+		if contextDir, err = extractContextGit(contextDir, ref); err != nil {
+			return err
+		}
+		defer os.RemoveAll(contextDir)
+	}
+
+	if contextTar := c.String("context-tar"); contextTar != "" {
+		if contextTar == "-" && stdinTaken {
+			return fmt.Errorf("Cannot read the --context-tar from stdin, it is taken by the Rockerfile or --vars")
+		}
+		if len(args) > 0 {
+			return fmt.Errorf("Cannot use both the context directory and --context-tar")
+		}
+		if watch {
+			return fmt.Errorf("Cannot --watch the context of --context-tar")
+		}
+		if contextDir, err = extractContextTar(contextTar); err != nil {
+			return err
+		}
+		defer os.RemoveAll(contextDir)
+		stdinTaken = stdinTaken || contextTar == "-"
+	}
+
+	attachIn := attachInput(stdinTaken, util.OpenTerminal)
+
+	if err := build.ValidateContextDir(contextDir); err != nil {
+		return err
+	}
+
+	dockerignore := []string{}
+
+	dockerignoreFilename := filepath.Join(contextDir, ".dockerignore")
+	if _, err := os.Stat(dockerignoreFilename); err == nil {
+		if dockerignore, err = build.ReadDockerignoreFile(dockerignoreFilename); err != nil {
+			return err
+		}
+	}
+
+	dockerConfig := dockerclient.NewConfigFromCli(c)
+	dockerClient, err := dockerclient.NewFromConfig(dockerConfig)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
-	auth := docker.AuthConfiguration{}
-	authParam := c.String("auth")
-	if strings.Contains(authParam, ":") {
-		userPass := strings.Split(authParam, ":")
-		auth.Username = userPass[0]
-		auth.Password = userPass[1]
+	// Check the docker connection before we actually run
+	if err := dockerclient.Ping(dockerClient, 5000); err != nil {
+		return err
+	}
+
+	// RUN flags needing a newer API are warned about, see --docker-api-version
+	apiVersion, err := dockerclient.NegotiatedAPIVersion(dockerClient, dockerConfig)
+	if err != nil {
+		log.Warnf("Failed to negotiate docker API version, error: %s", err)
+	}
+
+	auth, err := authFlag(c)
+	if err != nil {
+		return err
+	}
+	if auth.Password != "" {
+		textformatter.DefaultMasker.Add(auth.Password)
 	}
 
 	client := build.NewDockerClient(dockerClient, auth, log.StandardLogger())
+	if client.Raw, err = dockerclient.NewRawClient(dockerClient, dockerConfig); err != nil {
+		return err
+	}
+	client.MergeOutput = c.Bool("merge-output")
+	client.CommitInspectTimeout = c.Duration("commit-inspect-timeout")
+	client.Stdin = attachIn
+
+	artifactsPath, err := absolutePathFlag(c, "artifacts-path")
+	if err != nil {
+		return err
+	}
+
+	dumpStatesDir, err := absolutePathFlag(c, "dump-states")
+	if err != nil {
+		return err
+	}
+
+	manifestPath, err := absolutePathFlag(c, "manifest")
+	if err != nil {
+		return err
+	}
+
+	provenancePath, err := absolutePathFlag(c, "provenance")
+	if err != nil {
+		return err
+	}
+
+	outputConfig, err := absolutePathFlag(c, "output-config")
+	if err != nil {
+		return err
+	}
+
+	cacheDir, err := absolutePathFlag(c, "cache-dir")
+	if err != nil {
+		return err
+	}
+
+	persistentCache := false
 
 	var cache build.Cache
 	if !c.Bool("no-cache") {
-		cacheDir, err := util.MakeAbsolute(c.String("cache-dir"))
+		switch c.String("cache-backend") {
+		case "fs":
+			// Partition the cache by daemon, so switching DOCKER_HOST does not
+			// give us image IDs that do not exist on the current daemon
+			daemonID, err := dockerclient.DaemonID(dockerClient)
+			if err != nil {
+				return err
+			}
+			log.Debugf("Docker daemon ID: %s", daemonID)
+			cache = build.NewCacheFSForDaemon(cacheDir, daemonID)
+			persistentCache = true
+		case "memory":
+			cache = build.NewCacheMemory()
+		default:
+			return fmt.Errorf("Unknown --cache-backend %q, expected fs or memory", c.String("cache-backend"))
+		}
+	}
+
+	// Uploads of the previous run are kept next to the cache, there is
+	// nothing to keep them for without a persistent cache, so they are kept in memory only
+	var incremental *build.IncrementalContext
+	if c.Bool("incremental-context") || watch {
+		incrementalPath := ""
+		if persistentCache {
+			incrementalPath = filepath.Join(cacheDir, "incremental", fmt.Sprintf("%x.json", md5.Sum([]byte(contextDir+":"+configFilename))))
+		}
+		if incremental, err = build.NewIncrementalContext(incrementalPath); err != nil {
+			return err
+		}
+	}
+
+	contexts, err := build.ParseContexts(c.StringSlice("add-context"))
+	if err != nil {
+		return err
+	}
+
+	var uploadChunkSize int64
+	if c.String("upload-chunk-size") != "" {
+		if uploadChunkSize, err = units.FromHumanSize(c.String("upload-chunk-size")); err != nil {
+			return err
+		}
+	}
+
+	var maxSize int64
+	if c.String("max-size") != "" {
+		if maxSize, err = units.FromHumanSize(c.String("max-size")); err != nil {
+			return err
+		}
+	}
+
+	sourceDateEpoch, err := parseSourceDateEpoch(c.String("source-date-epoch"))
+	if err != nil {
+		return err
+	}
+
+	annotations, err := parseAnnotations(c.StringSlice("annotation"))
+	if err != nil {
+		return err
+	}
+
+	ociLayout, err := absolutePathFlag(c, "oci-layout")
+	if err != nil {
+		return err
+	}
+
+	attachOnError := c.Bool("attach-on-error")
+	if attachOnError && !term.IsTerminal(attachIn.Fd()) {
+		log.Warnf("Ignore --attach-on-error, stdin is not a terminal")
+		attachOnError = false
+	}
+
+	cfg := build.Config{
+		InStream:        attachIn,
+		OutStream:       os.Stdout,
+		ContextDir:      contextDir,
+		LocalDaemon:     strings.HasPrefix(dockerConfig.Host, "unix://"),
+		Dockerignore:    dockerignore,
+		ArtifactsPath:   artifactsPath,
+		DumpStatesDir:   dumpStatesDir,
+		ManifestPath:    manifestPath,
+		ProvenancePath:  provenancePath,
+		OutputConfig:    outputConfig,
+		Contexts:        contexts,
+		CapAdd:          c.StringSlice("cap-add"),
+		CapDrop:         c.StringSlice("cap-drop"),
+		Devices:         c.StringSlice("device"),
+		GPUs:            c.String("gpus"),
+		Sysctls:         c.StringSlice("sysctl"),
+		SecurityOpts:    c.StringSlice("security-opt"),
+		ReadOnly:        c.Bool("read-only"),
+		APIVersion:      apiVersion,
+		AllowLatest:     c.StringSlice("allow-latest"),
+		UploadChunkSize: uploadChunkSize,
+		MaxSize:         maxSize,
+		UploadRetries:   c.Int("upload-retries"),
+		Pull:            c.Bool("pull"),
+		NoReuse:         c.Bool("no-reuse"),
+		FromOverride:    c.String("from-override"),
+		NoGarbage:       c.Bool("no-garbage"),
+		Attach:          c.Bool("attach"),
+		AttachOnError:   attachOnError,
+		Verbose:         c.GlobalBool("verbose"),
+		ID:              c.String("id"),
+		NoCache:         c.Bool("no-cache"),
+		ReloadCache:     c.Bool("reload-cache"),
+		Push:            c.Bool("push"),
+		EmptyLayers:     c.Bool("empty-layers"),
+		AllowPrivileged: c.Bool("allow-privileged"),
+		Reproducible:    c.Bool("reproducible"),
+		SourceDateEpoch: sourceDateEpoch,
+		ForbidLatest:    c.Bool("forbid-latest"),
+		VerifyPush:      c.Bool("verify-push"),
+		PushBestEffort:  c.Bool("push-best-effort"),
+		PushFailOn:      c.String("push-fail-on"),
+		PushChanged:     c.Bool("push-changed"),
+		Annotations:     annotations,
+		ExportTransport: c.String("export-transport"),
+		Incremental:     incremental,
+		Warnings:        deprecatedFlags(c),
+		Explain:         c.Bool("explain"),
+		Observer:        observer,
+		Steps:           textformatter.DefaultStepCounter,
+	}
+
+	for _, value := range c.StringSlice("set") {
+		parts := strings.SplitN(value, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("Invalid --set %q, expected Field=value", value)
+		}
+		if err := cfg.Set(parts[0], parts[1]); err != nil {
+			return fmt.Errorf("Invalid --set %q, error: %s", value, err)
+		}
+	}
+
+	// The final config is checked, so that --set does not bypass the checks
+	switch cfg.PushFailOn {
+	case build.PushFailOnAll, build.PushFailOnAny, build.PushFailOnNone:
+	default:
+		return fmt.Errorf("Invalid --push-fail-on %q, expected all, any or none", cfg.PushFailOn)
+	}
+
+	if cfg.SecurityOpts, err = absoluteSecurityOpts(cfg.SecurityOpts); err != nil {
+		return err
+	}
+
+	if components := c.StringSlice("id-component"); len(components) > 0 {
+		id := cfg.ID
+		if id == "" {
+			id = build.DefaultID(contextDir, rockerfile.Name)
+		}
+		if cfg.ID, err = build.CompoundID(id, components); err != nil {
+			return err
+		}
+	}
+
+	if c.Bool("build-proxy") {
+		cfg.ProxyEnv = build.ProxyEnv(os.Environ())
+	}
+
+	if c.Bool("meta") {
+		cfg.Meta = imageMeta(contextDir)
+	}
+
+	if c.Bool("verify-base-signatures") {
+		if c.String("trust-policy") == "" {
+			return fmt.Errorf("--verify-base-signatures requires --trust-policy")
+		}
+		if cfg.TrustPolicy, err = build.ReadTrustPolicy(c.String("trust-policy")); err != nil {
+			return err
+		}
+		cfg.BaseVerifier = &build.CosignVerifier{Policy: *cfg.TrustPolicy}
+	}
+
+	if c.Bool("sign") || c.String("sign-key") != "" {
+		if !cfg.Push {
+			log.Warnf("Nothing is signed without --push")
+		}
+		cfg.Signer = &build.CosignSigner{Key: c.String("sign-key")}
+	}
+
+	// runBuild builds the Rockerfile with a new builder, in --watch
+	// mode it is called again with the reloaded Rockerfile on every change
+	var lock *util.FileLock
+	runBuild := func(rockerfile *build.Rockerfile, plan build.Plan) error {
+		cfg := cfg
+		if c.Bool("print-context-checksum") {
+			checksum, err := build.ContextChecksum(contextDir, dockerignore, rockerfile)
+			if err != nil {
+				return err
+			}
+			cfg.ContextChecksum = checksum
+		}
+
+		builder := build.New(client, rockerfile, cache, cfg)
+
+		// Concurrent builds of the same Rockerfile would clobber each other's
+		// helper containers, the lock is released by the OS if we exit on error;
+		// --watch holds the lock until it quits
+		if lock == nil {
+			l := util.NewFileLock(filepath.Join(os.TempDir(), builder.LockFileName()))
+			if err := acquireBuildLock(l, c.Duration("lock-timeout"), c.Bool("no-wait")); err != nil {
+				return err
+			}
+			lock = l
+		}
+
+		if err := builder.Run(plan); err != nil {
+			return err
+		}
+
+		if warm {
+			log.Infof("Warmed the cache up to %.12s", builder.GetImageID())
+			return nil
+		}
+
+		if ociLayout != "" {
+			if _, err := builder.ExportOCILayout(ociLayout); err != nil {
+				return err
+			}
+		}
+
+		if c.Bool("compare-history") {
+			if _, err := builder.CompareHistory(plan); err != nil {
+				log.Warn(err)
+			}
+		}
+
+		if cfg.Incremental != nil {
+			if err := cfg.Incremental.Save(); err != nil {
+				log.Warnf("Failed to save incremental context, error: %s", err)
+			}
+		}
+
+		if command := c.String("post-run"); command != "" {
+			if err := builder.PostRun(command); err != nil {
+				return &postRunError{err}
+			}
+		}
+
+		size := fmt.Sprintf("final size %s (+%s from the base image)",
+			units.HumanSize(float64(builder.VirtualSize)),
+			units.HumanSize(float64(builder.ProducedSize)),
+		)
+
+		fields := log.Fields{}
+		if cfg.ContextChecksum != "" {
+			fields["context_checksum"] = cfg.ContextChecksum
+		}
+
+		log.WithFields(fields).Infof("Successfully built %.12s | %s", builder.GetImageID(), size)
+
+		if c.Bool("print-image-id") {
+			printImageID(os.Stdout, builder.GetImageID())
+		}
+
+		return nil
+	}
+
+	defer func() {
+		if lock != nil {
+			lock.Unlock()
+		}
+	}()
+
+	if !watch {
+		return runBuild(rockerfile, plan)
+	}
+
+	watcher := util.NewPollWatcher(c.Duration("watch-interval"))
+	defer watcher.Close()
+
+	watchPaths := map[string][]string{
+		configFilename: nil,
+		contextDir:     dockerignore,
+	}
+	for _, pat := range c.StringSlice("vars") {
+		matches, err := filepath.Glob(pat)
 		if err != nil {
-			log.Fatal(err)
+			return err
+		}
+		for _, f := range matches {
+			watchPaths[f] = nil
+		}
+	}
+	for path, excludes := range watchPaths {
+		if err := watcher.Add(path, excludes); err != nil {
+			return err
 		}
-		cache = build.NewCacheFS(cacheDir)
-	}
-
-	builder := build.New(client, rockerfile, cache, build.Config{
-		InStream:      os.Stdin,
-		OutStream:     os.Stdout,
-		ContextDir:    contextDir,
-		Dockerignore:  dockerignore,
-		ArtifactsPath: c.String("artifacts-path"),
-		Pull:          c.Bool("pull"),
-		NoGarbage:     c.Bool("no-garbage"),
-		Attach:        c.Bool("attach"),
-		Verbose:       c.GlobalBool("verbose"),
-		ID:            c.String("id"),
-		NoCache:       c.Bool("no-cache"),
-		ReloadCache:   c.Bool("reload-cache"),
-		Push:          c.Bool("push"),
+	}
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+
+	watchBuilds(watcher, c.Duration("watch-debounce"), interrupt, os.Stderr, func(first bool) error {
+		if first {
+			return runBuild(rockerfile, plan)
+		}
+		rockerfile, err := loadRockerfile()
+		if err != nil {
+			return err
+		}
+		plan, err := build.NewPlan(rockerfile.Commands(), true)
+		if err != nil {
+			return err
+		}
+		return runBuild(rockerfile, plan)
 	})
 
-	plan, err := build.NewPlan(rockerfile.Commands(), true)
+	return nil
+}
+
+// extractContextTar extracts the context archive, given by path or "-" for
+// stdin, to a temporary directory; the caller should remove the directory
+func extractContextTar(path string) (dir string, err error) {
+	in := os.Stdin
+	if path != "-" {
+		if in, err = os.Open(path); err != nil {
+			return "", err
+		}
+		defer in.Close()
+	}
+
+	if dir, err = ioutil.TempDir("", "rocker-context-"); err != nil {
+		return "", err
+	}
+
+	if err := util.ExtractTar(in, dir); err != nil {
+		os.RemoveAll(dir)
+		return "", fmt.Errorf("Failed to extract --context-tar %s, error: %s", path, err)
+	}
+
+	return dir, nil
+}
+
+// extractContextGit extracts the tree of the git ref to a temporary directory,
+// limited to the repoDir if it is a subdirectory of the repository; the
+// uncommitted changes are not there; the caller should remove the directory
+func extractContextGit(repoDir, ref string) (dir string, err error) {
+	verify := exec.Command("git", "rev-parse", "--verify", "--quiet", ref+"^{tree}")
+	verify.Dir = repoDir
+	if err := verify.Run(); err != nil {
+		return "", fmt.Errorf("Failed to find --context-from-git %s in the git repository %s, error: %s", ref, repoDir, err)
+	}
+
+	if dir, err = ioutil.TempDir("", "rocker-context-"); err != nil {
+		return "", err
+	}
+
+	var stderr bytes.Buffer
+	archive := exec.Command("git", "archive", "--format=tar", ref)
+	archive.Dir = repoDir
+	archive.Stderr = &stderr
+
+	out, err := archive.StdoutPipe()
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	if err := archive.Start(); err != nil {
+		os.RemoveAll(dir)
+		return "", fmt.Errorf("Failed to run git archive, error: %s", err)
+	}
+
+	extractErr := util.ExtractTar(out, dir)
+	// Let git finish if the extraction has stopped early
+	io.Copy(ioutil.Discard, out)
+
+	if err := archive.Wait(); err != nil {
+		os.RemoveAll(dir)
+		return "", fmt.Errorf("Failed to git archive %s, error: %s, %s", ref, err, strings.TrimSpace(stderr.String()))
+	}
+	if extractErr != nil {
+		os.RemoveAll(dir)
+		return "", fmt.Errorf("Failed to extract --context-from-git %s, error: %s", ref, extractErr)
+	}
+
+	return dir, nil
+}
+
+// attachInput returns the input for ATTACH: stdin, unless it has been read
+// to the end for the Rockerfile or the context, then the controlling terminal
+func attachInput(stdinTaken bool, openTerminal func() (*os.File, error)) *os.File {
+	if !stdinTaken {
+		return os.Stdin
+	}
+
+	tty, err := openTerminal()
+	if err != nil {
+		log.Debugf("No terminal to attach to containers in place of stdin, error: %s", err)
+		return os.Stdin
+	}
+
+	return tty
+}
+
+// readPlan reads the plan serialized by --print-plan, the plan
+// file stands for the Rockerfile, e.g. it identifies the build
+func readPlan(filename string) (*build.Rockerfile, build.Plan, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var plan build.Plan
+	if err := json.Unmarshal(data, &plan); err != nil {
+		return nil, nil, fmt.Errorf("Failed to read plan %s, error: %s", filename, err)
+	}
+
+	rockerfile := &build.Rockerfile{
+		Name:    filename,
+		Source:  filename,
+		Content: string(data),
+	}
+
+	return rockerfile, plan, nil
+}
+
+// acquireBuildLock acquires the lock, waiting for another build to release it
+// for up to timeout, forever if timeout is zero, or not at all if noWait is set
+func acquireBuildLock(lock *util.FileLock, timeout time.Duration, noWait bool) error {
+	err := lock.Lock(0)
+	if err != util.ErrLocked || noWait {
+		return wrapLockError(lock, err)
+	}
+
+	if timeout <= 0 {
+		timeout = -1
+	}
+
+	log.Infof("Waiting for another build of the same Rockerfile to finish (lock %s)", lock.Path())
+
+	return wrapLockError(lock, lock.Lock(timeout))
+}
+
+func wrapLockError(lock *util.FileLock, err error) error {
+	if err == util.ErrLocked {
+		return fmt.Errorf("Another build of the same Rockerfile is running (lock %s), pass a different --id to run them concurrently", lock.Path())
+	}
+	return err
+}
+
+// printImageID writes the image ID as a single bare line, so scripts can
+// capture it with $(rocker build --print-image-id)
+func printImageID(out io.Writer, imageID string) {
+	fmt.Fprintln(out, imageID)
+}
+
+func gcImagesCommand(c *cli.Context) {
+	initLogs(c)
+
+	dockerClient, err := dockerclient.NewFromCli(c)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	// Check the docker connection before we actually run
-	if err := dockerclient.Ping(dockerClient, 5000); err != nil {
+	client := build.NewDockerClient(dockerClient, docker.AuthConfiguration{}, log.StandardLogger())
+
+	removed, err := build.GCImages(client, build.GCConfig{
+		OlderThan: c.Duration("older-than"),
+		Dangling:  c.Bool("dangling"),
+		DryRun:    c.Bool("dry-run"),
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if c.Bool("dry-run") {
+		log.Infof("%d images would be removed", len(removed))
+		return
+	}
+
+	log.Infof("Removed %d images", len(removed))
+}
+
+func inspectCommand(c *cli.Context) {
+	initLogs(c)
+
+	if len(c.Args()) != 1 {
+		log.Fatalf("inspect requires exactly one argument, the image")
+	}
+
+	format := c.String("format")
+	if format != "text" && format != "json" {
+		log.Fatalf("Unknown --format %q, expected text or json", format)
+	}
+
+	dockerClient, err := dockerclient.NewFromCli(c)
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	if err := builder.Run(plan); err != nil {
+	client := build.NewDockerClient(dockerClient, docker.AuthConfiguration{}, log.StandardLogger())
+
+	if err := inspectImage(os.Stdout, client, c.Args().First(), format == "json"); err != nil {
 		log.Fatal(err)
 	}
+}
 
-	size := fmt.Sprintf("final size %s (+%s from the base image)",
-		units.HumanSize(float64(builder.VirtualSize)),
-		units.HumanSize(float64(builder.ProducedSize)),
-	)
+// inspectImage prints the rocker metadata of the image
+func inspectImage(out io.Writer, client build.Client, name string, asJSON bool) error {
+	img, meta, err := build.InspectMeta(client, name)
+	if err != nil {
+		return err
+	}
+	return build.WriteImageMeta(out, img, meta, asJSON)
+}
+
+// imageMeta returns the metadata of the build that --meta adds to the images,
+// the git repository of the context is not required
+func imageMeta(contextDir string) *build.ImageMeta {
+	meta := &build.ImageMeta{
+		User: os.Getenv("USER"),
+	}
+	if u, err := user.Current(); err == nil {
+		meta.User = u.Username
+	}
+
+	git := func(args ...string) string {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = contextDir
+		out, err := cmd.Output()
+		if err != nil {
+			log.Debugf("Failed to run git %s, error: %s", strings.Join(args, " "), err)
+			return ""
+		}
+		return strings.TrimSpace(string(out))
+	}
+
+	if sha := git("rev-parse", "HEAD"); sha != "" {
+		meta.Git = &build.GitMeta{
+			Branch: git("rev-parse", "--abbrev-ref", "HEAD"),
+			Sha:    sha,
+			URL:    git("config", "--get", "remote.origin.url"),
+		}
+	}
 
-	log.Infof("Successfully built %.12s | %s", builder.GetImageID(), size)
+	return meta
 }
 
 func initLogs(ctx *cli.Context) {
@@ -347,6 +1465,11 @@ func initLogs(ctx *cli.Context) {
 		logger.Level = log.DebugLevel
 	}
 
+	// Keep stdout clean for the output that is consumed by scripts
+	if ctx.Bool("events-json") || ctx.Bool("print-image-id") {
+		logger.Out = os.Stderr
+	}
+
 	var (
 		isTerm    = log.IsTerminal()
 		json      = ctx.GlobalBool("json")
@@ -362,11 +1485,149 @@ func initLogs(ctx *cli.Context) {
 	if json {
 		logger.Formatter = &log.JSONFormatter{}
 	} else {
+		theme, err := textformatter.ThemeByName(ctx.GlobalString("color-theme"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		if theme, err = theme.WithEnv(os.Getenv); err != nil {
+			log.Fatal(err)
+		}
+
 		formatter := &textformatter.TextFormatter{}
 		formatter.DisableColors = !useColors
+		formatter.Theme = &theme
+
+		switch ctx.GlobalString("log-timestamps") {
+		case "", "relative":
+		case "rfc3339":
+			formatter.FullTimestamp = true
+			formatter.TimestampFormat = time.RFC3339
+		case "none":
+			formatter.DisableTimestamp = true
+		default:
+			log.Fatalf("Unknown --log-timestamps value %q, expected relative, rfc3339 or none", ctx.GlobalString("log-timestamps"))
+		}
+
+		if ctx.Bool("log-steps") {
+			formatter.Steps = textformatter.DefaultStepCounter
+		}
 
 		logger.Formatter = formatter
 	}
+
+	logger.Formatter = textformatter.NewMaskFormatter(logger.Formatter, textformatter.DefaultMasker)
+}
+
+// parseSourceDateEpoch parses the unix time given by --source-date-epoch,
+// the zero time is returned if it is not given
+func parseSourceDateEpoch(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	sec, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || sec < 0 {
+		return time.Time{}, fmt.Errorf("Invalid --source-date-epoch %q, expected unix time in seconds", value)
+	}
+	return time.Unix(sec, 0).UTC(), nil
+}
+
+// parseAnnotations parses the key=value pairs given by --annotation
+func parseAnnotations(values []string) (map[string]string, error) {
+	annotations := map[string]string{}
+	for _, value := range values {
+		parts := strings.SplitN(value, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("Invalid --annotation %q, expected key=value", value)
+		}
+		annotations[parts[0]] = parts[1]
+	}
+	return annotations, nil
+}
+
+// absolutePathFlag returns the value of a path flag made absolute with ~ and
+// environment variables expanded, empty value is returned as is
+func absolutePathFlag(c *cli.Context, name string) (string, error) {
+	path := c.String(name)
+	if path == "" {
+		return "", nil
+	}
+	return util.MakeAbsolute(os.ExpandEnv(path))
+}
+
+// authFlag returns the registry credentials given by --auth-file or by
+// --auth, which is deprecated since it leaks them to the process list
+func authFlag(c *cli.Context) (auth docker.AuthConfiguration, err error) {
+	value := c.String("auth")
+
+	if c.String("auth-file") != "" {
+		if value != "" {
+			return auth, fmt.Errorf("Cannot use both --auth and --auth-file")
+		}
+		if value, err = readAuthFile(c); err != nil {
+			return auth, err
+		}
+	}
+
+	if strings.Contains(value, ":") {
+		userPass := strings.SplitN(value, ":", 2)
+		auth.Username = userPass[0]
+		auth.Password = userPass[1]
+	}
+	return auth, nil
+}
+
+// deprecatedFlags returns the warnings about the deprecated flags given to
+// the command; the build reports them with the warnings of the build
+func deprecatedFlags(c *cli.Context) (warnings []string) {
+	if c.String("auth") != "" {
+		warnings = append(warnings, "--auth is deprecated, the credentials leak to the process list and the shell history, use --auth-file instead")
+	}
+	return warnings
+}
+
+// readAuthFile reads the credentials of --auth-file, the file should not be
+// readable by others
+func readAuthFile(c *cli.Context) (string, error) {
+	path, err := absolutePathFlag(c, "auth-file")
+	if err != nil {
+		return "", err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", fmt.Errorf("Failed to read auth file %s, error: %s", path, err)
+	}
+	if info.Mode().Perm()&0004 != 0 {
+		return "", fmt.Errorf("Auth file %s is readable by others, chmod it to 600", path)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("Failed to read auth file %s, error: %s", path, err)
+	}
+
+	value := strings.TrimSpace(string(data))
+	if !strings.Contains(value, ":") {
+		return "", fmt.Errorf("Auth file %s should contain user:password", path)
+	}
+	return value, nil
+}
+
+// absoluteSecurityOpts returns the security options with the paths of the
+// seccomp profiles made absolute, otherwise they are relative to the context
+func absoluteSecurityOpts(securityOpts []string) ([]string, error) {
+	opts := []string{}
+	for _, opt := range securityOpts {
+		if pair := strings.SplitN(opt, "=", 2); len(pair) == 2 && pair[0] == "seccomp" && pair[1] != "unconfined" {
+			path, err := util.MakeAbsolute(pair[1])
+			if err != nil {
+				return nil, err
+			}
+			opt = "seccomp=" + path
+		}
+		opts = append(opts, opt)
+	}
+	return opts, nil
 }
 
 func stringOr(args ...string) string {
@@ -377,3 +1638,110 @@ func stringOr(args ...string) string {
 	}
 	return ""
 }
+
+// preloadFlags are read before the Rockerfile is rendered, so they cannot
+// be given by its rocker:flags directives
+var preloadFlags = map[string]bool{
+	"file": true, "plan": true, "watch": true, "print": true, "print-plan": true,
+	"var": true, "vars": true, "vars-consul": true, "vars-format": true, "vars-merge": true,
+	"mask": true, "demand-artifacts": true, "allow-template-network": true, "strict-templates": true,
+	"rate-limit-max-wait": true, "registry-concurrency": true,
+	"events-json": true, "print-image-id": true, "log-steps": true,
+}
+
+// withFlagsDirectives returns the context of the command with the flags set
+// by the rocker:flags directives of the Rockerfile, unless they are given on
+// the command line; the flags are parsed anew, so the directives act as if
+// they were given on the command line
+func withFlagsDirectives(c *cli.Context, directives map[string]string) (*cli.Context, error) {
+	if len(directives) == 0 {
+		return c, nil
+	}
+
+	fs := flag.NewFlagSet(c.Command.Name, flag.ContinueOnError)
+	for _, f := range c.Command.Flags {
+		// The slice flags share their values with the parsed flag set
+		if sf, ok := f.(cli.StringSliceFlag); ok {
+			value := cli.StringSlice{}
+			if name := flagName(sf.Name); !c.IsSet(name) {
+				value = append(value, c.StringSlice(name)...)
+			}
+			sf.Value = &value
+			f = sf
+		}
+		f.Apply(fs)
+	}
+
+	// Carry over the flags of the command line
+	for _, f := range c.Command.Flags {
+		var (
+			name   string
+			values []string
+		)
+		switch f := f.(type) {
+		case cli.BoolFlag:
+			name = flagName(f.Name)
+			values = []string{strconv.FormatBool(c.Bool(name))}
+		case cli.BoolTFlag:
+			name = flagName(f.Name)
+			values = []string{strconv.FormatBool(c.BoolT(name))}
+		case cli.StringFlag:
+			name = flagName(f.Name)
+			values = []string{c.String(name)}
+		case cli.IntFlag:
+			name = flagName(f.Name)
+			values = []string{strconv.Itoa(c.Int(name))}
+		case cli.DurationFlag:
+			name = flagName(f.Name)
+			values = []string{c.Duration(name).String()}
+		case cli.StringSliceFlag:
+			name = flagName(f.Name)
+			values = c.StringSlice(name)
+		default:
+			return nil, fmt.Errorf("Flag %s of unsupported type %T", f, f)
+		}
+		if !c.IsSet(name) {
+			continue
+		}
+		for _, value := range values {
+			if err := fs.Set(name, value); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	names := make([]string, 0, len(directives))
+	for name := range directives {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if fs.Lookup(name) == nil {
+			return nil, fmt.Errorf("Unknown flag --%s of rocker:flags", name)
+		}
+		if preloadFlags[name] {
+			return nil, fmt.Errorf("Flag --%s cannot be set by rocker:flags, it is read before the Rockerfile", name)
+		}
+		if c.IsSet(name) {
+			log.Debugf("Flag --%s of rocker:flags is overridden by the command line", name)
+			continue
+		}
+		if err := fs.Set(name, directives[name]); err != nil {
+			return nil, fmt.Errorf("Invalid value %q of --%s in rocker:flags, error: %s", directives[name], name, err)
+		}
+	}
+
+	if err := fs.Parse(append([]string{"--"}, c.Args()...)); err != nil {
+		return nil, err
+	}
+
+	ctx := cli.NewContext(c.App, fs, c.Parent())
+	ctx.Command = c.Command
+	return ctx, nil
+}
+
+// flagName returns the name of the flag without its short aliases
+func flagName(name string) string {
+	return strings.TrimSpace(strings.Split(name, ",")[0])
+}
@@ -0,0 +1,588 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"rocker/build"
+	"rocker/template"
+	"rocker/textformatter"
+	"rocker/util"
+
+	"github.com/codegangsta/cli"
+	"github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+func TestBuildFlags_EnvDefaults(t *testing.T) {
+	os.Setenv("ROCKER_CACHE_DIR", "/tmp/env_cache")
+	os.Setenv("ROCKER_ARTIFACTS_PATH", "/tmp/env_artifacts")
+	defer os.Unsetenv("ROCKER_CACHE_DIR")
+	defer os.Unsetenv("ROCKER_ARTIFACTS_PATH")
+
+	c := runBuildFlags(t)
+	assert.Equal(t, "/tmp/env_cache", c.String("cache-dir"))
+	assert.Equal(t, "/tmp/env_artifacts", c.String("artifacts-path"))
+
+	c = runBuildFlags(t, "--cache-dir", "/tmp/flag_cache", "--artifacts-path", "/tmp/flag_artifacts")
+	assert.Equal(t, "/tmp/flag_cache", c.String("cache-dir"))
+	assert.Equal(t, "/tmp/flag_artifacts", c.String("artifacts-path"))
+}
+
+func TestBuildFlags_BuiltinDefaults(t *testing.T) {
+	os.Unsetenv("ROCKER_CACHE_DIR")
+	os.Unsetenv("ROCKER_ARTIFACTS_PATH")
+
+	c := runBuildFlags(t)
+	assert.Equal(t, "~/.rocker_cache", c.String("cache-dir"))
+	assert.Equal(t, "", c.String("artifacts-path"))
+}
+
+func runBuildFlags(t *testing.T, args ...string) (ctx *cli.Context) {
+	app := cli.NewApp()
+	app.Commands = []cli.Command{
+		{
+			Name:   "build",
+			Flags:  buildFlags(),
+			Action: func(c *cli.Context) { ctx = c },
+		},
+	}
+
+	if err := app.Run(append([]string{"rocker", "build"}, args...)); err != nil {
+		t.Fatal(err)
+	}
+
+	return ctx
+}
+
+func TestBuild_PrintImageID(t *testing.T) {
+	stdout, stderr := captureOutput(t, func() {
+		app := cli.NewApp()
+		app.Flags = globalFlags()
+		app.Commands = []cli.Command{
+			{
+				Name:  "build",
+				Flags: buildFlags(),
+				Action: func(c *cli.Context) {
+					initLogs(c)
+					log.Infof("Successfully built 123456789012")
+					printImageID(os.Stdout, "sha256:1234567890123456")
+				},
+			},
+		}
+		if err := app.Run([]string{"rocker", "build", "--print-image-id"}); err != nil {
+			t.Fatal(err)
+		}
+	})
+	defer log.SetOutput(os.Stdout)
+
+	assert.Equal(t, "sha256:1234567890123456\n", stdout)
+	assert.Contains(t, stderr, "Successfully built 123456789012")
+}
+
+func TestInitLogs_TimestampsAndSteps(t *testing.T) {
+	defer log.SetOutput(os.Stdout)
+
+	textformatter.DefaultStepCounter.Set(2, 7)
+	defer textformatter.DefaultStepCounter.Set(0, 0)
+
+	_, stderr := captureOutput(t, func() {
+		app := cli.NewApp()
+		app.Flags = globalFlags()
+		app.Commands = []cli.Command{
+			{
+				Name:  "build",
+				Flags: buildFlags(),
+				Action: func(c *cli.Context) {
+					initLogs(c)
+					log.Infof("hello")
+				},
+			},
+		}
+		args := []string{"rocker", "--colors=false", "--log-timestamps", "none", "build", "--log-steps", "--print-image-id"}
+		if err := app.Run(args); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	assert.Regexp(t, `^INFO \[2/7\] hello`, stderr)
+}
+
+func TestAcquireBuildLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rocker-lock-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "build.lock")
+
+	first := util.NewFileLock(path)
+	if err := acquireBuildLock(first, 0, false); err != nil {
+		t.Fatal(err)
+	}
+
+	second := util.NewFileLock(path)
+	err = acquireBuildLock(second, 0, true)
+	assert.EqualError(t, err, "Another build of the same Rockerfile is running (lock "+path+"), pass a different --id to run them concurrently")
+
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		first.Unlock()
+	}()
+
+	assert.NoError(t, acquireBuildLock(second, time.Second, false))
+	assert.NoError(t, second.Unlock())
+}
+
+// captureOutput runs f with os.Stdout and os.Stderr redirected and returns what was written to them
+func captureOutput(t *testing.T, f func()) (stdout, stderr string) {
+	outFile, err := ioutil.TempFile("", "rocker-stdout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(outFile.Name())
+
+	errFile, err := ioutil.TempFile("", "rocker-stderr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(errFile.Name())
+
+	origStdout, origStderr := os.Stdout, os.Stderr
+	os.Stdout, os.Stderr = outFile, errFile
+	defer func() {
+		os.Stdout, os.Stderr = origStdout, origStderr
+	}()
+
+	f()
+
+	outData, err := ioutil.ReadFile(outFile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	errData, err := ioutil.ReadFile(errFile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(outData), string(errData)
+}
+
+func TestReadPlan(t *testing.T) {
+	rockerfile, err := build.NewRockerfile("test", strings.NewReader("FROM ubuntu\nRUN make\nTAG app:1\n"), template.Vars{}, template.Funs{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan, err := build.NewPlan(rockerfile.Commands(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := json.Marshal(plan)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "rocker-plan-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "plan.json")
+	if err := ioutil.WriteFile(filename, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	rockerfile2, plan2, err := readPlan(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, plan, plan2)
+	assert.Equal(t, filename, rockerfile2.Name)
+	assert.Equal(t, string(data), rockerfile2.Content)
+
+	if err := ioutil.WriteFile(filename, []byte("FROM ubuntu"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = readPlan(filename)
+	assert.Error(t, err)
+}
+
+func TestAttachInput(t *testing.T) {
+	tty, err := ioutil.TempFile("", "rocker-tty-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tty.Name())
+	defer tty.Close()
+
+	opened := 0
+	openTerminal := func() (*os.File, error) {
+		opened++
+		return tty, nil
+	}
+
+	// Stdin is free for ATTACH
+	assert.Equal(t, os.Stdin, attachInput(false, openTerminal))
+	assert.Equal(t, 0, opened)
+
+	// Stdin is taken by the Rockerfile or the context
+	assert.Equal(t, tty, attachInput(true, openTerminal))
+	assert.Equal(t, 1, opened)
+
+	// No terminal, ATTACH fails on the non tty input later
+	noTerminal := func() (*os.File, error) {
+		return nil, fmt.Errorf("no such device or address")
+	}
+	assert.Equal(t, os.Stdin, attachInput(true, noTerminal))
+}
+
+func TestExtractContextTar(t *testing.T) {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	if err := tw.WriteHeader(&tar.Header{Name: "app/main.go", Mode: 0644, Size: 12}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write([]byte("package main")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	archive, err := ioutil.TempFile("", "rocker-context-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(archive.Name())
+	if _, err := archive.Write(buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	archive.Close()
+
+	dir, err := extractContextTar(archive.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "app/main.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "package main", string(data))
+}
+
+func TestParseSourceDateEpoch(t *testing.T) {
+	created, err := parseSourceDateEpoch("1450000000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, time.Date(2015, 12, 13, 9, 46, 40, 0, time.UTC), created)
+
+	created, err = parseSourceDateEpoch("")
+	assert.Nil(t, err)
+	assert.True(t, created.IsZero())
+
+	_, err = parseSourceDateEpoch("2015-12-13")
+	assert.Error(t, err)
+}
+
+func TestParseAnnotations(t *testing.T) {
+	annotations, err := parseAnnotations([]string{"org.opencontainers.image.title=app", "a=b=c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, map[string]string{"org.opencontainers.image.title": "app", "a": "b=c"}, annotations)
+
+	_, err = parseAnnotations([]string{"title"})
+	assert.Error(t, err)
+}
+
+func TestAbsolutePathFlag(t *testing.T) {
+	os.Setenv("ROCKER_TEST_DIR", "/tmp/rocker")
+	defer os.Unsetenv("ROCKER_TEST_DIR")
+
+	path, err := absolutePathFlag(runBuildFlags(t, "--cache-dir", "$ROCKER_TEST_DIR/cache"), "cache-dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "/tmp/rocker/cache", path)
+
+	path, err = absolutePathFlag(runBuildFlags(t, "--cache-dir", "${ROCKER_TEST_DIR}/cache"), "cache-dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "/tmp/rocker/cache", path)
+
+	path, err = absolutePathFlag(runBuildFlags(t, "--manifest", ""), "manifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, path)
+}
+
+func TestAuthFlag_File(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rocker-auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "auth")
+	if err := ioutil.WriteFile(path, []byte("robot:pa:ss\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	auth, err := authFlag(runBuildFlags(t, "--auth-file", path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, docker.AuthConfiguration{Username: "robot", Password: "pa:ss"}, auth)
+
+	_, err = authFlag(runBuildFlags(t, "--auth-file", path, "--auth", "user:pass"))
+	assert.EqualError(t, err, "Cannot use both --auth and --auth-file")
+
+	if err := os.Chmod(path, 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err = authFlag(runBuildFlags(t, "--auth-file", path))
+	assert.EqualError(t, err, fmt.Sprintf("Auth file %s is readable by others, chmod it to 600", path))
+
+	if err := ioutil.WriteFile(path, []byte("robot"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, err = authFlag(runBuildFlags(t, "--auth-file", path))
+	assert.EqualError(t, err, fmt.Sprintf("Auth file %s should contain user:password", path))
+}
+
+func TestAuthFlag_Deprecated(t *testing.T) {
+	c := runBuildFlags(t, "--auth", "user:pass")
+
+	auth, err := authFlag(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, docker.AuthConfiguration{Username: "user", Password: "pass"}, auth)
+	assert.Equal(t, []string{"--auth is deprecated, the credentials leak to the process list and the shell history, use --auth-file instead"}, deprecatedFlags(c))
+
+	assert.Empty(t, deprecatedFlags(runBuildFlags(t)))
+}
+
+func TestRunBuildCommand_RemovesContextOnError(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "rocker-build-command")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	rockerfile := filepath.Join(tmpDir, "Rockerfile")
+	if err := ioutil.WriteFile(rockerfile, []byte("FROM alpine:3.2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	archive := filepath.Join(tmpDir, "context.tar")
+	buf := &bytes.Buffer{}
+	if err := tar.NewWriter(buf).Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(archive, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The context is extracted to TMPDIR
+	extractDir := filepath.Join(tmpDir, "tmp")
+	if err := os.Mkdir(extractDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Setenv("TMPDIR", os.Getenv("TMPDIR"))
+	os.Setenv("TMPDIR", extractDir)
+
+	// There is no docker host given, so the build fails after the extraction
+	err = runBuildCommand(runBuildFlags(t, "--file", rockerfile, "--context-tar", archive))
+	assert.Error(t, err)
+
+	entries, err := ioutil.ReadDir(extractDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, entries)
+}
+
+func TestExtractContextGit(t *testing.T) {
+	repo, err := ioutil.TempDir("", "rocker-git-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(repo)
+
+	git := func(args ...string) {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+		cmd.Dir = repo
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %s failed, error: %s, output: %s", strings.Join(args, " "), err, out)
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Join(repo, "app"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(repo, "app/main.go"), []byte("package main"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	git("init", "-q")
+	git("add", "-A")
+	git("commit", "-q", "-m", "initial")
+
+	// Uncommitted changes are not a part of the context
+	if err := ioutil.WriteFile(filepath.Join(repo, "app/main.go"), []byte("package dirty"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(repo, "app/untracked.go"), []byte("package main"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := extractContextGit(repo, "HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "app/main.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "package main", string(data))
+	_, err = os.Stat(filepath.Join(dir, "app/untracked.go"))
+	assert.True(t, os.IsNotExist(err))
+
+	// A subdirectory of the repository gives its own tree
+	sub, err := extractContextGit(filepath.Join(repo, "app"), "HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(sub)
+	_, err = os.Stat(filepath.Join(sub, "main.go"))
+	assert.NoError(t, err)
+
+	_, err = extractContextGit(repo, "no-such-ref")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "Failed to find --context-from-git no-such-ref")
+	}
+}
+
+func TestWithFlagsDirectives(t *testing.T) {
+	flags := map[string]string{
+		"pull":         "true",
+		"no-garbage":   "false",
+		"push-fail-on": "any",
+		"no-cache":     "true",
+		"cache-dir":    "/tmp/cache",
+		"cap-add":      "NET_ADMIN",
+	}
+
+	c := runBuildFlags(t, "--no-cache=false", "--no-garbage", "--var", "X=1", "--var", "Y=2", "ctx")
+	c, err := withFlagsDirectives(c, flags)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.True(t, c.Bool("pull"))
+	assert.Equal(t, "any", c.String("push-fail-on"))
+	assert.Equal(t, "/tmp/cache", c.String("cache-dir"))
+	assert.Equal(t, []string{"NET_ADMIN"}, c.StringSlice("cap-add"))
+	assert.True(t, c.IsSet("cache-dir"))
+	// The command line wins
+	assert.False(t, c.Bool("no-cache"))
+	assert.True(t, c.Bool("no-garbage"))
+	assert.Equal(t, []string{"X=1", "Y=2"}, c.StringSlice("var"))
+	assert.Equal(t, []string{"ctx"}, []string(c.Args()))
+}
+
+func TestWithFlagsDirectives_Invalid(t *testing.T) {
+	c := runBuildFlags(t)
+
+	_, err := withFlagsDirectives(c, map[string]string{"platform": "linux/amd64"})
+	assert.EqualError(t, err, "Unknown flag --platform of rocker:flags")
+
+	_, err = withFlagsDirectives(c, map[string]string{"pull": "yes"})
+	assert.EqualError(t, err, "Invalid value \"yes\" of --pull in rocker:flags, error: parse error")
+
+	_, err = withFlagsDirectives(c, map[string]string{"var": "X=1"})
+	assert.EqualError(t, err, "Flag --var cannot be set by rocker:flags, it is read before the Rockerfile")
+}
+
+func TestInspectImage(t *testing.T) {
+	meta, err := json.Marshal(build.ImageMeta{
+		ImageName:  "grammarly/app:1.0",
+		Rockerfile: "Rockerfile",
+		Source:     "FROM alpine",
+		Vars:       template.Vars{"Version": "1.0"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/images/grammarly/app:1.0/json") {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(docker.Image{
+			ID:     "sha256:456",
+			Config: &docker.Config{Labels: map[string]string{build.MetaLabel: string(meta)}},
+		})
+	}))
+	defer server.Close()
+
+	dockerClient, err := docker.NewClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := build.NewDockerClient(dockerClient, docker.AuthConfiguration{}, nil)
+
+	out := &bytes.Buffer{}
+	if err := inspectImage(out, client, "grammarly/app:1.0", false); err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, out.String(), "Name:       grammarly/app:1.0\n")
+	assert.Contains(t, out.String(), "Vars:\n  Version=1.0\n")
+
+	err = inspectImage(out, client, "alpine", false)
+	assert.EqualError(t, err, "Image alpine not found")
+}
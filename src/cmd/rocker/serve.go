@@ -0,0 +1,119 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"net/http"
+
+	"rocker/build"
+	"rocker/dockerclient"
+	"rocker/server"
+	"rocker/textformatter"
+
+	"github.com/codegangsta/cli"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// serveFlags returns the flags of the serve command
+func serveFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.StringFlag{
+			Name:  "addr",
+			Value: "127.0.0.1:8080",
+			Usage: "address of the build API; anyone who can reach it can run builds of the host directories",
+		},
+		cli.StringFlag{
+			Name:  "metrics-addr",
+			Usage: "serve /metrics on a separate address as well, e.g. :9090",
+		},
+		cli.StringFlag{
+			Name:  "auth, a",
+			Value: "",
+			Usage: "Username and password in user:password format, deprecated in favor of --auth-file",
+		},
+		cli.StringFlag{
+			Name:   "auth-file",
+			Usage:  "File with username and password in user:password format, it should not be readable by others",
+			EnvVar: "ROCKER_AUTH_FILE",
+		},
+		cli.StringFlag{
+			Name:   "cache-dir",
+			Value:  "~/.rocker_cache",
+			Usage:  "Set the directory where the cache will be stored",
+			EnvVar: "ROCKER_CACHE_DIR",
+		},
+		cli.BoolFlag{
+			Name:  "pull",
+			Usage: "always attempt to pull a newer version of the FROM images",
+		},
+	}
+}
+
+func serveCommand(c *cli.Context) {
+	initLogs(c)
+
+	dockerConfig := dockerclient.NewConfigFromCli(c)
+	dockerClient, err := dockerclient.NewFromConfig(dockerConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+	rawClient, err := dockerclient.NewRawClient(dockerClient, dockerConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	auth, err := authFlag(c)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, warning := range deprecatedFlags(c) {
+		log.Warn(warning)
+	}
+	if auth.Password != "" {
+		textformatter.DefaultMasker.Add(auth.Password)
+	}
+
+	cacheDir, err := absolutePathFlag(c, "cache-dir")
+	if err != nil {
+		log.Fatal(err)
+	}
+	daemonID, err := dockerclient.DaemonID(dockerClient)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	srv := server.New(&server.DockerBuilder{
+		Client: dockerClient,
+		Raw:    rawClient,
+		Auth:   auth,
+		Cache:  build.NewCacheFSForDaemon(cacheDir, daemonID),
+		Config: build.Config{
+			Pull: c.Bool("pull"),
+		},
+	})
+
+	if addr := c.String("metrics-addr"); addr != "" {
+		go func() {
+			log.Infof("Serving metrics on %s", addr)
+			log.Fatal(http.ListenAndServe(addr, srv.MetricsHandler()))
+		}()
+	}
+
+	log.Infof("Serving the build API on %s", c.String("addr"))
+	log.Fatal(http.ListenAndServe(c.String("addr"), srv.Handler()))
+}
@@ -0,0 +1,111 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"rocker/util"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// watchBuilds runs the build, then runs it again every time the watcher
+// reports changes until a signal comes to interrupt. The changes are
+// debounced: a rebuild starts once no changes come for the debounce period.
+// A failed build is logged and does not stop watching.
+func watchBuilds(w util.Watcher, debounce time.Duration, interrupt <-chan os.Signal, out io.Writer, run func(first bool) error) {
+	changes := w.Changes()
+
+	if !runInterruptible(run, true, interrupt) {
+		return
+	}
+
+	for n := 2; ; n++ {
+		log.Infof("Watching for changes, press Ctrl-C to quit")
+
+		changed := map[string]struct{}{}
+
+		select {
+		case path := <-changes:
+			changed[path] = struct{}{}
+		case <-interrupt:
+			return
+		}
+
+		timer := time.NewTimer(debounce)
+	quiet:
+		for {
+			select {
+			case path := <-changes:
+				changed[path] = struct{}{}
+				timer.Reset(debounce)
+			case <-interrupt:
+				timer.Stop()
+				return
+			case <-timer.C:
+				break quiet
+			}
+		}
+
+		paths := make([]string, 0, len(changed))
+		for path := range changed {
+			paths = append(paths, path)
+		}
+		sort.Strings(paths)
+
+		fmt.Fprintf(out, "\n%s\n", watchSeparator(n, paths))
+
+		if !runInterruptible(run, false, interrupt) {
+			return
+		}
+	}
+}
+
+// runInterruptible runs the build in the background, so an interrupt quits
+// without waiting for the build to finish, the same way it does without --watch;
+// it returns false if interrupted
+func runInterruptible(run func(first bool) error, first bool, interrupt <-chan os.Signal) bool {
+	done := make(chan error, 1)
+	go func() {
+		done <- run(first)
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			log.Error(err)
+		}
+		return true
+	case <-interrupt:
+		return false
+	}
+}
+
+// watchSeparator makes the line printed between builds
+func watchSeparator(n int, changed []string) string {
+	what := changed[0]
+	if len(changed) > 1 {
+		what = fmt.Sprintf("%s and %d more", what, len(changed)-1)
+	}
+	return fmt.Sprintf("%s build #%d, changed %s %s", strings.Repeat("=", 10), n, what, strings.Repeat("=", 10))
+}
@@ -0,0 +1,144 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeWatcher struct {
+	changes chan string
+}
+
+func (w *fakeWatcher) Changes() <-chan string { return w.changes }
+func (w *fakeWatcher) Close() error           { return nil }
+
+// fakeBuilds records the builds and reports every finished build to the channel
+type fakeBuilds struct {
+	mu    sync.Mutex
+	first []bool
+	err   error
+	done  chan struct{}
+}
+
+func (b *fakeBuilds) run(first bool) error {
+	b.mu.Lock()
+	b.first = append(b.first, first)
+	err := b.err
+	b.mu.Unlock()
+	b.done <- struct{}{}
+	return err
+}
+
+func (b *fakeBuilds) wait(t *testing.T) {
+	select {
+	case <-b.done:
+	case <-time.After(time.Second):
+		t.Fatal("Expected a build")
+	}
+}
+
+func TestWatchBuilds_Debounce(t *testing.T) {
+	w := &fakeWatcher{changes: make(chan string)}
+	builds := &fakeBuilds{done: make(chan struct{})}
+	interrupt := make(chan os.Signal, 1)
+	out := &syncWriter{}
+	quit := make(chan struct{})
+
+	go func() {
+		watchBuilds(w, 50*time.Millisecond, interrupt, out, builds.run)
+		close(quit)
+	}()
+
+	builds.wait(t)
+
+	// A burst of changes makes a single rebuild
+	w.changes <- "/src/main.go"
+	w.changes <- "/src/util.go"
+	w.changes <- "/src/main.go"
+	builds.wait(t)
+
+	// Failed builds do not stop watching
+	builds.mu.Lock()
+	builds.err = fmt.Errorf("build failed")
+	builds.mu.Unlock()
+
+	w.changes <- "/src/Rockerfile"
+	builds.wait(t)
+
+	w.changes <- "/src/Rockerfile"
+	builds.wait(t)
+
+	interrupt <- os.Interrupt
+	select {
+	case <-quit:
+	case <-time.After(time.Second):
+		t.Fatal("Expected to quit on interrupt")
+	}
+
+	assert.Equal(t, []bool{true, false, false, false}, builds.first)
+	assert.Equal(t, "\n========== build #2, changed /src/main.go and 1 more ==========\n"+
+		"\n========== build #3, changed /src/Rockerfile ==========\n"+
+		"\n========== build #4, changed /src/Rockerfile ==========\n", out.String())
+}
+
+func TestWatchBuilds_InterruptDuringBuild(t *testing.T) {
+	w := &fakeWatcher{changes: make(chan string)}
+	interrupt := make(chan os.Signal, 1)
+	quit := make(chan struct{})
+	block := make(chan struct{})
+	defer close(block)
+
+	go func() {
+		watchBuilds(w, time.Millisecond, interrupt, &syncWriter{}, func(first bool) error {
+			<-block
+			return nil
+		})
+		close(quit)
+	}()
+
+	interrupt <- os.Interrupt
+	select {
+	case <-quit:
+	case <-time.After(time.Second):
+		t.Fatal("Expected to quit without waiting for the build")
+	}
+}
+
+type syncWriter struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (w *syncWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.buf.Write(p)
+}
+
+func (w *syncWriter) String() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.buf.String()
+}
@@ -0,0 +1,108 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// The vendored go-dockerclient lacks the fields added by the later docker
+// API versions, the types below extend its types with them; DockerClient
+// sends them with the RawClient when they are set
+
+// ImageConfig is docker.Config extended with the fields set by CONFIG.
+// The build knows only those set by CONFIG, the ones of the base image are
+// carried over by the daemon on commit.
+type ImageConfig struct {
+	docker.Config
+
+	StopSignal  string        `json:"StopSignal,omitempty"`
+	StopTimeout int           `json:"StopTimeout,omitempty"`
+	Shell       []string      `json:"Shell,omitempty"`
+	Healthcheck *HealthConfig `json:"Healthcheck,omitempty"`
+}
+
+// extended returns true if any of the fields unknown to go-dockerclient is set
+func (c ImageConfig) extended() bool {
+	return c.StopSignal != "" || c.StopTimeout != 0 || len(c.Shell) > 0 || c.Healthcheck != nil
+}
+
+// inherit takes the fields unknown to go-dockerclient that are not set from
+// the parent config, as the daemon does on commit
+func (c *ImageConfig) inherit(parent ImageConfig) {
+	if c.StopSignal == "" {
+		c.StopSignal = parent.StopSignal
+	}
+	if c.StopTimeout == 0 {
+		c.StopTimeout = parent.StopTimeout
+	}
+	if len(c.Shell) == 0 {
+		c.Shell = parent.Shell
+	}
+	if c.Healthcheck == nil {
+		c.Healthcheck = parent.Healthcheck
+	}
+}
+
+// HealthConfig is the HEALTHCHECK of the image, docker API 1.24
+type HealthConfig struct {
+	// Test is {} to inherit, {"NONE"} to disable, {"CMD", args...} or
+	// {"CMD-SHELL", command}
+	Test []string `json:"Test,omitempty"`
+
+	// Zero means to inherit, the durations are integer nanoseconds in JSON
+	Interval    time.Duration `json:"Interval,omitempty"`
+	Timeout     time.Duration `json:"Timeout,omitempty"`
+	StartPeriod time.Duration `json:"StartPeriod,omitempty"`
+	Retries     int           `json:"Retries,omitempty"`
+}
+
+// HostConfig is docker.HostConfig extended with the options set by
+// RUN --mount, --gpus and --sysctl
+type HostConfig struct {
+	docker.HostConfig
+
+	Tmpfs          map[string]string `json:"Tmpfs,omitempty"`
+	DeviceRequests []DeviceRequest   `json:"DeviceRequests,omitempty"`
+	Sysctls        map[string]string `json:"Sysctls,omitempty"`
+}
+
+// DeviceRequest is a request for devices sent to the device drivers, e.g.
+// GPUs; docker API 1.40
+type DeviceRequest struct {
+	Driver       string            `json:"Driver,omitempty"`
+	Count        int               `json:"Count,omitempty"`
+	DeviceIDs    []string          `json:"DeviceIDs,omitempty"`
+	Capabilities [][]string        `json:"Capabilities,omitempty"`
+	Options      map[string]string `json:"Options,omitempty"`
+}
+
+// extended returns true if any of the options unknown to go-dockerclient is set
+func (c HostConfig) extended() bool {
+	return len(c.Tmpfs) > 0 || len(c.DeviceRequests) > 0 || len(c.Sysctls) > 0
+}
+
+// inspectedRootFS is the part of the image inspection that lists the diff IDs
+// of the layers of the image, docker API 1.23
+type inspectedRootFS struct {
+	RootFS struct {
+		Type   string   `json:"Type"`
+		Layers []string `json:"Layers"`
+	} `json:"RootFS"`
+}
@@ -0,0 +1,63 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"sort"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// runFlagAPIVersions are the docker API versions the RUN flags need, the
+// older daemons ignore or reject the host config options set by them
+var runFlagAPIVersions = map[string]string{
+	"read-only":    "1.17",
+	"security-opt": "1.17",
+	"mount":        "1.22",
+	"sysctl":       "1.24",
+	"gpus":         "1.40",
+}
+
+// checkAPIVersion warns once per flag if the RUN flags need a newer docker
+// API than Config.APIVersion, nothing is checked if it is unknown
+func (b *Build) checkAPIVersion(flags map[string]string) {
+	if b.cfg.APIVersion == nil {
+		return
+	}
+
+	names := []string{}
+	for name := range flags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		required, ok := runFlagAPIVersions[name]
+		if !ok || b.apiWarned[name] {
+			continue
+		}
+		version, err := docker.NewAPIVersion(required)
+		if err != nil || !b.cfg.APIVersion.LessThan(version) {
+			continue
+		}
+		if b.apiWarned == nil {
+			b.apiWarned = map[string]bool{}
+		}
+		b.apiWarned[name] = true
+		b.warnf("RUN --%s requires docker API %s, the negotiated version is %s", name, required, b.cfg.APIVersion)
+	}
+}
@@ -0,0 +1,41 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"testing"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckAPIVersion(t *testing.T) {
+	b, _ := makeBuild(t, "", Config{APIVersion: docker.APIVersion{1, 22}})
+
+	b.checkAPIVersion(map[string]string{"mount": "type=tmpfs,target=/tmp", "read-only": "", "sysctl": "a=b"})
+	assert.Equal(t, map[string]bool{"sysctl": true}, b.apiWarned)
+
+	b.checkAPIVersion(map[string]string{"gpus": "all"})
+	assert.Equal(t, map[string]bool{"sysctl": true, "gpus": true}, b.apiWarned)
+}
+
+func TestCheckAPIVersion_Unknown(t *testing.T) {
+	b, _ := makeBuild(t, "", Config{})
+
+	b.checkAPIVersion(map[string]string{"gpus": "all"})
+	assert.Nil(t, b.apiWarned)
+}
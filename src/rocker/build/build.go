@@ -17,9 +17,15 @@
 package build
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"rocker/imagename"
+	"rocker/textformatter"
+	"time"
 
 	"github.com/docker/docker/pkg/units"
 	"github.com/fatih/color"
@@ -46,19 +52,63 @@ var (
 
 // Config used specify parameters for the builder in New()
 type Config struct {
-	OutStream     io.Writer
-	InStream      io.ReadCloser
-	ContextDir    string
-	ID            string
-	Dockerignore  []string
-	ArtifactsPath string
-	Pull          bool
-	NoGarbage     bool
-	Attach        bool
-	Verbose       bool
-	NoCache       bool
-	ReloadCache   bool
-	Push          bool
+	OutStream       io.Writer
+	InStream        io.ReadCloser
+	ContextDir      string
+	LocalDaemon     bool
+	ID              string
+	Dockerignore    []string
+	ArtifactsPath   string
+	DumpStatesDir   string
+	ContextChecksum string
+	ManifestPath    string
+	ProvenancePath  string
+	OutputConfig    string
+	Contexts        map[string]string
+	CapAdd          []string
+	CapDrop         []string
+	Devices         []string
+	GPUs            string
+	Sysctls         []string
+	SecurityOpts    []string
+	ReadOnly        bool
+	APIVersion      docker.APIVersion
+	ProxyEnv        []string
+	AllowLatest     []string
+	UploadChunkSize int64
+	MaxSize         int64
+	UploadRetries   int
+	Pull            bool
+	NoReuse         bool
+	FromOverride    string
+	NoGarbage       bool
+	Attach          bool
+	AttachOnError   bool
+	Verbose         bool
+	NoCache         bool
+	ReloadCache     bool
+	Push            bool
+	EmptyLayers     bool
+	AllowPrivileged bool
+	Reproducible    bool
+	SourceDateEpoch time.Time
+	ForbidLatest    bool
+	VerifyPush      bool
+	PushBestEffort  bool
+	PushChanged     bool
+	Signer          Signer
+	BaseVerifier    Verifier
+	TrustPolicy     *TrustPolicy
+	PushFailOn      string
+	Annotations     map[string]string
+	Meta            *ImageMeta
+	ExportTransport string
+	ExportTarLimit  int64
+	Incremental     *IncrementalContext
+	Explain         bool
+	Warnings        []string
+	Observer        Observer
+	Steps           *textformatter.StepCounter
 }
 
 // Build is the main object that processes build
@@ -75,17 +125,75 @@ type Build struct {
 	// A little hack to support cross-FROM cache for EXPORTS
 	// maybe rethink it later
 	exports []string
+
+	// Files injected by COPY/ADD, collected when ManifestPath is set
+	manifest Manifest
+
+	// Number of the step being executed, reported with build events
+	step int
+
+	// Images taken and produced by the steps, see Provenance
+	provenance Provenance
+
+	// Incremental uploads waiting for the commit, see setIncrementalImage
+	incremental []*IncrementalStep
+
+	// Set if the container to commit is made by an incremental upload
+	incrementalUpload bool
+
+	// The last image committed with Reproducible option, the commit on top
+	// of it is made without exporting it, see commitReproducible
+	reproducible *reproducibleImage
+
+	// Why the current step is executed, set by probeCache, see Explanations
+	reason string
+
+	// Explanations tell why every step of the plan was executed or skipped
+	Explanations []StepExplanation
+
+	// Pushes are the outcomes of PUSH steps, collected with PushBestEffort
+	// or PushChanged
+	Pushes []PushResult
+
+	// Warnings collected during the build, reported at its end
+	Warnings []Warning
+
+	// Exit code of the command run by the current step, noExitCode if it
+	// runs none, and of the last RUN executed, see RUN --if-prev-failed
+	exitCode     int
+	lastExitCode int
+
+	// Whether the first FROM has taken the image of FromOverride
+	fromOverridden bool
+
+	// Volume containers of the MOUNTs not reused, removed after the build,
+	// their names are made unique with freshMountsID
+	freshMounts   []string
+	freshMountsID string
+
+	// Wraps the client to remove the containers of the build on Cancel
+	canceler *cancelClient
+
+	// RUN flags already warned about by checkAPIVersion
+	apiWarned map[string]bool
 }
 
+// noExitCode means that the step has not run a command
+const noExitCode = -1
+
 // New creates the new build object
 func New(client Client, rockerfile *Rockerfile, cache Cache, cfg Config) *Build {
 	b := &Build{
 		rockerfile: rockerfile,
 		cache:      cache,
 		cfg:        cfg,
-		client:     client,
+		canceler:   newCancelClient(client),
 		exports:    []string{},
+		manifest:   Manifest{Steps: []*ManifestStep{}},
+
+		lastExitCode: noExitCode,
 	}
+	b.client = b.canceler
 	b.state = NewState(b)
 	return b
 }
@@ -93,9 +201,34 @@ func New(client Client, rockerfile *Rockerfile, cache Cache, cfg Config) *Build
 // Run runs the build following the given Plan
 func (b *Build) Run(plan Plan) (err error) {
 
+	defer func() {
+		if err != nil {
+			b.event(Event{Type: EventError, Step: b.step, Error: err.Error()})
+		}
+	}()
+
+	// Reported the last, so that the warnings are not lost in the output
+	defer b.reportWarnings()
+
+	// Lines logged after the build should not carry the step number
+	defer b.cfg.Steps.Set(0, 0)
+
+	defer b.removeFreshMounts()
+
+	// Warnings found before the build, e.g. of deprecated flags
+	for _, message := range b.cfg.Warnings {
+		b.warnf("%s", message)
+	}
+
+	b.warnUnusedVars()
+
 	for k := 0; k < len(plan); k++ {
 		c := plan[k]
 
+		if b.isCancelled() {
+			return ErrCancelled
+		}
+
 		log.Debugf("Step %d: %# v", k+1, pretty.Formatter(c))
 
 		var doRun bool
@@ -103,22 +236,68 @@ func (b *Build) Run(plan Plan) (err error) {
 			return err
 		}
 		if !doRun {
+			b.explain(k+1, c, ReasonSkipped)
 			continue
 		}
 
 		// Replace env for the command if appropriate
 		if c, ok := c.(EnvReplacableCommand); ok {
-			c.ReplaceEnv(b.state.Config.Env)
+			if err = c.ReplaceEnv(b.state.Config.Env); err != nil {
+				return fmt.Errorf("Failed to replace env variables in %s, error: %s", c, err)
+			}
 		}
 
 		log.Infof("%s", color.New(color.FgWhite, color.Bold).SprintFunc()(c))
 
+		b.step = k + 1
+		b.cfg.Steps.Set(b.step, len(plan))
+		started := time.Now()
+		b.event(Event{Type: EventStepStart, Step: b.step, Command: c.String()})
+
+		commitsBefore := len(b.state.Commits)
+		imageBefore, historyBefore := b.state.ImageID, b.state.NoCache.History
+
+		b.reason = ""
+		b.exitCode = noExitCode
+
 		if b.state, err = c.Execute(b); err != nil {
+			if b.isCancelled() {
+				return ErrCancelled
+			}
 			return err
 		}
 
+		// Skipped steps and the ones running no command keep the status
+		// of the previous RUN, so that --if-prev-* steps can be chained
+		if b.exitCode != noExitCode {
+			b.lastExitCode = b.exitCode
+		}
+
+		b.explain(b.step, c, b.reason)
+
+		b.recordProvenance(c, imageBefore, historyBefore)
+
+		b.event(Event{
+			Type:       EventStepEnd,
+			Step:       b.step,
+			Command:    c.String(),
+			ImageID:    b.state.ImageID,
+			DurationMs: int64(time.Since(started) / time.Millisecond),
+		})
+
+		// Remember the commands that go to the next commit as they are written
+		if len(b.state.Commits) > commitsBefore {
+			b.state.NoCache.History = append(b.state.NoCache.History, c.String())
+		}
+
 		log.Debugf("State after step %d: %# v", k+1, pretty.Formatter(b.state))
 
+		if b.cfg.DumpStatesDir != "" {
+			if err := b.dumpState(k + 1); err != nil {
+				return err
+			}
+		}
+
 		// Here we need to inject ONBUILD commands on the fly,
 		// build sub plan and merge it with the main plan.
 		// Not very beautiful, because Run uses Plan as the argument
@@ -139,9 +318,83 @@ func (b *Build) Run(plan Plan) (err error) {
 		}
 	}
 
+	if b.cfg.ManifestPath != "" {
+		if err = b.writeManifest(); err != nil {
+			return err
+		}
+	}
+
+	if b.cfg.ProvenancePath != "" {
+		if err = b.writeProvenance(); err != nil {
+			return err
+		}
+	}
+
+	if b.cfg.OutputConfig != "" {
+		if err = b.writeImageConfig(); err != nil {
+			return err
+		}
+	}
+
+	if b.cfg.PushChanged {
+		b.reportPushes()
+	}
+
+	if b.cfg.PushBestEffort {
+		if err = b.checkPushes(); err != nil {
+			return err
+		}
+	}
+
+	if err = b.checkSize(); err != nil {
+		return err
+	}
+
+	b.event(Event{
+		Type:         EventBuildEnd,
+		ImageID:      b.state.ImageID,
+		ProducedSize: b.ProducedSize,
+		VirtualSize:  b.VirtualSize,
+	})
+
 	return nil
 }
 
+// PostRun runs the shell command in a container of the resulting image, e.g.
+// to smoke test it; if the command exits with a non-zero code, the returned
+// error is *ContainerExitError
+func (b *Build) PostRun(command string) error {
+	if b.state.ImageID == "" {
+		return fmt.Errorf("Cannot post-run %q, the build produced no image", command)
+	}
+
+	img, err := b.client.InspectImage(b.state.ImageID)
+	if err != nil {
+		return err
+	}
+	if img == nil {
+		return fmt.Errorf("Cannot post-run %q, image %.12s not found", command, b.state.ImageID)
+	}
+
+	log.Infof("%s", color.New(color.FgWhite, color.Bold).SprintFunc()("POST-RUN "+command))
+
+	s := NewState(b)
+	s.ImageID = img.ID
+	if img.Config != nil {
+		s.Config = ImageConfig{Config: *img.Config}
+	}
+	s.Config.Cmd = []string{"/bin/sh", "-c", command}
+	s.Config.Entrypoint = []string{}
+
+	containerID, err := b.client.CreateContainer(s)
+	if err != nil {
+		return err
+	}
+	defer b.client.RemoveContainer(containerID)
+
+	return b.client.RunContainer(containerID, false)
+}
+
 // GetState returns current build state object
 func (b *Build) GetState() State {
 	return b.state
@@ -152,8 +405,50 @@ func (b *Build) GetImageID() string {
 	return b.state.ImageID
 }
 
+// GetAnnotations returns the annotations set by ANNOTATION commands of the last
+// stage, the ones given with Config override them
+func (b *Build) GetAnnotations() map[string]string {
+	annotations := map[string]string{}
+	for k, v := range b.state.NoCache.Annotations {
+		annotations[k] = v
+	}
+	for k, v := range b.cfg.Annotations {
+		annotations[k] = v
+	}
+	return annotations
+}
+
+// dumpState writes the current state to a JSON file named after the step number
+// in the DumpStatesDir directory; known sensitive values are masked
+func (b *Build) dumpState(step int) error {
+	if err := os.MkdirAll(b.cfg.DumpStatesDir, 0755); err != nil {
+		return fmt.Errorf("Failed to create directory %s for state dumps, error: %s", b.cfg.DumpStatesDir, err)
+	}
+
+	data, err := json.MarshalIndent(b.state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	fileName := filepath.Join(b.cfg.DumpStatesDir, fmt.Sprintf("step_%03d.json", step))
+	content := textformatter.DefaultMasker.Mask(string(data))
+
+	if err := ioutil.WriteFile(fileName, []byte(content), 0644); err != nil {
+		return fmt.Errorf("Failed to write state dump %s, error: %s", fileName, err)
+	}
+
+	log.Debugf("Dumped state after step %d to %s", step, fileName)
+
+	return nil
+}
+
 func (b *Build) probeCache(s State) (cachedState State, hit bool, err error) {
-	if b.cache == nil || s.NoCache.CacheBusted {
+	if b.cache == nil {
+		b.reason = ReasonNoCache
+		return s, false, nil
+	}
+	if s.NoCache.CacheBusted {
+		b.reason = ReasonCacheBusted
 		return s, false, nil
 	}
 
@@ -163,6 +458,7 @@ func (b *Build) probeCache(s State) (cachedState State, hit bool, err error) {
 	}
 	if s2 == nil {
 		s.NoCache.CacheBusted = true
+		b.reason = ReasonNotCached
 		log.Info(color.New(color.FgYellow).SprintFunc()("| Not cached"))
 		return s, false, nil
 	}
@@ -170,6 +466,7 @@ func (b *Build) probeCache(s State) (cachedState State, hit bool, err error) {
 	if b.cfg.ReloadCache {
 		defer b.cache.Del(*s2)
 		s.NoCache.CacheBusted = true
+		b.reason = ReasonCacheReloaded
 		log.Info(color.New(color.FgYellow).SprintFunc()("| Reload cache"))
 		return s, false, nil
 	}
@@ -181,10 +478,22 @@ func (b *Build) probeCache(s State) (cachedState State, hit bool, err error) {
 	if img == nil {
 		defer b.cache.Del(*s2)
 		s.NoCache.CacheBusted = true
+		b.reason = ReasonImageGone
 		log.Info(color.New(color.FgYellow).SprintFunc()("| Not cached"))
 		return s, false, nil
 	}
 
+	// Images of builds with another SOURCE_DATE_EPOCH are not reused, their
+	// created time would leak into the image
+	if !b.cfg.SourceDateEpoch.IsZero() && !img.Created.Equal(b.cfg.SourceDateEpoch) {
+		s.NoCache.CacheBusted = true
+		b.reason = ReasonCreatedMismatch
+		log.Info(color.New(color.FgYellow).SprintFunc()("| Not cached, the image has another created time"))
+		return s, false, nil
+	}
+
+	b.reason = fmt.Sprintf("cache hit (image %.12s)", s2.ImageID)
+
 	size := fmt.Sprintf("%s (+%s)",
 		units.HumanSize(float64(img.VirtualSize)),
 		units.HumanSize(float64(img.Size)),
@@ -194,6 +503,8 @@ func (b *Build) probeCache(s State) (cachedState State, hit bool, err error) {
 		"size": size,
 	}).Infof(color.New(color.FgGreen).SprintfFunc()("| Cached! Take image %.12s", s2.ImageID))
 
+	b.event(Event{Type: EventCacheHit, Step: b.step, ImageID: s2.ImageID})
+
 	// Store some stuff to the build
 	b.ProducedSize += img.Size
 	b.VirtualSize = img.VirtualSize
@@ -206,9 +517,56 @@ func (b *Build) probeCache(s State) (cachedState State, hit bool, err error) {
 	return *s2, true, nil
 }
 
-func (b *Build) getVolumeContainer(path string) (c *docker.Container, err error) {
+// verifyPush pulls the pushed image back from the registry to make sure it is
+// retrievable; the digest is pulled if known, so the check does not depend on
+// the tag being moved by someone else in the meantime
+func (b *Build) verifyPush(image *imagename.ImageName, digest string) error {
+	ref := image.String()
+	if digest != "" {
+		ref = fmt.Sprintf("%s@%s", image.NameWithRegistry(), digest)
+	}
+
+	log.Infof("| Verify that %s can be pulled", ref)
+
+	if err := b.client.PullImage(ref); err != nil {
+		return fmt.Errorf("Failed to verify the push of %s, the image cannot be pulled from the registry, error: %s", image, err)
+	}
+
+	return nil
+}
+
+// checkLatest returns an error if ForbidLatest is set and the image refers
+// to the latest tag, unless the image is in the AllowLatest list; without
+// ForbidLatest such image is only warned about
+func (b *Build) checkLatest(name string) error {
+	img := imagename.NewFromString(name)
+	if !img.IsLatest() {
+		return nil
+	}
+
+	for _, allowed := range b.cfg.AllowLatest {
+		if imagename.NewFromString(allowed).NameWithRegistry() == img.NameWithRegistry() {
+			return nil
+		}
+	}
+
+	if !b.cfg.ForbidLatest {
+		b.warnf("Image %s is not pinned to a version", img)
+		return nil
+	}
+
+	return fmt.Errorf("Image %s is not pinned to a version, pin it or pass --allow-latest %s", img, img.NameWithRegistry())
+}
+
+// getVolumeContainer returns the volume container of the MOUNT path, it is
+// reused by the next builds unless reuse is false; then a fresh container is
+// made for the build, which is removed when the build is done
+func (b *Build) getVolumeContainer(path string, reuse bool) (c *docker.Container, err error) {
 
 	name := b.mountsContainerName(path)
+	if !reuse {
+		name = b.freshMountsContainerName(path)
+	}
 
 	config := &docker.Config{
 		Image: MountVolumeImage,
@@ -223,11 +581,38 @@ func (b *Build) getVolumeContainer(path string) (c *docker.Container, err error)
 		return nil, err
 	}
 
+	if !reuse {
+		b.addFreshMount(name)
+	}
+
 	log.Infof("| Using container %s for %s", name, path)
 
 	return b.client.InspectContainer(name)
 }
 
+// addFreshMount remembers the volume container to remove after the build
+func (b *Build) addFreshMount(name string) {
+	for _, n := range b.freshMounts {
+		if n == name {
+			return
+		}
+	}
+	b.freshMounts = append(b.freshMounts, name)
+}
+
+// removeFreshMounts removes the volume containers of the MOUNTs with no reuse;
+// failures are only logged, since they should not fail the build that is already done
+func (b *Build) removeFreshMounts() {
+	names := b.freshMounts
+	b.freshMounts = nil
+
+	for _, name := range names {
+		if err := b.client.RemoveContainer(name); err != nil {
+			log.Warnf("Failed to remove MOUNT volume container %s, error: %s", name, err)
+		}
+	}
+}
+
 func (b *Build) getExportsContainer() (c *docker.Container, err error) {
 	name := b.exportsContainerName()
 
@@ -340,6 +725,7 @@ func (b *Build) lookupImage(name string) (img *docker.Image, err error) {
 		if err = b.client.PullImage(candidate.String()); err != nil {
 			return
 		}
+		b.event(Event{Type: EventPull, Step: b.step, Image: candidate.String()})
 	}
 
 	return b.client.InspectImage(candidate.String())
@@ -17,9 +17,14 @@
 package build
 
 import (
+	"encoding/json"
 	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"rocker/imagename"
 	"rocker/template"
+	"rocker/textformatter"
 	"runtime"
 	"strings"
 	"testing"
@@ -55,7 +60,7 @@ func TestBuild_ReplaceEnvVars(t *testing.T) {
 		assert.Equal(t, []string{"PATH=/usr/bin:/cassandra/bin"}, arg.Config.Env)
 	}).Once()
 
-	c.On("CommitContainer", mock.AnythingOfType("State"), "ENV PATH=/usr/bin:/cassandra/bin").Return(resultImage, nil).Once()
+	c.On("CommitContainer", mock.AnythingOfType("State"), "ENV PATH=$PATH:/cassandra/bin").Return(resultImage, nil).Once()
 
 	c.On("RemoveContainer", "456").Return(nil).Once()
 
@@ -64,6 +69,419 @@ func TestBuild_ReplaceEnvVars(t *testing.T) {
 	}
 }
 
+func TestBuild_Config(t *testing.T) {
+	rockerfile := `FROM ubuntu
+CONFIG {"Hostname": "web", "WorkingDir": "/app"}
+RUN make`
+	b, c := makeBuild(t, rockerfile, Config{})
+	plan := makePlan(t, rockerfile)
+
+	img := &docker.Image{
+		ID:     "123",
+		Config: &docker.Config{Env: []string{"PATH=/usr/bin"}},
+	}
+
+	c.On("InspectImage", "ubuntu").Return(img, nil).Once()
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("456", nil).Once()
+	c.On("RunContainer", "456", false).Return(nil).Once()
+	c.On("CommitContainer", mock.AnythingOfType("State"), `CONFIG {"Hostname": "web", "WorkingDir": "/app"}; RUN make`).Return(&docker.Image{ID: "789"}, nil).Run(func(args mock.Arguments) {
+		arg := args.Get(0).(State)
+		assert.Equal(t, "web", arg.Config.Hostname)
+		assert.Equal(t, "/app", arg.Config.WorkingDir)
+		assert.Equal(t, []string{"PATH=/usr/bin"}, arg.Config.Env)
+	}).Once()
+	c.On("RemoveContainer", "456").Return(nil).Once()
+
+	if err := b.Run(plan); err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+}
+
+func TestBuild_ConfigHealthcheck(t *testing.T) {
+	rockerfile := `FROM ubuntu
+CONFIG {"Healthcheck": {"Test": ["CMD-SHELL", "curl -f localhost"]}, "Shell": ["/bin/bash", "-c"]}
+RUN make`
+	b, c := makeBuild(t, rockerfile, Config{})
+	plan := makePlan(t, rockerfile)
+
+	c.On("InspectImage", "ubuntu").Return(&docker.Image{ID: "123", Config: &docker.Config{}}, nil).Once()
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("456", nil).Once()
+	c.On("RunContainer", "456", false).Return(nil).Once()
+	c.On("CommitContainer", mock.AnythingOfType("State"), mock.AnythingOfType("string")).Return(&docker.Image{ID: "789"}, nil).Run(func(args mock.Arguments) {
+		arg := args.Get(0).(State)
+		if assert.NotNil(t, arg.Config.Healthcheck) {
+			assert.Equal(t, []string{"CMD-SHELL", "curl -f localhost"}, arg.Config.Healthcheck.Test)
+		}
+		assert.Equal(t, []string{"/bin/bash", "-c"}, arg.Config.Shell)
+	}).Once()
+	c.On("RemoveContainer", "456").Return(nil).Once()
+
+	if err := b.Run(plan); err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+}
+
+func TestBuild_NoGarbageKeepStage(t *testing.T) {
+	rockerfile := `FROM golang:1.5 # rocker:keep
+RUN make
+FROM alpine
+RUN make`
+	b, c := makeBuild(t, rockerfile, Config{NoGarbage: true})
+	plan := makePlan(t, rockerfile)
+
+	c.On("InspectImage", "golang:1.5").Return(&docker.Image{ID: "111", Config: &docker.Config{}}, nil).Once()
+	c.On("InspectImage", "alpine").Return(&docker.Image{ID: "222", Config: &docker.Config{}}, nil).Once()
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("456", nil).Twice()
+	c.On("RunContainer", "456", false).Return(nil).Twice()
+	c.On("CommitContainer", mock.AnythingOfType("State"), "RUN make").Return(&docker.Image{ID: "789"}, nil).Once()
+	c.On("CommitContainer", mock.AnythingOfType("State"), "RUN make").Return(&docker.Image{ID: "790"}, nil).Once()
+	c.On("RemoveContainer", "456").Return(nil).Twice()
+	c.On("RemoveImage", "790").Return(nil).Once()
+
+	if err := b.Run(plan); err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+	c.AssertNotCalled(t, "RemoveImage", "789")
+}
+
+func TestBuild_ChainedEnvVars(t *testing.T) {
+	rockerfile := `FROM ubuntu
+ENV PATH=/opt/bin:$PATH
+ENV A=1
+ENV B=$A:${PATH} C=x$B
+ENV A=2 PATH=/x:$PATH
+RUN make`
+	b, c := makeBuild(t, rockerfile, Config{})
+	plan := makePlan(t, rockerfile)
+
+	baseEnv := []string{"PATH=/usr/bin", "B=0"}
+	img := &docker.Image{
+		ID:     "123",
+		Config: &docker.Config{Env: baseEnv},
+	}
+
+	c.On("InspectImage", "ubuntu").Return(img, nil).Once()
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("456", nil).Run(func(args mock.Arguments) {
+		arg := args.Get(0).(State)
+		// Values of the same ENV refer to the variables as they were before it, like in Docker
+		assert.Equal(t, []string{
+			"PATH=/x:/opt/bin:/usr/bin",
+			"B=1:/opt/bin:/usr/bin",
+			"A=2",
+			"C=x0",
+		}, arg.Config.Env)
+	}).Once()
+	c.On("RunContainer", "456", false).Return(nil).Once()
+	c.On("CommitContainer", mock.AnythingOfType("State"), mock.AnythingOfType("string")).Return(&docker.Image{ID: "789"}, nil).Once()
+	c.On("RemoveContainer", "456").Return(nil).Once()
+
+	if err := b.Run(plan); err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+	assert.Equal(t, []string{"PATH=/usr/bin", "B=0"}, baseEnv, "expected the env of the base image to stay intact")
+}
+
+func TestBuild_EnvReplaceError(t *testing.T) {
+	rockerfile := "FROM ubuntu\nENV A=${B"
+	b, c := makeBuild(t, rockerfile, Config{})
+	plan := makePlan(t, rockerfile)
+
+	c.On("InspectImage", "ubuntu").Return(&docker.Image{ID: "123"}, nil).Once()
+
+	assert.Error(t, b.Run(plan))
+}
+
+func TestBuild_CoalesceMetadataCommits(t *testing.T) {
+	rockerfile := "FROM ubuntu\nENV a=1\nLABEL b=2\nWORKDIR /app\nRUN make\nENV c=3\nUSER nobody\nRUN make install"
+	b, c := makeBuild(t, rockerfile, Config{})
+	plan := makePlan(t, rockerfile)
+
+	img := &docker.Image{ID: "123"}
+
+	c.On("InspectImage", "ubuntu").Return(img, nil).Once()
+
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("456", nil).Run(func(args mock.Arguments) {
+		arg := args.Get(0).(State)
+		assert.Equal(t, []string{"a=1"}, arg.Config.Env)
+		assert.Equal(t, "/app", arg.Config.WorkingDir)
+	}).Once()
+	c.On("RunContainer", "456", false).Return(nil).Once()
+	c.On("CommitContainer", mock.AnythingOfType("State"), "ENV a=1; LABEL b=2; WORKDIR /app; RUN make").Return(&docker.Image{ID: "789"}, nil).Once()
+	c.On("RemoveContainer", "456").Return(nil).Once()
+
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("654", nil).Run(func(args mock.Arguments) {
+		arg := args.Get(0).(State)
+		assert.Equal(t, []string{"a=1", "c=3"}, arg.Config.Env)
+		assert.Equal(t, "nobody", arg.Config.User)
+	}).Once()
+	c.On("RunContainer", "654", false).Return(nil).Once()
+	c.On("CommitContainer", mock.AnythingOfType("State"), "ENV c=3; USER nobody; RUN make install").Return(&docker.Image{ID: "987"}, nil).Once()
+	c.On("RemoveContainer", "654").Return(nil).Once()
+
+	if err := b.Run(plan); err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+	c.AssertNumberOfCalls(t, "CommitContainer", 2)
+	assert.Equal(t, "987", b.GetImageID())
+}
+
+func TestBuild_RunIfPrevFailed(t *testing.T) {
+	rockerfile := `FROM ubuntu
+RUN --allow-failure make test
+RUN --if-prev-succeeded make deploy
+RUN --if-prev-failed make cleanup`
+	b, c := makeBuild(t, rockerfile, Config{})
+	plan := makePlan(t, rockerfile)
+
+	c.On("InspectImage", "ubuntu").Return(&docker.Image{ID: "123"}, nil).Once()
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("456", nil).Once()
+	c.On("RunContainer", "456", false).Return(&ContainerExitError{ContainerID: "456", ExitCode: 2}).Once()
+	c.On("RemoveContainer", "456").Return(nil).Once()
+
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("654", nil).Run(func(args mock.Arguments) {
+		arg := args.Get(0).(State)
+		assert.Equal(t, []string{"/bin/sh", "-c", "make cleanup"}, arg.Config.Cmd)
+		assert.Equal(t, "123", arg.ImageID, "expected the failed step to leave no trace")
+	}).Once()
+	c.On("RunContainer", "654", false).Return(nil).Once()
+	c.On("CommitContainer", mock.AnythingOfType("State"), "RUN --if-prev-failed make cleanup").Return(&docker.Image{ID: "789"}, nil).Once()
+	c.On("RemoveContainer", "654").Return(nil).Once()
+
+	if err := b.Run(plan); err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+	c.AssertNumberOfCalls(t, "RunContainer", 2)
+	assert.Equal(t, "789", b.GetImageID())
+}
+
+func TestBuild_RunIfPrevSucceeded(t *testing.T) {
+	rockerfile := `FROM ubuntu
+RUN --allow-failure make test
+RUN --if-prev-succeeded make deploy
+RUN --if-prev-failed make cleanup`
+	b, c := makeBuild(t, rockerfile, Config{})
+	plan := makePlan(t, rockerfile)
+
+	c.On("InspectImage", "ubuntu").Return(&docker.Image{ID: "123"}, nil).Once()
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("456", nil).Once()
+	c.On("RunContainer", "456", false).Return(nil).Once()
+	c.On("CommitContainer", mock.AnythingOfType("State"), "RUN --allow-failure make test").Return(&docker.Image{ID: "789"}, nil).Once()
+	c.On("RemoveContainer", "456").Return(nil).Once()
+
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("654", nil).Run(func(args mock.Arguments) {
+		arg := args.Get(0).(State)
+		assert.Equal(t, []string{"/bin/sh", "-c", "make deploy"}, arg.Config.Cmd)
+	}).Once()
+	c.On("RunContainer", "654", false).Return(nil).Once()
+	c.On("CommitContainer", mock.AnythingOfType("State"), "RUN --if-prev-succeeded make deploy").Return(&docker.Image{ID: "987"}, nil).Once()
+	c.On("RemoveContainer", "654").Return(nil).Once()
+
+	if err := b.Run(plan); err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+	c.AssertNumberOfCalls(t, "RunContainer", 2)
+	assert.Equal(t, "987", b.GetImageID())
+}
+
+func TestBuild_RunIfPrevWithoutPrev(t *testing.T) {
+	rockerfile := "FROM ubuntu\nRUN --if-prev-failed make cleanup"
+	b, c := makeBuild(t, rockerfile, Config{})
+	plan := makePlan(t, rockerfile)
+
+	c.On("InspectImage", "ubuntu").Return(&docker.Image{ID: "123"}, nil).Once()
+
+	err := b.Run(plan)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "requires a previous RUN step")
+	}
+}
+
+func TestBuild_StepNumbers(t *testing.T) {
+	steps := &textformatter.StepCounter{}
+
+	rockerfile := "FROM ubuntu\nRUN make"
+	b, c := makeBuild(t, rockerfile, Config{Steps: steps})
+	plan := makePlan(t, rockerfile)
+
+	c.On("InspectImage", "ubuntu").Return(&docker.Image{ID: "123"}, nil).Run(func(args mock.Arguments) {
+		assert.Equal(t, "[1/4] ", steps.Prefix())
+	}).Once()
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("456", nil).Once()
+	c.On("RunContainer", "456", false).Return(nil).Run(func(args mock.Arguments) {
+		assert.Equal(t, "[2/4] ", steps.Prefix())
+	}).Once()
+	c.On("CommitContainer", mock.AnythingOfType("State"), "RUN make").Return(&docker.Image{ID: "789"}, nil).Run(func(args mock.Arguments) {
+		assert.Equal(t, "[3/4] ", steps.Prefix())
+	}).Once()
+	c.On("RemoveContainer", "456").Return(nil).Once()
+
+	if err := b.Run(plan); err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+	assert.Equal(t, "", steps.Prefix(), "expected the step number to be reset after the build")
+}
+
+func TestBuild_PostRun(t *testing.T) {
+	b, c := makeBuild(t, "", Config{})
+	b.state.ImageID = "789"
+
+	img := &docker.Image{
+		ID: "789",
+		Config: &docker.Config{
+			Env:        []string{"PATH=/app/bin"},
+			Entrypoint: []string{"/init"},
+		},
+	}
+
+	c.On("InspectImage", "789").Return(img, nil).Once()
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("456", nil).Run(func(args mock.Arguments) {
+		arg := args.Get(0).(State)
+		assert.Equal(t, "789", arg.ImageID)
+		assert.Equal(t, []string{"PATH=/app/bin"}, arg.Config.Env)
+		assert.Equal(t, []string{"/bin/sh", "-c", "app --version"}, arg.Config.Cmd)
+		assert.Equal(t, []string{}, arg.Config.Entrypoint)
+	}).Once()
+	c.On("RunContainer", "456", false).Return(nil).Once()
+	c.On("RemoveContainer", "456").Return(nil).Once()
+
+	if err := b.PostRun("app --version"); err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+}
+
+func TestBuild_PostRunExitCode(t *testing.T) {
+	b, c := makeBuild(t, "", Config{})
+	b.state.ImageID = "789"
+
+	c.On("InspectImage", "789").Return(&docker.Image{ID: "789"}, nil).Once()
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("456", nil).Once()
+	c.On("RunContainer", "456", false).Return(&ContainerExitError{ContainerID: "456", ExitCode: 3}).Once()
+	c.On("RemoveContainer", "456").Return(nil).Once()
+
+	err := b.PostRun("app --version")
+
+	c.AssertExpectations(t)
+	assert.EqualError(t, err, "Container 456 exited with code 3")
+	if exitErr, ok := err.(*ContainerExitError); assert.True(t, ok) {
+		assert.Equal(t, 3, exitErr.ExitCode)
+	}
+}
+
+func TestBuild_PostRunNoImage(t *testing.T) {
+	b, _ := makeBuild(t, "", Config{})
+	assert.EqualError(t, b.PostRun("true"), `Cannot post-run "true", the build produced no image`)
+}
+
+func TestBuild_HistoryMessages(t *testing.T) {
+	rockerfile := `FROM ubuntu
+ENV a=1 b=$a
+LABEL version=1
+WORKDIR /app
+USER nobody
+EXPOSE 80
+VOLUME /data
+CMD ["run"]
+ENTRYPOINT ["/init"]
+ONBUILD RUN make
+RUN make $a
+ENV c=3`
+	b, c := makeBuild(t, rockerfile, Config{})
+	plan := makePlan(t, rockerfile)
+
+	c.On("InspectImage", "ubuntu").Return(&docker.Image{ID: "123"}, nil).Once()
+
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("456", nil).Once()
+	c.On("RunContainer", "456", false).Return(nil).Once()
+	c.On("CommitContainer", mock.AnythingOfType("State"), strings.Join([]string{
+		"ENV a=1 b=$a",
+		"LABEL version=1",
+		"WORKDIR /app",
+		"USER nobody",
+		"EXPOSE 80",
+		"VOLUME /data",
+		`CMD ["run"]`,
+		`ENTRYPOINT ["/init"]`,
+		"ONBUILD RUN make",
+		"RUN make $a",
+	}, "; ")).Return(&docker.Image{ID: "789"}, nil).Once()
+	c.On("RemoveContainer", "456").Return(nil).Once()
+
+	// Metadata-only commit makes a container with the message in its Cmd
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("654", nil).Run(func(args mock.Arguments) {
+		arg := args.Get(0).(State)
+		assert.Equal(t, []string{"/bin/sh", "-c", "#(nop) ENV c=3"}, arg.Config.Cmd)
+	}).Once()
+	c.On("CommitContainer", mock.AnythingOfType("State"), "ENV c=3").Return(&docker.Image{ID: "987"}, nil).Once()
+	c.On("RemoveContainer", "654").Return(nil).Once()
+
+	if err := b.Run(plan); err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+	assert.Empty(t, b.state.NoCache.History)
+}
+
+func TestBuild_DumpStates(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "rocker-dump-states-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	rockerfile := "FROM ubuntu\nENV foo=bar"
+	b, c := makeBuild(t, rockerfile, Config{DumpStatesDir: tmpDir})
+	plan := makePlan(t, rockerfile)
+
+	c.On("InspectImage", "ubuntu").Return(&docker.Image{ID: "123"}, nil).Once()
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("456", nil).Once()
+	c.On("CommitContainer", mock.AnythingOfType("State"), "ENV foo=bar").Return(&docker.Image{ID: "789"}, nil).Once()
+	c.On("RemoveContainer", "456").Return(nil).Once()
+
+	if err := b.Run(plan); err != nil {
+		t.Fatal(err)
+	}
+
+	// from, env, commit, cleanup
+	files, err := filepath.Glob(filepath.Join(tmpDir, "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, files, len(plan))
+
+	data, err := ioutil.ReadFile(filepath.Join(tmpDir, "step_002.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := State{}
+	if err := json.Unmarshal(data, &s); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "123", s.ImageID)
+	assert.Equal(t, []string{"foo=bar"}, s.Config.Env)
+	assert.Equal(t, []string{"ENV foo=bar"}, s.Commits)
+}
+
 func TestBuild_LookupImage_ExactExistLocally(t *testing.T) {
 	var (
 		b, c        = makeBuild(t, "", Config{})
@@ -272,6 +690,16 @@ func (m *MockClient) InspectImage(name string) (*docker.Image, error) {
 	return args.Get(0).(*docker.Image), args.Error(1)
 }
 
+func (m *MockClient) ImageHistory(imageID string) ([]docker.ImageHistory, error) {
+	args := m.Called(imageID)
+	return args.Get(0).([]docker.ImageHistory), args.Error(1)
+}
+
+func (m *MockClient) ImageLayers(name string) ([]string, error) {
+	args := m.Called(name)
+	return args.Get(0).([]string), args.Error(1)
+}
+
 func (m *MockClient) PullImage(name string) error {
 	args := m.Called(name)
 	return args.Error(0)
@@ -282,6 +710,16 @@ func (m *MockClient) ListImages() (images []*imagename.ImageName, err error) {
 	return args.Get(0).([]*imagename.ImageName), args.Error(1)
 }
 
+func (m *MockClient) ListDanglingImages() (ids []string, err error) {
+	args := m.Called()
+	return args.Get(0).([]string), args.Error(1)
+}
+
+func (m *MockClient) ImageRepoDigests(imageID string) (digests []string, err error) {
+	args := m.Called(imageID)
+	return args.Get(0).([]string), args.Error(1)
+}
+
 func (m *MockClient) ListImageTags(name string) (images []*imagename.ImageName, err error) {
 	args := m.Called(name)
 	return args.Get(0).([]*imagename.ImageName), args.Error(1)
@@ -297,9 +735,14 @@ func (m *MockClient) TagImage(imageID, imageName string) error {
 	return args.Error(0)
 }
 
-func (m *MockClient) PushImage(imageName string) (string, error) {
+func (m *MockClient) Transfers() []ImageTransfer {
+	args := m.Called()
+	return args.Get(0).([]ImageTransfer)
+}
+
+func (m *MockClient) PushImage(imageName string) (string, PushStats, error) {
 	args := m.Called(imageName)
-	return args.String(0), args.Error(1)
+	return args.String(0), args.Get(1).(PushStats), args.Error(2)
 }
 
 func (m *MockClient) CreateContainer(state State) (string, error) {
@@ -327,6 +770,31 @@ func (m *MockClient) UploadToContainer(containerID string, stream io.Reader, pat
 	return args.Error(0)
 }
 
+func (m *MockClient) DownloadFromContainer(containerID string, path string) (io.ReadCloser, error) {
+	args := m.Called(containerID, path)
+	return args.Get(0).(io.ReadCloser), args.Error(1)
+}
+
+func (m *MockClient) ContainerChanges(containerID string) ([]docker.Change, error) {
+	args := m.Called(containerID)
+	return args.Get(0).([]docker.Change), args.Error(1)
+}
+
+func (m *MockClient) ExportContainer(containerID string) (io.ReadCloser, error) {
+	args := m.Called(containerID)
+	return args.Get(0).(io.ReadCloser), args.Error(1)
+}
+
+func (m *MockClient) ExportImage(imageID string) (io.ReadCloser, error) {
+	args := m.Called(imageID)
+	return args.Get(0).(io.ReadCloser), args.Error(1)
+}
+
+func (m *MockClient) LoadImage(stream io.Reader) error {
+	args := m.Called(stream)
+	return args.Error(0)
+}
+
 func (m *MockClient) ResolveHostPath(path string) (resultPath string, err error) {
 	args := m.Called(path)
 	return args.String(0), args.Error(1)
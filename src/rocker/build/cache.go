@@ -18,9 +18,12 @@ package build
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
@@ -33,16 +36,45 @@ type Cache interface {
 	Del(s State) error
 }
 
+// CacheVersion is the version of the cache entries. Bump it whenever the way
+// the states are matched changes (commit messages, checksums, etc.), so the
+// entries written by an incompatible version of rocker are ignored instead of trusted
+const CacheVersion = 2
+
 // CacheFS implements file based cache backend
 type CacheFS struct {
-	root string
+	root    string
+	version int
+}
+
+// cacheFSEntry is a cache entry file, the state with the version of the cache
+type cacheFSEntry struct {
+	State
+	CacheVersion int
 }
 
-// NewCacheFS creates a file based cache backend
+// NewCacheFS creates a file based cache backend; the entries of every
+// version of the cache are kept in a separate directory under root
 func NewCacheFS(root string) *CacheFS {
+	return newCacheFSVersion(root, CacheVersion)
+}
+
+func newCacheFSVersion(root string, version int) *CacheFS {
 	return &CacheFS{
-		root: root,
+		root:    filepath.Join(root, fmt.Sprintf("v%d", version)),
+		version: version,
+	}
+}
+
+// NewCacheFSForDaemon creates a file based cache backend that is partitioned by
+// the docker daemon ID. Switching between daemons (e.g. by changing DOCKER_HOST)
+// then uses separate cache partitions, so we never get image IDs that only
+// exist on the other daemon. Empty daemonID means no partitioning.
+func NewCacheFSForDaemon(root, daemonID string) *CacheFS {
+	if daemonID == "" {
+		return NewCacheFS(root)
 	}
+	return NewCacheFS(filepath.Join(root, "daemon_"+strings.Replace(daemonID, ":", "", -1)))
 }
 
 // Get fetches cache
@@ -59,15 +91,22 @@ func (c *CacheFS) Get(s State) (res *State, err error) {
 			return nil
 		}
 
-		s2 := State{}
+		entry := cacheFSEntry{}
 		data, err := ioutil.ReadFile(path)
 		if err != nil {
 			return err
 		}
-		if err := json.Unmarshal(data, &s2); err != nil {
+		if err := json.Unmarshal(data, &entry); err != nil {
 			return err
 		}
 
+		// Entries of another version are misses, even if they look the same
+		if entry.CacheVersion != c.version {
+			log.Debugf("CACHE SKIP %s version %d, expected %d", path, entry.CacheVersion, c.version)
+			return nil
+		}
+		s2 := entry.State
+
 		log.Debugf("CACHE COMPARE %s %s %q %q", s.ImageID, s2.ImageID, s.Commits, s2.Commits)
 
 		if s.Equals(s2) && info.ModTime().After(latestTime) {
@@ -89,7 +128,7 @@ func (c *CacheFS) Put(s State) error {
 	if err := os.MkdirAll(filepath.Dir(fileName), 0755); err != nil {
 		return err
 	}
-	data, err := json.Marshal(s)
+	data, err := json.Marshal(cacheFSEntry{State: s, CacheVersion: c.version})
 	if err != nil {
 		return err
 	}
@@ -103,3 +142,84 @@ func (c *CacheFS) Del(s State) error {
 	fileName := filepath.Join(c.root, s.ParentID, s.ImageID) + ".json"
 	return os.RemoveAll(fileName)
 }
+
+// CacheMemory implements in-memory cache backend that lives as long as
+// the process does; it suits single-shot builds where nothing should
+// persist, but the steps still share the state, e.g. EXPORT across FROMs
+type CacheMemory struct {
+	// parent image ID -> image ID -> serialized state
+	items map[string]map[string]cacheMemoryItem
+	seq   int
+	mu    sync.Mutex
+}
+
+type cacheMemoryItem struct {
+	data []byte
+	seq  int
+}
+
+// NewCacheMemory creates an in-memory cache backend
+func NewCacheMemory() *CacheMemory {
+	return &CacheMemory{
+		items: map[string]map[string]cacheMemoryItem{},
+	}
+}
+
+// Get fetches cache
+func (c *CacheMemory) Get(s State) (res *State, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	latest := -1
+
+	for _, item := range c.items[s.ImageID] {
+		// States are kept serialized, so the cached ones
+		// do not share slices and maps with the build
+		s2 := State{}
+		if err := json.Unmarshal(item.data, &s2); err != nil {
+			return nil, err
+		}
+
+		log.Debugf("CACHE COMPARE %s %s %q %q", s.ImageID, s2.ImageID, s.Commits, s2.Commits)
+
+		if s.Equals(s2) && item.seq > latest {
+			latest = item.seq
+			res = &s2
+		}
+	}
+
+	return res, nil
+}
+
+// Put stores cache
+func (c *CacheMemory) Put(s State) error {
+	log.Debugf("CACHE PUT %s %s %q", s.ParentID, s.ImageID, s.Commits)
+
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.items[s.ParentID] == nil {
+		c.items[s.ParentID] = map[string]cacheMemoryItem{}
+	}
+	c.seq++
+	c.items[s.ParentID][s.ImageID] = cacheMemoryItem{data: data, seq: c.seq}
+
+	return nil
+}
+
+// Del deletes cache
+func (c *CacheMemory) Del(s State) error {
+	log.Debugf("CACHE DELETE %s %s %q", s.ParentID, s.ImageID, s.Commits)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.items[s.ParentID], s.ImageID)
+
+	return nil
+}
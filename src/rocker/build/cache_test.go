@@ -17,8 +17,11 @@
 package build
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
+	"os/exec"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -59,6 +62,202 @@ func TestCache_Basic(t *testing.T) {
 	assert.Nil(t, res2)
 }
 
+func TestCache_DaemonPartitions(t *testing.T) {
+	tmpDir := cacheTestTmpDir(t)
+	defer os.RemoveAll(tmpDir)
+
+	c1 := NewCacheFSForDaemon(tmpDir, "ABCD:EFGH:IJKL")
+	c2 := NewCacheFSForDaemon(tmpDir, "MNOP:QRST:UVWX")
+
+	s := State{
+		ParentID: "123",
+		ImageID:  "456",
+	}
+	if err := c1.Put(s); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := c1.Get(State{ImageID: "123"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assert.NotNil(t, res) {
+		assert.Equal(t, "456", res.ImageID)
+	}
+
+	res2, err := c2.Get(State{ImageID: "123"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, res2, "cache of one daemon should not be visible to another")
+
+	assert.Equal(t, NewCacheFS(tmpDir).root, NewCacheFSForDaemon(tmpDir, "").root)
+}
+
+func TestCache_VersionMismatch(t *testing.T) {
+	tmpDir := cacheTestTmpDir(t)
+	defer os.RemoveAll(tmpDir)
+
+	s := State{
+		ParentID: "123",
+		ImageID:  "456",
+	}
+
+	// Written by an older rocker
+	old := newCacheFSVersion(tmpDir, CacheVersion-1)
+	if err := old.Put(s); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := old.Get(State{ImageID: "123"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NotNil(t, res, "the old version should serve its own entries")
+
+	c := NewCacheFS(tmpDir)
+
+	res, err = c.Get(State{ImageID: "123"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, res, "entries of the old version should not be served")
+
+	// An entry of the old version in the current directory is a miss too,
+	// the same as the one without a version written before it was introduced
+	for i, data := range []string{
+		fmt.Sprintf(`{"ParentID":"123","ImageID":"456","CacheVersion":%d}`, CacheVersion-1),
+		`{"ParentID":"123","ImageID":"457"}`,
+	} {
+		fileName := filepath.Join(c.root, "123", fmt.Sprintf("45%d.json", 6+i))
+		if err := os.MkdirAll(filepath.Dir(fileName), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fileName, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	res, err = c.Get(State{ImageID: "123"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, res)
+
+	// The current version is served
+	if err := c.Put(State{ParentID: "123", ImageID: "458"}); err != nil {
+		t.Fatal(err)
+	}
+	res, err = c.Get(State{ImageID: "123"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assert.NotNil(t, res) {
+		assert.Equal(t, "458", res.ImageID)
+	}
+}
+
+func TestCacheMemory_Basic(t *testing.T) {
+	c := NewCacheMemory()
+
+	s := State{
+		ParentID: "123",
+		ImageID:  "456",
+		Commits:  []string{"RUN make"},
+	}
+	if err := c.Put(s); err != nil {
+		t.Fatal(err)
+	}
+
+	// The cached state is not affected by the changes of the stored one
+	s.Commits[0] = "RUN make test"
+
+	res, err := c.Get(State{ImageID: "123", Commits: []string{"RUN make"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assert.NotNil(t, res) {
+		assert.Equal(t, "456", res.ImageID)
+		assert.Equal(t, []string{"RUN make"}, res.Commits)
+	}
+
+	res2, err := c.Get(State{ImageID: "123", Commits: []string{"RUN make install"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, res2)
+
+	res3, err := c.Get(State{ImageID: "789"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, res3)
+}
+
+func TestCacheMemory_LatestAndDel(t *testing.T) {
+	c := NewCacheMemory()
+
+	for _, id := range []string{"456", "457"} {
+		if err := c.Put(State{ParentID: "123", ImageID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	res, err := c.Get(State{ImageID: "123"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assert.NotNil(t, res) {
+		assert.Equal(t, "457", res.ImageID)
+	}
+
+	if err := c.Del(State{ParentID: "123", ImageID: "457"}); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err = c.Get(State{ImageID: "123"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assert.NotNil(t, res) {
+		assert.Equal(t, "456", res.ImageID)
+	}
+}
+
+// TestCacheMemory_Process runs a process that fills the cache, nothing
+// of it should outlive the process, neither on disk nor in a new cache
+func TestCacheMemory_Process(t *testing.T) {
+	if os.Getenv("ROCKER_TEST_CACHE_MEMORY") == "1" {
+		c := NewCacheMemory()
+		if err := c.Put(State{ParentID: "123", ImageID: "456"}); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	tmpDir := cacheTestTmpDir(t)
+	defer os.RemoveAll(tmpDir)
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestCacheMemory_Process$")
+	cmd.Dir = tmpDir
+	cmd.Env = append(os.Environ(), "ROCKER_TEST_CACHE_MEMORY=1", "HOME="+tmpDir, "TMPDIR="+tmpDir)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("%s: %s", err, out)
+	}
+
+	files, err := ioutil.ReadDir(tmpDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, files)
+
+	res, err := NewCacheMemory().Get(State{ImageID: "123"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, res)
+}
+
 func cacheTestTmpDir(t *testing.T) string {
 	tmpDir, err := ioutil.TempDir("", "rocker-cache-test")
 	if err != nil {
@@ -0,0 +1,139 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"fmt"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// ErrCancelled is returned by Run if the build is cancelled with Cancel
+var ErrCancelled = fmt.Errorf("The build is cancelled")
+
+// cancelClient tracks the containers created by the build, so that they are
+// removed if the build is cancelled; the calls made after that fail with
+// ErrCancelled. The volume containers of EnsureContainer are not tracked,
+// they are meant to outlive the build
+type cancelClient struct {
+	Client
+
+	mu         sync.Mutex
+	cancelled  bool
+	containers map[string]bool
+	removed    map[string]bool
+}
+
+func newCancelClient(client Client) *cancelClient {
+	return &cancelClient{
+		Client:     client,
+		containers: map[string]bool{},
+		removed:    map[string]bool{},
+	}
+}
+
+// isCancelled tells whether the build is cancelled
+func (c *cancelClient) isCancelled() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.cancelled
+}
+
+// cancel removes the containers created so far, a running container is
+// stopped by that
+func (c *cancelClient) cancel() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.cancelled = true
+
+	for id := range c.containers {
+		if err := c.Client.RemoveContainer(id); err != nil {
+			log.Errorf("Failed to remove container %.12s of the cancelled build, error: %s", id, err)
+		}
+		delete(c.containers, id)
+		c.removed[id] = true
+	}
+}
+
+// CreateContainer creates the container unless the build is cancelled
+func (c *cancelClient) CreateContainer(state State) (string, error) {
+	if c.isCancelled() {
+		return "", ErrCancelled
+	}
+
+	id, err := c.Client.CreateContainer(state)
+	if err != nil {
+		return id, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// The build could be cancelled while the container was being created
+	if c.cancelled {
+		if err := c.Client.RemoveContainer(id); err != nil {
+			log.Errorf("Failed to remove container %.12s of the cancelled build, error: %s", id, err)
+		}
+		return "", ErrCancelled
+	}
+
+	c.containers[id] = true
+	return id, nil
+}
+
+// RunContainer runs the container, ErrCancelled is returned if the build
+// is cancelled meanwhile
+func (c *cancelClient) RunContainer(containerID string, attachStdin bool) error {
+	if c.isCancelled() {
+		return ErrCancelled
+	}
+	err := c.Client.RunContainer(containerID, attachStdin)
+	if c.isCancelled() {
+		return ErrCancelled
+	}
+	return err
+}
+
+// RemoveContainer removes the container, unless cancel has removed it already
+func (c *cancelClient) RemoveContainer(containerID string) error {
+	c.mu.Lock()
+	if c.removed[containerID] {
+		c.mu.Unlock()
+		return nil
+	}
+	delete(c.containers, containerID)
+	c.mu.Unlock()
+
+	return c.Client.RemoveContainer(containerID)
+}
+
+// Cancel stops the build from another goroutine: the containers created by
+// the build are removed, which stops the running one, and Run returns
+// ErrCancelled once the current step is over. Cancel returns once the
+// containers are removed
+func (b *Build) Cancel() {
+	if b.canceler != nil {
+		b.canceler.cancel()
+	}
+}
+
+// isCancelled tells whether Cancel has been called
+func (b *Build) isCancelled() bool {
+	return b.canceler != nil && b.canceler.isCancelled()
+}
@@ -0,0 +1,74 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"testing"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestBuild_Cancel(t *testing.T) {
+	rockerfile := `FROM ubuntu
+RUN sleep 1000
+RUN make`
+	b, c := makeBuild(t, rockerfile, Config{})
+	plan := makePlan(t, rockerfile)
+
+	started := make(chan struct{})
+	removed := make(chan struct{})
+
+	c.On("InspectImage", "ubuntu").Return(&docker.Image{ID: "123", Config: &docker.Config{}}, nil).Once()
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("456", nil).Once()
+	c.On("RunContainer", "456", false).Return(nil).Run(func(args mock.Arguments) {
+		// The container runs until it is removed
+		close(started)
+		<-removed
+	}).Once()
+	c.On("RemoveContainer", "456").Return(nil).Run(func(args mock.Arguments) {
+		close(removed)
+	}).Once()
+
+	result := make(chan error)
+	go func() {
+		result <- b.Run(plan)
+	}()
+
+	<-started
+	b.Cancel()
+
+	assert.Equal(t, ErrCancelled, <-result)
+
+	// The second RUN is never started and the container is removed once
+	c.AssertExpectations(t)
+	c.AssertNumberOfCalls(t, "CreateContainer", 1)
+	c.AssertNotCalled(t, "CommitContainer", mock.Anything, mock.Anything)
+}
+
+func TestBuild_CancelBeforeRun(t *testing.T) {
+	rockerfile := `FROM ubuntu
+RUN make`
+	b, c := makeBuild(t, rockerfile, Config{})
+	plan := makePlan(t, rockerfile)
+
+	b.Cancel()
+
+	assert.Equal(t, ErrCancelled, b.Run(plan))
+	c.AssertExpectations(t)
+}
@@ -18,10 +18,14 @@ package build
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
+	"net/url"
 	"os"
 	"os/signal"
+	"strings"
+	"time"
 
 	"regexp"
 	"rocker/dockerclient"
@@ -41,40 +45,111 @@ import (
 // Client interface
 type Client interface {
 	InspectImage(name string) (*docker.Image, error)
+	ImageHistory(imageID string) ([]docker.ImageHistory, error)
+	ImageLayers(name string) (layers []string, err error)
 	PullImage(name string) error
 	ListImages() (images []*imagename.ImageName, err error)
 	ListImageTags(name string) (images []*imagename.ImageName, err error)
+	ListDanglingImages() (ids []string, err error)
+	ImageRepoDigests(imageID string) (digests []string, err error)
 	RemoveImage(imageID string) error
 	TagImage(imageID, imageName string) error
-	PushImage(imageName string) (digest string, err error)
+	PushImage(imageName string) (digest string, stats PushStats, err error)
 	EnsureImage(imageName string) error
 	CreateContainer(state State) (id string, err error)
 	RunContainer(containerID string, attachStdin bool) error
 	CommitContainer(state State, message string) (img *docker.Image, err error)
 	RemoveContainer(containerID string) error
 	UploadToContainer(containerID string, stream io.Reader, path string) error
+	DownloadFromContainer(containerID string, path string) (io.ReadCloser, error)
+	ContainerChanges(containerID string) ([]docker.Change, error)
+	ExportContainer(containerID string) (io.ReadCloser, error)
+	ExportImage(imageID string) (io.ReadCloser, error)
+	LoadImage(stream io.Reader) error
 	EnsureContainer(containerName string, config *docker.Config, purpose string) (containerID string, err error)
 	InspectContainer(containerName string) (*docker.Container, error)
 	ResolveHostPath(path string) (resultPath string, err error)
+	Transfers() []ImageTransfer
+}
+
+// Directions of image transfers
+const (
+	TransferPull = "pull"
+	TransferPush = "push"
+)
+
+// ImageTransfer describes an image pulled from or pushed to a registry;
+// Layers are the diff IDs of the layers of the image, from the base one
+type ImageTransfer struct {
+	Direction string   `json:"direction"`
+	Image     string   `json:"image"`
+	Digest    string   `json:"digest,omitempty"`
+	Layers    []string `json:"layers"`
+	Bytes     int64    `json:"bytes,omitempty"`
+}
+
+// ContainerExitError is returned by RunContainer if the container exits
+// with a non-zero code
+type ContainerExitError struct {
+	ContainerID string
+	ExitCode    int
+}
+
+// Error implements error
+func (e *ContainerExitError) Error() string {
+	return fmt.Sprintf("Container %.12s exited with code %d", e.ContainerID, e.ExitCode)
 }
 
 // DockerClient implements the client that works with a docker socket
 type DockerClient struct {
+	// MergeOutput sends stdout and stderr of containers through a single writer,
+	// so the lines keep the order in which the container emits them
+	MergeOutput bool
+
+	// Stdin is attached to the containers by ATTACH, os.Stdin if not set;
+	// it is the terminal when os.Stdin has been read to the end for the
+	// Rockerfile or the context
+	Stdin *os.File
+
+	// CommitInspectTimeout is how long to wait for a committed image to
+	// become inspectable, busy daemons may not find it right after the commit
+	CommitInspectTimeout time.Duration
+
+	// Raw sends the fields of ImageConfig and HostConfig that go-dockerclient
+	// does not know about and inspects the layers of images; the builds that
+	// need them fail if it is not set
+	Raw *dockerclient.RawClient
+
 	client *docker.Client
 	auth   docker.AuthConfiguration
 	log    *logrus.Logger
+
+	transfers []ImageTransfer
+
+	// Output filters of the containers created for RUN --grep
+	outputFilters map[string]*OutputFilter
 }
 
 var (
-	captureDigest = regexp.MustCompile("digest:\\s*(sha256:[a-f0-9]{64})")
+	// Pull streams say "Digest: ...", push streams say "latest: digest: ..."
+	captureDigest = regexp.MustCompile("(?i)digest:\\s*(sha256:[a-f0-9]{64})")
 )
 
+// defaultCommitInspectTimeout is the CommitInspectTimeout of new clients
+const defaultCommitInspectTimeout = 10 * time.Second
+
+// commitInspectInterval is the pause between the attempts to inspect a
+// committed image that the daemon does not find yet
+var commitInspectInterval = 200 * time.Millisecond
+
 // NewDockerClient makes a new client that works with a docker socket
 func NewDockerClient(dockerClient *docker.Client, auth docker.AuthConfiguration, log *logrus.Logger) *DockerClient {
 	if log == nil {
 		log = logrus.StandardLogger()
 	}
 	return &DockerClient{
+		CommitInspectTimeout: defaultCommitInspectTimeout,
+
 		client: dockerClient,
 		auth:   auth,
 		log:    log,
@@ -91,11 +166,60 @@ func (c *DockerClient) InspectImage(name string) (img *docker.Image, err error)
 	return img, err
 }
 
+// ImageHistory returns the history of docker image, the newest layer first
+func (c *DockerClient) ImageHistory(imageID string) ([]docker.ImageHistory, error) {
+	return c.client.ImageHistory(imageID)
+}
+
 // PullImage pulls docker image
 func (c *DockerClient) PullImage(name string) error {
 
 	var (
-		image                  = imagename.NewFromString(name)
+		image  = imagename.NewFromString(name)
+		buf    bytes.Buffer
+		waited time.Duration
+	)
+
+	c.log.Infof("| Pull image %s", image)
+
+	// The daemon does not pass Retry-After of the registry, so rate limited
+	// pulls are retried with backoff
+	for attempt := 0; ; attempt++ {
+		buf.Reset()
+
+		err := c.pullImage(image, &buf)
+		if err == nil {
+			break
+		}
+		if !imagename.IsRateLimited(err) {
+			return err
+		}
+
+		wait, ok := imagename.RateLimitWait("", attempt, waited)
+		if !ok {
+			return fmt.Errorf("Failed to pull image %s, the registry rate limit has not reset in %s, error: %s", image, waited, err)
+		}
+
+		c.log.Warnf("| Registry limits the rate of pulls, retry in %s", wait)
+		time.Sleep(wait)
+		waited += wait
+	}
+
+	transfer := ImageTransfer{Direction: TransferPull, Image: image.String()}
+	if matches := captureDigest.FindStringSubmatch(buf.String()); len(matches) > 0 {
+		transfer.Digest = matches[1]
+	}
+	transfer.Layers = c.imageLayers(image.String())
+	c.transfers = append(c.transfers, transfer)
+
+	return nil
+}
+
+// pullImage makes a single attempt to pull the image, the JSON stream of
+// the pull is displayed and written to buf
+func (c *DockerClient) pullImage(image *imagename.ImageName, buf *bytes.Buffer) error {
+
+	var (
 		pipeReader, pipeWriter = io.Pipe()
 		fdOut, isTerminalOut   = term.GetFdInfo(c.log.Out)
 		out                    = c.log.Out
@@ -110,18 +234,20 @@ func (c *DockerClient) PullImage(name string) error {
 		Repository:    image.NameWithRegistry(),
 		Registry:      image.Registry,
 		Tag:           image.GetTag(),
-		OutputStream:  pipeWriter,
+		OutputStream:  io.MultiWriter(pipeWriter, buf),
 		RawJSONStream: true,
 	}
 
-	c.log.Infof("| Pull image %s", image)
 	c.log.Debugf("Pull image %s with options: %# v", image, opts)
 
 	go func() {
 		errch <- jsonmessage.DisplayJSONMessagesStream(pipeReader, out, fdOut, isTerminalOut)
 	}()
 
-	if err := c.client.PullImage(opts, c.auth); err != nil {
+	err := c.client.PullImage(opts, c.auth)
+	pipeWriter.Close()
+
+	if err != nil {
 		return err
 	}
 
@@ -146,6 +272,45 @@ func (c *DockerClient) ListImages() (images []*imagename.ImageName, err error) {
 	return
 }
 
+// ListDanglingImages lists IDs of untagged images in the local docker registry
+func (c *DockerClient) ListDanglingImages() (ids []string, err error) {
+
+	var dockerImages []docker.APIImages
+	opts := docker.ListImagesOptions{
+		Filters: map[string][]string{"dangling": {"true"}},
+	}
+	if dockerImages, err = c.client.ListImages(opts); err != nil {
+		return
+	}
+
+	ids = []string{}
+	for _, image := range dockerImages {
+		ids = append(ids, image.ID)
+	}
+
+	return
+}
+
+// ImageRepoDigests returns the repo digests of the local image, e.g.
+// registry.example.com/app@sha256:..., they are known for the images that
+// were pushed or pulled by digest
+func (c *DockerClient) ImageRepoDigests(imageID string) (digests []string, err error) {
+
+	var dockerImages []docker.APIImages
+	if dockerImages, err = c.client.ListImages(docker.ListImagesOptions{}); err != nil {
+		return
+	}
+
+	digests = []string{}
+	for _, image := range dockerImages {
+		if strings.TrimPrefix(image.ID, "sha256:") == strings.TrimPrefix(imageID, "sha256:") {
+			digests = append(digests, image.RepoDigests...)
+		}
+	}
+
+	return
+}
+
 // ListImageTags returns the list of images instances obtained from all tags existing in the registry
 func (c *DockerClient) ListImageTags(name string) (images []*imagename.ImageName, err error) {
 	return imagename.RegistryListTags(imagename.NewFromString(name))
@@ -169,14 +334,7 @@ func (c *DockerClient) CreateContainer(s State) (string, error) {
 
 	// TODO: assign human readable name?
 
-	opts := docker.CreateContainerOptions{
-		Config:     &s.Config,
-		HostConfig: &s.NoCache.HostConfig,
-	}
-
-	c.log.Debugf("Create container: %# v", pretty.Formatter(opts))
-
-	container, err := c.client.CreateContainer(opts)
+	container, err := c.createContainer(s)
 	if err != nil {
 		return "", err
 	}
@@ -188,9 +346,48 @@ func (c *DockerClient) CreateContainer(s State) (string, error) {
 
 	c.log.Infof("| Created container %.12s %s", container.ID, imageStr)
 
+	if s.NoCache.OutputFilter != nil {
+		if c.outputFilters == nil {
+			c.outputFilters = map[string]*OutputFilter{}
+		}
+		c.outputFilters[container.ID] = s.NoCache.OutputFilter
+	}
+
 	return container.ID, nil
 }
 
+// createContainer creates the container with go-dockerclient, or with the
+// raw client if the state has the fields go-dockerclient does not know about
+func (c *DockerClient) createContainer(s State) (*docker.Container, error) {
+	if !s.Config.extended() && !s.NoCache.HostConfig.extended() {
+		opts := docker.CreateContainerOptions{
+			Config:     &s.Config.Config,
+			HostConfig: &s.NoCache.HostConfig.HostConfig,
+		}
+
+		c.log.Debugf("Create container: %# v", pretty.Formatter(opts))
+
+		return c.client.CreateContainer(opts)
+	}
+
+	if c.Raw == nil {
+		return nil, fmt.Errorf("Failed to create container, the docker client cannot send the options of the step")
+	}
+
+	body := struct {
+		*ImageConfig
+		HostConfig *HostConfig `json:"HostConfig,omitempty"`
+	}{&s.Config, &s.NoCache.HostConfig}
+
+	c.log.Debugf("Create container: %# v", pretty.Formatter(body))
+
+	container := &docker.Container{}
+	if err := c.Raw.Do("POST", "/containers/create", body, container); err != nil {
+		return nil, err
+	}
+	return container, nil
+}
+
 // RunContainer runs docker container and optionally attaches stdin
 func (c *DockerClient) RunContainer(containerID string, attachStdin bool) error {
 
@@ -201,26 +398,25 @@ func (c *DockerClient) RunContainer(containerID string, attachStdin bool) error
 		errch     = make(chan error, 1)
 		attacherr = make(chan error, 1)
 
-		// Wrap output streams with logger
-		outLogger = &logrus.Logger{
-			Out:       c.log.Out,
-			Formatter: NewContainerFormatter(containerID, logrus.InfoLevel),
-			Level:     c.log.Level,
-		}
-		errLogger = &logrus.Logger{
-			Out:       c.log.Out,
-			Formatter: NewContainerFormatter(containerID, logrus.ErrorLevel),
-			Level:     c.log.Level,
-		}
+		outStream, errStream = c.containerOutput(containerID)
 
-		in                 = os.Stdin
+		in                 = c.stdin()
 		fdIn, isTerminalIn = term.GetFdInfo(in)
 	)
 
+	output, err := c.filterOutput(containerID)
+	if err != nil {
+		return err
+	}
+	if output != nil {
+		outStream, errStream = output.writer(outStream), output.writer(errStream)
+		defer output.Close()
+	}
+
 	attachOpts := docker.AttachToContainerOptions{
 		Container:    containerID,
-		OutputStream: textformatter.LogWriter(outLogger),
-		ErrorStream:  textformatter.LogWriter(errLogger),
+		OutputStream: outStream,
+		ErrorStream:  errStream,
 		Stdout:       true,
 		Stderr:       true,
 		Stream:       true,
@@ -245,12 +441,14 @@ func (c *DockerClient) RunContainer(containerID string, attachStdin bool) error
 	// We want do debug the final attach options before setting raw term
 	c.log.Debugf("Attach to container with options: %# v", attachOpts)
 
+	// Some CI pseudo terminals cannot be put to raw mode, the input is then
+	// line buffered but the container is still usable
 	if attachStdin {
-		oldState, err := term.SetRawTerminal(fdIn)
-		if err != nil {
-			return err
+		if oldState, err := term.SetRawTerminal(fdIn); err != nil {
+			c.log.Debugf("Failed to set raw terminal mode, error: %s", err)
+		} else {
+			defer term.RestoreTerminal(fdIn, oldState)
 		}
-		defer term.RestoreTerminal(fdIn, oldState)
 	}
 
 	go func() {
@@ -283,9 +481,7 @@ func (c *DockerClient) RunContainer(containerID string, attachStdin bool) error
 	}
 
 	if attachStdin {
-		if err := c.monitorTtySize(containerID, os.Stdout); err != nil {
-			return fmt.Errorf("Failed to monitor TTY size for container %.12s, error: %s", containerID, err)
-		}
+		c.monitorTtySize(containerID, os.Stdout)
 	}
 
 	// TODO: move signal handling to the builder?
@@ -298,7 +494,7 @@ func (c *DockerClient) RunContainer(containerID string, attachStdin bool) error
 		if err != nil {
 			errch <- err
 		} else if statusCode != 0 {
-			errch <- fmt.Errorf("Container %.12s exited with code %d", containerID, statusCode)
+			errch <- &ContainerExitError{ContainerID: containerID, ExitCode: statusCode}
 		}
 		errch <- nil
 		return
@@ -308,6 +504,9 @@ func (c *DockerClient) RunContainer(containerID string, attachStdin bool) error
 	case err := <-errch:
 		// indicate 'finished' so the `attach` goroutine will not give any errors
 		finished <- struct{}{}
+		if _, ok := err.(*ContainerExitError); ok && output != nil {
+			c.logOutputTail(output)
+		}
 		if err != nil {
 			return err
 		}
@@ -328,25 +527,43 @@ func (c *DockerClient) RunContainer(containerID string, attachStdin bool) error
 	return nil
 }
 
-// CommitContainer commits docker container
-func (c *DockerClient) CommitContainer(s State, message string) (*docker.Image, error) {
-	commitOpts := docker.CommitContainerOptions{
-		Container: s.NoCache.ContainerID,
-		Message:   message,
-		Run:       &s.Config,
+// filterOutput returns the filtered output of the container if it is created
+// for RUN --grep, nil otherwise
+func (c *DockerClient) filterOutput(containerID string) (*filteredOutput, error) {
+	filter, ok := c.outputFilters[containerID]
+	if !ok {
+		return nil, nil
 	}
+	delete(c.outputFilters, containerID)
+	return newFilteredOutput(filter)
+}
 
-	c.log.Debugf("Commit container: %# v", pretty.Formatter(commitOpts))
+// logOutputTail shows the last lines of the full output of the failed
+// container, the lines that explain the failure may not match RUN --grep
+func (c *DockerClient) logOutputTail(output *filteredOutput) {
+	output.flush()
+	c.log.Errorf("| Last lines of the output:")
+	for _, line := range output.Tail() {
+		c.log.Errorf("|   %s", line)
+	}
+}
+
+func (c *DockerClient) stdin() *os.File {
+	if c.Stdin != nil {
+		return c.Stdin
+	}
+	return os.Stdin
+}
 
-	image, err := c.client.CommitContainer(commitOpts)
+// CommitContainer commits docker container
+func (c *DockerClient) CommitContainer(s State, message string) (*docker.Image, error) {
+	image, err := c.commitContainer(s, message)
 	if err != nil {
 		return nil, err
 	}
 
 	// Inspect the image to get the real size
-	c.log.Debugf("Inspect image %s", image.ID)
-
-	if image, err = c.client.InspectImage(image.ID); err != nil {
+	if image, err = c.inspectCommitted(image.ID); err != nil {
 		return nil, err
 	}
 
@@ -362,6 +579,59 @@ func (c *DockerClient) CommitContainer(s State, message string) (*docker.Image,
 	return image, nil
 }
 
+// commitContainer commits the container with go-dockerclient, or with the
+// raw client if the config has the fields go-dockerclient does not know about
+func (c *DockerClient) commitContainer(s State, message string) (*docker.Image, error) {
+	if !s.Config.extended() {
+		commitOpts := docker.CommitContainerOptions{
+			Container: s.NoCache.ContainerID,
+			Message:   message,
+			Run:       &s.Config.Config,
+		}
+
+		c.log.Debugf("Commit container: %# v", pretty.Formatter(commitOpts))
+
+		return c.client.CommitContainer(commitOpts)
+	}
+
+	if c.Raw == nil {
+		return nil, fmt.Errorf("Failed to commit container %.12s, the docker client cannot send the image config", s.NoCache.ContainerID)
+	}
+
+	c.log.Debugf("Commit container %.12s: %# v", s.NoCache.ContainerID, pretty.Formatter(s.Config))
+
+	query := url.Values{}
+	query.Set("container", s.NoCache.ContainerID)
+	query.Set("comment", message)
+
+	image := &docker.Image{}
+	if err := c.Raw.Do("POST", "/commit?"+query.Encode(), &s.Config, image); err != nil {
+		return nil, err
+	}
+	return image, nil
+}
+
+// inspectCommitted inspects the image just committed, waiting for up to
+// CommitInspectTimeout for it to appear on busy daemons, so the image ID
+// does not get to the cache before the image is there
+func (c *DockerClient) inspectCommitted(imageID string) (*docker.Image, error) {
+	deadline := time.Now().Add(c.CommitInspectTimeout)
+
+	for attempt := 1; ; attempt++ {
+		c.log.Debugf("Inspect image %s, attempt %d", imageID, attempt)
+
+		image, err := c.client.InspectImage(imageID)
+		if err != docker.ErrNoSuchImage {
+			return image, err
+		}
+		if !time.Now().Before(deadline) {
+			return nil, fmt.Errorf("Failed to inspect committed image %.12s, the daemon has not found it after %d attempts in %s", imageID, attempt, c.CommitInspectTimeout)
+		}
+
+		time.Sleep(commitInspectInterval)
+	}
+}
+
 // RemoveContainer removes docker container
 func (c *DockerClient) RemoveContainer(containerID string) error {
 	c.log.Infof("| Removing container %.12s", containerID)
@@ -388,6 +658,111 @@ func (c *DockerClient) UploadToContainer(containerID string, stream io.Reader, p
 	return c.client.UploadToContainer(containerID, opts)
 }
 
+// DownloadFromContainer downloads files from a docker container as a tar stream.
+// The stream is not buffered, so the caller has to read it till the end and close it;
+// errors of the download are returned by the reader.
+func (c *DockerClient) DownloadFromContainer(containerID string, path string) (io.ReadCloser, error) {
+	c.log.Infof("| Downloading %s from container %.12s", path, containerID)
+
+	pipeReader, pipeWriter := io.Pipe()
+
+	// The docker client closes the output stream if it is a Closer, hide it,
+	// so the error of the download is passed to the reader on close
+	opts := docker.DownloadFromContainerOptions{
+		OutputStream: struct{ io.Writer }{pipeWriter},
+		Path:         path,
+	}
+
+	go func() {
+		pipeWriter.CloseWithError(c.client.DownloadFromContainer(containerID, opts))
+	}()
+
+	return pipeReader, nil
+}
+
+// containerOutput returns writers for stdout and stderr of the container that
+// wrap the streams with loggers. Each stream goes through its own logger, so
+// the lines are marked with the stream name, but the order of lines between the
+// streams is not preserved. With MergeOutput both streams share a single logger.
+func (c *DockerClient) containerOutput(containerID string) (stdout, stderr io.Writer) {
+	if c.MergeOutput {
+		logger := &logrus.Logger{
+			Out:       c.log.Out,
+			Formatter: NewContainerFormatter(containerID, "", logrus.InfoLevel),
+			Level:     c.log.Level,
+		}
+		writer := textformatter.LogWriter(logger)
+		return writer, writer
+	}
+
+	outLogger := &logrus.Logger{
+		Out:       c.log.Out,
+		Formatter: NewContainerFormatter(containerID, "stdout", logrus.InfoLevel),
+		Level:     c.log.Level,
+	}
+	errLogger := &logrus.Logger{
+		Out:       c.log.Out,
+		Formatter: NewContainerFormatter(containerID, "stderr", logrus.ErrorLevel),
+		Level:     c.log.Level,
+	}
+
+	return textformatter.LogWriter(outLogger), textformatter.LogWriter(errLogger)
+}
+
+// ContainerChanges returns the changes made to the filesystem of a container
+func (c *DockerClient) ContainerChanges(containerID string) ([]docker.Change, error) {
+	c.log.Debugf("Get changes of container %.12s", containerID)
+
+	return c.client.ContainerChanges(containerID)
+}
+
+// ExportContainer exports the whole filesystem of a container as a tar stream.
+// Like for DownloadFromContainer, the stream is not buffered and errors
+// of the export are returned by the reader.
+func (c *DockerClient) ExportContainer(containerID string) (io.ReadCloser, error) {
+	c.log.Debugf("Export container %.12s", containerID)
+
+	pipeReader, pipeWriter := io.Pipe()
+
+	opts := docker.ExportContainerOptions{
+		ID:           containerID,
+		OutputStream: struct{ io.Writer }{pipeWriter},
+	}
+
+	go func() {
+		pipeWriter.CloseWithError(c.client.ExportContainer(opts))
+	}()
+
+	return pipeReader, nil
+}
+
+// ExportImage exports an image with all of its layers as a tar stream in the
+// format of `docker save`. Like for DownloadFromContainer, the stream is not
+// buffered and errors of the export are returned by the reader.
+func (c *DockerClient) ExportImage(imageID string) (io.ReadCloser, error) {
+	c.log.Debugf("Export image %.12s", imageID)
+
+	pipeReader, pipeWriter := io.Pipe()
+
+	opts := docker.ExportImageOptions{
+		Name:         imageID,
+		OutputStream: struct{ io.Writer }{pipeWriter},
+	}
+
+	go func() {
+		pipeWriter.CloseWithError(c.client.ExportImage(opts))
+	}()
+
+	return pipeReader, nil
+}
+
+// LoadImage loads an image from a tar stream in the format of `docker save`
+func (c *DockerClient) LoadImage(stream io.Reader) error {
+	c.log.Debugf("Load image")
+
+	return c.client.LoadImage(docker.LoadImageOptions{InputStream: stream})
+}
+
 // TagImage adds tag to the image
 func (c *DockerClient) TagImage(imageID, imageName string) error {
 	img := imagename.NewFromString(imageName)
@@ -405,8 +780,9 @@ func (c *DockerClient) TagImage(imageID, imageName string) error {
 	return c.client.TagImage(imageID, opts)
 }
 
-// PushImage pushes the image
-func (c *DockerClient) PushImage(imageName string) (digest string, err error) {
+// PushImage pushes the image, the stats are empty if the output of the push
+// cannot be parsed
+func (c *DockerClient) PushImage(imageName string) (digest string, stats PushStats, err error) {
 	var (
 		img = imagename.NewFromString(imageName)
 
@@ -440,12 +816,12 @@ func (c *DockerClient) PushImage(imageName string) (digest string, err error) {
 	}()
 
 	if err := c.client.PushImage(opts, c.auth); err != nil {
-		return "", err
+		return "", stats, err
 	}
 	pipeWriter.Close()
 
 	if err := <-errch; err != nil {
-		return "", fmt.Errorf("Failed to process json stream, error %s", err)
+		return "", stats, fmt.Errorf("Failed to process json stream, error %s", err)
 	}
 
 	// It is the best way to have pushed image digest so far
@@ -454,7 +830,92 @@ func (c *DockerClient) PushImage(imageName string) (digest string, err error) {
 		digest = matches[1]
 	}
 
-	return digest, nil
+	stats, err = parsePushStats(bytes.NewReader(buf.Bytes()))
+	c.transfers = append(c.transfers, ImageTransfer{
+		Direction: TransferPush,
+		Image:     img.String(),
+		Digest:    digest,
+		Layers:    c.imageLayers(img.String()),
+		Bytes:     stats.PushedBytes,
+	})
+	if err != nil {
+		c.log.Debugf("Failed to collect push stats, error: %s", err)
+		return digest, PushStats{}, nil
+	}
+
+	c.log.WithFields(logrus.Fields{
+		"pushed_layers":  stats.PushedLayers,
+		"pushed_bytes":   stats.PushedBytes,
+		"skipped_layers": stats.SkippedLayers,
+	}).Infof("| Pushed %d layers (%s), %d layers already exist",
+		stats.PushedLayers, units.HumanSize(float64(stats.PushedBytes)), stats.SkippedLayers)
+
+	return digest, stats, nil
+}
+
+// PushStats is the summary of layers transferred by a push
+type PushStats struct {
+	PushedLayers  int
+	PushedBytes   int64
+	SkippedLayers int
+}
+
+// parsePushStats reads the JSON stream of a push and tallies layers that were
+// actually pushed versus the ones that already exist in the registry.
+// The size of a pushed layer is taken from the "Pushing" progress messages.
+func parsePushStats(r io.Reader) (stats PushStats, err error) {
+	var (
+		dec   = json.NewDecoder(r)
+		sizes = map[string]int64{}
+	)
+
+	for {
+		var msg jsonmessage.JSONMessage
+		if err = dec.Decode(&msg); err == io.EOF {
+			return stats, nil
+		} else if err != nil {
+			return stats, err
+		}
+
+		switch {
+		case msg.Status == "Pushing" && msg.Progress != nil && msg.Progress.Total > 0:
+			sizes[msg.ID] = int64(msg.Progress.Total)
+		case msg.Status == "Pushed":
+			stats.PushedLayers++
+			stats.PushedBytes += sizes[msg.ID]
+		case msg.Status == "Layer already exists":
+			stats.SkippedLayers++
+		}
+	}
+}
+
+// ImageLayers returns the diff IDs of the layers of the image, from the base one
+func (c *DockerClient) ImageLayers(name string) ([]string, error) {
+	if c.Raw == nil {
+		return nil, fmt.Errorf("Failed to inspect layers of image %s, the docker client cannot inspect them", name)
+	}
+
+	img := inspectedRootFS{}
+	if err := c.Raw.Do("GET", "/images/"+name+"/json", nil, &img); err != nil {
+		return nil, err
+	}
+	return append([]string{}, img.RootFS.Layers...), nil
+}
+
+// imageLayers returns the diff IDs of the layers of the image; they are
+// only collected for the provenance, so failures are not fatal
+func (c *DockerClient) imageLayers(name string) []string {
+	layers, err := c.ImageLayers(name)
+	if err != nil {
+		c.log.Debugf("Failed to inspect layers of image %s, error: %s", name, err)
+		return []string{}
+	}
+	return layers
+}
+
+// Transfers returns the images pulled and pushed by the client so far
+func (c *DockerClient) Transfers() []ImageTransfer {
+	return append([]ImageTransfer{}, c.transfers...)
 }
 
 // ResolveHostPath proxy for the dockerclient.ResolveHostPath
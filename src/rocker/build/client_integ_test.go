@@ -0,0 +1,76 @@
+//go:build integration
+// +build integration
+
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"archive/tar"
+	"io"
+	"io/ioutil"
+	"rocker/dockerclient"
+	"testing"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInteg_Client_DownloadFromContainer(t *testing.T) {
+	dockerCli, err := dockerclient.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewDockerClient(dockerCli, docker.AuthConfiguration{}, nil)
+
+	if err := c.EnsureImage("alpine:3.2"); err != nil {
+		t.Fatal(err)
+	}
+
+	containerID, err := c.CreateContainer(State{
+		ImageID: "alpine:3.2",
+		Config:  docker.Config{Cmd: []string{"/bin/true"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.RemoveContainer(containerID)
+
+	stream, err := c.DownloadFromContainer(containerID, "/etc/alpine-release")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+
+	tr := tar.NewReader(stream)
+
+	hdr, err := tr.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "alpine-release", hdr.Name)
+
+	data, err := ioutil.ReadAll(tr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, string(data), "3.2")
+
+	_, err = tr.Next()
+	assert.Equal(t, io.EOF, err)
+}
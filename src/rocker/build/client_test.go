@@ -0,0 +1,606 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"rocker/dockerclient"
+	"rocker/imagename"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClient_ParsePushStats(t *testing.T) {
+	stream := `{"status":"The push refers to a repository [registry.example.com/app] (len: 1)"}
+{"status":"Preparing","progressDetail":{},"id":"5f70bf18a086"}
+{"status":"Preparing","progressDetail":{},"id":"e8a3c1b2d4f6"}
+{"status":"Preparing","progressDetail":{},"id":"a1b2c3d4e5f6"}
+{"status":"Layer already exists","progressDetail":{},"id":"5f70bf18a086"}
+{"status":"Pushing","progressDetail":{"current":512,"total":2048},"progress":"[====>  ] 512 B/2.048 kB","id":"e8a3c1b2d4f6"}
+{"status":"Pushing","progressDetail":{"current":2048,"total":2048},"progress":"[=======>] 2.048 kB/2.048 kB","id":"e8a3c1b2d4f6"}
+{"status":"Pushed","progressDetail":{},"id":"e8a3c1b2d4f6"}
+{"status":"Pushing","progressDetail":{"current":1024,"total":1024},"progress":"[=======>] 1.024 kB/1.024 kB","id":"a1b2c3d4e5f6"}
+{"status":"Pushed","progressDetail":{},"id":"a1b2c3d4e5f6"}
+{"status":"latest: digest: sha256:ead434cd278824865d6e3b67e5d4579ded02eb2e8367fc165efa21138b225f11 size: 2743"}
+`
+
+	stats, err := parsePushStats(strings.NewReader(stream))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, 2, stats.PushedLayers)
+	assert.Equal(t, int64(3072), stats.PushedBytes)
+	assert.Equal(t, 1, stats.SkippedLayers)
+}
+
+func TestClient_PullImage_Layers(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/images/create"):
+			fmt.Fprintln(w, `{"status":"Already exists","progressDetail":{},"id":"5f70bf18a086"}`)
+			fmt.Fprintln(w, `{"status":"Pull complete","progressDetail":{},"id":"e8a3c1b2d4f6"}`)
+			fmt.Fprintln(w, `{"status":"Digest: sha256:ead434cd278824865d6e3b67e5d4579ded02eb2e8367fc165efa21138b225f11"}`)
+		case strings.HasSuffix(r.URL.Path, "/images/ubuntu:14.04/json"):
+			fmt.Fprint(w, `{"Id":"sha256:123","RootFS":{"Type":"layers","Layers":["sha256:5f70bf18a0860070b6ebd9bb9b2a4e43d5e6ab2cb7b8c2e8d3dc4d6f9a1e0c11","sha256:e8a3c1b2d4f6e8a3c1b2d4f6e8a3c1b2d4f6e8a3c1b2d4f6e8a3c1b2d4f6e8a3"]}}`)
+		default:
+			http.Error(w, "not found", http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	dockerCli, err := docker.NewClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	c := NewDockerClient(dockerCli, docker.AuthConfiguration{}, logger)
+	if c.Raw, err = dockerclient.NewRawClient(dockerCli, &dockerclient.Config{Host: server.URL}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.PullImage("ubuntu:14.04"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The short IDs of the progress messages are not the layers
+	assert.Equal(t, []ImageTransfer{{
+		Direction: TransferPull,
+		Image:     "ubuntu:14.04",
+		Digest:    "sha256:ead434cd278824865d6e3b67e5d4579ded02eb2e8367fc165efa21138b225f11",
+		Layers: []string{
+			"sha256:5f70bf18a0860070b6ebd9bb9b2a4e43d5e6ab2cb7b8c2e8d3dc4d6f9a1e0c11",
+			"sha256:e8a3c1b2d4f6e8a3c1b2d4f6e8a3c1b2d4f6e8a3c1b2d4f6e8a3c1b2d4f6e8a3",
+		},
+	}}, c.Transfers())
+}
+
+func TestClient_ParsePushStats_Empty(t *testing.T) {
+	stats, err := parsePushStats(strings.NewReader(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, PushStats{}, stats)
+}
+
+func TestClient_DownloadFromContainer(t *testing.T) {
+	archive := &bytes.Buffer{}
+	writeTestTar(t, archive, map[string]string{"alpine-release": "3.2.3"})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/containers/123/archive") || r.URL.Query().Get("path") != "/etc/alpine-release" {
+			http.Error(w, "no such container", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-tar")
+		w.Write(archive.Bytes())
+	}))
+	defer server.Close()
+
+	dockerCli, err := docker.NewClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewDockerClient(dockerCli, docker.AuthConfiguration{}, nil)
+
+	stream, err := c.DownloadFromContainer("123", "/etc/alpine-release")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+
+	tr := tar.NewReader(stream)
+	hdr, err := tr.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(tr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "alpine-release", hdr.Name)
+	assert.Equal(t, "3.2.3", string(data))
+
+	// Errors of the download are returned by the reader
+	stream, err = c.DownloadFromContainer("456", "/etc/alpine-release")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ioutil.ReadAll(stream)
+	assert.Error(t, err)
+}
+
+func TestClient_PullImage_RateLimited(t *testing.T) {
+	pulls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/images/create") {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		pulls++
+		if pulls < 3 {
+			fmt.Fprintln(w, `{"errorDetail":{"message":"toomanyrequests: You have reached your pull rate limit"},"error":"toomanyrequests: You have reached your pull rate limit"}`)
+			return
+		}
+		fmt.Fprintln(w, `{"status":"Digest: sha256:ead434cd278824865d6e3b67e5d4579ded02eb2e8367fc165efa21138b225f11"}`)
+	}))
+	defer server.Close()
+
+	defer func(backoff time.Duration) { imagename.RateLimitBackoff = backoff }(imagename.RateLimitBackoff)
+	imagename.RateLimitBackoff = time.Millisecond
+
+	dockerCli, err := docker.NewClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	c := NewDockerClient(dockerCli, docker.AuthConfiguration{}, logger)
+
+	if err := c.PullImage("ubuntu:14.04"); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, 3, pulls)
+	if transfers := c.Transfers(); assert.Len(t, transfers, 1) {
+		assert.Equal(t, "sha256:ead434cd278824865d6e3b67e5d4579ded02eb2e8367fc165efa21138b225f11", transfers[0].Digest)
+	}
+}
+
+func TestClient_PullImage_RateLimitExceeded(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"errorDetail":{"message":"toomanyrequests: You have reached your pull rate limit"},"error":"toomanyrequests: You have reached your pull rate limit"}`)
+	}))
+	defer server.Close()
+
+	defer func(backoff, maxWait time.Duration) {
+		imagename.RateLimitBackoff, imagename.RateLimitMaxWait = backoff, maxWait
+	}(imagename.RateLimitBackoff, imagename.RateLimitMaxWait)
+	imagename.RateLimitBackoff = time.Millisecond
+	imagename.RateLimitMaxWait = 10 * time.Millisecond
+
+	dockerCli, err := docker.NewClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	c := NewDockerClient(dockerCli, docker.AuthConfiguration{}, logger)
+
+	err = c.PullImage("ubuntu:14.04")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "rate limit has not reset")
+	}
+}
+
+// startFakeCommitDaemon commits containers to image abc, which the daemon
+// finds only after `missing` inspects of it
+func startFakeCommitDaemon(t *testing.T, missing int) (c *DockerClient, inspects *int, stop func()) {
+	inspects = new(int)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/commit"):
+			fmt.Fprint(w, `{"Id":"abc"}`)
+		case strings.HasSuffix(r.URL.Path, "/images/abc/json"):
+			*inspects++
+			if *inspects <= missing {
+				http.Error(w, "No such image: abc", http.StatusNotFound)
+				return
+			}
+			fmt.Fprint(w, `{"Id":"abc","Size":1024}`)
+		default:
+			http.Error(w, "not found", http.StatusNotFound)
+		}
+	}))
+
+	dockerCli, err := docker.NewClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	c = NewDockerClient(dockerCli, docker.AuthConfiguration{}, logger)
+
+	interval := commitInspectInterval
+	commitInspectInterval = time.Millisecond
+
+	stop = func() {
+		server.Close()
+		commitInspectInterval = interval
+	}
+
+	return c, inspects, stop
+}
+
+func TestClient_CommitContainer_InspectRetry(t *testing.T) {
+	c, inspects, stop := startFakeCommitDaemon(t, 1)
+	defer stop()
+
+	s := State{}
+	s.NoCache.ContainerID = "456"
+
+	image, err := c.CommitContainer(s, "RUN make")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "abc", image.ID)
+	assert.EqualValues(t, 1024, image.Size)
+	assert.Equal(t, 2, *inspects)
+}
+
+func TestClient_CommitContainer_InspectTimeout(t *testing.T) {
+	c, inspects, stop := startFakeCommitDaemon(t, 1000)
+	defer stop()
+
+	c.CommitInspectTimeout = 20 * time.Millisecond
+
+	s := State{}
+	s.NoCache.ContainerID = "456"
+
+	_, err := c.CommitContainer(s, "RUN make")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "Failed to inspect committed image abc")
+	}
+	assert.True(t, *inspects > 1)
+}
+
+// startFakeRawDaemon records the requests of the raw client, it creates
+// container 456 and commits it to image abc
+func startFakeRawDaemon(t *testing.T, requests *[]string) (c *DockerClient, stop func()) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		*requests = append(*requests, r.Method+" "+r.URL.RequestURI()+" "+string(body))
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/containers/create"):
+			fmt.Fprint(w, `{"Id":"456"}`)
+		case strings.HasSuffix(r.URL.Path, "/commit"):
+			fmt.Fprint(w, `{"Id":"abc"}`)
+		case strings.HasSuffix(r.URL.Path, "/images/abc/json"):
+			fmt.Fprint(w, `{"Id":"abc"}`)
+		default:
+			http.Error(w, "not found", http.StatusNotFound)
+		}
+	}))
+
+	dockerCli, err := docker.NewClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	c = NewDockerClient(dockerCli, docker.AuthConfiguration{}, logger)
+	if c.Raw, err = dockerclient.NewRawClient(dockerCli, &dockerclient.Config{Host: server.URL}); err != nil {
+		t.Fatal(err)
+	}
+
+	return c, server.Close
+}
+
+func TestClient_CreateContainer_Extended(t *testing.T) {
+	requests := []string{}
+	c, stop := startFakeRawDaemon(t, &requests)
+	defer stop()
+
+	s := State{ImageID: "123"}
+	s.NoCache.HostConfig.Tmpfs = map[string]string{"/tmp/work": "size=64m"}
+	s.NoCache.HostConfig.Sysctls = map[string]string{"net.core.somaxconn": "1024"}
+
+	containerID, err := c.CreateContainer(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "456", containerID)
+	if assert.Len(t, requests, 1) {
+		assert.Contains(t, requests[0], "POST /containers/create ")
+		assert.Contains(t, requests[0], `"Image":"123"`)
+		assert.Contains(t, requests[0], `"Tmpfs":{"/tmp/work":"size=64m"}`)
+		assert.Contains(t, requests[0], `"Sysctls":{"net.core.somaxconn":"1024"}`)
+	}
+}
+
+func TestClient_CommitContainer_Extended(t *testing.T) {
+	requests := []string{}
+	c, stop := startFakeRawDaemon(t, &requests)
+	defer stop()
+
+	s := State{}
+	s.NoCache.ContainerID = "456"
+	s.Config.Cmd = []string{"/bin/app"}
+	s.Config.Healthcheck = &HealthConfig{Test: []string{"CMD", "true"}}
+
+	image, err := c.CommitContainer(s, "CONFIG")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "abc", image.ID)
+	if assert.Len(t, requests, 2) {
+		assert.Contains(t, requests[0], "POST /commit?comment=CONFIG&container=456 ")
+		assert.Contains(t, requests[0], `"Cmd":["/bin/app"]`)
+		assert.Contains(t, requests[0], `"Healthcheck":{"Test":["CMD","true"]}`)
+	}
+}
+
+func TestClient_CreateContainer_ExtendedWithoutRaw(t *testing.T) {
+	c := NewDockerClient(nil, docker.AuthConfiguration{}, nil)
+
+	s := State{}
+	s.NoCache.HostConfig.Tmpfs = map[string]string{"/tmp/work": ""}
+
+	_, err := c.CreateContainer(s)
+	assert.EqualError(t, err, "Failed to create container, the docker client cannot send the options of the step")
+}
+
+func TestClient_ResizeTty_DefaultSize(t *testing.T) {
+	resized := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/containers/123/resize") {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		resized <- r.URL.Query().Get("w") + "x" + r.URL.Query().Get("h")
+	}))
+	defer server.Close()
+
+	dockerCli, err := docker.NewClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewDockerClient(dockerCli, docker.AuthConfiguration{}, nil)
+
+	// The size of a pipe cannot be determined
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+
+	h, wd := c.getTtySize(w)
+	assert.Equal(t, defaultTtyHeight, h)
+	assert.Equal(t, defaultTtyWidth, wd)
+
+	c.resizeTty("123", w)
+
+	select {
+	case size := <-resized:
+		assert.Equal(t, "80x24", size)
+	case <-time.After(5 * time.Second):
+		t.Fatal("The container TTY was not resized")
+	}
+}
+
+func TestClient_ContainerOutput_Separate(t *testing.T) {
+	lines := runFakeAttach(t, false, 6)
+
+	stdout, stderr := []string{}, []string{}
+	for _, line := range lines {
+		switch {
+		case strings.Contains(line, "stream=stdout"):
+			stdout = append(stdout, line)
+		case strings.Contains(line, "stream=stderr"):
+			stderr = append(stderr, line)
+		default:
+			t.Fatalf("Expected the line to have a stream prefix: %s", line)
+		}
+	}
+
+	// The order is only preserved within a stream
+	assert.Len(t, stdout, 3)
+	assert.Len(t, stderr, 3)
+	for i := 0; i < 3; i++ {
+		assert.Contains(t, stdout[i], fmt.Sprintf("out %d", i*2))
+		assert.Contains(t, stderr[i], fmt.Sprintf("err %d", i*2+1))
+	}
+}
+
+func TestClient_ContainerOutput_Merged(t *testing.T) {
+	lines := runFakeAttach(t, true, 6)
+
+	assert.Len(t, lines, 6)
+	for i, line := range lines {
+		if i%2 == 0 {
+			assert.Contains(t, line, fmt.Sprintf("out %d", i))
+		} else {
+			assert.Contains(t, line, fmt.Sprintf("err %d", i))
+		}
+		assert.NotContains(t, line, "stream=")
+	}
+}
+
+func TestClient_ContainerOutput_Grep(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rocker-grep")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	out := &syncBuffer{}
+	c := NewDockerClient(nil, docker.AuthConfiguration{}, &logrus.Logger{
+		Out:       out,
+		Formatter: &logrus.TextFormatter{DisableColors: true},
+		Level:     logrus.InfoLevel,
+	})
+	c.MergeOutput = true
+	c.outputFilters = map[string]*OutputFilter{
+		"123": {Pattern: "ERROR|WARN", LogFile: filepath.Join(dir, "logs/make.log")},
+	}
+
+	output, err := c.filterOutput("123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, stderr := c.containerOutput("123")
+	stdout, stderr = output.writer(stdout), output.writer(stderr)
+
+	// Attach gives the stream in chunks that do not follow the lines
+	full := "compiling a.c\nWARN: unused x\ncompiling b.c\nERROR: b.c:3\nlinking\nDONE ERROR"
+	for i := 0; i < len(full); i += 5 {
+		end := i + 5
+		if end > len(full) {
+			end = len(full)
+		}
+		if _, err := io.WriteString(stdout, full[i:end]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := io.WriteString(stderr, "fatal: stopped\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := output.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The last line has no newline, it is flushed on Close
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); {
+		if strings.Contains(strings.Join(out.Lines(), "\n"), "DONE ERROR") {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	lines := out.Lines()
+	assert.Len(t, lines, 3)
+	assert.Contains(t, lines[0], "WARN: unused x")
+	assert.Contains(t, lines[1], "ERROR: b.c:3")
+	assert.Contains(t, lines[2], "DONE ERROR")
+
+	// The full output goes to the log file and the error tail
+	data, err := ioutil.ReadFile(filepath.Join(dir, "logs/make.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "compiling a.c\nWARN: unused x\ncompiling b.c\nERROR: b.c:3\nlinking\nfatal: stopped\nDONE ERROR\n", string(data))
+	assert.Equal(t, []string{"compiling a.c", "WARN: unused x", "compiling b.c", "ERROR: b.c:3", "linking", "fatal: stopped", "DONE ERROR"}, output.Tail())
+
+	_, ok := c.outputFilters["123"]
+	assert.False(t, ok)
+}
+
+func TestClient_ContainerOutput_GrepTail(t *testing.T) {
+	output, err := newFilteredOutput(&OutputFilter{Pattern: "nothing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := output.writer(ioutil.Discard)
+	for i := 0; i < 30; i++ {
+		fmt.Fprintf(w, "line %d\n", i)
+	}
+
+	tail := output.Tail()
+	assert.Len(t, tail, outputTailLines)
+	assert.Equal(t, "line 10", tail[0])
+	assert.Equal(t, "line 29", tail[outputTailLines-1])
+}
+
+// runFakeAttach writes lines to the container output the way attach does,
+// alternating stdout and stderr, and returns the lines that got to the log
+func runFakeAttach(t *testing.T, merge bool, n int) []string {
+	out := &syncBuffer{}
+	c := NewDockerClient(nil, docker.AuthConfiguration{}, &logrus.Logger{
+		Out:       out,
+		Formatter: &logrus.TextFormatter{DisableColors: true},
+		Level:     logrus.InfoLevel,
+	})
+	c.MergeOutput = merge
+
+	stdout, stderr := c.containerOutput("123")
+	for i := 0; i < n; i++ {
+		var err error
+		if i%2 == 0 {
+			_, err = io.WriteString(stdout, fmt.Sprintf("out %d\n", i))
+		} else {
+			_, err = io.WriteString(stderr, fmt.Sprintf("err %d\n", i))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Lines are logged asynchronously
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); {
+		if lines := out.Lines(); len(lines) >= n {
+			return lines
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Expected %d lines in the output, got: %q", n, out.Lines())
+	return nil
+}
+
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) Lines() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return strings.Split(strings.TrimSpace(b.buf.String()), "\n")
+}
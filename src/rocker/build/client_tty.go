@@ -1,6 +1,6 @@
 // This code is borrowed from Docker
 // Licensed under the Apache License, Version 2.0; Copyright 2013-2015 Docker, Inc. See LICENSE.APACHE
-// NOTICE: no changes has been made to these functions code
+// NOTICE: getTtySize is changed to fall back to the default size, the rest of the code is unchanged
 
 package build
 
@@ -16,7 +16,14 @@ import (
 	"github.com/docker/docker/pkg/term"
 )
 
-func (c *DockerClient) monitorTtySize(id string, out io.Writer) error {
+// The size given to the container TTY when the size of the terminal cannot be
+// determined, e.g. by some CI pseudo terminals
+const (
+	defaultTtyHeight = 24
+	defaultTtyWidth  = 80
+)
+
+func (c *DockerClient) monitorTtySize(id string, out io.Writer) {
 	c.resizeTty(id, out)
 
 	if runtime.GOOS == "windows" {
@@ -42,7 +49,6 @@ func (c *DockerClient) monitorTtySize(id string, out io.Writer) error {
 			}
 		}()
 	}
-	return nil
 }
 
 func (c *DockerClient) resizeTty(id string, out io.Writer) {
@@ -62,15 +68,14 @@ func (c *DockerClient) getTtySize(out io.Writer) (int, int) {
 	)
 
 	if !isTerminalOut {
-		return 0, 0
+		c.log.Debugf("Output is not a terminal, use the default TTY size %dx%d", defaultTtyWidth, defaultTtyHeight)
+		return defaultTtyHeight, defaultTtyWidth
 	}
 
 	ws, err := term.GetWinsize(fdOut)
-	if err != nil {
-		log.Errorf("Error getting TTY size: %s\n", err)
-		if ws == nil {
-			return 0, 0
-		}
+	if err != nil || ws == nil || ws.Height == 0 || ws.Width == 0 {
+		c.log.Debugf("Failed to get TTY size, use the default %dx%d, error: %v", defaultTtyWidth, defaultTtyHeight, err)
+		return defaultTtyHeight, defaultTtyWidth
 	}
 
 	return int(ws.Height), int(ws.Width)
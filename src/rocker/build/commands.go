@@ -17,16 +17,20 @@
 package build
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
+	"reflect"
 	"regexp"
 	"rocker/imagename"
 	"rocker/shellparser"
 	"rocker/util"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -69,54 +73,42 @@ type EnvReplacableCommand interface {
 	ReplaceEnv(env []string) error
 }
 
+// commandTypes makes commands of the Rockerfile instructions by their names,
+// the names are also the command types of a serialized Plan
+var commandTypes = map[string]func(cfg ConfigCommand) Command{
+	"from":       func(cfg ConfigCommand) Command { return &CommandFrom{cfg} },
+	"maintainer": func(cfg ConfigCommand) Command { return &CommandMaintainer{cfg} },
+	"run":        func(cfg ConfigCommand) Command { return &CommandRun{cfg} },
+	"attach":     func(cfg ConfigCommand) Command { return &CommandAttach{cfg} },
+	"env":        func(cfg ConfigCommand) Command { return &CommandEnv{cfg} },
+	"label":      func(cfg ConfigCommand) Command { return &CommandLabel{cfg} },
+	"annotation": func(cfg ConfigCommand) Command { return &CommandAnnotation{cfg} },
+	"config":     func(cfg ConfigCommand) Command { return &CommandConfig{cfg} },
+	"workdir":    func(cfg ConfigCommand) Command { return &CommandWorkdir{cfg} },
+	"tag":        func(cfg ConfigCommand) Command { return &CommandTag{cfg} },
+	"push":       func(cfg ConfigCommand) Command { return &CommandPush{cfg} },
+	"copy":       func(cfg ConfigCommand) Command { return &CommandCopy{cfg} },
+	"add":        func(cfg ConfigCommand) Command { return &CommandAdd{cfg} },
+	"cmd":        func(cfg ConfigCommand) Command { return &CommandCmd{cfg} },
+	"entrypoint": func(cfg ConfigCommand) Command { return &CommandEntrypoint{cfg} },
+	"expose":     func(cfg ConfigCommand) Command { return &CommandExpose{cfg} },
+	"volume":     func(cfg ConfigCommand) Command { return &CommandVolume{cfg} },
+	"user":       func(cfg ConfigCommand) Command { return &CommandUser{cfg} },
+	"onbuild":    func(cfg ConfigCommand) Command { return &CommandOnbuild{cfg} },
+	"mount":      func(cfg ConfigCommand) Command { return &CommandMount{cfg} },
+	"export":     func(cfg ConfigCommand) Command { return &CommandExport{cfg} },
+	"import":     func(cfg ConfigCommand) Command { return &CommandImport{cfg} },
+}
+
 // NewCommand make a new command according to the configuration given
 func NewCommand(cfg ConfigCommand) (cmd Command, err error) {
-	// TODO: use reflection?
-	switch cfg.name {
-	case "from":
-		cmd = &CommandFrom{cfg}
-	case "maintainer":
-		cmd = &CommandMaintainer{cfg}
-	case "run":
-		cmd = &CommandRun{cfg}
-	case "attach":
-		cmd = &CommandAttach{cfg}
-	case "env":
-		cmd = &CommandEnv{cfg}
-	case "label":
-		cmd = &CommandLabel{cfg}
-	case "workdir":
-		cmd = &CommandWorkdir{cfg}
-	case "tag":
-		cmd = &CommandTag{cfg}
-	case "push":
-		cmd = &CommandPush{cfg}
-	case "copy":
-		cmd = &CommandCopy{cfg}
-	case "add":
-		cmd = &CommandAdd{cfg}
-	case "cmd":
-		cmd = &CommandCmd{cfg}
-	case "entrypoint":
-		cmd = &CommandEntrypoint{cfg}
-	case "expose":
-		cmd = &CommandExpose{cfg}
-	case "volume":
-		cmd = &CommandVolume{cfg}
-	case "user":
-		cmd = &CommandUser{cfg}
-	case "onbuild":
-		cmd = &CommandOnbuild{cfg}
-	case "mount":
-		cmd = &CommandMount{cfg}
-	case "export":
-		cmd = &CommandExport{cfg}
-	case "import":
-		cmd = &CommandImport{cfg}
-	default:
+	newCommand, ok := commandTypes[cfg.name]
+	if !ok {
 		return nil, fmt.Errorf("Unknown command: %s", cfg.name)
 	}
 
+	cmd = newCommand(cfg)
+
 	if cfg.isOnbuild {
 		cmd = &CommandOnbuildWrap{cmd}
 	}
@@ -152,11 +144,23 @@ func (c *CommandFrom) Execute(b *Build) (s State, err error) {
 		name = c.cfg.args[0]
 	)
 
+	// Only the first FROM is overridden, the images of the later ones are
+	// usually the stages the build relies on
+	if b.cfg.FromOverride != "" && !b.fromOverridden {
+		b.fromOverridden = true
+		log.Infof("| Override image %s with %s", name, b.cfg.FromOverride)
+		name = b.cfg.FromOverride
+	}
+
 	if name == "scratch" {
 		s.NoBaseImage = true
 		return s, nil
 	}
 
+	if err = b.checkLatest(name); err != nil {
+		return s, fmt.Errorf("FROM error: %s", err)
+	}
+
 	if img, err = b.lookupImage(name); err != nil {
 		return s, fmt.Errorf("FROM error: %s", err)
 	}
@@ -165,6 +169,12 @@ func (c *CommandFrom) Execute(b *Build) (s State, err error) {
 		return s, fmt.Errorf("FROM: image %s not found", name)
 	}
 
+	if b.cfg.BaseVerifier != nil {
+		if err = b.verifyBase(name, img.ID); err != nil {
+			return s, fmt.Errorf("FROM error: %s", err)
+		}
+	}
+
 	// We want to say the size of the FROM image. Better to do it
 	// from the client, but don't know how to do it better,
 	// without duplicating InspectImage calls and making unnecessary functions
@@ -175,10 +185,10 @@ func (c *CommandFrom) Execute(b *Build) (s State, err error) {
 
 	s = b.state
 	s.ImageID = img.ID
-	s.Config = docker.Config{}
+	s.Config = ImageConfig{}
 
 	if img.Config != nil {
-		s.Config = *img.Config
+		s.Config = ImageConfig{Config: *img.Config}
 	}
 
 	b.ProducedSize = 0
@@ -219,6 +229,8 @@ func (c *CommandMaintainer) Execute(b *Build) (State, error) {
 		return b.state, fmt.Errorf("MAINTAINER requires exactly one argument")
 	}
 
+	b.warnf("MAINTAINER is deprecated, use LABEL maintainer=%q instead", c.cfg.args[0])
+
 	// Don't see any sense of doing a commit here, as Docker does
 
 	return b.state, nil
@@ -228,6 +240,7 @@ func (c *CommandMaintainer) Execute(b *Build) (State, error) {
 type CommandCleanup struct {
 	final  bool
 	tagged bool
+	keep   bool
 }
 
 // String returns the human readable string representation of the command
@@ -245,7 +258,9 @@ func (c *CommandCleanup) Execute(b *Build) (State, error) {
 	s := b.state
 
 	if b.cfg.NoGarbage && !c.tagged && s.ImageID != "" && s.ProducedImage {
-		if err := b.client.RemoveImage(s.ImageID); err != nil {
+		if c.keep {
+			log.Infof("| Keep image %.12s of the stage marked with rocker:keep", s.ImageID)
+		} else if err := b.client.RemoveImage(s.ImageID); err != nil {
 			return s, err
 		}
 	}
@@ -257,9 +272,11 @@ func (c *CommandCleanup) Execute(b *Build) (State, error) {
 	// Keep some stuff between froms
 	s.ExportsID = dirtyState.ExportsID
 
-	// For final cleanup we want to keep imageID
+	// For final cleanup we want to keep imageID, its config and annotations
 	if c.final {
 		s.ImageID = dirtyState.ImageID
+		s.Config = dirtyState.Config
+		s.NoCache.Annotations = dirtyState.NoCache.Annotations
 	} else {
 		log.Infof("====================================")
 	}
@@ -289,6 +306,13 @@ func (c *CommandCommit) Execute(b *Build) (s State, err error) {
 		return s, nil
 	}
 
+	// Commits are sorted and carry checksums to identify the cache, so
+	// prefer the commands as written in the Rockerfile for `docker history`
+	message := commits
+	if len(s.NoCache.History) > 0 {
+		message = strings.Join(s.NoCache.History, "; ")
+	}
+
 	if s.ImageID == "" && !s.NoBaseImage {
 		return s, fmt.Errorf("Please provide a source image with `from` prior to commit")
 	}
@@ -311,14 +335,17 @@ func (c *CommandCommit) Execute(b *Build) (s State, err error) {
 			return s, nil
 		}
 
-		origCmd := s.Config.Cmd
-		s.Config.Cmd = []string{"/bin/sh", "-c", "#(nop) " + commits}
+		// The container is never started, it only serves as a marker for
+		// the metadata-only commit; the actual config is given on commit
+		marker := s
+		if b.cfg.EmptyLayers {
+			marker = s.emptyLayer()
+		}
+		marker.Config.Cmd = []string{"/bin/sh", "-c", "#(nop) " + message}
 
-		if s.NoCache.ContainerID, err = b.client.CreateContainer(s); err != nil {
+		if s.NoCache.ContainerID, err = b.client.CreateContainer(marker); err != nil {
 			return s, err
 		}
-
-		s.Config.Cmd = origCmd
 	}
 
 	defer func(id string) {
@@ -329,7 +356,15 @@ func (c *CommandCommit) Execute(b *Build) (s State, err error) {
 	}(s.NoCache.ContainerID)
 
 	var img *docker.Image
-	if img, err = b.client.CommitContainer(s, commits); err != nil {
+	if b.cfg.Reproducible {
+		img, err = b.commitReproducible(s, message)
+	} else {
+		img, err = b.client.CommitContainer(s, message)
+		if err == nil && !b.cfg.SourceDateEpoch.IsZero() {
+			img, err = b.normalizeCreated(img)
+		}
+	}
+	if err != nil {
 		return s, err
 	}
 
@@ -338,7 +373,18 @@ func (c *CommandCommit) Execute(b *Build) (s State, err error) {
 	s.ImageID = img.ID
 	s.ProducedImage = true
 
-	if b.cache != nil {
+	if b.cfg.ManifestPath != "" {
+		b.setManifestImage(img.ID)
+	}
+
+	b.setIncrementalImage(img.ID)
+
+	// The image of an incremental upload depends on the previous builds,
+	// it should not be found by the builds of the same context elsewhere
+	incremental := b.incrementalUpload
+	b.incrementalUpload = false
+
+	if b.cache != nil && !incremental {
 		if err := b.cache.Put(s); err != nil {
 			return s, err
 		}
@@ -363,7 +409,7 @@ func (c *CommandRun) String() string {
 
 // ShouldRun returns true if the command should be executed
 func (c *CommandRun) ShouldRun(b *Build) (bool, error) {
-	return true, nil
+	return runConditionMet(b, c.cfg.flags)
 }
 
 // Execute runs the command
@@ -380,7 +426,40 @@ func (c *CommandRun) Execute(b *Build) (s State, err error) {
 		cmd = append([]string{"/bin/sh", "-c"}, cmd...)
 	}
 
-	s.Commit("RUN %q", cmd)
+	flags := runFlagValues(b, c.cfg.flags)
+	b.checkAPIVersion(flags)
+
+	hostConfig, err := runHostConfig(b, flags, s.NoCache.HostConfig)
+	if err != nil {
+		return s, err
+	}
+
+	allowFailure, err := runBoolFlag(flags, "allow-failure")
+	if err != nil {
+		return s, err
+	}
+
+	outputFilter, err := runOutputFilter(b, flags)
+	if err != nil {
+		return s, err
+	}
+
+	// The checksum of the files goes to the commit message, so that it is
+	// a part of the cache key
+	if value, ok := flags["cache-key-file"]; ok {
+		sum, err := runCacheKeyFiles(b, value)
+		if err != nil {
+			return s, err
+		}
+		flags["cache-key-file"] = value + "@" + sum
+	}
+
+	// So does the content of the seccomp profiles
+	if sum := securityOptsKey(hostConfig.SecurityOpt); sum != "" {
+		flags["security-opt"] += "@" + sum
+	}
+
+	s.Commit("RUN%s %q", runCommitFlags(flags), cmd)
 
 	// Check cache
 	s, hit, err := b.probeCache(s)
@@ -388,6 +467,7 @@ func (c *CommandRun) Execute(b *Build) (s State, err error) {
 		return s, err
 	}
 	if hit {
+		b.exitCode = 0
 		return s, nil
 	}
 
@@ -399,15 +479,44 @@ func (c *CommandRun) Execute(b *Build) (s State, err error) {
 	s.Config.Cmd = cmd
 	s.Config.Entrypoint = []string{}
 
-	if s.NoCache.ContainerID, err = b.client.CreateContainer(s); err != nil {
+	// Options given by RUN flags are only applied to this step
+	origHostConfig := s.NoCache.HostConfig
+	s.NoCache.HostConfig = hostConfig
+
+	// The proxy variables are given to the container, but not committed
+	origEnv := s.Config.Env
+	s.Config.Env = runEnv(b, origEnv)
+
+	s.NoCache.OutputFilter = outputFilter
+
+	s.NoCache.ContainerID, err = b.client.CreateContainer(s)
+	s.NoCache.HostConfig = origHostConfig
+	s.NoCache.OutputFilter = nil
+	s.Config.Env = origEnv
+
+	if err != nil {
 		return s, err
 	}
 
 	if err = b.client.RunContainer(s.NoCache.ContainerID, false); err != nil {
+		exitErr, isExit := err.(*ContainerExitError)
+		if isExit && allowFailure {
+			// The failed step leaves no trace in the image, only its exit code
+			// is recorded for the following RUN --if-prev-* steps
+			b.warnf("%s, continue because of --allow-failure", err)
+			b.client.RemoveContainer(s.NoCache.ContainerID)
+			b.exitCode = exitErr.ExitCode
+			return b.state, nil
+		}
+		if isExit && b.cfg.AttachOnError {
+			b.attachOnError(s, c.String())
+		}
 		b.client.RemoveContainer(s.NoCache.ContainerID)
-		return s, err
+		return s, runContainerError(hostConfig, err)
 	}
 
+	b.exitCode = 0
+
 	// Restore command after commit
 	s.Config.Cmd = origCmd
 	s.Config.Entrypoint = origEntrypoint
@@ -464,6 +573,23 @@ func (c *CommandAttach) Execute(b *Build) (s State, err error) {
 		s = origState
 	}()
 
+	s = attachState(s, cmd)
+
+	if s.NoCache.ContainerID, err = b.client.CreateContainer(s); err != nil {
+		return s, err
+	}
+
+	if err = b.client.RunContainer(s.NoCache.ContainerID, true); err != nil {
+		b.client.RemoveContainer(s.NoCache.ContainerID)
+		return s, err
+	}
+
+	return s, nil
+}
+
+// attachState returns the state for a container that runs the command with
+// the terminal attached, the way ATTACH does
+func attachState(s State, cmd []string) State {
 	s.Config.Cmd = cmd
 	s.Config.Entrypoint = []string{}
 	s.Config.Tty = true
@@ -472,17 +598,40 @@ func (c *CommandAttach) Execute(b *Build) (s State, err error) {
 	s.Config.AttachStdin = true
 	s.Config.AttachStderr = true
 	s.Config.AttachStdout = true
+	return s
+}
 
-	if s.NoCache.ContainerID, err = b.client.CreateContainer(s); err != nil {
-		return s, err
+// attachOnError commits the container of the failed RUN step and attaches to
+// a shell in a container of that image, so the failure can be investigated.
+// The image and the container are removed afterwards; errors are only logged,
+// since the build fails anyway.
+func (b *Build) attachOnError(s State, command string) {
+	log.Infof("| %s failed, attach to a shell in the container state after it; exit the shell to finish the build", command)
+
+	img, err := b.client.CommitContainer(s, "Failed "+command)
+	if err != nil {
+		log.Errorf("Failed to commit container %.12s of the failed step, error: %s", s.NoCache.ContainerID, err)
+		return
 	}
+	defer func() {
+		if err := b.client.RemoveImage(img.ID); err != nil {
+			log.Errorf("Failed to remove image %.12s of the failed step, error: %s", img.ID, err)
+		}
+	}()
 
-	if err = b.client.RunContainer(s.NoCache.ContainerID, true); err != nil {
-		b.client.RemoveContainer(s.NoCache.ContainerID)
-		return s, err
+	shell := attachState(s, []string{"/bin/sh"})
+	shell.ImageID = img.ID
+
+	containerID, err := b.client.CreateContainer(shell)
+	if err != nil {
+		log.Errorf("Failed to create a shell container for the failed step, error: %s", err)
+		return
 	}
+	defer b.client.RemoveContainer(containerID)
 
-	return s, nil
+	if err := b.client.RunContainer(containerID, true); err != nil {
+		log.Debugf("Shell of the failed step exited with error: %s", err)
+	}
 }
 
 // CommandEnv implements ENV
@@ -522,6 +671,10 @@ func (c *CommandEnv) Execute(b *Build) (s State, err error) {
 
 	commitStr := "ENV"
 
+	// The env may be shared with the previous state and the base image config,
+	// so we modify a copy of it
+	s.Config.Env = append([]string{}, s.Config.Env...)
+
 	for j := 0; j < len(args); j += 2 {
 		// name  ==> args[j]
 		// value ==> args[j+1]
@@ -603,6 +756,157 @@ func (c *CommandLabel) Execute(b *Build) (s State, err error) {
 	return s, nil
 }
 
+// CommandAnnotation implements ANNOTATION
+type CommandAnnotation struct {
+	cfg ConfigCommand
+}
+
+// String returns the human readable string representation of the command
+func (c *CommandAnnotation) String() string {
+	return c.cfg.original
+}
+
+// ShouldRun returns true if the command should be executed
+func (c *CommandAnnotation) ShouldRun(b *Build) (bool, error) {
+	return true, nil
+}
+
+// ReplaceEnv implements EnvReplacableCommand interface
+func (c *CommandAnnotation) ReplaceEnv(env []string) error {
+	return replaceEnv(c.cfg.args, env)
+}
+
+// Execute runs the command
+func (c *CommandAnnotation) Execute(b *Build) (s State, err error) {
+
+	s = b.state
+	args := c.cfg.args
+
+	if len(args) == 0 {
+		return s, fmt.Errorf("ANNOTATION requires at least one argument")
+	}
+
+	if len(args)%2 != 0 {
+		// should never get here, but just in case
+		return s, fmt.Errorf("Bad input to ANNOTATION, too many args")
+	}
+
+	// Annotations go to the manifest rather than the image config, so there
+	// is nothing to commit; the map may be shared with the previous state
+	annotations := map[string]string{}
+	for k, v := range s.NoCache.Annotations {
+		annotations[k] = v
+	}
+	for j := 0; j < len(args); j += 2 {
+		annotations[args[j]] = args[j+1]
+	}
+	s.NoCache.Annotations = annotations
+
+	return s, nil
+}
+
+// CommandConfig implements CONFIG
+type CommandConfig struct {
+	cfg ConfigCommand
+}
+
+// String returns the human readable string representation of the command
+func (c *CommandConfig) String() string {
+	return c.cfg.original
+}
+
+// ShouldRun returns true if the command should be executed
+func (c *CommandConfig) ShouldRun(b *Build) (bool, error) {
+	return true, nil
+}
+
+// Execute runs the command
+func (c *CommandConfig) Execute(b *Build) (s State, err error) {
+
+	s = b.state
+	args := c.cfg.args
+
+	if len(args) != 1 {
+		return s, fmt.Errorf("CONFIG requires exactly one argument")
+	}
+
+	if err = validateConfigBlob(args[0]); err != nil {
+		return s, err
+	}
+
+	// Make a deep copy, so the slices and maps of the previous state are left intact
+	data, err := json.Marshal(s.Config)
+	if err != nil {
+		return s, fmt.Errorf("Failed to marshal the image config, error: %s", err)
+	}
+	config := ImageConfig{}
+	if err = json.Unmarshal(data, &config); err != nil {
+		return s, fmt.Errorf("Failed to unmarshal the image config, error: %s", err)
+	}
+	if err = json.Unmarshal([]byte(args[0]), &config); err != nil {
+		return s, fmt.Errorf("Failed to apply CONFIG %s, error: %s", args[0], err)
+	}
+	s.Config = config
+
+	// The compacted JSON goes to the cache key, so that formatting of the blob
+	// does not bust the cache
+	compact := &bytes.Buffer{}
+	if err = json.Compact(compact, []byte(args[0])); err != nil {
+		return s, fmt.Errorf("Failed to compact CONFIG %s, error: %s", args[0], err)
+	}
+
+	s.Commit("CONFIG %s", compact)
+
+	return s, nil
+}
+
+// validateConfigBlob checks that the argument of CONFIG is a JSON object
+// having only the fields of ImageConfig
+func validateConfigBlob(blob string) error {
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal([]byte(blob), &fields); err != nil {
+		return fmt.Errorf("CONFIG requires a JSON object, error: %s", err)
+	}
+
+	known := configFields()
+	for name := range fields {
+		if !known[name] {
+			return fmt.Errorf("CONFIG has unknown field %q, only the fields of the docker image config are supported", name)
+		}
+	}
+
+	// Types of the values are checked by decoding the blob
+	if err := json.Unmarshal([]byte(blob), &ImageConfig{}); err != nil {
+		return fmt.Errorf("Bad input to CONFIG, error: %s", err)
+	}
+
+	return nil
+}
+
+// configFields returns the JSON names of the fields of ImageConfig,
+// including the ones of the embedded docker.Config
+func configFields() map[string]bool {
+	fields := map[string]bool{}
+	addFields(fields, reflect.TypeOf(ImageConfig{}))
+	return fields
+}
+
+func addFields(fields map[string]bool, t reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).Anonymous {
+			addFields(fields, t.Field(i).Type)
+			continue
+		}
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if name == "" {
+			name = t.Field(i).Name
+		}
+		if name != "-" {
+			fields[name] = true
+		}
+	}
+}
+
 // CommandWorkdir implements WORKDIR
 type CommandWorkdir struct {
 	cfg ConfigCommand
@@ -932,6 +1236,10 @@ func (c *CommandTag) Execute(b *Build) (State, error) {
 		return b.state, fmt.Errorf("Cannot TAG on empty image")
 	}
 
+	if err := b.commitMeta(c.cfg.args[0]); err != nil {
+		return b.state, err
+	}
+
 	if err := b.client.TagImage(b.state.ImageID, c.cfg.args[0]); err != nil {
 		return b.state, err
 	}
@@ -964,56 +1272,110 @@ func (c *CommandPush) Execute(b *Build) (State, error) {
 		return b.state, fmt.Errorf("Cannot PUSH empty image")
 	}
 
+	if err := b.commitMeta(c.cfg.args[0]); err != nil {
+		return b.state, err
+	}
+
+	// Images over the size budget should not reach the registry
+	if err := b.checkSize(); err != nil {
+		return b.state, err
+	}
+
 	if err := b.client.TagImage(b.state.ImageID, c.cfg.args[0]); err != nil {
 		return b.state, err
 	}
 
 	image := imagename.NewFromString(c.cfg.args[0])
 	artifact := imagename.Artifact{
-		Name:      image,
-		Pushed:    b.cfg.Push,
-		Tag:       image.GetTag(),
-		ImageID:   b.state.ImageID,
-		BuildTime: time.Now(),
+		Name:            image,
+		Pushed:          b.cfg.Push,
+		Tag:             image.GetTag(),
+		ImageID:         b.state.ImageID,
+		BuildTime:       time.Now(),
+		ContextChecksum: b.cfg.ContextChecksum,
 	}
 
 	// push image and add some lines to artifacts
 	if b.cfg.Push {
-		digest, err := b.client.PushImage(image.String())
+		if len(b.GetAnnotations()) > 0 {
+			b.warnf("The Docker daemon does not push annotations, use --oci-layout to export the image with them")
+		}
+		if b.cfg.PushChanged {
+			if digest, ok := b.pushedDigest(image); ok {
+				log.Infof("| Image %s is unchanged in the registry, skip push", image)
+				b.Pushes = append(b.Pushes, PushResult{Image: image.String(), ImageID: b.state.ImageID, Digest: digest, Skipped: true})
+				artifact.Digest = digest
+				artifact.Addressable = fmt.Sprintf("%s@%s", image.NameWithRegistry(), digest)
+				return b.state, b.writeArtifact(artifact)
+			}
+		}
+		digest, stats, err := b.client.PushImage(image.String())
+		if err == nil && b.cfg.VerifyPush {
+			err = b.verifyPush(image, digest)
+		}
+		if err == nil && b.cfg.Signer != nil {
+			err = b.signImage(image, digest)
+		}
+		if b.cfg.PushBestEffort || b.cfg.PushChanged {
+			b.recordPush(image.String(), b.state.ImageID, digest, stats, err)
+		}
+		if b.cfg.PushBestEffort && err != nil {
+			// Failed pushes are reported at the end of the build,
+			// there are no artifacts for them
+			b.warnf("Failed to push %s, continue because of --push-best-effort, error: %s", image, err)
+			return b.state, nil
+		}
 		if err != nil {
 			return b.state, err
 		}
 		artifact.Digest = digest
 		artifact.Addressable = fmt.Sprintf("%s@%s", image.NameWithRegistry(), digest)
+
+		b.event(Event{
+			Type:          EventPush,
+			Step:          b.step,
+			Image:         image.String(),
+			ImageID:       b.state.ImageID,
+			Digest:        digest,
+			PushedLayers:  stats.PushedLayers,
+			PushedBytes:   stats.PushedBytes,
+			SkippedLayers: stats.SkippedLayers,
+		})
 	} else {
 		log.Infof("| Don't push. Pass --push flag to actually push to the registry")
 	}
 
-	// Publish artifact files
-	if b.cfg.ArtifactsPath != "" {
-		if err := os.MkdirAll(b.cfg.ArtifactsPath, 0755); err != nil {
-			return b.state, fmt.Errorf("Failed to create directory %s for the artifacts, error: %s", b.cfg.ArtifactsPath, err)
-		}
+	return b.state, b.writeArtifact(artifact)
+}
 
-		filePath := filepath.Join(b.cfg.ArtifactsPath, artifact.GetFileName())
+// writeArtifact publishes the artifact file of the pushed image
+func (b *Build) writeArtifact(artifact imagename.Artifact) error {
+	if b.cfg.ArtifactsPath == "" {
+		return nil
+	}
 
-		artifacts := imagename.Artifacts{
-			[]imagename.Artifact{artifact},
-		}
-		content, err := yaml.Marshal(artifacts)
-		if err != nil {
-			return b.state, err
-		}
+	if err := os.MkdirAll(b.cfg.ArtifactsPath, 0755); err != nil {
+		return fmt.Errorf("Failed to create directory %s for the artifacts, error: %s", b.cfg.ArtifactsPath, err)
+	}
 
-		if err := ioutil.WriteFile(filePath, content, 0644); err != nil {
-			return b.state, fmt.Errorf("Failed to write artifact file %s, error: %s", filePath, err)
-		}
+	filePath := filepath.Join(b.cfg.ArtifactsPath, artifact.GetFileName())
+
+	artifacts := imagename.Artifacts{
+		[]imagename.Artifact{artifact},
+	}
+	content, err := yaml.Marshal(artifacts)
+	if err != nil {
+		return err
+	}
 
-		log.Infof("| Saved artifact file %s", filePath)
-		log.Debugf("Artifact properties: %# v", pretty.Formatter(artifact))
+	if err := ioutil.WriteFile(filePath, content, 0644); err != nil {
+		return fmt.Errorf("Failed to write artifact file %s, error: %s", filePath, err)
 	}
 
-	return b.state, nil
+	log.Infof("| Saved artifact file %s", filePath)
+	log.Debugf("Artifact properties: %# v", pretty.Formatter(artifact))
+
+	return nil
 }
 
 // CommandCopy implements COPY
@@ -1041,6 +1403,9 @@ func (c *CommandCopy) Execute(b *Build) (State, error) {
 	if len(c.cfg.args) < 2 {
 		return b.state, fmt.Errorf("COPY requires at least two arguments")
 	}
+	if name, ok := c.cfg.flags["from-context"]; ok {
+		return copyFromContext(b, name, c.cfg.args, "COPY")
+	}
 	return copyFiles(b, c.cfg.args, "COPY")
 }
 
@@ -1097,9 +1462,26 @@ func (c *CommandMount) Execute(b *Build) (s State, err error) {
 		return b.state, fmt.Errorf("MOUNT requires at least one argument")
 	}
 
+	args, err := normalizeMounts(c.cfg.args)
+	if err != nil {
+		return b.state, err
+	}
+
+	// MOUNT --no-reuse overrides --no-reuse of the build for the volumes of the step
+	reuse := !b.cfg.NoReuse
+	if value, ok := c.cfg.flags["no-reuse"]; ok {
+		noReuse := true
+		if value != "" {
+			if noReuse, err = strconv.ParseBool(value); err != nil {
+				return b.state, fmt.Errorf("MOUNT --no-reuse takes true or false, got %q", value)
+			}
+		}
+		reuse = !noReuse
+	}
+
 	commitIds := []string{}
 
-	for _, arg := range c.cfg.args {
+	for _, arg := range args {
 
 		switch strings.Contains(arg, ":") {
 		// MOUNT src:dest
@@ -1119,6 +1501,17 @@ func (c *CommandMount) Execute(b *Build) (s State, err error) {
 				src = path.Join(b.cfg.ContextDir, src)
 			}
 
+			// Docker would make an empty directory for the missing path,
+			// which is hardly what the user wants to mount; the path can
+			// only be checked if the daemon shares the filesystem with us
+			if b.cfg.LocalDaemon {
+				if _, err = os.Stat(src); os.IsNotExist(err) {
+					return s, fmt.Errorf("MOUNT source %s does not exist", src)
+				} else if err != nil {
+					return s, err
+				}
+			}
+
 			if src, err = b.client.ResolveHostPath(src); err != nil {
 				return s, err
 			}
@@ -1132,7 +1525,7 @@ func (c *CommandMount) Execute(b *Build) (s State, err error) {
 
 		// MOUNT dir
 		case false:
-			c, err := b.getVolumeContainer(arg)
+			c, err := b.getVolumeContainer(arg, reuse)
 			if err != nil {
 				return s, err
 			}
@@ -1144,7 +1537,8 @@ func (c *CommandMount) Execute(b *Build) (s State, err error) {
 			s.NoCache.HostConfig.Binds = append(s.NoCache.HostConfig.Binds,
 				mountsToBinds(c.Mounts)...)
 
-			commitIds = append(commitIds, strings.TrimLeft(c.Name, "/")+":"+arg)
+			// A fresh volume does not change the cache key of the step
+			commitIds = append(commitIds, b.mountsContainerName(arg)+":"+arg)
 		}
 	}
 
@@ -1153,6 +1547,43 @@ func (c *CommandMount) Execute(b *Build) (s State, err error) {
 	return s, nil
 }
 
+// normalizeMounts checks that the container paths of MOUNT arguments, either
+// "dir" or "src:dest[:mode]", are absolute and do not overlap each other, and
+// returns the arguments with the trailing slashes of the paths removed
+func normalizeMounts(args []string) (result []string, err error) {
+	var dests []string
+
+	for _, arg := range args {
+		var src, dest, mode string
+
+		if parts := strings.SplitN(arg, ":", 3); len(parts) == 1 {
+			dest = parts[0]
+		} else {
+			src, dest = parts[0]+":", parts[1]
+			if len(parts) == 3 {
+				mode = ":" + parts[2]
+			}
+		}
+
+		if !path.IsAbs(dest) {
+			return nil, fmt.Errorf("MOUNT requires absolute paths in the container, got %q", dest)
+		}
+		dest = path.Clean(dest)
+
+		for _, other := range dests {
+			if dest == other || strings.HasPrefix(dest, strings.TrimSuffix(other, "/")+"/") ||
+				strings.HasPrefix(other, strings.TrimSuffix(dest, "/")+"/") {
+				return nil, fmt.Errorf("MOUNT paths %s and %s overlap", other, dest)
+			}
+		}
+		dests = append(dests, dest)
+
+		result = append(result, src+dest+mode)
+	}
+
+	return result, nil
+}
+
 // CommandExport implements EXPORT
 type CommandExport struct {
 	cfg ConfigCommand
@@ -1246,6 +1677,11 @@ func (c *CommandExport) Execute(b *Build) (s State, err error) {
 	}
 	defer b.client.RemoveContainer(exportsID)
 
+	// Small exports are copied with tar streams faster than the rsync container starts
+	if copied, err := b.exportWithTar(exportsID, src, exportsContainer.ID, cmdDestPath); err != nil || copied {
+		return s, err
+	}
+
 	log.Infof("| Running in %.12s: %s", exportsID, strings.Join(cmd, " "))
 
 	if err = b.client.RunContainer(exportsID, false); err != nil {
@@ -1311,8 +1747,25 @@ func (c *CommandImport) Execute(b *Build) (s State, err error) {
 		src = append(src, argResolved)
 	}
 
+	// The files small enough for the tar transport are identified in the
+	// cache by their checksum rather than by the exports, so that importing
+	// the same files again hits the cache
+	files, err := b.downloadImport(exportsContainer.ID, src, dest)
+	if err != nil {
+		return s, err
+	}
+
 	sort.Strings(b.exports)
-	s.Commit("IMPORT %q : %q %s", b.exports, src, dest)
+	importKey := fmt.Sprintf("%q", b.exports)
+	if files != nil {
+		importKey = files.checksum()
+	}
+
+	// Remember the state before IMPORT in case the files are unchanged
+	commitsBefore := append([]string{}, s.Commits...)
+	cacheBusted := s.NoCache.CacheBusted
+
+	s.Commit("IMPORT %s : %q %s", importKey, src, dest)
 
 	// Check cache
 	s, hit, err := b.probeCache(s)
@@ -1353,6 +1806,34 @@ func (c *CommandImport) Execute(b *Build) (s State, err error) {
 		return s, err
 	}
 
+	if files != nil {
+		// Nothing is committed if the image already has the same files
+		if origState.ImageID != "" && b.tarUnchanged(importID, files) {
+			log.Infof("| Files are unchanged, skip IMPORT")
+			b.reason = ReasonUnchanged
+
+			if err := b.client.RemoveContainer(importID); err != nil {
+				return s, err
+			}
+			importID = ""
+			origState.Commits = commitsBefore
+			origState.NoCache.CacheBusted = cacheBusted
+			return s, nil
+		}
+
+		// The container is committed without running rsync in it
+		if err := b.uploadTar(importID, files); err != nil {
+			return s, err
+		}
+		log.Infof("| Copied %s to %s with tar", strings.Join(src, " "), dest)
+		return s, nil
+	}
+
+	// The container is committed as it is, whether rsync has run in it or not
+	if copied, err := b.exportWithTar(exportsContainer.ID, src, importID, dest); err != nil || copied {
+		return s, err
+	}
+
 	log.Infof("| Running in %.12s: %s", importID, strings.Join(cmd, " "))
 
 	if err = b.client.RunContainer(importID, false); err != nil {
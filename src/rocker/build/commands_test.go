@@ -18,9 +18,13 @@ package build
 
 import (
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"reflect"
 	"rocker/imagename"
 	"testing"
+	"time"
 
 	"github.com/kr/pretty"
 	"github.com/stretchr/testify/mock"
@@ -56,39 +60,875 @@ func TestCommandFrom_Existing(t *testing.T) {
 	assert.Equal(t, "localhost", state.Config.Hostname)
 }
 
+func TestCommandFrom_Override(t *testing.T) {
+	b, c := makeBuild(t, "", Config{FromOverride: "ubuntu:debug"})
+	first := &CommandFrom{ConfigCommand{
+		args: []string{"ubuntu:release"},
+	}}
+	second := &CommandFrom{ConfigCommand{
+		args: []string{"alpine:3.3"},
+	}}
+
+	c.On("InspectImage", "ubuntu:debug").Return(&docker.Image{ID: "123"}, nil).Once()
+	c.On("InspectImage", "alpine:3.3").Return(&docker.Image{ID: "456"}, nil).Once()
+
+	state, err := first.Execute(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "123", state.ImageID)
+
+	if state, err = second.Execute(b); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "456", state.ImageID)
+
+	c.AssertExpectations(t)
+}
+
+func TestCommandFrom_OverrideScratch(t *testing.T) {
+	b, c := makeBuild(t, "", Config{FromOverride: "ubuntu:debug"})
+	cmd := &CommandFrom{ConfigCommand{
+		args: []string{"scratch"},
+	}}
+
+	c.On("InspectImage", "ubuntu:debug").Return(&docker.Image{ID: "123"}, nil).Once()
+
+	state, err := cmd.Execute(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.False(t, state.NoBaseImage)
+	assert.Equal(t, "123", state.ImageID)
+
+	c.AssertExpectations(t)
+}
+
 func TestCommandFrom_NotExisting(t *testing.T) {
 	b, c := makeBuild(t, "", Config{})
 	cmd := &CommandFrom{ConfigCommand{
 		args: []string{"not-existing"},
 	}}
 
-	var nilImg *docker.Image
-	var nilList []*imagename.ImageName
+	var nilImg *docker.Image
+	var nilList []*imagename.ImageName
+
+	c.On("InspectImage", "not-existing").Return(nilImg, nil).Once()
+	c.On("ListImages").Return(nilList, nil).Once()
+	c.On("ListImageTags", "not-existing:latest").Return(nilList, nil).Once()
+
+	_, err := cmd.Execute(b)
+	c.AssertExpectations(t)
+	assert.Equal(t, "FROM error: Image not found: not-existing:latest (also checked in the remote registry)", err.Error())
+}
+
+func TestCommandFrom_ForbidLatest(t *testing.T) {
+	tests := []struct {
+		name  string
+		allow []string
+		err   string
+	}{
+		{"ubuntu:14.04", nil, ""},
+		{"golang@sha256:ead434cd278824865d6e3b67e5d4579ded02eb2e8367fc165efa21138b225f11", nil, ""},
+		{"ubuntu", nil, "FROM error: Image ubuntu:latest is not pinned to a version, pin it or pass --allow-latest ubuntu"},
+		{"quay.io/ubuntu:latest", nil, "FROM error: Image quay.io/ubuntu:latest is not pinned to a version, pin it or pass --allow-latest quay.io/ubuntu"},
+		{"ubuntu:latest", []string{"ubuntu"}, ""},
+		{"ubuntu", []string{"debian", "ubuntu:latest"}, ""},
+		{"quay.io/ubuntu", []string{"ubuntu"}, "FROM error: Image quay.io/ubuntu:latest is not pinned to a version, pin it or pass --allow-latest quay.io/ubuntu"},
+	}
+
+	for _, test := range tests {
+		b, c := makeBuild(t, "", Config{ForbidLatest: true, AllowLatest: test.allow})
+		cmd := &CommandFrom{ConfigCommand{
+			args: []string{test.name},
+		}}
+
+		if test.err == "" {
+			c.On("InspectImage", test.name).Return(&docker.Image{ID: "123"}, nil).Once()
+		}
+
+		_, err := cmd.Execute(b)
+		c.AssertExpectations(t)
+
+		if test.err == "" {
+			assert.NoError(t, err, "FROM %s", test.name)
+		} else {
+			assert.EqualError(t, err, test.err, "FROM %s", test.name)
+		}
+	}
+}
+
+// =========== Testing RUN ===========
+
+func TestCommandRun_Simple(t *testing.T) {
+	b, c := makeBuild(t, "", Config{})
+	cmd := &CommandRun{ConfigCommand{
+		args: []string{"whoami"},
+	}}
+
+	origCmd := []string{"/bin/program"}
+	b.state.Config.Cmd = origCmd
+	b.state.ImageID = "123"
+
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("456", nil).Run(func(args mock.Arguments) {
+		arg := args.Get(0).(State)
+		assert.Equal(t, []string{"/bin/sh", "-c", "whoami"}, arg.Config.Cmd)
+	}).Once()
+
+	c.On("RunContainer", "456", false).Return(nil).Once()
+
+	state, err := cmd.Execute(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+	assert.Equal(t, origCmd, b.state.Config.Cmd)
+	assert.Equal(t, origCmd, state.Config.Cmd)
+	assert.Equal(t, "123", state.ImageID)
+	assert.Equal(t, "456", state.NoCache.ContainerID)
+}
+
+func TestCommandRun_ProxyEnv(t *testing.T) {
+	b, c := makeBuild(t, "", Config{
+		ProxyEnv: []string{"http_proxy=http://proxy:3128", "no_proxy=localhost"},
+	})
+	cmd := &CommandRun{ConfigCommand{
+		args: []string{"apt-get update"},
+	}}
+
+	b.state.ImageID = "123"
+	b.state.Config.Env = []string{"PATH=/bin", "no_proxy=internal"}
+
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("456", nil).Run(func(args mock.Arguments) {
+		// ENV of the image takes precedence over the proxy of the host
+		assert.Equal(t, []string{"PATH=/bin", "no_proxy=internal", "http_proxy=http://proxy:3128"},
+			args.Get(0).(State).Config.Env)
+	}).Once()
+	c.On("RunContainer", "456", false).Return(nil).Once()
+
+	state, err := cmd.Execute(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+
+	// The config to commit and the cache key have no proxy
+	assert.Equal(t, []string{"PATH=/bin", "no_proxy=internal"}, state.Config.Env)
+	assert.NotContains(t, state.GetCommits(), "proxy")
+}
+
+func TestProxyEnv(t *testing.T) {
+	env := ProxyEnv([]string{
+		"HOME=/root",
+		"https_proxy=http://proxy:3128",
+		"HTTP_PROXY=http://proxy:3128",
+		"NO_PROXY=",
+		"no_proxy=localhost,.local",
+	})
+	assert.Equal(t, []string{
+		"HTTP_PROXY=http://proxy:3128",
+		"https_proxy=http://proxy:3128",
+		"no_proxy=localhost,.local",
+	}, env)
+}
+
+func TestCommandRun_CacheKeyFile(t *testing.T) {
+	contextDir, rm := makeMountSources(t, "scripts")
+	defer rm()
+
+	script := filepath.Join(contextDir, "scripts", "install.sh")
+	writeScript := func(content string) {
+		if err := ioutil.WriteFile(script, []byte(content), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cache := NewCacheMemory()
+
+	// run executes the step and tells whether it has hit the cache
+	run := func() bool {
+		b, c := makeBuild(t, "", Config{ContextDir: contextDir})
+		b.cache = cache
+		b.state.ImageID = "123"
+		cmd := &CommandRun{ConfigCommand{
+			args:  []string{"./scripts/install.sh"},
+			flags: map[string]string{"cache-key-file": "scripts/*.sh"},
+		}}
+
+		c.On("InspectImage", "789").Return(&docker.Image{ID: "789"}, nil)
+		c.On("CreateContainer", mock.AnythingOfType("State")).Return("456", nil)
+		c.On("RunContainer", "456", false).Return(nil)
+
+		state, err := cmd.Execute(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if state.ImageID == "789" {
+			return true
+		}
+
+		// Cache the step as if it was committed
+		state.ParentID, state.ImageID = "123", "789"
+		if err := cache.Put(state); err != nil {
+			t.Fatal(err)
+		}
+		return false
+	}
+
+	writeScript("apt-get install -y curl")
+	assert.False(t, run())
+	assert.True(t, run(), "expected the same script to hit the cache")
+
+	writeScript("apt-get install -y curl wget")
+	assert.False(t, run(), "expected the changed script to bust the cache")
+}
+
+func TestCommandRun_CacheKeyFileInvalid(t *testing.T) {
+	contextDir, rm := makeMountSources(t, "src")
+	defer rm()
+
+	tests := map[string]string{
+		"":             "RUN --cache-key-file requires a path in the context",
+		"../etc/hosts": "RUN --cache-key-file ../etc/hosts is outside of the context",
+		"install.sh":   "RUN --cache-key-file install.sh matches no files in the context",
+	}
+
+	for value, expected := range tests {
+		b, _ := makeBuild(t, "", Config{ContextDir: contextDir})
+		b.state.ImageID = "123"
+		cmd := &CommandRun{ConfigCommand{
+			args:  []string{"./install.sh"},
+			flags: map[string]string{"cache-key-file": value},
+		}}
+
+		_, err := cmd.Execute(b)
+		assert.EqualError(t, err, expected)
+	}
+}
+
+func TestCommandRun_AttachOnError(t *testing.T) {
+	b, c := makeBuild(t, "", Config{AttachOnError: true})
+	cmd := &CommandRun{ConfigCommand{
+		args:     []string{"make"},
+		original: "RUN make",
+	}}
+
+	b.state.ImageID = "123"
+	b.state.Config.Env = []string{"A=1"}
+
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("456", nil).Once()
+	c.On("RunContainer", "456", false).Return(&ContainerExitError{ContainerID: "456", ExitCode: 2}).Once()
+
+	c.On("CommitContainer", mock.AnythingOfType("State"), "Failed RUN make").Return(&docker.Image{ID: "789"}, nil).Run(func(args mock.Arguments) {
+		arg := args.Get(0).(State)
+		assert.Equal(t, "456", arg.NoCache.ContainerID)
+	}).Once()
+
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("999", nil).Run(func(args mock.Arguments) {
+		arg := args.Get(0).(State)
+		assert.Equal(t, "789", arg.ImageID, "expected the shell to start from the failed state")
+		assert.Equal(t, []string{"A=1"}, arg.Config.Env)
+		assert.Equal(t, []string{"/bin/sh"}, arg.Config.Cmd)
+		assert.True(t, arg.Config.Tty)
+		assert.True(t, arg.Config.OpenStdin)
+	}).Once()
+	c.On("RunContainer", "999", true).Return(nil).Once()
+	c.On("RemoveContainer", "999").Return(nil).Once()
+	c.On("RemoveImage", "789").Return(nil).Once()
+	c.On("RemoveContainer", "456").Return(nil).Once()
+
+	_, err := cmd.Execute(b)
+	assert.EqualError(t, err, "Container 456 exited with code 2")
+
+	c.AssertExpectations(t)
+}
+
+func TestCommandRun_Tmpfs(t *testing.T) {
+	b, c := makeBuild(t, "", Config{})
+	cmd := &CommandRun{ConfigCommand{
+		args:  []string{"make"},
+		flags: map[string]string{"mount": "type=tmpfs,target=/tmp/work,size=64m"},
+	}}
+
+	b.state.ImageID = "123"
+
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("456", nil).Run(func(args mock.Arguments) {
+		arg := args.Get(0).(State)
+		assert.Equal(t, map[string]string{"/tmp/work": "size=64m"}, arg.NoCache.HostConfig.Tmpfs)
+	}).Once()
+
+	c.On("RunContainer", "456", false).Return(nil).Once()
+
+	state, err := cmd.Execute(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+	assert.Nil(t, state.NoCache.HostConfig.Tmpfs)
+	assert.Equal(t, []string{`RUN --mount=type=tmpfs,target=/tmp/work,size=64m ["/bin/sh" "-c" "make"]`}, state.Commits)
+}
+
+func TestCommandRun_ReadOnly(t *testing.T) {
+	b, c := makeBuild(t, "", Config{})
+	cmd := &CommandRun{ConfigCommand{
+		args: []string{"make"},
+		flags: map[string]string{
+			"read-only": "",
+			"mount":     "type=tmpfs,target=/tmp/work,size=64m",
+		},
+	}}
+
+	b.state.ImageID = "123"
+
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("456", nil).Run(func(args mock.Arguments) {
+		arg := args.Get(0).(State)
+		assert.True(t, arg.NoCache.HostConfig.ReadonlyRootfs)
+		assert.Equal(t, map[string]string{"/tmp/work": "size=64m"}, arg.NoCache.HostConfig.Tmpfs)
+	}).Once()
+
+	c.On("RunContainer", "456", false).Return(nil).Once()
+
+	state, err := cmd.Execute(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+	assert.False(t, state.NoCache.HostConfig.ReadonlyRootfs)
+	assert.Equal(t, []string{`RUN --mount=type=tmpfs,target=/tmp/work,size=64m --read-only ["/bin/sh" "-c" "make"]`}, state.Commits)
+}
+
+func TestCommandRun_Grep(t *testing.T) {
+	b, c := makeBuild(t, "", Config{ContextDir: "/src", ArtifactsPath: "/artifacts"})
+	cmd := &CommandRun{ConfigCommand{
+		args: []string{"make"},
+		flags: map[string]string{
+			"grep":     "ERROR|WARN",
+			"grep-log": "logs/make.log",
+		},
+	}}
+
+	b.state.ImageID = "123"
+
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("456", nil).Run(func(args mock.Arguments) {
+		arg := args.Get(0).(State)
+		assert.Equal(t, &OutputFilter{Pattern: "ERROR|WARN", LogFile: "/artifacts/logs/make.log"}, arg.NoCache.OutputFilter)
+	}).Once()
+
+	c.On("RunContainer", "456", false).Return(nil).Once()
+
+	state, err := cmd.Execute(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+	assert.Nil(t, state.NoCache.OutputFilter)
+	// The filter does not change the image, so it is not in the cache key
+	assert.Equal(t, []string{`RUN ["/bin/sh" "-c" "make"]`}, state.Commits)
+}
+
+func TestCommandRun_GrepLogWorkingDir(t *testing.T) {
+	b, _ := makeBuild(t, "", Config{ContextDir: "/src"})
+
+	filter, err := runOutputFilter(b, map[string]string{"grep": "ERROR", "grep-log": "make.log"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, filepath.Join(wd, "make.log"), filter.LogFile)
+}
+
+func TestCommandRun_GrepErrors(t *testing.T) {
+	b, _ := makeBuild(t, "", Config{})
+	b.state.ImageID = "123"
+
+	tests := []struct {
+		flags map[string]string
+		err   string
+	}{
+		{map[string]string{"grep-log": "make.log"}, "RUN --grep-log requires --grep"},
+		{map[string]string{"grep": ""}, "RUN --grep requires a pattern"},
+		{map[string]string{"grep": "ERROR("}, "Invalid RUN --grep \"ERROR(\", error: error parsing regexp: missing closing ): `ERROR(`"},
+		{map[string]string{"grep": "ERROR", "grep-log": ""}, "RUN --grep-log requires a path"},
+	}
+
+	for _, test := range tests {
+		cmd := &CommandRun{ConfigCommand{args: []string{"make"}, flags: test.flags}}
+		_, err := cmd.Execute(b)
+		assert.EqualError(t, err, test.err)
+	}
+}
+
+func TestCommandRun_ReadOnlyDefault(t *testing.T) {
+	b, c := makeBuild(t, "", Config{ReadOnly: true})
+	cmd := &CommandRun{ConfigCommand{
+		args: []string{"make"},
+	}}
+
+	b.state.ImageID = "123"
+
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("456", nil).Run(func(args mock.Arguments) {
+		arg := args.Get(0).(State)
+		assert.True(t, arg.NoCache.HostConfig.ReadonlyRootfs)
+	}).Once()
+
+	c.On("RunContainer", "456", false).Return(nil).Once()
+
+	state, err := cmd.Execute(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+	assert.Equal(t, []string{`RUN --read-only ["/bin/sh" "-c" "make"]`}, state.Commits)
+
+	cmd.cfg.flags = map[string]string{"read-only": "yes"}
+	_, err = cmd.Execute(b)
+	assert.EqualError(t, err, `RUN --read-only does not take a value, got "yes"`)
+}
+
+func TestCommandRun_ParseMount(t *testing.T) {
+	tmpfs, err := parseRunMount("type=tmpfs,target=/tmp/work")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, map[string]string{"/tmp/work": ""}, tmpfs)
+
+	tmpfs, err = parseRunMount("type=tmpfs,dst=/cache,size=1g,mode=1777")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, map[string]string{"/cache": "size=1g,mode=1777"}, tmpfs)
+
+	for _, value := range []string{
+		"type=bind,target=/tmp/work",
+		"type=tmpfs",
+		"type=tmpfs,target=tmp",
+		"type=tmpfs,target=/tmp,readonly",
+		"type=tmpfs,target=/tmp,uid=0",
+	} {
+		_, err := parseRunMount(value)
+		assert.Error(t, err, value)
+	}
+}
+
+func TestCommandRun_Privileged(t *testing.T) {
+	b, c := makeBuild(t, "", Config{AllowPrivileged: true})
+	cmd := &CommandRun{ConfigCommand{
+		args:  []string{"mount -t tmpfs none /mnt"},
+		flags: map[string]string{"privileged": ""},
+	}}
+
+	b.state.ImageID = "123"
+
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("456", nil).Run(func(args mock.Arguments) {
+		arg := args.Get(0).(State)
+		assert.True(t, arg.NoCache.HostConfig.Privileged)
+	}).Once()
+
+	c.On("RunContainer", "456", false).Return(nil).Once()
+
+	state, err := cmd.Execute(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+	assert.False(t, state.NoCache.HostConfig.Privileged)
+	assert.Equal(t, []string{`RUN --privileged ["/bin/sh" "-c" "mount -t tmpfs none /mnt"]`}, state.Commits)
+}
+
+func TestCommandRun_PrivilegedNotAllowed(t *testing.T) {
+	b, c := makeBuild(t, "", Config{})
+	cmd := &CommandRun{ConfigCommand{
+		args:  []string{"mount -t tmpfs none /mnt"},
+		flags: map[string]string{"privileged": ""},
+	}}
+
+	b.state.ImageID = "123"
+
+	_, err := cmd.Execute(b)
+	assert.EqualError(t, err, "RUN --privileged requires the build to be run with --allow-privileged")
+	c.AssertExpectations(t)
+}
+
+func TestCommandRun_Capabilities(t *testing.T) {
+	b, c := makeBuild(t, "", Config{CapDrop: []string{"MKNOD"}})
+	cmd := &CommandRun{ConfigCommand{
+		args:  []string{"tcpdump -c 1"},
+		flags: map[string]string{"cap-add": "net_admin,CAP_NET_RAW", "cap-drop": "SETUID"},
+	}}
+
+	b.state.ImageID = "123"
+
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("456", nil).Run(func(args mock.Arguments) {
+		arg := args.Get(0).(State)
+		assert.Equal(t, []string{"NET_ADMIN", "NET_RAW"}, arg.NoCache.HostConfig.CapAdd)
+		assert.Equal(t, []string{"MKNOD", "SETUID"}, arg.NoCache.HostConfig.CapDrop)
+	}).Once()
+
+	c.On("RunContainer", "456", false).Return(nil).Once()
+
+	state, err := cmd.Execute(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+	assert.Nil(t, state.NoCache.HostConfig.CapAdd)
+	assert.Nil(t, state.NoCache.HostConfig.CapDrop)
+	assert.Equal(t, []string{`RUN --cap-add=net_admin,CAP_NET_RAW --cap-drop=MKNOD,SETUID ["/bin/sh" "-c" "tcpdump -c 1"]`}, state.Commits)
+}
+
+func TestCommandRun_CapabilitiesDefaults(t *testing.T) {
+	b, c := makeBuild(t, "", Config{CapAdd: []string{"SYS_PTRACE"}})
+	cmd := &CommandRun{ConfigCommand{
+		args: []string{"strace ls"},
+	}}
+
+	b.state.ImageID = "123"
+
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("456", nil).Run(func(args mock.Arguments) {
+		arg := args.Get(0).(State)
+		assert.Equal(t, []string{"SYS_PTRACE"}, arg.NoCache.HostConfig.CapAdd)
+	}).Once()
+
+	c.On("RunContainer", "456", false).Return(nil).Once()
+
+	state, err := cmd.Execute(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+	assert.Equal(t, []string{`RUN --cap-add=SYS_PTRACE ["/bin/sh" "-c" "strace ls"]`}, state.Commits)
+}
+
+func TestCommandRun_ParseCapabilities(t *testing.T) {
+	caps, err := parseCapabilities("cap-add", "ALL, cap_sys_admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"ALL", "SYS_ADMIN"}, caps)
+
+	_, err = parseCapabilities("cap-drop", "NET_ADMIN,SUPERPOWER")
+	assert.EqualError(t, err, `Unknown capability "SUPERPOWER" given to --cap-drop`)
+}
+
+func TestCommandRun_Devices(t *testing.T) {
+	b, c := makeBuild(t, "", Config{Devices: []string{"/dev/fuse"}})
+	cmd := &CommandRun{ConfigCommand{
+		args:  []string{"make test"},
+		flags: map[string]string{"device": "/dev/sdc:/dev/xvdc:r"},
+	}}
+
+	b.state.ImageID = "123"
+
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("456", nil).Run(func(args mock.Arguments) {
+		arg := args.Get(0).(State)
+		assert.Equal(t, []docker.Device{
+			{PathOnHost: "/dev/fuse", PathInContainer: "/dev/fuse", CgroupPermissions: "rwm"},
+			{PathOnHost: "/dev/sdc", PathInContainer: "/dev/xvdc", CgroupPermissions: "r"},
+		}, arg.NoCache.HostConfig.Devices)
+	}).Once()
+
+	c.On("RunContainer", "456", false).Return(nil).Once()
+
+	state, err := cmd.Execute(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+	assert.Nil(t, state.NoCache.HostConfig.Devices)
+	assert.Equal(t, []string{`RUN --device=/dev/fuse,/dev/sdc:/dev/xvdc:r ["/bin/sh" "-c" "make test"]`}, state.Commits)
+}
+
+func TestCommandRun_ParseDevice(t *testing.T) {
+	tests := map[string]docker.Device{
+		"/dev/fuse":              {PathOnHost: "/dev/fuse", PathInContainer: "/dev/fuse", CgroupPermissions: "rwm"},
+		"/dev/fuse:rw":           {PathOnHost: "/dev/fuse", PathInContainer: "/dev/fuse", CgroupPermissions: "rw"},
+		"/dev/sdc:/dev/xvdc":     {PathOnHost: "/dev/sdc", PathInContainer: "/dev/xvdc", CgroupPermissions: "rwm"},
+		"/dev/sdc:/dev/xvdc:rwm": {PathOnHost: "/dev/sdc", PathInContainer: "/dev/xvdc", CgroupPermissions: "rwm"},
+	}
+	for spec, expected := range tests {
+		device, err := parseDevice(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, expected, device, spec)
+	}
+
+	for _, spec := range []string{
+		"",
+		"dev/fuse",
+		"/dev/fuse:fuse",
+		"/dev/sdc:/dev/xvdc:rwx",
+		"/dev/sdc:/dev/xvdc:r:w",
+	} {
+		_, err := parseDevice(spec)
+		assert.Error(t, err, spec)
+	}
+}
+
+func TestCommandRun_GPUs(t *testing.T) {
+	b, c := makeBuild(t, "", Config{GPUs: "all"})
+	cmd := &CommandRun{ConfigCommand{
+		args:  []string{"nvcc kernel.cu"},
+		flags: map[string]string{"gpus": "device=0,device=1"},
+	}}
+
+	b.state.ImageID = "123"
+
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("456", nil).Run(func(args mock.Arguments) {
+		arg := args.Get(0).(State)
+		assert.Equal(t, []DeviceRequest{
+			{DeviceIDs: []string{"0", "1"}, Capabilities: [][]string{{"gpu"}}},
+		}, arg.NoCache.HostConfig.DeviceRequests)
+	}).Once()
+
+	c.On("RunContainer", "456", false).Return(nil).Once()
+
+	state, err := cmd.Execute(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+	assert.Nil(t, state.NoCache.HostConfig.DeviceRequests)
+	assert.Equal(t, []string{`RUN --gpus=device=0,device=1 ["/bin/sh" "-c" "nvcc kernel.cu"]`}, state.Commits)
+}
+
+func TestCommandRun_GPUsNotSupported(t *testing.T) {
+	b, c := makeBuild(t, "", Config{GPUs: "all"})
+	cmd := &CommandRun{ConfigCommand{
+		args: []string{"nvidia-smi"},
+	}}
+
+	b.state.ImageID = "123"
+
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("456", nil).Once()
+	c.On("RunContainer", "456", false).Return(fmt.Errorf(`could not select device driver "" with capabilities: [[gpu]]`)).Once()
+	c.On("RemoveContainer", "456").Return(nil).Once()
+
+	_, err := cmd.Execute(b)
+	assert.EqualError(t, err, `Failed to run container with --gpus, the Docker daemon has no GPU support (is NVIDIA Container Toolkit installed?), error: could not select device driver "" with capabilities: [[gpu]]`)
+	c.AssertExpectations(t)
+}
+
+func TestCommandRun_ParseGPUs(t *testing.T) {
+	tests := map[string]DeviceRequest{
+		"all":                     {Count: -1, Capabilities: [][]string{{"gpu"}}},
+		"2":                       {Count: 2, Capabilities: [][]string{{"gpu"}}},
+		"device=GPU-3a23c669":     {DeviceIDs: []string{"GPU-3a23c669"}, Capabilities: [][]string{{"gpu"}}},
+		"count=all,driver=nvidia": {Driver: "nvidia", Count: -1, Capabilities: [][]string{{"gpu"}}},
+		"count=1,capabilities=gpu,capabilities=compute": {Count: 1, Capabilities: [][]string{{"gpu", "compute"}}},
+	}
+	for value, expected := range tests {
+		request, err := parseGPUs(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, expected, request, value)
+	}
+
+	for _, value := range []string{
+		"",
+		"0",
+		"-2",
+		"some",
+		"count=two",
+		"count=1,device=0",
+		"device=",
+		"memory=1g",
+	} {
+		_, err := parseGPUs(value)
+		assert.Error(t, err, value)
+	}
+}
+
+func TestCommandRun_Sysctls(t *testing.T) {
+	b, c := makeBuild(t, "", Config{Sysctls: []string{"net.core.somaxconn=1024", "net.ipv4.ip_forward=1"}})
+	cmd := &CommandRun{ConfigCommand{
+		args:  []string{"make test"},
+		flags: map[string]string{"sysctl": "net.core.somaxconn=4096"},
+	}}
+
+	b.state.ImageID = "123"
+
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("456", nil).Run(func(args mock.Arguments) {
+		arg := args.Get(0).(State)
+		assert.Equal(t, map[string]string{
+			"net.core.somaxconn":  "4096",
+			"net.ipv4.ip_forward": "1",
+		}, arg.NoCache.HostConfig.Sysctls)
+	}).Once()
+
+	c.On("RunContainer", "456", false).Return(nil).Once()
+
+	state, err := cmd.Execute(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+	assert.Nil(t, state.NoCache.HostConfig.Sysctls)
+	assert.Equal(t, []string{`RUN --sysctl=net.core.somaxconn=1024,net.ipv4.ip_forward=1,net.core.somaxconn=4096 ["/bin/sh" "-c" "make test"]`}, state.Commits)
+}
+
+// The same command with other values of the flags should not hit the cache
+func TestCommandRun_FlagsCache(t *testing.T) {
+	tests := []struct {
+		flag, value, other string
+	}{
+		{"sysctl", "net.core.somaxconn=1024", "net.core.somaxconn=4096"},
+		{"security-opt", "apparmor=rocker-build", "apparmor=unconfined"},
+	}
+
+	for _, test := range tests {
+		b, c := makeBuild(t, "", Config{})
+		cmd := &CommandRun{ConfigCommand{
+			args:  []string{"make test"},
+			flags: map[string]string{test.flag: test.value},
+		}}
+
+		tmpDir := cacheTestTmpDir(t)
+		defer os.RemoveAll(tmpDir)
+
+		b.cache = NewCacheFS(tmpDir)
+		b.state.ImageID = "123"
+
+		for imageID, value := range map[string]string{"456": test.other, "789": test.value} {
+			s := State{ParentID: "123", ImageID: imageID}
+			s.Commit("RUN --%s=%s [\"/bin/sh\" \"-c\" \"make test\"]", test.flag, value)
+			if err := b.cache.Put(s); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		c.On("InspectImage", "789").Return(&docker.Image{ID: "789"}, nil).Once()
+
+		state, err := cmd.Execute(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c.AssertExpectations(t)
+		assert.Equal(t, "789", state.ImageID, test.flag)
+	}
+}
+
+func TestCommandRun_SecurityOpt(t *testing.T) {
+	tmpDir := makeTmpDir(t, map[string]string{
+		"seccomp.json": "{\n  \"defaultAction\": \"SCMP_ACT_ERRNO\"\n}\n",
+	})
+	defer os.RemoveAll(tmpDir)
+
+	b, c := makeBuild(t, "", Config{ContextDir: tmpDir, SecurityOpts: []string{"no-new-privileges"}})
+	cmd := &CommandRun{ConfigCommand{
+		args:  []string{"make test"},
+		flags: map[string]string{"security-opt": "seccomp=seccomp.json"},
+	}}
+
+	b.state.ImageID = "123"
+
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("456", nil).Run(func(args mock.Arguments) {
+		arg := args.Get(0).(State)
+		assert.Equal(t, []string{
+			"no-new-privileges",
+			`seccomp={"defaultAction":"SCMP_ACT_ERRNO"}`,
+		}, arg.NoCache.HostConfig.SecurityOpt)
+	}).Once()
+
+	c.On("RunContainer", "456", false).Return(nil).Once()
 
-	c.On("InspectImage", "not-existing").Return(nilImg, nil).Once()
-	c.On("ListImages").Return(nilList, nil).Once()
-	c.On("ListImageTags", "not-existing:latest").Return(nilList, nil).Once()
+	state, err := cmd.Execute(b)
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	_, err := cmd.Execute(b)
 	c.AssertExpectations(t)
-	assert.Equal(t, "FROM error: Image not found: not-existing:latest (also checked in the remote registry)", err.Error())
+	assert.Nil(t, state.NoCache.HostConfig.SecurityOpt)
+
+	// The content of the profile is a part of the cache key
+	sum := securityOptsKey([]string{`seccomp={"defaultAction":"SCMP_ACT_ERRNO"}`})
+	assert.Equal(t, []string{`RUN --security-opt=no-new-privileges,seccomp=seccomp.json@` + sum + ` ["/bin/sh" "-c" "make test"]`}, state.Commits)
 }
 
-// =========== Testing RUN ===========
+func TestCommandRun_SecurityOptInvalid(t *testing.T) {
+	tmpDir := makeTmpDir(t, map[string]string{
+		"seccomp.json": `{"defaultAction": `,
+	})
+	defer os.RemoveAll(tmpDir)
+
+	for value, expected := range map[string]string{
+		"seccomp=seccomp.json": "Seccomp profile seccomp.json is not valid JSON, error: unexpected end of JSON input",
+		"seccomp=missing.json": "Failed to read seccomp profile missing.json, error: open " + filepath.Join(tmpDir, "missing.json") + ": no such file or directory",
+		"=unconfined":          `Invalid --security-opt "=unconfined"`,
+	} {
+		b, _ := makeBuild(t, "", Config{ContextDir: tmpDir})
+		cmd := &CommandRun{ConfigCommand{
+			args:  []string{"make test"},
+			flags: map[string]string{"security-opt": value},
+		}}
+		b.state.ImageID = "123"
+
+		_, err := cmd.Execute(b)
+		assert.EqualError(t, err, expected)
+	}
+}
 
-func TestCommandRun_Simple(t *testing.T) {
+func TestCommandRun_SecurityOptAppArmor(t *testing.T) {
+	b, c := makeBuild(t, "", Config{SecurityOpts: []string{"apparmor=docker-default"}})
+	cmd := &CommandRun{ConfigCommand{
+		args:  []string{"make test"},
+		flags: map[string]string{"security-opt": "apparmor=rocker-build"},
+	}}
+
+	b.state.ImageID = "123"
+
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("456", nil).Run(func(args mock.Arguments) {
+		arg := args.Get(0).(State)
+		assert.Equal(t, []string{"apparmor=docker-default", "apparmor=rocker-build"}, arg.NoCache.HostConfig.SecurityOpt)
+	}).Once()
+
+	c.On("RunContainer", "456", false).Return(nil).Once()
+
+	state, err := cmd.Execute(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+	assert.Equal(t, []string{`RUN --security-opt=apparmor=docker-default,apparmor=rocker-build ["/bin/sh" "-c" "make test"]`}, state.Commits)
+
+	for _, value := range []string{"apparmor", "apparmor="} {
+		cmd.cfg.flags["security-opt"] = value
+		_, err := cmd.Execute(b)
+		assert.EqualError(t, err, fmt.Sprintf("Invalid --security-opt %q, expected apparmor=profile", value))
+	}
+}
+
+func TestCommandRun_SecurityOptUnconfined(t *testing.T) {
 	b, c := makeBuild(t, "", Config{})
 	cmd := &CommandRun{ConfigCommand{
-		args: []string{"whoami"},
+		args:  []string{"make test"},
+		flags: map[string]string{"security-opt": "seccomp=unconfined"},
 	}}
 
-	origCmd := []string{"/bin/program"}
-	b.state.Config.Cmd = origCmd
 	b.state.ImageID = "123"
 
 	c.On("CreateContainer", mock.AnythingOfType("State")).Return("456", nil).Run(func(args mock.Arguments) {
 		arg := args.Get(0).(State)
-		assert.Equal(t, []string{"/bin/sh", "-c", "whoami"}, arg.Config.Cmd)
+		assert.Equal(t, []string{"seccomp=unconfined"}, arg.NoCache.HostConfig.SecurityOpt)
 	}).Once()
 
 	c.On("RunContainer", "456", false).Return(nil).Once()
@@ -99,10 +939,7 @@ func TestCommandRun_Simple(t *testing.T) {
 	}
 
 	c.AssertExpectations(t)
-	assert.Equal(t, origCmd, b.state.Config.Cmd)
-	assert.Equal(t, origCmd, state.Config.Cmd)
-	assert.Equal(t, "123", state.ImageID)
-	assert.Equal(t, "456", state.NoCache.ContainerID)
+	assert.Equal(t, []string{`RUN --security-opt=seccomp=unconfined ["/bin/sh" "-c" "make test"]`}, state.Commits)
 }
 
 // =========== Testing COMMIT ===========
@@ -132,6 +969,38 @@ func TestCommandCommit_Simple(t *testing.T) {
 	assert.Equal(t, "", state.NoCache.ContainerID)
 }
 
+func TestCommandCommit_IncrementalNotCached(t *testing.T) {
+	b, c := makeBuild(t, "", Config{})
+	cmd := &CommandCommit{}
+
+	tmpDir := cacheTestTmpDir(t)
+	defer os.RemoveAll(tmpDir)
+
+	b.cache = NewCacheFS(tmpDir)
+	b.incrementalUpload = true
+	b.state.ImageID = "123"
+	b.state.NoCache.ContainerID = "456"
+	b.state.Commit("COPY abc to /app/")
+
+	c.On("CommitContainer", mock.AnythingOfType("State"), "COPY abc to /app/").Return(&docker.Image{ID: "789"}, nil).Once()
+	c.On("RemoveContainer", "456").Return(nil).Once()
+
+	if _, err := cmd.Execute(b); err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+	assert.False(t, b.incrementalUpload)
+
+	s := State{ImageID: "123"}
+	s.Commit("COPY abc to /app/")
+	cached, err := b.cache.Get(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, cached, "expected the image of the incremental upload not to be cached")
+}
+
 func TestCommandCommit_NoContainer(t *testing.T) {
 	b, c := makeBuild(t, "", Config{})
 	cmd := &CommandCommit{}
@@ -160,6 +1029,49 @@ func TestCommandCommit_NoContainer(t *testing.T) {
 	assert.Equal(t, "", state.NoCache.ContainerID)
 }
 
+func TestCommandCommit_EmptyLayer(t *testing.T) {
+	b, c := makeBuild(t, "", Config{EmptyLayers: true})
+	cmd := &CommandCommit{}
+
+	resultImage := &docker.Image{ID: "789"}
+	b.state.ImageID = "123"
+	b.state.Config.WorkingDir = "/app"
+	b.state.Config.Env = []string{"FOO=bar"}
+	b.state.Config.Volumes = map[string]struct{}{"/data": struct{}{}}
+	b.state.NoCache.HostConfig.Binds = []string{"/tmp:/tmp"}
+	b.state.Commit("ENV FOO=bar").Commit("WORKDIR /app")
+
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("456", nil).Run(func(args mock.Arguments) {
+		arg := args.Get(0).(State)
+		assert.Equal(t, "123", arg.ImageID)
+		assert.Equal(t, []string{"/bin/sh", "-c", "#(nop) ENV FOO=bar; WORKDIR /app"}, arg.Config.Cmd)
+		assert.Equal(t, "", arg.Config.WorkingDir)
+		assert.Empty(t, arg.Config.Env)
+		assert.Empty(t, arg.Config.Volumes)
+		assert.Empty(t, arg.NoCache.HostConfig.Binds)
+	}).Once()
+
+	c.On("CommitContainer", mock.AnythingOfType("State"), "ENV FOO=bar; WORKDIR /app").Return(resultImage, nil).Run(func(args mock.Arguments) {
+		arg := args.Get(0).(State)
+		assert.Equal(t, "456", arg.NoCache.ContainerID)
+		assert.Equal(t, "/app", arg.Config.WorkingDir)
+		assert.Equal(t, []string{"FOO=bar"}, arg.Config.Env)
+		assert.Equal(t, []string(nil), arg.Config.Cmd)
+	}).Once()
+
+	c.On("RemoveContainer", "456").Return(nil).Once()
+
+	state, err := cmd.Execute(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+	c.AssertNotCalled(t, "RunContainer", "456", false)
+	assert.Equal(t, "789", state.ImageID)
+	assert.Equal(t, "/app", state.Config.WorkingDir)
+}
+
 func TestCommandCommit_NoCommitMsgs(t *testing.T) {
 	b, _ := makeBuild(t, "", Config{})
 	cmd := &CommandCommit{}
@@ -256,6 +1168,62 @@ func TestCommandLabel_Advanced(t *testing.T) {
 	assert.True(t, reflect.DeepEqual(state.Config.Labels, expectedLabels), "bad result labels")
 }
 
+// =========== Testing CONFIG ===========
+
+func TestCommandConfig_Simple(t *testing.T) {
+	b, _ := makeBuild(t, "", Config{})
+	cmd := &CommandConfig{ConfigCommand{
+		args: []string{`{"Hostname": "web", "Labels": {"env": "prod"}, "OnBuild": ["RUN make"]}`},
+	}}
+
+	b.state.Config.User = "app"
+	b.state.Config.Labels = map[string]string{"version": "1.2.3"}
+
+	state, err := cmd.Execute(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, `CONFIG {"Hostname":"web","Labels":{"env":"prod"},"OnBuild":["RUN make"]}`, state.GetCommits())
+	assert.Equal(t, "web", state.Config.Hostname)
+	assert.Equal(t, "app", state.Config.User)
+	assert.Equal(t, []string{"RUN make"}, state.Config.OnBuild)
+	// Maps are merged like encoding/json does, keys of the blob are added
+	assert.Equal(t, map[string]string{"version": "1.2.3", "env": "prod"}, state.Config.Labels)
+	assert.Equal(t, map[string]string{"version": "1.2.3"}, b.state.Config.Labels, "expected the previous state to stay intact")
+}
+
+func TestCommandConfig_UnknownField(t *testing.T) {
+	b, _ := makeBuild(t, "", Config{})
+	cmd := &CommandConfig{ConfigCommand{
+		args: []string{`{"User": "app", "Platform": "linux"}`},
+	}}
+
+	_, err := cmd.Execute(b)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), `CONFIG has unknown field "Platform"`)
+	}
+}
+
+func TestCommandConfig_Healthcheck(t *testing.T) {
+	b, _ := makeBuild(t, "", Config{})
+	cmd := &CommandConfig{ConfigCommand{
+		args: []string{`{"Healthcheck": {"Test": ["CMD", "true"], "Interval": 5000000000}, "Shell": ["/bin/bash", "-c"], "StopSignal": "SIGINT"}`},
+	}}
+
+	state, err := cmd.Execute(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if assert.NotNil(t, state.Config.Healthcheck) {
+		assert.Equal(t, []string{"CMD", "true"}, state.Config.Healthcheck.Test)
+		assert.Equal(t, 5*time.Second, state.Config.Healthcheck.Interval)
+	}
+	assert.Equal(t, []string{"/bin/bash", "-c"}, state.Config.Shell)
+	assert.Equal(t, "SIGINT", state.Config.StopSignal)
+}
+
 // =========== Testing MAINTAINER ===========
 
 func TestCommandMaintainer_Simple(t *testing.T) {
@@ -603,7 +1571,7 @@ func TestCommandPush_Simple(t *testing.T) {
 	b.state.ImageID = "123"
 
 	c.On("TagImage", "123", "docker.io/grammarly/rocker:1.0").Return(nil).Once()
-	c.On("PushImage", "docker.io/grammarly/rocker:1.0").Return("sha256:fafa", nil).Once()
+	c.On("PushImage", "docker.io/grammarly/rocker:1.0").Return("sha256:fafa", PushStats{}, nil).Once()
 
 	_, err := cmd.Execute(b)
 	if err != nil {
@@ -613,6 +1581,43 @@ func TestCommandPush_Simple(t *testing.T) {
 	c.AssertExpectations(t)
 }
 
+func TestCommandPush_Verify(t *testing.T) {
+	b, c := makeBuild(t, "", Config{Push: true, VerifyPush: true})
+	cmd := &CommandPush{ConfigCommand{
+		args: []string{"docker.io/grammarly/rocker:1.0"},
+	}}
+
+	b.state.ImageID = "123"
+
+	c.On("TagImage", "123", "docker.io/grammarly/rocker:1.0").Return(nil).Once()
+	c.On("PushImage", "docker.io/grammarly/rocker:1.0").Return("sha256:fafa", PushStats{}, nil).Once()
+	c.On("PullImage", "docker.io/grammarly/rocker@sha256:fafa").Return(nil).Once()
+
+	if _, err := cmd.Execute(b); err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+}
+
+func TestCommandPush_VerifyFailed(t *testing.T) {
+	b, c := makeBuild(t, "", Config{Push: true, VerifyPush: true})
+	cmd := &CommandPush{ConfigCommand{
+		args: []string{"docker.io/grammarly/rocker:1.0"},
+	}}
+
+	b.state.ImageID = "123"
+
+	c.On("TagImage", "123", "docker.io/grammarly/rocker:1.0").Return(nil).Once()
+	c.On("PushImage", "docker.io/grammarly/rocker:1.0").Return("", PushStats{}, nil).Once()
+	c.On("PullImage", "docker.io/grammarly/rocker:1.0").Return(fmt.Errorf("manifest unknown")).Once()
+
+	_, err := cmd.Execute(b)
+
+	c.AssertExpectations(t)
+	assert.EqualError(t, err, "Failed to verify the push of docker.io/grammarly/rocker:1.0, the image cannot be pulled from the registry, error: manifest unknown")
+}
+
 func TestCommandPush_WrongArgsNumber(t *testing.T) {
 	b, _ := makeBuild(t, "", Config{})
 	cmd := &CommandPush{ConfigCommand{
@@ -643,6 +1648,21 @@ func TestCommandPush_NoImage(t *testing.T) {
 
 // =========== Testing MOUNT ===========
 
+// makeMountSources makes a context directory with the given subdirectories
+func makeMountSources(t *testing.T, dirs ...string) (string, func()) {
+	tmpDir, err := ioutil.TempDir("", "rocker-mount-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range dirs {
+		if err := os.MkdirAll(filepath.Join(tmpDir, dir), 0755); err != nil {
+			os.RemoveAll(tmpDir)
+			t.Fatal(err)
+		}
+	}
+	return tmpDir, func() { os.RemoveAll(tmpDir) }
+}
+
 func TestCommandMount_Simple(t *testing.T) {
 	b, c := makeBuild(t, "", Config{})
 	cmd := &CommandMount{ConfigCommand{
@@ -661,6 +1681,144 @@ func TestCommandMount_Simple(t *testing.T) {
 	assert.Equal(t, `MOUNT ["/src:/dest"]`, state.GetCommits())
 }
 
+func TestCommandMount_RelativeSource(t *testing.T) {
+	tmpDir, rm := makeMountSources(t, "src")
+	defer rm()
+
+	b, c := makeBuild(t, "", Config{ContextDir: tmpDir, LocalDaemon: true})
+	cmd := &CommandMount{ConfigCommand{
+		args: []string{"src:/dest"},
+	}}
+
+	c.On("ResolveHostPath", tmpDir+"/src").Return("/resolved/src", nil).Once()
+
+	state, err := cmd.Execute(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+	assert.Equal(t, []string{"/resolved/src:/dest"}, state.NoCache.HostConfig.Binds)
+	assert.Equal(t, `MOUNT ["src:/dest"]`, state.GetCommits())
+}
+
+func TestCommandMount_Normalize(t *testing.T) {
+	tmpDir, rm := makeMountSources(t, "src", "lib")
+	defer rm()
+
+	b, c := makeBuild(t, "", Config{ContextDir: tmpDir, LocalDaemon: true})
+	cmd := &CommandMount{ConfigCommand{
+		args: []string{"src/:/dest/:ro", tmpDir + "/lib:/dest2"},
+	}}
+
+	c.On("ResolveHostPath", tmpDir+"/src").Return("/resolved/src", nil).Once()
+	c.On("ResolveHostPath", tmpDir+"/lib").Return("/resolved/lib", nil).Once()
+
+	state, err := cmd.Execute(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+	assert.Equal(t, []string{"/resolved/src:/dest:ro", "/resolved/lib:/dest2"}, state.NoCache.HostConfig.Binds)
+	assert.Equal(t, fmt.Sprintf(`MOUNT ["src/:/dest:ro" "%s/lib:/dest2"]`, tmpDir), state.GetCommits())
+}
+
+func TestCommandMount_BindMissing(t *testing.T) {
+	tmpDir, rm := makeMountSources(t)
+	defer rm()
+
+	b, _ := makeBuild(t, "", Config{ContextDir: tmpDir, LocalDaemon: true})
+	cmd := &CommandMount{ConfigCommand{
+		args: []string{"deps:/deps"},
+	}}
+
+	_, err := cmd.Execute(b)
+	assert.EqualError(t, err, fmt.Sprintf("MOUNT source %s/deps does not exist", tmpDir))
+}
+
+func TestCommandMount_BindMissingRemote(t *testing.T) {
+	tmpDir, rm := makeMountSources(t)
+	defer rm()
+
+	b, c := makeBuild(t, "", Config{ContextDir: tmpDir})
+	cmd := &CommandMount{ConfigCommand{
+		args: []string{"deps:/deps"},
+	}}
+
+	// The path is on the host of the daemon, it is not there to check
+	c.On("ResolveHostPath", tmpDir+"/deps").Return(tmpDir+"/deps", nil).Once()
+
+	state, err := cmd.Execute(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+	assert.Equal(t, []string{tmpDir + "/deps:/deps"}, state.NoCache.HostConfig.Binds)
+}
+
+func TestBuild_MountBind(t *testing.T) {
+	tmpDir, rm := makeMountSources(t, "deps")
+	defer rm()
+
+	rockerfile := fmt.Sprintf(`FROM ubuntu
+MOUNT %s/deps:/deps
+RUN make`, tmpDir)
+	b, c := makeBuild(t, rockerfile, Config{LocalDaemon: true})
+	plan := makePlan(t, rockerfile)
+
+	c.On("InspectImage", "ubuntu").Return(&docker.Image{ID: "123", Config: &docker.Config{}}, nil).Once()
+	c.On("ResolveHostPath", tmpDir+"/deps").Return("/host/deps", nil).Once()
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("456", nil).Run(func(args mock.Arguments) {
+		assert.Equal(t, []string{"/host/deps:/deps"}, args.Get(0).(State).NoCache.HostConfig.Binds)
+	}).Once()
+	c.On("RunContainer", "456", false).Return(nil).Once()
+	c.On("CommitContainer", mock.AnythingOfType("State"), mock.AnythingOfType("string")).Return(&docker.Image{ID: "789"}, nil).Run(func(args mock.Arguments) {
+		// The bind is neither a volume nor a part of the committed config
+		config := args.Get(0).(State).Config
+		assert.Empty(t, config.Volumes)
+		assert.NotContains(t, fmt.Sprintf("%v", config), "/deps")
+	}).Once()
+	c.On("RemoveContainer", "456").Return(nil).Once()
+
+	if err := b.Run(plan); err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+}
+
+func TestCommandMount_Invalid(t *testing.T) {
+	tests := []struct {
+		args []string
+		err  string
+	}{
+		{[]string{"cache"}, `MOUNT requires absolute paths in the container, got "cache"`},
+		{[]string{"/src:dest"}, `MOUNT requires absolute paths in the container, got "dest"`},
+		{[]string{"/cache", "/src:/cache/"}, "MOUNT paths /cache and /cache overlap"},
+		{[]string{"/src:/app", "/data:/app/data"}, "MOUNT paths /app and /app/data overlap"},
+		{[]string{"/go/pkg", "/go"}, "MOUNT paths /go/pkg and /go overlap"},
+		{[]string{"/src:/"}, ""},
+		{[]string{"/app", "/application"}, ""},
+	}
+
+	for _, test := range tests {
+		_, err := normalizeMounts(test.args)
+		if test.err == "" {
+			assert.NoError(t, err, "%q", test.args)
+		} else {
+			assert.EqualError(t, err, test.err, "%q", test.args)
+		}
+
+		// The same is checked by ValidateCommand
+		err = ValidateCommand(ConfigCommand{name: "mount", args: test.args})
+		if test.err != "" {
+			assert.EqualError(t, err, test.err, "%q", test.args)
+		}
+	}
+}
+
 func TestCommandMount_VolumeContainer(t *testing.T) {
 	b, c := makeBuild(t, "", Config{})
 	cmd := &CommandMount{ConfigCommand{
@@ -702,4 +1860,104 @@ func TestCommandMount_VolumeContainer(t *testing.T) {
 	assert.Equal(t, commitMsg, state.GetCommits())
 }
 
+func TestCommandMount_NoReuse(t *testing.T) {
+	tests := []struct {
+		global bool
+		flags  map[string]string
+		reuse  bool
+	}{
+		{false, nil, true},
+		{false, map[string]string{"no-reuse": ""}, false},
+		{false, map[string]string{"no-reuse": "false"}, true},
+		{true, nil, false},
+		{true, map[string]string{"no-reuse": "false"}, true},
+	}
+
+	for _, test := range tests {
+		b, c := makeBuild(t, "", Config{NoReuse: test.global})
+		cmd := &CommandMount{ConfigCommand{
+			args:  []string{"/cache"},
+			flags: test.flags,
+		}}
+
+		reused := b.mountsContainerName("/cache")
+		name := reused
+		if !test.reuse {
+			name = b.freshMountsContainerName("/cache")
+			assert.NotEqual(t, reused, name)
+		}
+
+		c.On("EnsureContainer", name, mock.AnythingOfType("*docker.Config"), "/cache").Return("123", nil).Once()
+		c.On("InspectContainer", name).Return(&docker.Container{
+			Name:   "/" + name,
+			Mounts: []docker.Mount{{Source: "/volumedir", Destination: "/cache"}},
+		}, nil).Once()
+
+		state, err := cmd.Execute(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The cache key of the step does not depend on the reuse
+		assert.Equal(t, fmt.Sprintf("MOUNT [\"%s:/cache\"]", reused), state.GetCommits())
+
+		if test.reuse {
+			assert.Empty(t, b.freshMounts)
+		} else {
+			assert.Equal(t, []string{name}, b.freshMounts)
+			c.On("RemoveContainer", name).Return(nil).Once()
+			b.removeFreshMounts()
+			assert.Empty(t, b.freshMounts)
+		}
+
+		c.AssertExpectations(t)
+	}
+}
+
+func TestCommandMount_NoReuseInvalid(t *testing.T) {
+	b, _ := makeBuild(t, "", Config{})
+	cmd := &CommandMount{ConfigCommand{
+		args:  []string{"/cache"},
+		flags: map[string]string{"no-reuse": "yes"},
+	}}
+
+	_, err := cmd.Execute(b)
+	assert.EqualError(t, err, `MOUNT --no-reuse takes true or false, got "yes"`)
+}
+
+func TestBuild_MountNoReuse(t *testing.T) {
+	rockerfile := `FROM ubuntu
+MOUNT /cache
+MOUNT --no-reuse /build
+RUN make`
+	b, c := makeBuild(t, rockerfile, Config{})
+	plan := makePlan(t, rockerfile)
+
+	reused := b.mountsContainerName("/cache")
+	fresh := b.freshMountsContainerName("/build")
+
+	c.On("InspectImage", "ubuntu").Return(&docker.Image{ID: "123", Config: &docker.Config{}}, nil).Once()
+	for name, path := range map[string]string{reused: "/cache", fresh: "/build"} {
+		c.On("EnsureContainer", name, mock.AnythingOfType("*docker.Config"), path).Return("", nil).Once()
+		c.On("InspectContainer", name).Return(&docker.Container{
+			Name:   "/" + name,
+			Mounts: []docker.Mount{{Source: "/volumedir" + path, Destination: path}},
+		}, nil).Once()
+	}
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("456", nil).Run(func(args mock.Arguments) {
+		assert.Equal(t, []string{"/volumedir/cache:/cache:ro", "/volumedir/build:/build:ro"}, args.Get(0).(State).NoCache.HostConfig.Binds)
+	}).Once()
+	c.On("RunContainer", "456", false).Return(nil).Once()
+	c.On("CommitContainer", mock.AnythingOfType("State"), mock.AnythingOfType("string")).Return(&docker.Image{ID: "789"}, nil).Once()
+	c.On("RemoveContainer", "456").Return(nil).Once()
+	// Only the fresh volume is removed after the build
+	c.On("RemoveContainer", fresh).Return(nil).Once()
+
+	if err := b.Run(plan); err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+}
+
 // TODO: test Cleanup
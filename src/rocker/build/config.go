@@ -0,0 +1,86 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/pkg/units"
+)
+
+// Set sets the field of the config by its name, the value is converted to
+// the type of the field; only the fields of bool, string, integer, duration
+// and string list types can be set. Durations take values like 90s, int64
+// fields are sizes and take values like 512MB, lists take comma separated values
+func (cfg *Config) Set(name, value string) error {
+	v := reflect.ValueOf(cfg).Elem()
+
+	field, ok := v.Type().FieldByNameFunc(func(n string) bool {
+		return strings.EqualFold(n, name)
+	})
+	if !ok {
+		return fmt.Errorf("Config has no field %q", name)
+	}
+
+	f := v.FieldByIndex(field.Index)
+
+	switch kind := field.Type.Kind(); {
+	case field.Type == reflect.TypeOf(time.Duration(0)):
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("Bad value %q of %s, expected duration like 90s", value, field.Name)
+		}
+		f.SetInt(int64(d))
+	case kind == reflect.Int64:
+		n, err := units.FromHumanSize(value)
+		if err != nil {
+			return fmt.Errorf("Bad value %q of %s, expected size like 512MB", value, field.Name)
+		}
+		f.SetInt(n)
+	case kind == reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("Bad value %q of %s, expected true or false", value, field.Name)
+		}
+		f.SetBool(b)
+	case kind == reflect.String:
+		f.SetString(value)
+	case kind == reflect.Int, kind == reflect.Int8, kind == reflect.Int16, kind == reflect.Int32:
+		n, err := strconv.ParseInt(value, 10, field.Type.Bits())
+		if err != nil {
+			return fmt.Errorf("Bad value %q of %s, expected integer", value, field.Name)
+		}
+		f.SetInt(n)
+	case kind == reflect.Slice:
+		if field.Type.Elem().Kind() != reflect.String {
+			return fmt.Errorf("Config field %s of type %s cannot be set", field.Name, field.Type)
+		}
+		list := []string{}
+		if value != "" {
+			list = strings.Split(value, ",")
+		}
+		f.Set(reflect.ValueOf(list))
+	default:
+		return fmt.Errorf("Config field %s of type %s cannot be set", field.Name, field.Type)
+	}
+
+	return nil
+}
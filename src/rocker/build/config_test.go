@@ -0,0 +1,69 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfig_Set(t *testing.T) {
+	cfg := Config{}
+
+	for name, value := range map[string]string{
+		"NoGarbage":     "true",
+		"pull":          "1",
+		"ID":            "app",
+		"UploadRetries": "5",
+		"CapAdd":        "NET_ADMIN,SYS_TIME",
+		"MaxSize":       "512MB",
+	} {
+		if err := cfg.Set(name, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	assert.True(t, cfg.NoGarbage)
+	assert.True(t, cfg.Pull)
+	assert.Equal(t, "app", cfg.ID)
+	assert.Equal(t, 5, cfg.UploadRetries)
+	assert.Equal(t, []string{"NET_ADMIN", "SYS_TIME"}, cfg.CapAdd)
+	assert.EqualValues(t, 512*1000*1000, cfg.MaxSize)
+}
+
+func TestConfig_SetErrors(t *testing.T) {
+	cfg := Config{}
+
+	tests := []struct {
+		name, value, err string
+	}{
+		{"NoSuchField", "true", `Config has no field "NoSuchField"`},
+		{"Pull", "yes please", "expected true or false"},
+		{"UploadRetries", "five", "expected integer"},
+		{"MaxSize", "lots", "expected size"},
+		{"OutStream", "stdout", "cannot be set"},
+		{"SourceDateEpoch", "0", "cannot be set"},
+	}
+
+	for _, test := range tests {
+		err := cfg.Set(test.name, test.value)
+		if assert.Error(t, err, test.name) {
+			assert.Contains(t, err.Error(), test.err, test.name)
+		}
+	}
+}
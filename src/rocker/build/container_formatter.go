@@ -24,15 +24,18 @@ import (
 
 type formatter struct {
 	containerID string
+	stream      string
 	level       log.Level
 	delegate    log.Formatter
 }
 
 // NewContainerFormatter returns an object that is given to logrus to better format
-// contaienr output
-func NewContainerFormatter(containerID string, level log.Level) log.Formatter {
+// contaienr output; stream is the name of the container stream to mark the lines
+// with, e.g. "stdout", or empty when the streams are merged
+func NewContainerFormatter(containerID, stream string, level log.Level) log.Formatter {
 	return &formatter{
 		containerID: containerID,
+		stream:      stream,
 		level:       level,
 		delegate:    log.StandardLogger().Formatter,
 	}
@@ -40,9 +43,13 @@ func NewContainerFormatter(containerID string, level log.Level) log.Formatter {
 
 // Format formats a message from container
 func (f *formatter) Format(entry *log.Entry) ([]byte, error) {
-	e := entry.WithFields(log.Fields{
+	fields := log.Fields{
 		"container": fmt.Sprintf("%.12s", f.containerID),
-	})
+	}
+	if f.stream != "" {
+		fields["stream"] = f.stream
+	}
+	e := entry.WithFields(fields)
 	e.Message = entry.Message
 	e.Level = f.level
 	return f.delegate.Format(e)
@@ -0,0 +1,92 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// ValidateContextDir checks that the build context directory exists and is
+// a directory, so we can fail early with a clear message
+func ValidateContextDir(contextDir string) error {
+	info, err := os.Stat(contextDir)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("Context directory %s does not exist", contextDir)
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to check context directory %s, error: %s", contextDir, err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("Context directory %s is not a directory", contextDir)
+	}
+	return nil
+}
+
+// ContextChecksum calculates a deterministic checksum of the effective build
+// context and the rendered Rockerfile. Only files that are left after applying
+// .dockerignore patterns are taken into account; both their relative paths
+// and contents go to the checksum, so renaming a file changes it as well.
+func ContextChecksum(contextDir string, excludes []string, rockerfile *Rockerfile) (string, error) {
+	files, err := listFiles(contextDir, []string{"."}, excludes)
+	if err != nil {
+		return "", err
+	}
+
+	sort.Sort(uploadFilesByPath(files))
+
+	h := sha256.New()
+
+	if err := hashFiles(h, files); err != nil {
+		return "", err
+	}
+
+	if rockerfile != nil {
+		io.WriteString(h, rockerfile.Content)
+	}
+
+	return fmt.Sprintf("sha256:%x", h.Sum(nil)), nil
+}
+
+// hashFiles writes the relative paths, sizes and contents of the files to
+// the hash, in the given order
+func hashFiles(h io.Writer, files []*uploadFile) error {
+	for _, f := range files {
+		fmt.Fprintf(h, "%s\x00%d\x00", f.relDest, f.size)
+
+		fd, err := os.Open(f.src)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(h, fd)
+		fd.Close()
+		if err != nil {
+			return fmt.Errorf("Failed to read file %s for the checksum, error: %s", f.src, err)
+		}
+	}
+	return nil
+}
+
+// uploadFilesByPath sorts the list of files by their path relative to the context
+type uploadFilesByPath []*uploadFile
+
+func (f uploadFilesByPath) Len() int           { return len(f) }
+func (f uploadFilesByPath) Less(i, j int) bool { return f[i].relDest < f[j].relDest }
+func (f uploadFilesByPath) Swap(i, j int)      { f[i], f[j] = f[j], f[i] }
@@ -0,0 +1,146 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"rocker/template"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestContextChecksum_Identical(t *testing.T) {
+	files := map[string]string{
+		"a/test.txt": "hello",
+		"b/1.txt":    "hello",
+		"c.txt":      "world",
+	}
+
+	tmpDir1 := makeTmpDir(t, files)
+	defer os.RemoveAll(tmpDir1)
+
+	tmpDir2 := makeTmpDir(t, files)
+	defer os.RemoveAll(tmpDir2)
+
+	r := makeChecksumRockerfile(t, "FROM ubuntu")
+
+	sum1, err := ContextChecksum(tmpDir1, []string{}, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum2, err := ContextChecksum(tmpDir2, []string{}, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.True(t, strings.HasPrefix(sum1, "sha256:"))
+	assert.Equal(t, sum1, sum2)
+}
+
+func TestContextChecksum_Changed(t *testing.T) {
+	tmpDir := makeTmpDir(t, map[string]string{
+		"a/test.txt": "hello",
+		"b/1.txt":    "hello",
+	})
+	defer os.RemoveAll(tmpDir)
+
+	r := makeChecksumRockerfile(t, "FROM ubuntu")
+
+	sum1, err := ContextChecksum(tmpDir, []string{}, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(tmpDir, "b/1.txt"), []byte("hello!"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	sum2, err := ContextChecksum(tmpDir, []string{}, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.NotEqual(t, sum1, sum2)
+
+	// Rockerfile is also a part of the checksum
+	sum3, err := ContextChecksum(tmpDir, []string{}, makeChecksumRockerfile(t, "FROM alpine"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.NotEqual(t, sum2, sum3)
+}
+
+func TestContextChecksum_Excludes(t *testing.T) {
+	tmpDir := makeTmpDir(t, map[string]string{
+		"a/test.txt": "hello",
+		"b/1.txt":    "hello",
+	})
+	defer os.RemoveAll(tmpDir)
+
+	excludes := []string{"b"}
+
+	sum1, err := ContextChecksum(tmpDir, excludes, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(tmpDir, "b/1.txt"), []byte("hello!"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	sum2, err := ContextChecksum(tmpDir, excludes, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, sum1, sum2)
+}
+
+func TestValidateContextDir(t *testing.T) {
+	tmpDir := makeTmpDir(t, map[string]string{
+		"file.txt": "hello",
+	})
+	defer os.RemoveAll(tmpDir)
+
+	assert.NoError(t, ValidateContextDir(tmpDir))
+
+	missing := filepath.Join(tmpDir, "missing")
+	err := ValidateContextDir(missing)
+	if assert.Error(t, err) {
+		assert.Equal(t, "Context directory "+missing+" does not exist", err.Error())
+	}
+
+	file := filepath.Join(tmpDir, "file.txt")
+	err = ValidateContextDir(file)
+	if assert.Error(t, err) {
+		assert.Equal(t, "Context directory "+file+" is not a directory", err.Error())
+	}
+}
+
+func makeChecksumRockerfile(t *testing.T, content string) *Rockerfile {
+	r, err := NewRockerfile("Rockerfile", strings.NewReader(content), template.Vars{}, template.Funs{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
@@ -52,6 +52,12 @@ type uploadFile struct {
 }
 
 func copyFiles(b *Build, args []string, cmdName string) (s State, err error) {
+	return copyFilesFrom(b, b.cfg.ContextDir, b.state.NoCache.Dockerignore, args, cmdName)
+}
+
+// copyFilesFrom copies files from the given directory to the image, sources
+// are taken relative to contextDir and filtered by excludes patterns
+func copyFilesFrom(b *Build, contextDir string, excludes []string, args []string, cmdName string) (s State, err error) {
 
 	s = b.state
 
@@ -60,17 +66,23 @@ func copyFiles(b *Build, args []string, cmdName string) (s State, err error) {
 	}
 
 	var (
-		tarSum   tarsum.TarSum
-		src      = args[0 : len(args)-1]
-		dest     = filepath.FromSlash(args[len(args)-1]) // last one is always the dest
-		u        *upload
-		excludes = s.NoCache.Dockerignore
+		tarSum tarsum.TarSum
+		src    = args[0 : len(args)-1]
+		dest   = filepath.FromSlash(args[len(args)-1]) // last one is always the dest
+		u      *upload
 	)
 
-	// If destination is not a directory (no leading slash)
+	// If destination is not a directory (no leading slash), there should be
+	// a single source, either given explicitly or matched by a wildcard
 	hasLeadingSlash := strings.HasSuffix(dest, string(os.PathSeparator))
-	if !hasLeadingSlash && len(src) > 1 {
-		return s, fmt.Errorf("When using %s with more than one source file, the destination must be a directory and end with a /", cmdName)
+	if !hasLeadingSlash {
+		n, err := countSources(contextDir, src, excludes)
+		if err != nil {
+			return s, err
+		}
+		if n > 1 {
+			return s, fmt.Errorf("When using %s with more than one source file, the destination must be a directory and end with a /", cmdName)
+		}
 	}
 
 	if !filepath.IsAbs(dest) {
@@ -81,7 +93,7 @@ func copyFiles(b *Build, args []string, cmdName string) (s State, err error) {
 		}
 	}
 
-	if u, err = makeTarStream(b.cfg.ContextDir, dest, cmdName, src, excludes); err != nil {
+	if u, err = makeTarStream(contextDir, dest, cmdName, src, excludes); err != nil {
 		return s, err
 	}
 
@@ -111,35 +123,180 @@ func copyFiles(b *Build, args []string, cmdName string) (s State, err error) {
 	if err != nil {
 		return s, err
 	}
+
+	if b.cfg.ManifestPath != "" {
+		// The image ID is known already if cached, otherwise it is set on commit
+		imageID := ""
+		if hit {
+			imageID = s.ImageID
+		}
+		if err := b.addManifestStep(cmdName+" "+strings.Join(args, " "), u, imageID); err != nil {
+			return s, err
+		}
+	}
+
+	key := incrementalKey(b.state.ImageID, contextDir+" "+cmdName+" "+strings.Join(args, " "))
+
 	if hit {
+		if b.cfg.Incremental != nil {
+			if _, err := b.cfg.Incremental.record(key, u, s.ImageID); err != nil {
+				return s, err
+			}
+		}
 		return s, nil
 	}
 
-	origCmd := s.Config.Cmd
-	s.Config.Cmd = []string{"/bin/sh", "-c", "#(nop) " + message}
+	// The container is made of the state, unless we upload
+	// incrementally on top of the previous image of the step
+	base := s
+	incremental := false
 
-	if s.NoCache.ContainerID, err = b.client.CreateContainer(s); err != nil {
+	if b.cfg.Incremental != nil {
+		if u, err = prepareUpload(contextDir, dest, cmdName, src, excludes); err != nil {
+			return s, err
+		}
+
+		if prev, changed, ok := b.cfg.Incremental.delta(key, u); ok {
+			if img, err := b.client.InspectImage(prev.ImageID); err == nil && img != nil {
+				log.Infof("| Uploading %d changed of %d files on top of %.12s", len(changed), len(u.files), prev.ImageID)
+				base.ImageID = prev.ImageID
+				u.files = changed
+				incremental = true
+			}
+		}
+
+		// The step is recorded by whole uploads only, so that the next
+		// changes go on top of the same image
+		if !incremental {
+			step, err := b.cfg.Incremental.record(key, u, "")
+			if err != nil {
+				return s, err
+			}
+			b.incremental = append(b.incremental, step)
+		}
+		b.incrementalUpload = incremental
+	}
+
+	base.Config.Cmd = []string{"/bin/sh", "-c", "#(nop) " + message}
+
+	if s.NoCache.ContainerID, err = b.client.CreateContainer(base); err != nil {
 		return s, err
 	}
 
-	s.Config.Cmd = origCmd
+	if incremental {
+		if len(u.files) == 0 {
+			return s, nil
+		}
+		if b.cfg.UploadChunkSize > 0 {
+			return s, uploadChunks(b.client, s.NoCache.ContainerID, u, b.cfg.UploadChunkSize, b.cfg.UploadRetries)
+		}
+		tar := writeTar(u.files, u.dest)
+		defer tar.Close()
+		return s, b.client.UploadToContainer(s.NoCache.ContainerID, tar, "/")
+	}
+
+	if b.cfg.UploadChunkSize > 0 {
+		if u, err = prepareUpload(contextDir, dest, cmdName, src, excludes); err != nil {
+			return s, err
+		}
+		return s, uploadChunks(b.client, s.NoCache.ContainerID, u, b.cfg.UploadChunkSize, b.cfg.UploadRetries)
+	}
 
 	// We need to make a new tar stream, because the previous one has been
 	// read by the tarsum; maybe, optimize this in future
-	if u, err = makeTarStream(b.cfg.ContextDir, dest, cmdName, src, excludes); err != nil {
+	if u, err = makeTarStream(contextDir, dest, cmdName, src, excludes); err != nil {
 		return s, err
 	}
 
+	var stream io.Reader = u.tar
+
+	// Report progress of large uploads, so it does not look like we hang
+	if u.size >= uploadProgressMinSize {
+		stream = newProgressReader(u.tar, u.size, log.StandardLogger())
+	}
+
 	// Copy to "/" because we made the prefix inside the tar archive
 	// Do that because we are not able to reliably create directories inside the container
-	if err = b.client.UploadToContainer(s.NoCache.ContainerID, u.tar, "/"); err != nil {
+	if err = b.client.UploadToContainer(s.NoCache.ContainerID, stream, "/"); err != nil {
 		return s, err
 	}
 
 	return s, nil
 }
 
+// uploadChunks uploads files to the container by chunks of about chunkSize
+// bytes each, every chunk is a separate tar archive. A failed chunk is retried
+// up to the given number of times, chunks that are already uploaded are not
+// sent again. A single file larger than chunkSize makes a chunk of its own.
+func uploadChunks(client Client, containerID string, u *upload, chunkSize int64, retries int) (err error) {
+	chunks := chunkFiles(u.files, chunkSize)
+
+	for i, chunk := range chunks {
+		var size int64
+		for _, f := range chunk {
+			size += f.size
+		}
+
+		log.Infof("| Uploading chunk %d/%d (%d files, %s)", i+1, len(chunks), len(chunk), units.HumanSize(float64(size)))
+
+		for attempt := 0; attempt <= retries; attempt++ {
+			if attempt > 0 {
+				log.Warnf("| Failed to upload chunk %d/%d, retry %d of %d, error: %s", i+1, len(chunks), attempt, retries, err)
+			}
+
+			tar := writeTar(chunk, u.dest)
+			err = client.UploadToContainer(containerID, tar, "/")
+			tar.Close()
+
+			if err == nil {
+				break
+			}
+		}
+
+		if err != nil {
+			return fmt.Errorf("Failed to upload chunk %d/%d, error: %s", i+1, len(chunks), err)
+		}
+	}
+
+	return nil
+}
+
+// chunkFiles splits the list of files into the groups of about chunkSize bytes
+func chunkFiles(files []*uploadFile, chunkSize int64) (chunks [][]*uploadFile) {
+	var (
+		chunk []*uploadFile
+		size  int64
+	)
+
+	for _, f := range files {
+		if len(chunk) > 0 && size+f.size > chunkSize {
+			chunks = append(chunks, chunk)
+			chunk, size = nil, 0
+		}
+		chunk = append(chunk, f)
+		size += f.size
+	}
+
+	if len(chunk) > 0 {
+		chunks = append(chunks, chunk)
+	}
+
+	return chunks
+}
+
 func makeTarStream(srcPath, dest, cmdName string, includes, excludes []string) (u *upload, err error) {
+	if u, err = prepareUpload(srcPath, dest, cmdName, includes, excludes); err != nil || len(u.files) == 0 {
+		return u, err
+	}
+
+	u.tar = writeTar(u.files, u.dest)
+
+	return u, nil
+}
+
+// prepareUpload lists the files to upload and calculates their destinations
+// inside the tar archive, but does not make the archive itself
+func prepareUpload(srcPath, dest, cmdName string, includes, excludes []string) (u *upload, err error) {
 
 	u = &upload{
 		src:  srcPath,
@@ -218,8 +375,14 @@ func makeTarStream(srcPath, dest, cmdName string, includes, excludes []string) (
 
 	log.Debugf("Making archive prefix=%s %# v", u.dest, pretty.Formatter(u))
 
+	return u, nil
+}
+
+// writeTar starts writing the given files into a tar stream
+// in the background and returns the reading end of it; the errors
+// of writing are returned by the reads of the stream
+func writeTar(files []*uploadFile, prefix string) io.ReadCloser {
 	pipeReader, pipeWriter := io.Pipe()
-	u.tar = pipeReader
 
 	go func() {
 		ta := &tarAppender{
@@ -228,22 +391,61 @@ func makeTarStream(srcPath, dest, cmdName string, includes, excludes []string) (
 			SeenFiles: make(map[uint64]string),
 		}
 
-		defer func() {
-			if err := ta.TarWriter.Close(); err != nil {
-				log.Errorf("Failed to close tar writer, error: %s", err)
-			}
-			if err := pipeWriter.Close(); err != nil {
-				log.Errorf("Failed to close pipe writer, error: %s", err)
-			}
-		}()
+		var err error
 
 		// write files to tar
-		for _, f := range u.files {
-			ta.addTarFile(f.src, u.dest+f.dest)
+		for _, f := range files {
+			if err = ta.addTarFile(f.src, prefix+f.dest); err != nil {
+				err = fmt.Errorf("Failed to add %s to tar, error: %s", f.src, err)
+				break
+			}
+		}
+
+		if err == nil {
+			err = ta.TarWriter.Close()
 		}
+
+		pipeWriter.CloseWithError(err)
 	}()
 
-	return u, nil
+	return pipeReader
+}
+
+// countSources returns the number of items the sources resolve to; wildcards
+// are expanded relative to srcPath and the ignored matches are not counted
+func countSources(srcPath string, includes, excludes []string) (n int, err error) {
+	excludes, patDirs, _, err := fileutils.CleanPatterns(excludes)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, pattern := range includes {
+		if !containsWildcards(pattern) {
+			n++
+			continue
+		}
+
+		matches, err := filepath.Glob(filepath.Join(srcPath, pattern))
+		if err != nil {
+			return n, err
+		}
+
+		for _, match := range matches {
+			relFilePath, err := filepath.Rel(srcPath, match)
+			if err != nil {
+				return n, err
+			}
+			skip, err := fileutils.OptimizedMatches(relFilePath, excludes, patDirs)
+			if err != nil {
+				return n, err
+			}
+			if !skip {
+				n++
+			}
+		}
+	}
+
+	return n, nil
 }
 
 func listFiles(srcPath string, includes, excludes []string) ([]*uploadFile, error) {
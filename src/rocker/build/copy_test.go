@@ -17,17 +17,22 @@
 package build
 
 import (
+	"archive/tar"
 	"bytes"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"rocker/test"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/kr/pretty"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
 
 	"github.com/docker/docker/pkg/tarsum"
 )
@@ -821,6 +826,172 @@ func TestCopy_MakeTarStream_SingleFileDirRename(t *testing.T) {
 	assert.Equal(t, assertion, out, "bad tar content")
 }
 
+func TestCopy_CountSources(t *testing.T) {
+	tmpDir := makeTmpDir(t, map[string]string{
+		"src/a.conf":  "hello",
+		"src/b.conf":  "hello",
+		"src/c.conf":  "hello",
+		"src/d.txt":   "hello",
+		"lib/foo.txt": "hello",
+	})
+	defer os.RemoveAll(tmpDir)
+
+	tests := []struct {
+		includes []string
+		excludes []string
+		expected int
+	}{
+		{[]string{"src/a.conf"}, []string{}, 1},
+		{[]string{"lib"}, []string{}, 1},
+		{[]string{"src/*.conf"}, []string{}, 3},
+		{[]string{"src/*.conf"}, []string{"src/b.conf", "src/c.conf"}, 1},
+		{[]string{"src/*.txt", "lib"}, []string{}, 2},
+		{[]string{"src/*.none"}, []string{}, 0},
+	}
+
+	for _, test := range tests {
+		n, err := countSources(tmpDir, test.includes, test.excludes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, test.expected, n, "includes: %v, excludes: %v", test.includes, test.excludes)
+	}
+}
+
+func TestCopy_MultipleSourcesToFile(t *testing.T) {
+	tmpDir := makeTmpDir(t, map[string]string{
+		"src/a.conf": "hello",
+		"src/b.conf": "hello",
+	})
+	defer os.RemoveAll(tmpDir)
+
+	b, _ := makeBuild(t, "", Config{ContextDir: tmpDir})
+
+	for _, args := range [][]string{
+		{"src/a.conf", "src/b.conf", "/etc/app.conf"},
+		{"src/*.conf", "/etc/app.conf"},
+	} {
+		_, err := copyFiles(b, args, "COPY")
+		assert.EqualError(t, err, "When using COPY with more than one source file, the destination must be a directory and end with a /", "args: %v", args)
+	}
+}
+
+func TestCopy_MakeTarStream_PreservesMtime(t *testing.T) {
+	tmpDir := makeTmpDir(t, map[string]string{
+		"foo.txt": "hello",
+	})
+	defer os.RemoveAll(tmpDir)
+
+	mtime := time.Date(2015, 10, 21, 16, 29, 0, 0, time.UTC)
+	if err := os.Chtimes(filepath.Join(tmpDir, "foo.txt"), mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := makeTarStream(tmpDir, "/", "COPY", []string{"foo.txt"}, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer u.tar.Close()
+
+	hdr, err := tar.NewReader(u.tar).Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "foo.txt", hdr.Name)
+	assert.True(t, mtime.Equal(hdr.ModTime), "expected mtime %s, got %s", mtime, hdr.ModTime)
+}
+
+func TestCopy_ChunkFiles(t *testing.T) {
+	files := []*uploadFile{
+		{dest: "a", size: 4},
+		{dest: "b", size: 4},
+		{dest: "c", size: 20},
+		{dest: "d", size: 1},
+		{dest: "e", size: 9},
+	}
+
+	chunks := chunkFiles(files, 10)
+
+	dests := [][]string{}
+	for _, chunk := range chunks {
+		names := []string{}
+		for _, f := range chunk {
+			names = append(names, f.dest)
+		}
+		dests = append(dests, names)
+	}
+
+	assert.Equal(t, [][]string{{"a", "b"}, {"c"}, {"d", "e"}}, dests)
+}
+
+func TestCopy_UploadChunks_Resume(t *testing.T) {
+	tmpDir := makeTmpDir(t, map[string]string{
+		"a.txt": "hello",
+		"b.txt": "hello",
+		"c.txt": "hello",
+	})
+	defer os.RemoveAll(tmpDir)
+
+	u, err := prepareUpload(tmpDir, "/src/", "COPY", []string{"."}, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &MockClient{}
+
+	// The second chunk fails once, only that chunk should be uploaded again
+	c.On("UploadToContainer", "123", mock.Anything, "/").Return(nil).Once()
+	c.On("UploadToContainer", "123", mock.Anything, "/").Return(fmt.Errorf("connection reset")).Once()
+	c.On("UploadToContainer", "123", mock.Anything, "/").Return(nil).Once()
+
+	if err := uploadChunks(c, "123", u, 10, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+	c.AssertNumberOfCalls(t, "UploadToContainer", 3)
+}
+
+func TestCopy_UploadChunks_NoRetries(t *testing.T) {
+	tmpDir := makeTmpDir(t, map[string]string{
+		"a.txt": "hello",
+		"b.txt": "hello",
+	})
+	defer os.RemoveAll(tmpDir)
+
+	u, err := prepareUpload(tmpDir, "/src/", "COPY", []string{"."}, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &MockClient{}
+	c.On("UploadToContainer", "123", mock.Anything, "/").Return(fmt.Errorf("connection reset")).Once()
+
+	err = uploadChunks(c, "123", u, 5, 0)
+	assert.EqualError(t, err, "Failed to upload chunk 1/2, error: connection reset")
+	c.AssertNumberOfCalls(t, "UploadToContainer", 1)
+}
+
+func TestCopy_WriteTar_Error(t *testing.T) {
+	tmpDir := makeTmpDir(t, map[string]string{
+		"a.txt": "hello",
+	})
+	defer os.RemoveAll(tmpDir)
+
+	files := []*uploadFile{
+		{src: filepath.Join(tmpDir, "a.txt"), dest: "a.txt", size: 5},
+		{src: filepath.Join(tmpDir, "b.txt"), dest: "b.txt", size: 5},
+	}
+
+	stream := writeTar(files, "src/")
+	defer stream.Close()
+
+	_, err := ioutil.ReadAll(stream)
+	assert.Error(t, err, "expected the missing file to fail the stream")
+	assert.Contains(t, err.Error(), "Failed to add "+filepath.Join(tmpDir, "b.txt")+" to tar")
+}
+
 // helper functions
 
 func makeTmpDir(t *testing.T, files map[string]string) string {
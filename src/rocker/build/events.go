@@ -0,0 +1,96 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Types of build events
+const (
+	EventStepStart = "step_start"
+	EventStepEnd   = "step_end"
+	EventCacheHit  = "cache_hit"
+	EventPull      = "pull"
+	EventPush      = "push"
+	EventError     = "error"
+	EventBuildEnd  = "build_end"
+)
+
+// Event is a structured record of something that happened during the build
+type Event struct {
+	Type         string    `json:"type"`
+	Time         time.Time `json:"time"`
+	Step         int       `json:"step,omitempty"`
+	Command      string    `json:"command,omitempty"`
+	ImageID      string    `json:"image_id,omitempty"`
+	Image        string    `json:"image,omitempty"`
+	Digest       string    `json:"digest,omitempty"`
+	DurationMs   int64     `json:"duration_ms,omitempty"`
+	ProducedSize int64     `json:"produced_size,omitempty"`
+	VirtualSize  int64     `json:"virtual_size,omitempty"`
+	Error        string    `json:"error,omitempty"`
+
+	// Layers transferred by the push, set for push events
+	PushedLayers  int   `json:"pushed_layers,omitempty"`
+	PushedBytes   int64 `json:"pushed_bytes,omitempty"`
+	SkippedLayers int   `json:"skipped_layers,omitempty"`
+}
+
+// Observer receives the events of the build as they happen
+type Observer interface {
+	Event(e Event)
+}
+
+// JSONEventWriter is an Observer that writes every event as a single line
+// of JSON, so the stream can be consumed while the build is running
+type JSONEventWriter struct {
+	w  io.Writer
+	mu sync.Mutex
+}
+
+// NewJSONEventWriter returns a new JSONEventWriter writing to w
+func NewJSONEventWriter(w io.Writer) *JSONEventWriter {
+	return &JSONEventWriter{w: w}
+}
+
+// Event implements Observer
+func (j *JSONEventWriter) Event(e Event) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	// json.Encoder terminates every value with a newline
+	if err := json.NewEncoder(j.w).Encode(e); err != nil {
+		log.Errorf("Failed to write build event %s, error: %s", e.Type, err)
+	}
+}
+
+// event sends the event to the observer of the build, if any
+func (b *Build) event(e Event) {
+	if b.cfg.Observer == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	b.cfg.Observer.Event(e)
+}
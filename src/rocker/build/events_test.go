@@ -0,0 +1,140 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestEvents_JSONLines(t *testing.T) {
+	var buf bytes.Buffer
+
+	rockerfile := "FROM ubuntu\nRUN make"
+	b, c := makeBuild(t, rockerfile, Config{Observer: NewJSONEventWriter(&buf)})
+	plan := makePlan(t, rockerfile)
+
+	c.On("InspectImage", "ubuntu").Return(&docker.Image{ID: "123"}, nil).Once()
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("456", nil).Once()
+	c.On("RunContainer", "456", false).Return(nil).Once()
+	c.On("CommitContainer", mock.AnythingOfType("State"), "RUN make").Return(&docker.Image{ID: "789"}, nil).Once()
+	c.On("RemoveContainer", "456").Return(nil).Once()
+
+	if err := b.Run(plan); err != nil {
+		t.Fatal(err)
+	}
+
+	events := parseEvents(t, buf.Bytes())
+
+	types := []string{}
+	for _, e := range events {
+		types = append(types, e["type"].(string))
+		assert.NotEmpty(t, e["time"])
+	}
+	assert.Equal(t, []string{
+		EventStepStart, EventStepEnd, // FROM
+		EventStepStart, EventStepEnd, // RUN
+		EventStepStart, EventStepEnd, // final commit
+		EventStepStart, EventStepEnd, // cleanup
+		EventBuildEnd,
+	}, types)
+
+	assert.Equal(t, float64(1), events[0]["step"])
+	assert.Equal(t, "FROM ubuntu", events[0]["command"])
+	assert.Equal(t, "123", events[1]["image_id"])
+	assert.Equal(t, "RUN make", events[2]["command"])
+	assert.Equal(t, "789", events[8]["image_id"])
+
+	_, hasError := events[0]["error"]
+	assert.False(t, hasError, "expected empty fields to be omitted")
+}
+
+func TestEvents_Error(t *testing.T) {
+	var buf bytes.Buffer
+
+	rockerfile := "FROM ubuntu\nRUN make"
+	b, c := makeBuild(t, rockerfile, Config{Observer: NewJSONEventWriter(&buf)})
+	plan := makePlan(t, rockerfile)
+
+	c.On("InspectImage", "ubuntu").Return(&docker.Image{ID: "123"}, nil).Once()
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("456", nil).Once()
+	c.On("RunContainer", "456", false).Return(fmt.Errorf("exit code 2")).Once()
+	c.On("RemoveContainer", "456").Return(nil).Once()
+
+	assert.EqualError(t, b.Run(plan), "exit code 2")
+
+	events := parseEvents(t, buf.Bytes())
+	last := events[len(events)-1]
+
+	assert.Equal(t, EventError, last["type"])
+	assert.Equal(t, float64(2), last["step"])
+	assert.Equal(t, "exit code 2", last["error"])
+}
+
+func TestEvents_Push(t *testing.T) {
+	var buf bytes.Buffer
+
+	rockerfile := "FROM ubuntu\nPUSH app:1.0"
+	b, c := makeBuild(t, rockerfile, Config{Push: true, Observer: NewJSONEventWriter(&buf)})
+	plan := makePlan(t, rockerfile)
+
+	stats := PushStats{PushedLayers: 2, PushedBytes: 3072, SkippedLayers: 1}
+
+	c.On("InspectImage", "ubuntu").Return(&docker.Image{ID: "123"}, nil).Once()
+	c.On("TagImage", "123", "app:1.0").Return(nil).Once()
+	c.On("PushImage", "app:1.0").Return("sha256:fafa", stats, nil).Once()
+
+	if err := b.Run(plan); err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+
+	var push map[string]interface{}
+	for _, e := range parseEvents(t, buf.Bytes()) {
+		if e["type"] == EventPush {
+			push = e
+		}
+	}
+	if push == nil {
+		t.Fatal("Expected the push event")
+	}
+
+	assert.Equal(t, "sha256:fafa", push["digest"])
+	assert.Equal(t, float64(2), push["pushed_layers"])
+	assert.Equal(t, float64(3072), push["pushed_bytes"])
+	assert.Equal(t, float64(1), push["skipped_layers"])
+}
+
+func parseEvents(t *testing.T, data []byte) (events []map[string]interface{}) {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		e := map[string]interface{}{}
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatalf("Expected every line to be a JSON object, got %q: %s", scanner.Text(), err)
+		}
+		events = append(events, e)
+	}
+	return events
+}
@@ -0,0 +1,58 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import log "github.com/Sirupsen/logrus"
+
+// Reasons of executing or skipping a step, see StepExplanation; a cache hit
+// is explained as "cache hit (image <id>)"
+const (
+	ReasonExecuted        = "executed"
+	ReasonNoCache         = "executed (no cache)"
+	ReasonNotCached       = "executed (not cached)"
+	ReasonCacheBusted     = "executed (cache busted by a previous step)"
+	ReasonImageGone       = "executed (cached image is gone)"
+	ReasonCreatedMismatch = "executed (cached image has another created time)"
+	ReasonCacheReloaded   = "cache reloaded"
+	ReasonSkipped         = "skipped (ShouldRun=false)"
+	ReasonUnchanged       = "skipped (files are unchanged)"
+)
+
+// StepExplanation tells why a step of the plan was executed or skipped
+type StepExplanation struct {
+	Step    int
+	Command string
+	Reason  string
+}
+
+// explain records the reason of the step and prints it if Explain is set;
+// empty reason means the step does not use the cache and is simply executed
+func (b *Build) explain(step int, c Command, reason string) {
+	if reason == "" {
+		reason = ReasonExecuted
+	}
+
+	b.Explanations = append(b.Explanations, StepExplanation{
+		Step:    step,
+		Command: c.String(),
+		Reason:  reason,
+	})
+
+	if b.cfg.Explain {
+		log.Infof("| Step %d %q: %s", step, c.String(), reason)
+	}
+}
@@ -0,0 +1,97 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"strings"
+	"testing"
+
+	"rocker/template"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestBuild_Explain(t *testing.T) {
+	cache := NewCacheMemory()
+	c := &MockClient{}
+
+	build := func(rockerfile string) []StepExplanation {
+		r, err := NewRockerfile("explain", strings.NewReader(rockerfile), template.Vars{}, template.Funs{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := New(c, r, cache, Config{Explain: true})
+		if err := b.Run(makePlan(t, rockerfile)); err != nil {
+			t.Fatal(err)
+		}
+		return b.Explanations
+	}
+
+	c.On("InspectImage", "ubuntu").Return(&docker.Image{ID: "123"}, nil)
+	c.On("InspectImage", "789").Return(&docker.Image{ID: "789"}, nil)
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("456", nil)
+	c.On("RunContainer", "456", false).Return(nil)
+	c.On("RemoveContainer", "456").Return(nil)
+	c.On("CommitContainer", mock.AnythingOfType("State"), mock.AnythingOfType("string")).Return(&docker.Image{ID: "789"}, nil).Once()
+	c.On("CommitContainer", mock.AnythingOfType("State"), mock.AnythingOfType("string")).Return(&docker.Image{ID: "790"}, nil).Once()
+	c.On("CommitContainer", mock.AnythingOfType("State"), mock.AnythingOfType("string")).Return(&docker.Image{ID: "791"}, nil).Once()
+
+	explanations := build("FROM ubuntu\nENV A=1\nRUN make\nRUN make install")
+
+	assert.Equal(t, []StepExplanation{
+		{1, "FROM ubuntu", ReasonExecuted},
+		{2, "ENV A=1", ReasonExecuted},
+		{3, "RUN make", ReasonNotCached},
+		{4, "Commit changes", ReasonExecuted},
+		{5, "RUN make install", ReasonCacheBusted},
+		{6, "Commit changes", ReasonExecuted},
+		{7, "Cleaning up", ReasonExecuted},
+	}, explanations)
+
+	explanations = build("FROM ubuntu\nENV A=1\nRUN make\nRUN make test")
+
+	assert.Equal(t, []StepExplanation{
+		{1, "FROM ubuntu", ReasonExecuted},
+		{2, "ENV A=1", ReasonExecuted},
+		{3, "RUN make", "cache hit (image 789)"},
+		{4, "Commit changes", ReasonSkipped},
+		{5, "RUN make test", ReasonNotCached},
+		{6, "Commit changes", ReasonExecuted},
+		{7, "Cleaning up", ReasonExecuted},
+	}, explanations)
+
+	c.AssertExpectations(t)
+}
+
+func TestBuild_Explain_NoCache(t *testing.T) {
+	rockerfile := "FROM ubuntu\nRUN make"
+	b, c := makeBuild(t, rockerfile, Config{Explain: true})
+
+	c.On("InspectImage", "ubuntu").Return(&docker.Image{ID: "123"}, nil)
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("456", nil)
+	c.On("RunContainer", "456", false).Return(nil)
+	c.On("RemoveContainer", "456").Return(nil)
+	c.On("CommitContainer", mock.AnythingOfType("State"), mock.AnythingOfType("string")).Return(&docker.Image{ID: "789"}, nil)
+
+	if err := b.Run(makePlan(t, rockerfile)); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, ReasonNoCache, b.Explanations[1].Reason)
+}
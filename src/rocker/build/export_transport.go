@@ -0,0 +1,399 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Transports of EXPORT and IMPORT, see Config.ExportTransport
+const (
+	// ExportTransportAuto copies with tar streams below ExportTarLimit
+	// and with rsync above it
+	ExportTransportAuto = "auto"
+	// ExportTransportTar copies files with tar streams of the Docker archive
+	// API, without running the rsync container
+	ExportTransportTar = "tar"
+	// ExportTransportRsync runs rsync in a container of the step
+	ExportTransportRsync = "rsync"
+)
+
+// DefaultExportTarLimit is the size of the files up to which EXPORT and
+// IMPORT use tar streams with ExportTransportAuto
+const DefaultExportTarLimit = 1024 * 1024
+
+// errTarTooLarge tells that the files exceed the limit of copyTar
+var errTarTooLarge = fmt.Errorf("The files are too large to copy with tar")
+
+// exportTarLimit returns the size limit of the tar transport for the files
+// to copy from src to dest, 0 means no limit; ok is false if the files
+// should be copied with rsync
+func (b *Build) exportTarLimit(src []string, dest string) (limit int64, ok bool, err error) {
+	switch b.cfg.ExportTransport {
+	case "", ExportTransportAuto:
+	case ExportTransportRsync:
+		return 0, false, nil
+	case ExportTransportTar:
+		if err := tarTransportSupports(src, dest); err != nil {
+			return 0, false, fmt.Errorf("Cannot copy with the tar transport, error: %s", err)
+		}
+		return 0, true, nil
+	default:
+		return 0, false, fmt.Errorf("Unknown EXPORT transport %q, expected %s, %s or %s",
+			b.cfg.ExportTransport, ExportTransportAuto, ExportTransportTar, ExportTransportRsync)
+	}
+
+	if err := tarTransportSupports(src, dest); err != nil {
+		log.Debugf("Copy with rsync, %s", err)
+		return 0, false, nil
+	}
+
+	limit = b.cfg.ExportTarLimit
+	if limit <= 0 {
+		limit = DefaultExportTarLimit
+	}
+	return limit, true, nil
+}
+
+// exportWithTar copies the files of EXPORT or IMPORT with copyTar if the
+// transport allows it, copied is false if they should be copied with rsync
+func (b *Build) exportWithTar(fromID string, src []string, toID, dest string) (copied bool, err error) {
+	limit, ok, err := b.exportTarLimit(src, dest)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	err = b.copyTar(fromID, src, toID, dest, limit)
+	if err == errTarTooLarge {
+		log.Debugf("The files exceed %d bytes, copy with rsync", limit)
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	log.Infof("| Copied %s to %s with tar", strings.Join(src, " "), dest)
+
+	return true, nil
+}
+
+// downloadImport downloads the files of IMPORT if the transport allows to
+// copy them with tar; files are nil if they should be copied with rsync or
+// take more than the limit of the tar transport, which is DefaultExportTarLimit
+// for ExportTransportTar unless ExportTarLimit is set
+func (b *Build) downloadImport(fromID string, src []string, dest string) (files *tarFiles, err error) {
+	limit, ok, err := b.exportTarLimit(src, dest)
+	if err != nil || !ok {
+		return nil, err
+	}
+	if limit == 0 {
+		if limit = b.cfg.ExportTarLimit; limit <= 0 {
+			limit = DefaultExportTarLimit
+		}
+	}
+
+	files, err = b.downloadTar(fromID, src, dest, limit)
+	if err == errTarTooLarge {
+		log.Debugf("The files exceed %d bytes, do not checksum them", limit)
+		return nil, nil
+	}
+	return files, err
+}
+
+// tarTransportSupports checks that copyTar does the same as rsync would do;
+// it only copies to directories, while rsync renames a single file copied
+// to the destination not ending with slash
+func tarTransportSupports(src []string, dest string) error {
+	if !path.IsAbs(dest) {
+		return fmt.Errorf("the destination %s is not absolute", dest)
+	}
+	if len(src) == 1 && !strings.HasSuffix(src[0], "/") && !strings.HasSuffix(dest, "/") {
+		return fmt.Errorf("the destination %s may be a file, it should end with /", dest)
+	}
+	for _, p := range src {
+		if !path.IsAbs(p) {
+			return fmt.Errorf("the source %s is not absolute", p)
+		}
+		if containsWildcards(p) {
+			return fmt.Errorf("the source %s has wildcards", p)
+		}
+	}
+	return nil
+}
+
+// copyTar copies the files from one container to the directory of another one
+// with the Docker archive API, as `rsync -a src... dest/` does: a source
+// ending with slash copies its content, otherwise the source itself; none of
+// the containers have to be running. With limit > 0 the files are buffered
+// and nothing is copied if they take more than limit bytes, errTarTooLarge
+// is returned then
+func (b *Build) copyTar(fromID string, src []string, toID, dest string, limit int64) error {
+	if limit > 0 {
+		files, err := b.downloadTar(fromID, src, dest, limit)
+		if err != nil {
+			return err
+		}
+		return b.uploadTar(toID, files)
+	}
+
+	// The archives are extracted to the root, so that the missing
+	// directories of the destination are made
+	prefix := strings.TrimPrefix(path.Clean(dest), "/")
+
+	for _, p := range src {
+		r, err := b.client.DownloadFromContainer(fromID, tarSource(p))
+		if err != nil {
+			return err
+		}
+
+		pr, pw := io.Pipe()
+		go func(r io.Reader) {
+			pw.CloseWithError(prefixTar(pw, r, prefix))
+		}(r)
+
+		err = b.client.UploadToContainer(toID, pr, "/")
+		pr.Close()
+		r.Close()
+		if err != nil {
+			return fmt.Errorf("Failed to upload %s to container %.12s, error: %s", p, toID, err)
+		}
+	}
+
+	return nil
+}
+
+// tarFiles are the files buffered by downloadTar as the archives to extract
+// to the root of the container, with the checksums of the files by their paths
+type tarFiles struct {
+	src      []string
+	archives [][]byte
+	sums     map[string]string
+	limit    int64
+}
+
+// downloadTar downloads the files that copyTar copies from src to dest,
+// errTarTooLarge is returned if they take more than limit bytes
+func (b *Build) downloadTar(fromID string, src []string, dest string, limit int64) (*tarFiles, error) {
+	var (
+		files = &tarFiles{src: src, sums: map[string]string{}, limit: limit}
+		size  int64
+	)
+
+	prefix := strings.TrimPrefix(path.Clean(dest), "/")
+
+	for _, p := range src {
+		r, err := b.client.DownloadFromContainer(fromID, tarSource(p))
+		if err != nil {
+			return nil, err
+		}
+
+		buf := &bytes.Buffer{}
+		n, err := io.CopyN(buf, r, limit-size+1)
+		r.Close()
+		if err != nil && err != io.EOF {
+			return nil, fmt.Errorf("Failed to download %s from container %.12s, error: %s", p, fromID, err)
+		}
+		if size += n; size > limit {
+			return nil, errTarTooLarge
+		}
+
+		archive := &bytes.Buffer{}
+		if err := prefixTar(archive, buf, prefix); err != nil {
+			return nil, fmt.Errorf("Failed to read %s from container %.12s, error: %s", p, fromID, err)
+		}
+		if err := sumTar(bytes.NewReader(archive.Bytes()), "", files.sums); err != nil {
+			return nil, err
+		}
+		files.archives = append(files.archives, archive.Bytes())
+	}
+
+	return files, nil
+}
+
+// uploadTar extracts the files of downloadTar to the root of the container
+func (b *Build) uploadTar(toID string, files *tarFiles) error {
+	for i, archive := range files.archives {
+		if err := b.client.UploadToContainer(toID, bytes.NewReader(archive), "/"); err != nil {
+			return fmt.Errorf("Failed to upload %s to container %.12s, error: %s", files.src[i], toID, err)
+		}
+	}
+	return nil
+}
+
+// checksum returns the checksum of all the files, it does not depend on
+// the time the files were modified
+func (files *tarFiles) checksum() string {
+	names := make([]string, 0, len(files.sums))
+	for name := range files.sums {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	h := sha256.New()
+	for _, name := range names {
+		fmt.Fprintf(h, "%s %s\n", name, files.sums[name])
+	}
+	return fmt.Sprintf("sha256:%x", h.Sum(nil))
+}
+
+// tarUnchanged tells whether the container already has all the files with
+// the same content, mode and owner. The topmost files and directories are
+// downloaded from the container for that, so the directories having other
+// files as well take more than the limit of the files sooner, and are then
+// treated as changed
+func (b *Build) tarUnchanged(containerID string, files *tarFiles) bool {
+	remaining := files.limit
+	found := 0
+
+	for _, root := range files.roots() {
+		r, err := b.client.DownloadFromContainer(containerID, "/"+root)
+		if err != nil {
+			// Most likely the file does not exist in the container
+			log.Debugf("Failed to download %s from container %.12s, error: %s", root, containerID, err)
+			return false
+		}
+
+		lr := &io.LimitedReader{R: r, N: remaining + 1}
+		sums := map[string]string{}
+		err = sumTar(lr, path.Dir(root), sums)
+		r.Close()
+		if remaining = lr.N - 1; remaining < 0 {
+			log.Debugf("The files in container %.12s exceed %d bytes, treat them as changed", containerID, files.limit)
+			return false
+		}
+		if err != nil {
+			log.Debugf("Failed to read %s from container %.12s, error: %s", root, containerID, err)
+			return false
+		}
+
+		for name, sum := range sums {
+			want, ok := files.sums[name]
+			if !ok {
+				continue
+			}
+			if sum != want {
+				return false
+			}
+			found++
+		}
+	}
+
+	return found == len(files.sums)
+}
+
+// roots returns the paths of the files which directories are not among the files
+func (files *tarFiles) roots() (roots []string) {
+	for name := range files.sums {
+		if _, ok := files.sums[path.Dir(name)]; !ok {
+			roots = append(roots, name)
+		}
+	}
+	sort.Strings(roots)
+	return roots
+}
+
+// sumTar adds the checksums of the files of the tar stream to sums by their
+// paths joined with dir; the checksum covers the type, mode, owner, link
+// target and content of a file, but not its modification time
+func sumTar(r io.Reader, dir string, sums map[string]string) error {
+	tr := tar.NewReader(r)
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		typeflag := hdr.Typeflag
+		if typeflag == tar.TypeRegA {
+			typeflag = tar.TypeReg
+		}
+		linkname := hdr.Linkname
+		if typeflag == tar.TypeLink {
+			linkname = path.Join(dir, linkname)
+		}
+
+		h := sha256.New()
+		fmt.Fprintf(h, "%c %o %d:%d %s\n", typeflag, hdr.Mode&07777, hdr.Uid, hdr.Gid, linkname)
+		if _, err := io.Copy(h, tr); err != nil {
+			return err
+		}
+
+		sums[path.Join(dir, hdr.Name)] = fmt.Sprintf("%x", h.Sum(nil))
+	}
+}
+
+// tarSource returns the path to download for the source of copyTar, the
+// archive of "dir/." has the content of the dir instead of the dir
+func tarSource(p string) string {
+	if strings.HasSuffix(p, "/") {
+		return p + "."
+	}
+	return p
+}
+
+// prefixTar copies the tar stream moving its files to the directory prefix
+func prefixTar(w io.Writer, r io.Reader, prefix string) error {
+	tr := tar.NewReader(r)
+	tw := tar.NewWriter(w)
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		name := path.Join(prefix, hdr.Name)
+		if name == "" || name == "." {
+			// The root always exists, so its "./" entry is not needed
+			continue
+		}
+		if hdr.Typeflag == tar.TypeDir {
+			name += "/"
+		}
+		hdr.Name = name
+
+		// Hard links refer to the other files of the archive
+		if hdr.Typeflag == tar.TypeLink {
+			hdr.Linkname = path.Join(prefix, hdr.Linkname)
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return err
+		}
+	}
+
+	return tw.Close()
+}
@@ -0,0 +1,382 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// mockExportsContainer expects the exports container to be looked up
+func mockExportsContainer(b *Build, c *MockClient) {
+	name := b.exportsContainerName()
+	c.On("EnsureContainer", name, mock.AnythingOfType("*docker.Config"), "exports").Return("exports1", nil).Once()
+	c.On("InspectContainer", "exports1").Return(&docker.Container{
+		ID:     "exports1",
+		Mounts: []docker.Mount{{Source: "/volumedir", Destination: ExportsPath}},
+	}, nil).Once()
+}
+
+func TestCommandExport_Tar(t *testing.T) {
+	b, c := makeBuild(t, "", Config{})
+	cmd := &CommandExport{ConfigCommand{
+		args: []string{"/app/bin"},
+	}}
+
+	mockExportsContainer(b, c)
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("456", nil).Once()
+	c.On("DownloadFromContainer", "456", "/app/bin").Return(makeTestTar(t, time.Now(),
+		testTarEntry{"bin/", ""},
+		testTarEntry{"bin/app", "binary"},
+	), nil).Once()
+	c.On("UploadToContainer", "exports1", mock.Anything, "/").Return(nil).Run(func(args mock.Arguments) {
+		headers, files := readTestTar(t, args.Get(1).(io.Reader))
+		if assert.Len(t, headers, 2) {
+			assert.Equal(t, ".rocker_exports/bin/", headers[0].Name)
+		}
+		assert.Equal(t, "binary", string(files[".rocker_exports/bin/app"]))
+	}).Once()
+	c.On("RemoveContainer", "456").Return(nil).Once()
+
+	state, err := cmd.Execute(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// rsync container is not run
+	c.AssertExpectations(t)
+	assert.Equal(t, "456", state.ExportsID)
+	assert.Equal(t, []string{"456"}, b.exports)
+}
+
+func TestCommandExport_TarAboveLimit(t *testing.T) {
+	b, c := makeBuild(t, "", Config{ExportTarLimit: 1024})
+	cmd := &CommandExport{ConfigCommand{
+		args: []string{"/app/bin", "/"},
+	}}
+
+	mockExportsContainer(b, c)
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("456", nil).Run(func(args mock.Arguments) {
+		assert.Equal(t, []string{"/opt/rsync/bin/rsync", "-a", "--delete-during", "/app/bin", ExportsPath + "/"},
+			[]string(args.Get(0).(State).Config.Cmd))
+	}).Once()
+	c.On("DownloadFromContainer", "456", "/app/bin").Return(makeTestTar(t, time.Now(),
+		testTarEntry{"bin", strings.Repeat("x", 2048)},
+	), nil).Once()
+	c.On("RunContainer", "456", false).Return(nil).Once()
+	c.On("RemoveContainer", "456").Return(nil).Once()
+
+	if _, err := cmd.Execute(b); err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+}
+
+func TestCommandExport_Rsync(t *testing.T) {
+	tests := []struct {
+		transport string
+		args      []string
+	}{
+		{ExportTransportRsync, []string{"/app/bin"}},
+		// rsync renames the file copied to a destination that is not a directory
+		{ExportTransportAuto, []string{"/app/bin", "/app"}},
+		{ExportTransportAuto, []string{"bin", "/"}},
+	}
+
+	for _, test := range tests {
+		b, c := makeBuild(t, "", Config{ExportTransport: test.transport})
+		cmd := &CommandExport{ConfigCommand{
+			args: test.args,
+		}}
+
+		mockExportsContainer(b, c)
+		c.On("CreateContainer", mock.AnythingOfType("State")).Return("456", nil).Once()
+		c.On("RunContainer", "456", false).Return(nil).Once()
+		c.On("RemoveContainer", "456").Return(nil).Once()
+
+		if _, err := cmd.Execute(b); err != nil {
+			t.Fatal(err)
+		}
+
+		c.AssertExpectations(t)
+	}
+}
+
+func TestCommandExport_TarUnsupported(t *testing.T) {
+	b, c := makeBuild(t, "", Config{ExportTransport: ExportTransportTar})
+	cmd := &CommandExport{ConfigCommand{
+		args: []string{"/app/bin", "/app"},
+	}}
+
+	mockExportsContainer(b, c)
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("456", nil).Once()
+	c.On("RemoveContainer", "456").Return(nil).Once()
+
+	_, err := cmd.Execute(b)
+	assert.EqualError(t, err, "Cannot copy with the tar transport, error: the destination /.rocker_exports/app may be a file, it should end with /")
+}
+
+func TestCommandExport_TarDirContent(t *testing.T) {
+	b, c := makeBuild(t, "", Config{})
+	cmd := &CommandExport{ConfigCommand{
+		args: []string{"/src/", "/app"},
+	}}
+
+	mockExportsContainer(b, c)
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("456", nil).Once()
+	c.On("DownloadFromContainer", "456", "/src/.").Return(makeTestTar(t, time.Now(),
+		testTarEntry{"./", ""},
+		testTarEntry{"./main.go", "package main"},
+	), nil).Once()
+	c.On("UploadToContainer", "exports1", mock.Anything, "/").Return(nil).Run(func(args mock.Arguments) {
+		_, files := readTestTar(t, args.Get(1).(io.Reader))
+		assert.Equal(t, "package main", string(files[".rocker_exports/app/main.go"]))
+	}).Once()
+	c.On("RemoveContainer", "456").Return(nil).Once()
+
+	if _, err := cmd.Execute(b); err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+}
+
+func TestCommandImport_Tar(t *testing.T) {
+	b, c := makeBuild(t, "", Config{ExportTransport: ExportTransportTar})
+	b.exports = []string{"456"}
+	cmd := &CommandImport{ConfigCommand{
+		args: []string{"bin/", "/usr/local/bin/"},
+	}}
+
+	mockExportsContainer(b, c)
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("789", nil).Once()
+	c.On("DownloadFromContainer", "exports1", ExportsPath+"/bin/.").Return(makeTestTar(t, time.Now(),
+		testTarEntry{"./", ""},
+		testTarEntry{"./app", "binary"},
+	), nil).Once()
+	c.On("UploadToContainer", "789", mock.Anything, "/").Return(nil).Run(func(args mock.Arguments) {
+		// The content of the dir is copied to the destination, as with rsync
+		headers, files := readTestTar(t, args.Get(1).(io.Reader))
+		if assert.Len(t, headers, 2) {
+			assert.Equal(t, "usr/local/bin/", headers[0].Name)
+		}
+		assert.Equal(t, "binary", string(files["usr/local/bin/app"]))
+	}).Once()
+
+	state, err := cmd.Execute(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The container is committed without running rsync in it
+	c.AssertExpectations(t)
+	assert.Equal(t, "789", state.NoCache.ContainerID)
+}
+
+func TestPrefixTar_Root(t *testing.T) {
+	buf := &bytes.Buffer{}
+	src := makeTestTar(t, time.Now(),
+		testTarEntry{"./", ""},
+		testTarEntry{"./file", "content"},
+	)
+
+	if err := prefixTar(buf, src, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	headers, _ := readTestTar(t, buf)
+	if assert.Len(t, headers, 1) {
+		assert.Equal(t, "file", headers[0].Name)
+	}
+}
+
+func TestPrefixTar(t *testing.T) {
+	buf := &bytes.Buffer{}
+	src := makeTestTar(t, time.Now(),
+		testTarEntry{"./", ""},
+		testTarEntry{"dir/", ""},
+		testTarEntry{"dir/file", "content"},
+	)
+
+	if err := prefixTar(buf, src, "a/b"); err != nil {
+		t.Fatal(err)
+	}
+
+	headers, files := readTestTar(t, buf)
+	names := []string{}
+	for _, hdr := range headers {
+		names = append(names, hdr.Name)
+	}
+	// The root entry of the dir content stands for the prefix
+	assert.Equal(t, []string{"a/b/", "a/b/dir/", "a/b/dir/file"}, names)
+	assert.Equal(t, "content", string(files["a/b/dir/file"]))
+}
+
+func TestCommandImport_Unchanged(t *testing.T) {
+	b, c := makeBuild(t, "", Config{})
+	b.state.ImageID = "123"
+	b.exports = []string{"456"}
+	cmd := &CommandImport{ConfigCommand{
+		args: []string{"bin/", "/usr/local/bin/"},
+	}}
+
+	mockExportsContainer(b, c)
+	c.On("DownloadFromContainer", "exports1", ExportsPath+"/bin/.").Return(makeTestTar(t, time.Now(),
+		testTarEntry{"./", ""},
+		testTarEntry{"./app", "binary"},
+	), nil).Once()
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("789", nil).Once()
+	// The files in the image were modified at another time
+	c.On("DownloadFromContainer", "789", "/usr/local/bin").Return(makeTestTar(t, time.Unix(0, 0),
+		testTarEntry{"bin/", ""},
+		testTarEntry{"bin/app", "binary"},
+		testTarEntry{"bin/other", "other binary"},
+	), nil).Once()
+	c.On("RemoveContainer", "789").Return(nil).Once()
+
+	state, err := cmd.Execute(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing is uploaded and committed
+	c.AssertExpectations(t)
+	assert.Equal(t, "", state.NoCache.ContainerID)
+	assert.Equal(t, "", state.GetCommits())
+	assert.Equal(t, "123", state.ImageID)
+	assert.Equal(t, ReasonUnchanged, b.reason)
+}
+
+func TestCommandImport_Changed(t *testing.T) {
+	b, c := makeBuild(t, "", Config{})
+	b.state.ImageID = "123"
+	b.exports = []string{"456"}
+	cmd := &CommandImport{ConfigCommand{
+		args: []string{"bin/", "/usr/local/bin/"},
+	}}
+
+	mockExportsContainer(b, c)
+	c.On("DownloadFromContainer", "exports1", ExportsPath+"/bin/.").Return(makeTestTar(t, time.Now(),
+		testTarEntry{"./", ""},
+		testTarEntry{"./app", "binary"},
+	), nil).Once()
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("789", nil).Once()
+	c.On("DownloadFromContainer", "789", "/usr/local/bin").Return(makeTestTar(t, time.Now(),
+		testTarEntry{"bin/", ""},
+		testTarEntry{"bin/app", "old binary"},
+	), nil).Once()
+	c.On("UploadToContainer", "789", mock.Anything, "/").Return(nil).Run(func(args mock.Arguments) {
+		_, files := readTestTar(t, args.Get(1).(io.Reader))
+		assert.Equal(t, "binary", string(files["usr/local/bin/app"]))
+	}).Once()
+
+	state, err := cmd.Execute(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+	assert.Equal(t, "789", state.NoCache.ContainerID)
+	assert.Contains(t, state.GetCommits(), "IMPORT sha256:")
+}
+
+func TestCommandImport_ChecksumCache(t *testing.T) {
+	commits := []string{}
+
+	// The same files exported by different EXPORT steps
+	for _, exportID := range []string{"456", "457"} {
+		b, c := makeBuild(t, "", Config{})
+		b.exports = []string{exportID}
+		cmd := &CommandImport{ConfigCommand{
+			args: []string{"/app/bin"},
+		}}
+
+		mockExportsContainer(b, c)
+		c.On("DownloadFromContainer", "exports1", ExportsPath+"/app/bin").Return(makeTestTar(t, time.Now(),
+			testTarEntry{"bin", "binary"},
+		), nil).Once()
+		c.On("CreateContainer", mock.AnythingOfType("State")).Return("789", nil).Once()
+		c.On("UploadToContainer", "789", mock.Anything, "/").Return(nil).Once()
+
+		state, err := cmd.Execute(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c.AssertExpectations(t)
+		assert.NotContains(t, state.GetCommits(), exportID)
+		commits = append(commits, state.GetCommits())
+	}
+
+	assert.Equal(t, commits[0], commits[1])
+}
+
+func TestCommandImport_CacheHit(t *testing.T) {
+	b, c := makeBuild(t, "", Config{})
+	b.cache = NewCacheMemory()
+	b.state.ImageID = "123"
+	b.exports = []string{"457"}
+	cmd := &CommandImport{ConfigCommand{
+		args: []string{"/app/bin"},
+	}}
+
+	tarBin := func() io.ReadCloser {
+		return makeTestTar(t, time.Now(), testTarEntry{"bin", "binary"})
+	}
+
+	// The image imported the same files from an earlier EXPORT
+	files := &tarFiles{sums: map[string]string{}}
+	if err := sumTar(tarBin(), "", files.sums); err != nil {
+		t.Fatal(err)
+	}
+	cached := State{ParentID: "123", ImageID: "789"}
+	cached.Commit("IMPORT %s : %q %s", files.checksum(), []string{ExportsPath + "/app/bin"}, "/")
+	if err := b.cache.Put(cached); err != nil {
+		t.Fatal(err)
+	}
+
+	mockExportsContainer(b, c)
+	c.On("DownloadFromContainer", "exports1", ExportsPath+"/app/bin").Return(tarBin(), nil).Once()
+	c.On("InspectImage", "789").Return(&docker.Image{ID: "789"}, nil).Once()
+
+	state, err := cmd.Execute(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// No container is made
+	c.AssertExpectations(t)
+	assert.Equal(t, "789", state.ImageID)
+}
+
+func TestTarFiles_Roots(t *testing.T) {
+	files := &tarFiles{sums: map[string]string{
+		"usr/local/bin":     "",
+		"usr/local/bin/app": "",
+		"etc/app.conf":      "",
+		"app":               "",
+	}}
+	assert.Equal(t, []string{"app", "etc/app.conf", "usr/local/bin"}, files.roots())
+}
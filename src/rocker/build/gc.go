@@ -0,0 +1,70 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// GCConfig is the configuration of the images garbage collection
+type GCConfig struct {
+	OlderThan time.Duration
+	Dangling  bool
+	DryRun    bool
+}
+
+// GCImages removes rocker-produced images that are older than the configured
+// threshold. Only dangling images are supported so far; an image is considered
+// rocker-produced if it has a commit message, which rocker always sets.
+// With DryRun, images are only listed but not removed.
+func GCImages(client Client, cfg GCConfig) (removed []string, err error) {
+	if !cfg.Dangling {
+		return nil, fmt.Errorf("Nothing to collect, only --dangling images are supported so far")
+	}
+
+	ids, err := client.ListDanglingImages()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list dangling images, error: %s", err)
+	}
+
+	deadline := time.Now().Add(-cfg.OlderThan)
+	removed = []string{}
+
+	for _, id := range ids {
+		img, err := client.InspectImage(id)
+		if err != nil {
+			return removed, fmt.Errorf("Failed to inspect image %.12s, error: %s", id, err)
+		}
+		// The image could be removed in the meantime
+		if img == nil || img.Comment == "" || !img.Created.Before(deadline) {
+			continue
+		}
+
+		if cfg.DryRun {
+			log.Infof("| Would remove image %.12s created %s ago", id, time.Since(img.Created))
+		} else if err := client.RemoveImage(id); err != nil {
+			return removed, fmt.Errorf("Failed to remove image %.12s, error: %s", id, err)
+		}
+
+		removed = append(removed, id)
+	}
+
+	return removed, nil
+}
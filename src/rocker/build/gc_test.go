@@ -0,0 +1,72 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"testing"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGCImages(t *testing.T) {
+	c := &MockClient{}
+
+	images := map[string]*docker.Image{
+		"old":      {ID: "old", Comment: "RUN make", Created: time.Now().Add(-100 * time.Hour)},
+		"fresh":    {ID: "fresh", Comment: "RUN make", Created: time.Now().Add(-1 * time.Hour)},
+		"external": {ID: "external", Created: time.Now().Add(-100 * time.Hour)},
+	}
+
+	c.On("ListDanglingImages").Return([]string{"old", "fresh", "external"}, nil).Once()
+	for id, img := range images {
+		c.On("InspectImage", id).Return(img, nil).Once()
+	}
+	c.On("RemoveImage", "old").Return(nil).Once()
+
+	removed, err := GCImages(c, GCConfig{OlderThan: 72 * time.Hour, Dangling: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+	assert.Equal(t, []string{"old"}, removed)
+}
+
+func TestGCImages_DryRun(t *testing.T) {
+	c := &MockClient{}
+
+	img := &docker.Image{ID: "old", Comment: "RUN make", Created: time.Now().Add(-100 * time.Hour)}
+
+	c.On("ListDanglingImages").Return([]string{"old"}, nil).Once()
+	c.On("InspectImage", "old").Return(img, nil).Once()
+
+	removed, err := GCImages(c, GCConfig{OlderThan: 72 * time.Hour, Dangling: true, DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+	c.AssertNotCalled(t, "RemoveImage", "old")
+	assert.Equal(t, []string{"old"}, removed)
+}
+
+func TestGCImages_NotDangling(t *testing.T) {
+	_, err := GCImages(&MockClient{}, GCConfig{OlderThan: time.Hour})
+	assert.Error(t, err)
+}
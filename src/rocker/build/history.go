@@ -0,0 +1,174 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"fmt"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/fsouza/go-dockerclient"
+)
+
+// HistoryLayer pairs a layer the plan is expected to commit with the
+// entry of the image history at its place, see CompareHistory
+type HistoryLayer struct {
+	// Commands of the plan committed to the layer
+	Commands []string
+
+	// Expected is CreatedBy of the history entry, or its prefix if the
+	// rest is not known from the plan, e.g. the checksum of COPY
+	Expected string
+	prefix   bool
+
+	// LayerID and CreatedBy of the history entry, empty if the history
+	// has no entry for the layer
+	LayerID   string
+	CreatedBy string
+
+	Match bool
+}
+
+// PlanLayers returns the layers the last stage of the plan (the commands
+// after the last FROM) commits, the oldest first; layers of the base image
+// and ONBUILD triggers of it are not included
+func PlanLayers(plan Plan) []HistoryLayer {
+	layers := []HistoryLayer{}
+	commands := []Command{}
+
+	for _, c := range plan {
+		switch c.(type) {
+		case *CommandFrom:
+			layers = []HistoryLayer{}
+			commands = []Command{}
+		case *CommandCommit:
+			if layer, ok := planLayer(commands); ok {
+				layers = append(layers, layer)
+			}
+			commands = []Command{}
+		case *CommandCleanup:
+		default:
+			commands = append(commands, c)
+		}
+	}
+
+	return layers
+}
+
+// planLayer makes the layer committed for the group of commands; it tells
+// CreatedBy the same way the commands make the container to commit
+func planLayer(commands []Command) (layer HistoryLayer, ok bool) {
+	var (
+		originals = []string{}
+		last      Command
+	)
+	for _, c := range commands {
+		switch c.(type) {
+		case *CommandAttach, *CommandTag, *CommandPush:
+			// These never change the state to commit
+			continue
+		}
+		originals = append(originals, c.String())
+		last = c
+	}
+
+	if last == nil {
+		return layer, false
+	}
+
+	layer.Commands = originals
+
+	switch c := last.(type) {
+	case *CommandRun:
+		cmd := handleJSONArgs(c.cfg.args, c.cfg.attrs)
+		if !c.cfg.attrs["json"] {
+			cmd = append([]string{"/bin/sh", "-c"}, cmd...)
+		}
+		layer.Expected = strings.Join(cmd, " ")
+	case *CommandCopy:
+		layer.Expected, layer.prefix = "/bin/sh -c #(nop) COPY ", true
+	case *CommandAdd:
+		layer.Expected, layer.prefix = "/bin/sh -c #(nop) ADD ", true
+	case *CommandImport:
+		layer.Expected, layer.prefix = "/opt/rsync/bin/rsync ", true
+	default:
+		layer.Expected = "/bin/sh -c #(nop) " + strings.Join(originals, "; ")
+	}
+
+	return layer, true
+}
+
+// CompareHistory matches the layers the plan commits with the history of
+// the image, the newest entry first as `docker history` gives it; it returns
+// the layers and the index of the first one that diverges, -1 if none
+func CompareHistory(plan Plan, history []docker.ImageHistory) (layers []HistoryLayer, diverged int) {
+	layers = PlanLayers(plan)
+	diverged = -1
+
+	for i := range layers {
+		// The newest layer of the plan is the top of the history
+		if j := len(layers) - 1 - i; j < len(history) {
+			layers[i].LayerID = history[j].ID
+			layers[i].CreatedBy = history[j].CreatedBy
+			if layers[i].prefix {
+				layers[i].Match = strings.HasPrefix(history[j].CreatedBy, layers[i].Expected)
+			} else {
+				layers[i].Match = history[j].CreatedBy == layers[i].Expected
+			}
+		}
+		if !layers[i].Match && diverged < 0 {
+			diverged = i
+		}
+	}
+
+	return layers, diverged
+}
+
+// CompareHistory fetches the history of the built image and logs where it
+// diverges from the plan, to debug cache hits that do not look as expected
+func (b *Build) CompareHistory(plan Plan) ([]HistoryLayer, error) {
+	imageID := b.GetImageID()
+	if imageID == "" {
+		return nil, fmt.Errorf("Cannot compare history, the build has produced no image")
+	}
+
+	history, err := b.client.ImageHistory(imageID)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get history of image %.12s, error: %s", imageID, err)
+	}
+
+	layers, diverged := CompareHistory(plan, history)
+
+	for i, layer := range layers {
+		switch {
+		case layer.Match:
+			log.Infof("| Layer %d %.12s matches: %s", i+1, layer.LayerID, strings.Join(layer.Commands, "; "))
+		case layer.LayerID == "":
+			log.Warnf("| Layer %d is missing in the history: %s", i+1, strings.Join(layer.Commands, "; "))
+		default:
+			log.Warnf("| Layer %d %.12s diverges: expected %q, history has %q", i+1, layer.LayerID, layer.Expected, layer.CreatedBy)
+		}
+	}
+
+	if diverged < 0 {
+		log.Infof("History of %.12s matches the plan", imageID)
+	} else {
+		log.Warnf("History of %.12s diverges from the plan at layer %d: %s", imageID, diverged+1, strings.Join(layers[diverged].Commands, "; "))
+	}
+
+	return layers, nil
+}
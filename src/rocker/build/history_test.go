@@ -0,0 +1,97 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"testing"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+)
+
+const historyRockerfile = `FROM golang:1.5
+ENV GOPATH=/go
+RUN go build
+COPY . /src
+LABEL version=1
+TAG app:latest`
+
+func TestHistory_PlanLayers(t *testing.T) {
+	layers := PlanLayers(makePlan(t, historyRockerfile))
+
+	assert.Len(t, layers, 3)
+	assert.Equal(t, []string{"ENV GOPATH=/go", "RUN go build"}, layers[0].Commands)
+	assert.Equal(t, "/bin/sh -c go build", layers[0].Expected)
+	assert.Equal(t, []string{"COPY . /src"}, layers[1].Commands)
+	assert.Equal(t, "/bin/sh -c #(nop) COPY ", layers[1].Expected)
+	assert.Equal(t, []string{"LABEL version=1"}, layers[2].Commands)
+	assert.Equal(t, "/bin/sh -c #(nop) LABEL version=1", layers[2].Expected)
+}
+
+func TestHistory_Match(t *testing.T) {
+	b, c := makeBuild(t, "", Config{})
+	b.state.ImageID = "789"
+
+	c.On("ImageHistory", "789").Return([]docker.ImageHistory{
+		{ID: "789", CreatedBy: "/bin/sh -c #(nop) LABEL version=1"},
+		{ID: "678", CreatedBy: "/bin/sh -c #(nop) COPY 8f4c2a6d to /src"},
+		{ID: "567", CreatedBy: "/bin/sh -c go build"},
+		{ID: "456", CreatedBy: "/bin/sh -c #(nop) CMD [\"/bin/bash\"]"},
+	}, nil).Once()
+
+	layers, err := b.CompareHistory(makePlan(t, historyRockerfile))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+	assert.Len(t, layers, 3)
+	for _, layer := range layers {
+		assert.True(t, layer.Match, "expected the layer to match: %+v", layer)
+	}
+	assert.Equal(t, "567", layers[0].LayerID)
+	assert.Equal(t, "789", layers[2].LayerID)
+}
+
+func TestHistory_Diverged(t *testing.T) {
+	history := []docker.ImageHistory{
+		{ID: "789", CreatedBy: "/bin/sh -c #(nop) LABEL version=1"},
+		{ID: "678", CreatedBy: "/bin/sh -c #(nop) COPY 8f4c2a6d to /src"},
+		{ID: "567", CreatedBy: "/bin/sh -c go build -race"},
+	}
+
+	layers, diverged := CompareHistory(makePlan(t, historyRockerfile), history)
+
+	assert.Equal(t, 0, diverged)
+	assert.False(t, layers[0].Match)
+	assert.Equal(t, "/bin/sh -c go build -race", layers[0].CreatedBy)
+	assert.True(t, layers[1].Match)
+	assert.True(t, layers[2].Match)
+}
+
+func TestHistory_Missing(t *testing.T) {
+	history := []docker.ImageHistory{
+		{ID: "789", CreatedBy: "/bin/sh -c #(nop) LABEL version=1"},
+	}
+
+	layers, diverged := CompareHistory(makePlan(t, historyRockerfile), history)
+
+	assert.Equal(t, 0, diverged)
+	assert.Equal(t, "", layers[0].LayerID)
+	assert.Equal(t, "", layers[1].LayerID)
+	assert.Equal(t, "789", layers[2].LayerID)
+}
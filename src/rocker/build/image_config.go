@@ -0,0 +1,48 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// writeImageConfig writes the config of the resulting image, e.g. its env,
+// cmd, entrypoint, labels and exposed ports, to a JSON file at OutputConfig
+func (b *Build) writeImageConfig() error {
+	data, err := json.MarshalIndent(b.state.Config, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(b.cfg.OutputConfig), 0755); err != nil {
+		return fmt.Errorf("Failed to create directory for image config %s, error: %s", b.cfg.OutputConfig, err)
+	}
+
+	if err := ioutil.WriteFile(b.cfg.OutputConfig, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("Failed to write image config %s, error: %s", b.cfg.OutputConfig, err)
+	}
+
+	log.Infof("Saved image config to %s", b.cfg.OutputConfig)
+
+	return nil
+}
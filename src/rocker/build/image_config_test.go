@@ -0,0 +1,77 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestBuild_OutputConfig(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "rocker-config-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	configPath := filepath.Join(tmpDir, "out", "config.json")
+
+	rockerfile := `FROM ubuntu
+ENV PATH=/app/bin:/usr/bin
+LABEL team=web
+EXPOSE 8080
+ENTRYPOINT ["/app/bin/server"]
+CMD ["--port", "8080"]`
+
+	b, c := makeBuild(t, rockerfile, Config{OutputConfig: configPath})
+	plan := makePlan(t, rockerfile)
+
+	c.On("InspectImage", "ubuntu").Return(&docker.Image{ID: "123", Config: &docker.Config{Env: []string{"PATH=/usr/bin"}}}, nil).Once()
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("456", nil).Once()
+	c.On("CommitContainer", mock.AnythingOfType("State"), mock.Anything).Return(&docker.Image{ID: "789"}, nil).Once()
+	c.On("RemoveContainer", "456").Return(nil).Once()
+
+	if err := b.Run(plan); err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+
+	data, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := ImageConfig{}
+	if err := json.Unmarshal(data, &config); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, b.state.Config, config)
+	assert.Equal(t, []string{"PATH=/app/bin:/usr/bin"}, config.Env)
+	assert.Equal(t, []string{"/app/bin/server"}, config.Entrypoint)
+	assert.Equal(t, []string{"--port", "8080"}, config.Cmd)
+	assert.Equal(t, map[string]string{"team": "web"}, config.Labels)
+	assert.Equal(t, map[docker.Port]struct{}{"8080/tcp": {}}, config.ExposedPorts)
+}
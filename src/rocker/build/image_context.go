@@ -0,0 +1,138 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"rocker/util"
+
+	"github.com/fsouza/go-dockerclient"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// ImageContextScheme is the prefix of a build context that refers to a docker image
+const ImageContextScheme = "docker-image://"
+
+// ParseContexts parses the list of named build contexts given
+// in the "name=docker-image://image:tag" format
+func ParseContexts(values []string) (contexts map[string]string, err error) {
+	contexts = map[string]string{}
+
+	for _, value := range values {
+		parts := strings.SplitN(value, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("Invalid build context %q, expected name=%simage", value, ImageContextScheme)
+		}
+		if !strings.HasPrefix(parts[1], ImageContextScheme) || len(parts[1]) == len(ImageContextScheme) {
+			return nil, fmt.Errorf("Invalid build context %q, only %s sources are supported", value, ImageContextScheme)
+		}
+		contexts[parts[0]] = strings.TrimPrefix(parts[1], ImageContextScheme)
+	}
+
+	return contexts, nil
+}
+
+// copyFromContext copies files from the image of a named build context.
+// Sources are absolute paths inside the image; wildcards are not supported.
+func copyFromContext(b *Build, name string, args []string, cmdName string) (s State, err error) {
+	image, ok := b.cfg.Contexts[name]
+	if !ok {
+		return b.state, fmt.Errorf("Unknown build context %s, please add it with --add-context", name)
+	}
+
+	tmpDir, err := ioutil.TempDir("", "rocker-context-")
+	if err != nil {
+		return b.state, err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	var (
+		src  = args[0 : len(args)-1]
+		dest = args[len(args)-1]
+	)
+
+	if err := fetchContextFiles(b.client, image, src, tmpDir); err != nil {
+		return b.state, err
+	}
+
+	// Sources are now relative to the temporary directory
+	relArgs := []string{}
+	for _, path := range src {
+		relArgs = append(relArgs, strings.TrimPrefix(filepath.Clean("/"+path), "/"))
+	}
+
+	return copyFilesFrom(b, tmpDir, []string{}, append(relArgs, dest), cmdName)
+}
+
+// fetchContextFiles makes a throwaway container from the image and downloads
+// the given paths from it to the directory, keeping their full paths
+func fetchContextFiles(client Client, image string, paths []string, dir string) (err error) {
+	if err = client.EnsureImage(image); err != nil {
+		return err
+	}
+
+	// The container is never started
+	s := State{
+		ImageID: image,
+		Config: ImageConfig{Config: docker.Config{
+			Cmd: []string{"/bin/sh", "-c", "#(nop) build context"},
+		}},
+	}
+
+	containerID, err := client.CreateContainer(s)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err := client.RemoveContainer(containerID); err != nil {
+			log.Errorf("Failed to remove temporary container %.12s, error: %s", containerID, err)
+		}
+	}()
+
+	for _, path := range paths {
+		path = filepath.Clean("/" + path)
+
+		// The archive contains the base name of the path, so extract it to the parent dir
+		destDir := filepath.Join(dir, filepath.Dir(path))
+
+		// The archives of the previous paths may have left symlinks there
+		if err := util.NoSymlinks(dir, destDir); err != nil {
+			return fmt.Errorf("Failed to copy %s from image %s, error: %s", path, image, err)
+		}
+		if err := os.MkdirAll(destDir, 0755); err != nil {
+			return err
+		}
+
+		stream, err := client.DownloadFromContainer(containerID, path)
+		if err == nil {
+			err = util.ExtractTar(stream, destDir)
+			stream.Close()
+		}
+		if err != nil {
+			return fmt.Errorf("Failed to copy %s from image %s, error: %s", path, image, err)
+		}
+	}
+
+	return nil
+}
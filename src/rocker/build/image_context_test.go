@@ -0,0 +1,190 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestImageContext_ParseContexts(t *testing.T) {
+	contexts, err := ParseContexts([]string{
+		"app=docker-image://foo:1.0",
+		"tools=docker-image://registry.example.com/tools@sha256:abc",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, map[string]string{
+		"app":   "foo:1.0",
+		"tools": "registry.example.com/tools@sha256:abc",
+	}, contexts)
+
+	for _, value := range []string{"app", "=docker-image://foo", "app=foo:1.0", "app=docker-image://"} {
+		_, err := ParseContexts([]string{value})
+		assert.Error(t, err, value)
+	}
+}
+
+func TestImageContext_FetchContextFiles(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "rocker-context-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	c := &MockClient{}
+
+	c.On("EnsureImage", "foo:1.0").Return(nil).Once()
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("123", nil).Run(func(args mock.Arguments) {
+		assert.Equal(t, "foo:1.0", args.Get(0).(State).ImageID)
+	}).Once()
+	archive := &bytes.Buffer{}
+	writeTestTar(t, archive, map[string]string{
+		"bin/":         "",
+		"bin/tool":     "#!/bin/sh",
+		"bin/lib/a.so": "binary",
+	})
+
+	c.On("DownloadFromContainer", "123", "/app/bin").Return(ioutil.NopCloser(archive), nil).Once()
+	c.On("RemoveContainer", "123").Return(nil).Once()
+
+	if err := fetchContextFiles(c, "foo:1.0", []string{"/app/bin"}, tmpDir); err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+
+	data, err := ioutil.ReadFile(filepath.Join(tmpDir, "app/bin/tool"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "#!/bin/sh", string(data))
+
+	data, err = ioutil.ReadFile(filepath.Join(tmpDir, "app/bin/lib/a.so"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "binary", string(data))
+}
+
+func TestImageContext_FetchContextFiles_Escape(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "rocker-context-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	archive := &bytes.Buffer{}
+	writeTestTar(t, archive, map[string]string{"../evil": "boo"})
+
+	err = fetchTestArchive(t, archive, filepath.Join(tmpDir, "context"))
+	assert.EqualError(t, err, "Failed to copy /app/bin from image foo:1.0, error: Tar entry ../evil points outside of "+filepath.Join(tmpDir, "context/app"))
+
+	_, err = os.Stat(filepath.Join(tmpDir, "context/evil"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestImageContext_FetchContextFiles_Symlink(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "rocker-context-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// The symlink points to the host, the next entry writes through it
+	archive := &bytes.Buffer{}
+	tw := tar.NewWriter(archive)
+	for _, hdr := range []*tar.Header{
+		{Name: "bin", Typeflag: tar.TypeSymlink, Linkname: tmpDir, ModTime: time.Now()},
+		{Name: "bin/evil", Typeflag: tar.TypeReg, Mode: 0644, Size: 3, ModTime: time.Now()},
+	} {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Size > 0 {
+			if _, err := tw.Write([]byte("boo")); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	err = fetchTestArchive(t, archive, filepath.Join(tmpDir, "context"))
+	assert.EqualError(t, err, "Failed to copy /app/bin from image foo:1.0, error: Path bin/evil goes through the symlink "+filepath.Join(tmpDir, "context/app/bin"))
+
+	_, err = os.Stat(filepath.Join(tmpDir, "evil"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+// fetchTestArchive fetches /app/bin of the image to dir, the archive is
+// what the container gives for the path
+func fetchTestArchive(t *testing.T, archive io.Reader, dir string) error {
+	c := &MockClient{}
+	c.On("EnsureImage", "foo:1.0").Return(nil).Once()
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("123", nil).Once()
+	c.On("DownloadFromContainer", "123", "/app/bin").Return(ioutil.NopCloser(archive), nil).Once()
+	c.On("RemoveContainer", "123").Return(nil).Once()
+
+	err := fetchContextFiles(c, "foo:1.0", []string{"/app/bin"}, dir)
+	c.AssertExpectations(t)
+	return err
+}
+
+func TestImageContext_UnknownContext(t *testing.T) {
+	b, _ := makeBuild(t, "", Config{})
+	_, err := copyFromContext(b, "app", []string{"/app/bin", "/bin"}, "COPY")
+	assert.EqualError(t, err, "Unknown build context app, please add it with --add-context")
+}
+
+func writeTestTar(t *testing.T, w io.Writer, files map[string]string) {
+	tw := tar.NewWriter(w)
+	for name, content := range files {
+		hdr := &tar.Header{
+			Name:     name,
+			Mode:     0644,
+			Size:     int64(len(content)),
+			ModTime:  time.Now(),
+			Typeflag: tar.TypeReg,
+		}
+		if name[len(name)-1] == '/' {
+			hdr.Mode = 0755
+			hdr.Typeflag = tar.TypeDir
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
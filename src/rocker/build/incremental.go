@@ -0,0 +1,205 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// IncrementalContext remembers the files uploaded by COPY/ADD steps and the
+// images they produced, so the next build of a changed context uploads only
+// the files changed since, on top of the image of the step, instead of the
+// whole context. Files are compared by size, mode and modification time.
+//
+// The changes are always uploaded on top of the image of the last whole
+// upload, not of the previous incremental one, so the layers do not pile up
+// build after build. The images of incremental uploads are not cached,
+// since they depend on the history of the builds rather than on the context.
+//
+// It is shared by consecutive builds, e.g. in --watch mode, and can be saved
+// to a file to be used by the next run of rocker.
+type IncrementalContext struct {
+	path  string
+	steps map[string]*IncrementalStep
+	mu    sync.Mutex
+}
+
+// IncrementalStep is the last whole upload of a COPY/ADD step
+type IncrementalStep struct {
+	ImageID string
+	Files   map[string]IncrementalFile
+}
+
+// IncrementalFile is the stamp of an uploaded file
+type IncrementalFile struct {
+	Size    int64
+	Mode    os.FileMode
+	ModTime time.Time
+}
+
+// NewIncrementalContext makes an IncrementalContext that is saved to the
+// given file and loads it, if the file exists; empty path keeps it in memory
+func NewIncrementalContext(path string) (*IncrementalContext, error) {
+	ic := &IncrementalContext{
+		path:  path,
+		steps: map[string]*IncrementalStep{},
+	}
+
+	if path == "" {
+		return ic, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return ic, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &ic.steps); err != nil {
+		// It is only an optimization, start from scratch
+		log.Warnf("Failed to read incremental context %s, error: %s", path, err)
+		ic.steps = map[string]*IncrementalStep{}
+	}
+
+	return ic, nil
+}
+
+// Save writes the IncrementalContext to its file
+func (ic *IncrementalContext) Save() error {
+	if ic.path == "" {
+		return nil
+	}
+
+	ic.mu.Lock()
+	data, err := json.Marshal(ic.steps)
+	ic.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(ic.path), 0755); err != nil {
+		return fmt.Errorf("Failed to create directory for incremental context %s, error: %s", ic.path, err)
+	}
+
+	return ioutil.WriteFile(ic.path, data, 0644)
+}
+
+// delta returns the files changed since the last whole upload of the step and
+// the image to upload them on top of. It returns false if the whole upload is needed:
+// the step was not uploaded before or some of the files are gone, since the
+// changes can be only added to the previous image, not removed from it
+func (ic *IncrementalContext) delta(key string, u *upload) (prev *IncrementalStep, changed []*uploadFile, ok bool) {
+	ic.mu.Lock()
+	prev = ic.steps[key]
+	ic.mu.Unlock()
+
+	if prev == nil || prev.ImageID == "" {
+		return nil, nil, false
+	}
+
+	stamps, err := stampFiles(u)
+	if err != nil {
+		return nil, nil, false
+	}
+
+	for name := range prev.Files {
+		if _, exists := stamps[name]; !exists {
+			return nil, nil, false
+		}
+	}
+
+	for _, f := range u.files {
+		name := u.dest + f.dest
+		if old, exists := prev.Files[name]; !exists || !old.equal(stamps[name]) {
+			changed = append(changed, f)
+		}
+	}
+
+	return prev, changed, true
+}
+
+// record remembers the files of the upload; imageID is set later
+// on commit if not known yet, see Build.setIncrementalImage
+func (ic *IncrementalContext) record(key string, u *upload, imageID string) (*IncrementalStep, error) {
+	stamps, err := stampFiles(u)
+	if err != nil {
+		return nil, err
+	}
+
+	step := &IncrementalStep{
+		ImageID: imageID,
+		Files:   stamps,
+	}
+
+	ic.mu.Lock()
+	ic.steps[key] = step
+	ic.mu.Unlock()
+
+	return step, nil
+}
+
+// setImage assigns the committed image ID to the recorded step
+func (ic *IncrementalContext) setImage(step *IncrementalStep, imageID string) {
+	ic.mu.Lock()
+	step.ImageID = imageID
+	ic.mu.Unlock()
+}
+
+// incrementalKey identifies a COPY/ADD step by the image it is applied to
+// and the command; the previous image of the step can be only reused on the same parent
+func incrementalKey(parentID, command string) string {
+	return parentID + " " + command
+}
+
+// equal returns true if the file is not changed since the other stamp
+func (f IncrementalFile) equal(other IncrementalFile) bool {
+	return f.Size == other.Size && f.Mode == other.Mode && f.ModTime.Equal(other.ModTime)
+}
+
+func stampFiles(u *upload) (map[string]IncrementalFile, error) {
+	stamps := make(map[string]IncrementalFile, len(u.files))
+	for _, f := range u.files {
+		fi, err := os.Stat(f.src)
+		if err != nil {
+			return nil, err
+		}
+		stamps[u.dest+f.dest] = IncrementalFile{
+			Size:    fi.Size(),
+			Mode:    fi.Mode(),
+			ModTime: fi.ModTime(),
+		}
+	}
+	return stamps, nil
+}
+
+// setIncrementalImage assigns the committed image ID to the uploads that wait for it
+func (b *Build) setIncrementalImage(imageID string) {
+	for _, step := range b.incremental {
+		b.cfg.Incremental.setImage(step, imageID)
+	}
+	b.incremental = nil
+}
@@ -0,0 +1,161 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIncrementalContext_Delta(t *testing.T) {
+	tmpDir := makeTmpDir(t, map[string]string{
+		"a.txt":     "hello",
+		"b/1.txt":   "hello",
+		"b/2.txt":   "hello",
+		"debug.log": "hello",
+	})
+	defer os.RemoveAll(tmpDir)
+
+	upload := func() *upload {
+		u, err := prepareUpload(tmpDir, "/app/", "COPY", []string{"."}, []string{"*.log"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return u
+	}
+
+	ic, err := NewIncrementalContext("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing to compare to at first
+	_, _, ok := ic.delta("123 COPY . /app/", upload())
+	assert.False(t, ok)
+
+	step, err := ic.record("123 COPY . /app/", upload(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The image is not committed yet
+	_, _, ok = ic.delta("123 COPY . /app/", upload())
+	assert.False(t, ok)
+
+	ic.setImage(step, "456")
+
+	// Modify one file and add another; the ignored file does not count
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(filepath.Join(tmpDir, "b/1.txt"), later, later); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(tmpDir, "c.txt"), []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(tmpDir, "debug.log"), []byte("more output"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	prev, changed, ok := ic.delta("123 COPY . /app/", upload())
+	assert.True(t, ok)
+	assert.Equal(t, "456", prev.ImageID)
+
+	names := []string{}
+	for _, f := range changed {
+		names = append(names, f.dest)
+	}
+	assert.Equal(t, []string{"b/1.txt", "c.txt"}, names)
+
+	// Mode-only changes count too
+	if err := os.Chmod(filepath.Join(tmpDir, "a.txt"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	_, changed, ok = ic.delta("123 COPY . /app/", upload())
+	assert.True(t, ok)
+	assert.Len(t, changed, 3)
+
+	// Another parent image makes another step
+	_, _, ok = ic.delta("789 COPY . /app/", upload())
+	assert.False(t, ok)
+
+	// Removed files cannot be removed from the previous image
+	if err := os.Remove(filepath.Join(tmpDir, "a.txt")); err != nil {
+		t.Fatal(err)
+	}
+	_, _, ok = ic.delta("123 COPY . /app/", upload())
+	assert.False(t, ok)
+}
+
+func TestIncrementalContext_Save(t *testing.T) {
+	tmpDir := makeTmpDir(t, map[string]string{
+		"a.txt": "hello",
+	})
+	defer os.RemoveAll(tmpDir)
+
+	u, err := prepareUpload(tmpDir, "/app/", "COPY", []string{"a.txt"}, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(tmpDir, "state", "incremental.json")
+
+	ic, err := NewIncrementalContext(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ic.record("123 COPY a.txt /app/", u, "456"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ic.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	ic2, err := NewIncrementalContext(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prev, changed, ok := ic2.delta("123 COPY a.txt /app/", u)
+	assert.True(t, ok)
+	assert.Equal(t, "456", prev.ImageID)
+	assert.Empty(t, changed)
+}
+
+func TestIncrementalContext_SetIncrementalImage(t *testing.T) {
+	ic, err := NewIncrementalContext("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, _ := makeBuild(t, "", Config{Incremental: ic})
+
+	step, err := ic.record("123 COPY . /app/", &upload{}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.incremental = append(b.incremental, step)
+
+	b.setIncrementalImage("456")
+
+	assert.Equal(t, "456", step.ImageID)
+	assert.Empty(t, b.incremental)
+}
@@ -0,0 +1,120 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Manifest is the list of files injected to the image by COPY/ADD steps
+type Manifest struct {
+	Steps []*ManifestStep
+}
+
+// ManifestStep describes files injected by a single COPY/ADD step
+// and the image that resulted from it
+type ManifestStep struct {
+	Command string
+	ImageID string
+	Files   []ManifestFile
+}
+
+// ManifestFile describes a single injected file
+type ManifestFile struct {
+	Path   string
+	Size   int64
+	SHA256 string
+}
+
+// addManifestStep records the files of the upload to the build manifest;
+// the image ID is filled in on the next commit, unless imageID is known already
+func (b *Build) addManifestStep(command string, u *upload, imageID string) error {
+	step := &ManifestStep{
+		Command: command,
+		ImageID: imageID,
+		Files:   make([]ManifestFile, 0, len(u.files)),
+	}
+
+	for _, f := range u.files {
+		sum, err := sha256File(f.src)
+		if err != nil {
+			return fmt.Errorf("Failed to calculate sha256 of %s, error: %s", f.src, err)
+		}
+		step.Files = append(step.Files, ManifestFile{
+			Path:   filepath.Join("/", u.dest, f.dest),
+			Size:   f.size,
+			SHA256: sum,
+		})
+	}
+
+	b.manifest.Steps = append(b.manifest.Steps, step)
+
+	return nil
+}
+
+// setManifestImage assigns the committed image ID to the steps that wait for it
+func (b *Build) setManifestImage(imageID string) {
+	for _, step := range b.manifest.Steps {
+		if step.ImageID == "" {
+			step.ImageID = imageID
+		}
+	}
+}
+
+// writeManifest writes the build manifest to a JSON file at ManifestPath
+func (b *Build) writeManifest() error {
+	data, err := json.MarshalIndent(b.manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(b.cfg.ManifestPath), 0755); err != nil {
+		return fmt.Errorf("Failed to create directory for manifest %s, error: %s", b.cfg.ManifestPath, err)
+	}
+
+	if err := ioutil.WriteFile(b.cfg.ManifestPath, data, 0644); err != nil {
+		return fmt.Errorf("Failed to write manifest %s, error: %s", b.cfg.ManifestPath, err)
+	}
+
+	log.Infof("Saved files manifest to %s", b.cfg.ManifestPath)
+
+	return nil
+}
+
+func sha256File(path string) (string, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer fd.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, fd); err != nil {
+		return "", err
+	}
+
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,94 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestManifest_Write(t *testing.T) {
+	tmpDir := makeTmpDir(t, map[string]string{
+		"a.txt":     "hello",
+		"lib/b.txt": "hello world",
+	})
+	defer os.RemoveAll(tmpDir)
+
+	manifestPath := filepath.Join(tmpDir, "out", "manifest.json")
+
+	b, _ := makeBuild(t, "", Config{ContextDir: tmpDir, ManifestPath: manifestPath})
+
+	u1, err := prepareUpload(tmpDir, "/src/", "COPY", []string{"a.txt", "lib"}, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	u2, err := prepareUpload(tmpDir, "/etc/b.txt", "ADD", []string{"lib/b.txt"}, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The first step was cached, the second one waits for the commit
+	if err := b.addManifestStep("COPY a.txt lib /src/", u1, "111"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.addManifestStep("ADD lib/b.txt /etc/b.txt", u2, ""); err != nil {
+		t.Fatal(err)
+	}
+	b.setManifestImage("222")
+
+	if err := b.writeManifest(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(manifestPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manifest := Manifest{}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		helloSum      = "sha256:2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+		helloWorldSum = "sha256:b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9"
+	)
+
+	assert.Equal(t, Manifest{Steps: []*ManifestStep{
+		{
+			Command: "COPY a.txt lib /src/",
+			ImageID: "111",
+			Files: []ManifestFile{
+				{Path: "/src/a.txt", Size: 5, SHA256: helloSum},
+				{Path: "/src/lib/b.txt", Size: 11, SHA256: helloWorldSum},
+			},
+		},
+		{
+			Command: "ADD lib/b.txt /etc/b.txt",
+			ImageID: "222",
+			Files: []ManifestFile{
+				{Path: "/etc/b.txt", Size: 11, SHA256: helloWorldSum},
+			},
+		},
+	}}, manifest)
+}
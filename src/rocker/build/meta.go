@@ -0,0 +1,200 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"rocker/template"
+	"rocker/textformatter"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// MetaLabel is the label holding the JSON of ImageMeta, it is added to the
+// images tagged by TAG and PUSH if Config.Meta is set
+const MetaLabel = "rocker-data"
+
+// ContextChecksumLabel is the label holding the checksum of the build context,
+// it is added to the images tagged by TAG and PUSH if Config.ContextChecksum is set
+const ContextChecksumLabel = "rocker-context-checksum"
+
+// ImageMeta is the metadata of the build stored in the images with --meta
+type ImageMeta struct {
+	ImageName  string        `json:"image_name"`
+	Rockerfile string        `json:"rockerfile"`
+	Source     string        `json:"source"`
+	Vars       template.Vars `json:"vars,omitempty"`
+	User       string        `json:"user,omitempty"`
+	Git        *GitMeta      `json:"git,omitempty"`
+}
+
+// GitMeta is the state of the git repository of the build context
+type GitMeta struct {
+	Branch string `json:"branch,omitempty"`
+	Sha    string `json:"sha,omitempty"`
+	URL    string `json:"url,omitempty"`
+}
+
+// commitMeta commits the metadata of the build to the current image before
+// it is tagged as imageName: the MetaLabel if Config.Meta is set and the
+// ContextChecksumLabel if Config.ContextChecksum is set. The labels are
+// committed as a metadata-only step, so the cache keeps the images with
+// the same metadata
+func (b *Build) commitMeta(imageName string) error {
+	var (
+		s = b.state
+
+		// Labels are shared with the previous states
+		labels  = map[string]string{}
+		changes = []string{}
+	)
+	for k, v := range s.Config.Labels {
+		labels[k] = v
+	}
+
+	if b.cfg.Meta != nil {
+		meta := *b.cfg.Meta
+		meta.ImageName = imageName
+		meta.Rockerfile = b.rockerfile.Name
+		meta.Source = b.rockerfile.Source
+		meta.Vars = b.rockerfile.Vars
+
+		data, err := json.Marshal(meta)
+		if err != nil {
+			return fmt.Errorf("Failed to serialize the metadata of %s, error: %s", imageName, err)
+		}
+		// The variables may carry credentials
+		data = []byte(textformatter.DefaultMasker.Mask(string(data)))
+
+		labels[MetaLabel] = string(data)
+		changes = append(changes, fmt.Sprintf("%s=sha256:%x", MetaLabel, sha256.Sum256(data)))
+	}
+
+	if b.cfg.ContextChecksum != "" {
+		labels[ContextChecksumLabel] = b.cfg.ContextChecksum
+		changes = append(changes, ContextChecksumLabel+"="+b.cfg.ContextChecksum)
+	}
+
+	if len(changes) == 0 {
+		return nil
+	}
+
+	s.Config.Labels = labels
+	s.Commit("LABEL %s", strings.Join(changes, " "))
+	b.state = s
+
+	var err error
+	b.state, err = (&CommandCommit{}).Execute(b)
+	return err
+}
+
+// InspectMeta returns the image and its rocker metadata, an error is
+// returned if the image is not found or has no metadata
+func InspectMeta(client Client, name string) (*docker.Image, *ImageMeta, error) {
+	img, err := client.InspectImage(name)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to inspect image %s, error: %s", name, err)
+	}
+	if img == nil {
+		return nil, nil, fmt.Errorf("Image %s not found", name)
+	}
+
+	var data string
+	if img.Config != nil {
+		data = img.Config.Labels[MetaLabel]
+	}
+	if data == "" {
+		return img, nil, fmt.Errorf("Image %s has no rocker metadata, build it with --meta", name)
+	}
+
+	meta := &ImageMeta{}
+	if err := json.Unmarshal([]byte(data), meta); err != nil {
+		return img, nil, fmt.Errorf("Failed to parse the %s label of image %s, error: %s", MetaLabel, name, err)
+	}
+
+	return img, meta, nil
+}
+
+// imageMetaJSON is the output of WriteImageMeta in JSON
+type imageMetaJSON struct {
+	ID      string     `json:"id"`
+	Parent  string     `json:"parent,omitempty"`
+	Created time.Time  `json:"created"`
+	Meta    *ImageMeta `json:"meta"`
+}
+
+// WriteImageMeta prints the metadata of the image, either as text for
+// humans or as JSON if asJSON is set
+func WriteImageMeta(w io.Writer, img *docker.Image, meta *ImageMeta, asJSON bool) error {
+	if asJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(imageMetaJSON{
+			ID:      img.ID,
+			Parent:  img.Parent,
+			Created: img.Created,
+			Meta:    meta,
+		})
+	}
+
+	lines := [][2]string{
+		{"Image", img.ID},
+		{"Parent", img.Parent},
+		{"Created", img.Created.Format(time.RFC3339)},
+		{"Name", meta.ImageName},
+		{"Rockerfile", meta.Rockerfile},
+		{"User", meta.User},
+	}
+	if meta.Git != nil {
+		lines = append(lines,
+			[2]string{"Git branch", meta.Git.Branch},
+			[2]string{"Git sha", meta.Git.Sha},
+			[2]string{"Git url", meta.Git.URL},
+		)
+	}
+
+	for _, line := range lines {
+		if line[1] == "" {
+			continue
+		}
+		if _, err := fmt.Fprintf(w, "%-12s%s\n", line[0]+":", line[1]); err != nil {
+			return err
+		}
+	}
+
+	if len(meta.Vars) > 0 {
+		fmt.Fprintln(w, "Vars:")
+		for _, v := range meta.Vars.ToStrings() {
+			fmt.Fprintf(w, "  %s\n", v)
+		}
+	}
+
+	fmt.Fprintln(w, "Source:")
+	for _, line := range strings.Split(strings.TrimRight(meta.Source, "\n"), "\n") {
+		if _, err := fmt.Fprintf(w, "  %s\n", line); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
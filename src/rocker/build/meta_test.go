@@ -0,0 +1,186 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"rocker/template"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func makeMetaImage(t *testing.T) *docker.Image {
+	data, err := json.Marshal(ImageMeta{
+		ImageName:  "grammarly/app:1.0",
+		Rockerfile: "Rockerfile",
+		Source:     "FROM alpine\nTAG grammarly/app:{{ .Version }}\n",
+		Vars:       template.Vars{"Version": "1.0"},
+		User:       "builder",
+		Git:        &GitMeta{Branch: "master", Sha: "abc123"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &docker.Image{
+		ID:      "sha256:456",
+		Parent:  "sha256:123",
+		Created: time.Date(2016, 1, 2, 3, 4, 5, 0, time.UTC),
+		Config: &docker.Config{
+			Labels: map[string]string{MetaLabel: string(data), "other": "label"},
+		},
+	}
+}
+
+func TestInspectMeta(t *testing.T) {
+	c := &MockClient{}
+	c.On("InspectImage", "grammarly/app:1.0").Return(makeMetaImage(t), nil).Once()
+
+	img, meta, err := InspectMeta(c, "grammarly/app:1.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+	assert.Equal(t, "sha256:456", img.ID)
+	assert.Equal(t, "grammarly/app:1.0", meta.ImageName)
+	assert.Equal(t, "1.0", meta.Vars["Version"])
+	assert.Equal(t, "abc123", meta.Git.Sha)
+}
+
+func TestInspectMeta_NoMeta(t *testing.T) {
+	c := &MockClient{}
+	c.On("InspectImage", "alpine").Return(&docker.Image{ID: "123", Config: &docker.Config{}}, nil).Once()
+	c.On("InspectImage", "missing").Return((*docker.Image)(nil), nil).Once()
+
+	_, _, err := InspectMeta(c, "alpine")
+	assert.EqualError(t, err, "Image alpine has no rocker metadata, build it with --meta")
+
+	_, _, err = InspectMeta(c, "missing")
+	assert.EqualError(t, err, "Image missing not found")
+}
+
+func TestWriteImageMeta(t *testing.T) {
+	c := &MockClient{}
+	c.On("InspectImage", "grammarly/app:1.0").Return(makeMetaImage(t), nil).Once()
+
+	img, meta, err := InspectMeta(c, "grammarly/app:1.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := WriteImageMeta(buf, img, meta, false); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, `Image:      sha256:456
+Parent:     sha256:123
+Created:    2016-01-02T03:04:05Z
+Name:       grammarly/app:1.0
+Rockerfile: Rockerfile
+User:       builder
+Git branch: master
+Git sha:    abc123
+Vars:
+  Version=1.0
+Source:
+  FROM alpine
+  TAG grammarly/app:{{ .Version }}
+`, buf.String())
+
+	buf.Reset()
+	if err := WriteImageMeta(buf, img, meta, true); err != nil {
+		t.Fatal(err)
+	}
+
+	out := struct {
+		ID     string
+		Parent string
+		Meta   ImageMeta
+	}{}
+	if err := json.Unmarshal(buf.Bytes(), &out); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "sha256:456", out.ID)
+	assert.Equal(t, "sha256:123", out.Parent)
+	assert.Equal(t, "Rockerfile", out.Meta.Rockerfile)
+}
+
+func TestCommandTag_Meta(t *testing.T) {
+	b, c := makeBuild(t, "FROM alpine", Config{Meta: &ImageMeta{User: "builder"}})
+	b.state.ImageID = "123"
+	b.rockerfile.Vars = template.Vars{"Version": "1.0"}
+	cmd := &CommandTag{ConfigCommand{
+		args: []string{"grammarly/app:1.0"},
+	}}
+
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("456", nil).Run(func(args mock.Arguments) {
+		meta := ImageMeta{}
+		label := args.Get(0).(State).Config.Labels[MetaLabel]
+		if err := json.Unmarshal([]byte(label), &meta); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, "grammarly/app:1.0", meta.ImageName)
+		assert.Equal(t, "builder", meta.User)
+		assert.Equal(t, "FROM alpine", meta.Source)
+		assert.Equal(t, "1.0", meta.Vars["Version"])
+	}).Once()
+	c.On("CommitContainer", mock.AnythingOfType("State"), mock.AnythingOfType("string")).Return(&docker.Image{ID: "789"}, nil).Once()
+	c.On("RemoveContainer", "456").Return(nil).Once()
+	c.On("TagImage", "789", "grammarly/app:1.0").Return(nil).Once()
+
+	state, err := cmd.Execute(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+	assert.Equal(t, "789", state.ImageID)
+}
+
+func TestCommandTag_ContextChecksum(t *testing.T) {
+	b, c := makeBuild(t, "FROM alpine", Config{ContextChecksum: "sha256:abc"})
+	b.state.ImageID = "123"
+	cmd := &CommandTag{ConfigCommand{
+		args: []string{"grammarly/app:1.0"},
+	}}
+
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("456", nil).Run(func(args mock.Arguments) {
+		labels := args.Get(0).(State).Config.Labels
+		assert.Equal(t, "sha256:abc", labels[ContextChecksumLabel])
+		_, ok := labels[MetaLabel]
+		assert.False(t, ok, "expected no metadata without --meta")
+	}).Once()
+	c.On("CommitContainer", mock.AnythingOfType("State"), "LABEL rocker-context-checksum=sha256:abc").Return(&docker.Image{ID: "789"}, nil).Once()
+	c.On("RemoveContainer", "456").Return(nil).Once()
+	c.On("TagImage", "789", "grammarly/app:1.0").Return(nil).Once()
+
+	state, err := cmd.Execute(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+	assert.Equal(t, "789", state.ImageID)
+}
@@ -0,0 +1,251 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Media types of the OCI image layout written by ExportOCILayout
+const (
+	ociManifestMediaType = "application/vnd.oci.image.manifest.v1+json"
+	ociIndexMediaType    = "application/vnd.oci.image.index.v1+json"
+	ociConfigMediaType   = "application/vnd.oci.image.config.v1+json"
+	ociLayerMediaType    = "application/vnd.oci.image.layer.v1.tar"
+)
+
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type ociManifest struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType"`
+	Config        ociDescriptor     `json:"config"`
+	Layers        []ociDescriptor   `json:"layers"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+type ociIndex struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType"`
+	Manifests     []ociDescriptor `json:"manifests"`
+}
+
+// ExportOCILayout writes the built image to dir as an OCI image layout with
+// the annotations of the build in the manifest; the daemon cannot push
+// annotations, but the layout can be pushed by tools like skopeo or oras
+func (b *Build) ExportOCILayout(dir string) (digest string, err error) {
+	imageID := b.GetImageID()
+	if imageID == "" {
+		return "", fmt.Errorf("Cannot export OCI layout, the build has produced no image")
+	}
+
+	r, err := b.client.ExportImage(imageID)
+	if err != nil {
+		return "", fmt.Errorf("Failed to export image %.12s, error: %s", imageID, err)
+	}
+	defer r.Close()
+
+	if digest, err = writeOCILayout(dir, r, b.GetAnnotations()); err != nil {
+		return "", fmt.Errorf("Failed to write OCI layout to %s, error: %s", dir, err)
+	}
+
+	log.Infof("| Exported image %.12s to OCI layout %s, manifest %s", imageID, dir, digest)
+
+	return digest, nil
+}
+
+// writeOCILayout converts the `docker save` archive to an OCI image layout in
+// dir and returns the digest of the manifest
+func writeOCILayout(dir string, r io.Reader, annotations map[string]string) (digest string, err error) {
+	blobsDir := filepath.Join(dir, "blobs", "sha256")
+	if err := os.MkdirAll(blobsDir, 0755); err != nil {
+		return "", err
+	}
+
+	// Files of the archive are written to blobs as they come, manifest.json
+	// telling which of them are the config and the layers is usually the last
+	var (
+		tr       = tar.NewReader(r)
+		blobs    = map[string]ociDescriptor{}
+		links    = map[string]string{}
+		manifest []byte
+	)
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeSymlink:
+			// Layers shared by images are symlinked to each other
+			links[hdr.Name] = path.Join(path.Dir(hdr.Name), hdr.Linkname)
+			continue
+		case tar.TypeReg, tar.TypeRegA:
+		default:
+			continue
+		}
+
+		switch hdr.Name {
+		case "manifest.json":
+			if manifest, err = ioutil.ReadAll(tr); err != nil {
+				return "", err
+			}
+			continue
+		case "repositories", "index.json", "oci-layout":
+			continue
+		}
+		switch path.Base(hdr.Name) {
+		case "json", "VERSION":
+			// Legacy metadata of the layers
+			continue
+		}
+
+		desc, err := writeOCIBlob(blobsDir, tr)
+		if err != nil {
+			return "", err
+		}
+		blobs[hdr.Name] = desc
+	}
+
+	if manifest == nil {
+		return "", fmt.Errorf("The image archive has no manifest.json, Docker 1.10 or later is required")
+	}
+	manifests := []imageManifest{}
+	if err := json.Unmarshal(manifest, &manifests); err != nil {
+		return "", fmt.Errorf("Failed to parse manifest.json of the image archive, error: %s", err)
+	}
+	if len(manifests) != 1 {
+		return "", fmt.Errorf("Expected a single image in the archive, got %d", len(manifests))
+	}
+
+	blob := func(name string) (ociDescriptor, error) {
+		if target, ok := links[name]; ok {
+			name = target
+		}
+		desc, ok := blobs[name]
+		if !ok {
+			return desc, fmt.Errorf("The image archive has no file %s", name)
+		}
+		return desc, nil
+	}
+
+	m := ociManifest{
+		SchemaVersion: 2,
+		MediaType:     ociManifestMediaType,
+		Layers:        []ociDescriptor{},
+		Annotations:   annotations,
+	}
+	if len(m.Annotations) == 0 {
+		m.Annotations = nil
+	}
+
+	if m.Config, err = blob(manifests[0].Config); err != nil {
+		return "", err
+	}
+	m.Config.MediaType = ociConfigMediaType
+
+	for _, name := range manifests[0].Layers {
+		layer, err := blob(name)
+		if err != nil {
+			return "", err
+		}
+		layer.MediaType = ociLayerMediaType
+		m.Layers = append(m.Layers, layer)
+	}
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		return "", err
+	}
+	desc, err := writeOCIBlob(blobsDir, bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	desc.MediaType = ociManifestMediaType
+
+	index := ociIndex{
+		SchemaVersion: 2,
+		MediaType:     ociIndexMediaType,
+		Manifests:     []ociDescriptor{desc},
+	}
+	if data, err = json.Marshal(index); err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "index.json"), data, 0644); err != nil {
+		return "", err
+	}
+
+	layout := []byte(`{"imageLayoutVersion":"1.0.0"}`)
+	if err := ioutil.WriteFile(filepath.Join(dir, "oci-layout"), layout, 0644); err != nil {
+		return "", err
+	}
+
+	return desc.Digest, nil
+}
+
+// writeOCIBlob writes the content to the blobs directory named after its digest
+func writeOCIBlob(blobsDir string, r io.Reader) (desc ociDescriptor, err error) {
+	f, err := ioutil.TempFile(blobsDir, ".tmp-")
+	if err != nil {
+		return desc, err
+	}
+	defer func() {
+		f.Close()
+		if err != nil {
+			os.Remove(f.Name())
+		}
+	}()
+
+	h := sha256.New()
+	if desc.Size, err = io.Copy(io.MultiWriter(f, h), r); err != nil {
+		return desc, err
+	}
+	if err = f.Close(); err != nil {
+		return desc, err
+	}
+
+	sum := hex.EncodeToString(h.Sum(nil))
+	desc.Digest = "sha256:" + sum
+
+	if err = os.Rename(f.Name(), filepath.Join(blobsDir, sum)); err != nil {
+		return desc, err
+	}
+
+	return desc, nil
+}
@@ -0,0 +1,190 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// makeSaveArchive makes a `docker save` archive of an image with two layers,
+// the second one is a symlink to the first as docker writes shared layers
+func makeSaveArchive(t *testing.T) []byte {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+
+	file := func(name, content string) {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	file("aaa/layer.tar", "layer data")
+	file("aaa/VERSION", "1.0")
+	if err := tw.WriteHeader(&tar.Header{Name: "bbb/layer.tar", Linkname: "../aaa/layer.tar", Typeflag: tar.TypeSymlink}); err != nil {
+		t.Fatal(err)
+	}
+	file("123.json", `{"architecture":"amd64","os":"linux"}`)
+	file("manifest.json", `[{"Config":"123.json","RepoTags":null,"Layers":["aaa/layer.tar","bbb/layer.tar"]}]`)
+
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func readOCIManifest(t *testing.T, dir string) (index ociIndex, manifest ociManifest) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, "index.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, &index); err != nil {
+		t.Fatal(err)
+	}
+	if !assert.Len(t, index.Manifests, 1) {
+		t.FailNow()
+	}
+
+	data, err = ioutil.ReadFile(filepath.Join(dir, "blobs", "sha256", strings.TrimPrefix(index.Manifests[0].Digest, "sha256:")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	return index, manifest
+}
+
+func TestWriteOCILayout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rocker-oci-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	annotations := map[string]string{"org.opencontainers.image.source": "https://github.com/grammarly/rocker"}
+
+	digest, err := writeOCILayout(dir, bytes.NewReader(makeSaveArchive(t)), annotations)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	index, manifest := readOCIManifest(t, dir)
+	assert.Equal(t, digest, index.Manifests[0].Digest)
+	assert.Equal(t, ociManifestMediaType, index.Manifests[0].MediaType)
+
+	assert.Equal(t, ociManifestMediaType, manifest.MediaType)
+	assert.Equal(t, annotations, manifest.Annotations)
+	assert.Equal(t, ociConfigMediaType, manifest.Config.MediaType)
+
+	layerSum := sha256.Sum256([]byte("layer data"))
+	layerDigest := "sha256:" + hex.EncodeToString(layerSum[:])
+	if assert.Len(t, manifest.Layers, 2) {
+		for _, layer := range manifest.Layers {
+			assert.Equal(t, ociLayerMediaType, layer.MediaType)
+			assert.Equal(t, layerDigest, layer.Digest)
+			assert.EqualValues(t, len("layer data"), layer.Size)
+		}
+	}
+
+	for _, d := range []string{manifest.Config.Digest, layerDigest} {
+		_, err := os.Stat(filepath.Join(dir, "blobs", "sha256", strings.TrimPrefix(d, "sha256:")))
+		assert.NoError(t, err, "blob %s", d)
+	}
+
+	layout, err := ioutil.ReadFile(filepath.Join(dir, "oci-layout"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, `{"imageLayoutVersion":"1.0.0"}`, string(layout))
+}
+
+func TestWriteOCILayout_NoAnnotations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rocker-oci-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if _, err := writeOCILayout(dir, bytes.NewReader(makeSaveArchive(t)), map[string]string{}); err != nil {
+		t.Fatal(err)
+	}
+
+	_, manifest := readOCIManifest(t, dir)
+	assert.Nil(t, manifest.Annotations)
+}
+
+func TestBuild_ExportOCILayout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rocker-oci-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rockerfile := `FROM ubuntu
+ANNOTATION org.opencontainers.image.title=app org.opencontainers.image.version=1.0
+RUN make`
+	b, c := makeBuild(t, rockerfile, Config{
+		Annotations: map[string]string{"org.opencontainers.image.version": "1.1"},
+	})
+	plan := makePlan(t, rockerfile)
+
+	img := &docker.Image{
+		ID:     "123",
+		Config: &docker.Config{},
+	}
+
+	c.On("InspectImage", "ubuntu").Return(img, nil).Once()
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("456", nil).Once()
+	c.On("RunContainer", "456", false).Return(nil).Once()
+	c.On("CommitContainer", mock.AnythingOfType("State"), "RUN make").Return(&docker.Image{ID: "789"}, nil).Run(func(args mock.Arguments) {
+		// Annotations are not labels
+		assert.Empty(t, args.Get(0).(State).Config.Labels)
+	}).Once()
+	c.On("RemoveContainer", "456").Return(nil).Once()
+	c.On("ExportImage", "789").Return(ioutil.NopCloser(bytes.NewReader(makeSaveArchive(t))), nil).Once()
+
+	if err := b.Run(plan); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.ExportOCILayout(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	_, manifest := readOCIManifest(t, dir)
+	assert.Equal(t, map[string]string{
+		"org.opencontainers.image.title":   "app",
+		"org.opencontainers.image.version": "1.1",
+	}, manifest.Annotations)
+
+	c.AssertExpectations(t)
+}
@@ -0,0 +1,155 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+)
+
+// OutputFilter is given by RUN --grep, only the lines of the container
+// output matching Pattern are shown; the full output goes to LogFile if set
+type OutputFilter struct {
+	Pattern string
+	LogFile string
+}
+
+// outputTailLines is the number of the last lines of the full output shown
+// when the container of a filtered step fails
+const outputTailLines = 20
+
+// filteredOutput is shared by the stdout and stderr writers of a container,
+// it keeps the tail of the full output and writes it to the log file
+type filteredOutput struct {
+	mu      sync.Mutex
+	pattern *regexp.Regexp
+	log     *os.File
+	tail    []string
+	writers []*filterWriter
+}
+
+// newFilteredOutput compiles the pattern of the filter and creates its log
+// file, the caller should close the output once the container is finished
+func newFilteredOutput(filter *OutputFilter) (*filteredOutput, error) {
+	pattern, err := regexp.Compile(filter.Pattern)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid RUN --grep %q, error: %s", filter.Pattern, err)
+	}
+
+	o := &filteredOutput{pattern: pattern}
+
+	if filter.LogFile != "" {
+		if err := os.MkdirAll(filepath.Dir(filter.LogFile), 0755); err != nil {
+			return nil, fmt.Errorf("Failed to create directory for RUN --grep-log %s, error: %s", filter.LogFile, err)
+		}
+		if o.log, err = os.Create(filter.LogFile); err != nil {
+			return nil, fmt.Errorf("Failed to create RUN --grep-log %s, error: %s", filter.LogFile, err)
+		}
+	}
+
+	return o, nil
+}
+
+// writer wraps the writer of a container stream, so that it only gets the
+// matching lines
+func (o *filteredOutput) writer(out io.Writer) io.Writer {
+	w := &filterWriter{output: o, out: out}
+	o.writers = append(o.writers, w)
+	return w
+}
+
+// line passes a complete line of the full output to out if it matches
+func (o *filteredOutput) line(out io.Writer, line []byte) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.log != nil {
+		if _, err := o.log.Write(line); err != nil {
+			return err
+		}
+	}
+
+	o.tail = append(o.tail, string(bytes.TrimRight(line, "\n")))
+	if len(o.tail) > outputTailLines {
+		o.tail = o.tail[1:]
+	}
+
+	if !o.pattern.Match(line) {
+		return nil
+	}
+	_, err := out.Write(line)
+	return err
+}
+
+// Tail returns the last lines of the full output
+func (o *filteredOutput) Tail() []string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return append([]string{}, o.tail...)
+}
+
+// flush passes the incomplete last lines of the streams
+func (o *filteredOutput) flush() {
+	for _, w := range o.writers {
+		w.flush()
+	}
+}
+
+// Close flushes the streams and closes the log file
+func (o *filteredOutput) Close() error {
+	o.flush()
+	if o.log == nil {
+		return nil
+	}
+	return o.log.Close()
+}
+
+// filterWriter splits the stream written by attach into lines, they may come
+// in chunks of any size
+type filterWriter struct {
+	output *filteredOutput
+	out    io.Writer
+	buf    []byte
+}
+
+// Write implements io.Writer
+func (w *filterWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		line := append([]byte{}, w.buf[:i+1]...)
+		w.buf = w.buf[i+1:]
+		if err := w.output.line(w.out, line); err != nil {
+			return len(p), err
+		}
+	}
+}
+
+func (w *filterWriter) flush() {
+	if len(w.buf) > 0 {
+		w.output.line(w.out, append(w.buf, '\n'))
+		w.buf = nil
+	}
+}
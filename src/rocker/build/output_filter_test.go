@@ -0,0 +1,121 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFilteredOutput_Lines(t *testing.T) {
+	output, err := newFilteredOutput(&OutputFilter{Pattern: "ERROR"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := &bytes.Buffer{}
+	w := output.writer(out)
+
+	// Lines come in chunks of any size
+	for _, chunk := range []string{"compiling\nERR", "OR: no such file\nli", "nking\n"} {
+		if _, err := w.Write([]byte(chunk)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	assert.Equal(t, "ERROR: no such file\n", out.String())
+	assert.Equal(t, []string{"compiling", "ERROR: no such file", "linking"}, output.Tail())
+}
+
+func TestFilteredOutput_Flush(t *testing.T) {
+	output, err := newFilteredOutput(&OutputFilter{Pattern: "ERROR"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	w1, w2 := output.writer(stdout), output.writer(stderr)
+
+	w1.Write([]byte("done\nERROR: no newline"))
+	w2.Write([]byte("ERROR: on stderr"))
+
+	assert.Equal(t, "", stdout.String())
+	assert.Equal(t, "", stderr.String())
+
+	if err := output.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "ERROR: no newline\n", stdout.String())
+	assert.Equal(t, "ERROR: on stderr\n", stderr.String())
+	assert.Equal(t, []string{"done", "ERROR: no newline", "ERROR: on stderr"}, output.Tail())
+}
+
+func TestFilteredOutput_Tail(t *testing.T) {
+	output, err := newFilteredOutput(&OutputFilter{Pattern: "ERROR"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := output.writer(ioutil.Discard)
+	for i := 1; i <= outputTailLines+5; i++ {
+		fmt.Fprintf(w, "line %d\n", i)
+	}
+
+	tail := output.Tail()
+	if assert.Len(t, tail, outputTailLines) {
+		assert.Equal(t, "line 6", tail[0])
+		assert.Equal(t, fmt.Sprintf("line %d", outputTailLines+5), tail[len(tail)-1])
+	}
+}
+
+func TestFilteredOutput_LogFile(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "rocker-grep-log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	logFile := filepath.Join(tmpDir, "logs", "make.log")
+
+	output, err := newFilteredOutput(&OutputFilter{Pattern: "ERROR", LogFile: logFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := &bytes.Buffer{}
+	w := output.writer(out)
+	w.Write([]byte("compiling\nERROR: no such file\nlinking"))
+
+	if err := output.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(logFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "compiling\nERROR: no such file\nlinking\n", string(data))
+	assert.Equal(t, "ERROR: no such file\n", out.String())
+}
@@ -22,11 +22,22 @@ import "strings"
 type Plan []Command
 
 // NewPlan makes a new plan out of the list of commands from a Rockerfile
+//
+// Metadata-only commands (ENV, LABEL, WORKDIR, etc.) do not produce a commit
+// on their own. Their changes are collected and coalesced into the commit of
+// the next command that changes the filesystem (RUN, ADD, COPY), so that
+// "ENV; LABEL; RUN" ends up in a single layer carrying both the config and
+// the filesystem change, the same way the final image would look anyway.
+// Commands that need an image ID (TAG, PUSH, FROM, etc.) still commit the
+// collected changes before they run, so tagged images never miss metadata.
 func NewPlan(commands []ConfigCommand, finalCleanup bool) (plan Plan, err error) {
 	plan = Plan{}
 
 	committed := true
 
+	// keep is set for the stages marked with "# rocker:keep"
+	keep := false
+
 	commit := func() {
 		plan = append(plan, &CommandCommit{})
 		committed = true
@@ -36,10 +47,11 @@ func NewPlan(commands []ConfigCommand, finalCleanup bool) (plan Plan, err error)
 		plan = append(plan, &CommandCleanup{
 			final:  i == len(commands)-1,
 			tagged: strings.Contains("tag push from", commands[i].name),
+			keep:   keep,
 		})
 	}
 
-	alwaysCommitBefore := "run attach add copy tag push export import"
+	alwaysCommitBefore := "attach tag push export import"
 	alwaysCommitAfter := "run attach add copy export import"
 	neverCommitAfter := "from maintainer tag push"
 
@@ -60,6 +72,7 @@ func NewPlan(commands []ConfigCommand, finalCleanup bool) (plan Plan, err error)
 			if i > 0 {
 				cleanup(i - 1)
 			}
+			keep = cfg.attrs["keep"]
 		}
 
 		// Commit before commands that require state
@@ -0,0 +1,176 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Types of the commands that are only made by NewPlan, the Rockerfile
+// instructions are serialized by their names, see commandTypes
+const (
+	planCommit  = "commit"
+	planCleanup = "cleanup"
+)
+
+// planCommand is a command of a serialized Plan
+type planCommand struct {
+	Type     string            `json:"type"`
+	Args     []string          `json:"args,omitempty"`
+	Attrs    map[string]bool   `json:"attrs,omitempty"`
+	Flags    map[string]string `json:"flags,omitempty"`
+	Original string            `json:"original,omitempty"`
+	Onbuild  bool              `json:"onbuild,omitempty"`
+	Final    bool              `json:"final,omitempty"`
+	Tagged   bool              `json:"tagged,omitempty"`
+	Keep     bool              `json:"keep,omitempty"`
+}
+
+// MarshalJSON serializes the plan as the list of commands with their types
+// and arguments, so it can be built later without rendering the Rockerfile
+func (p Plan) MarshalJSON() ([]byte, error) {
+	commands := make([]planCommand, 0, len(p))
+
+	for i, cmd := range p {
+		var pc planCommand
+
+		switch c := cmd.(type) {
+		case *CommandCommit:
+			pc.Type = planCommit
+		case *CommandCleanup:
+			pc.Type = planCleanup
+			pc.Final = c.final
+			pc.Tagged = c.tagged
+			pc.Keep = c.keep
+		default:
+			cfg, ok := commandConfig(cmd)
+			if !ok {
+				return nil, fmt.Errorf("Cannot serialize step %d of the plan, unknown command %T", i+1, cmd)
+			}
+			pc = planCommand{
+				Type:     cfg.name,
+				Args:     cfg.args,
+				Attrs:    cfg.attrs,
+				Flags:    cfg.flags,
+				Original: cfg.original,
+				Onbuild:  cfg.isOnbuild,
+			}
+		}
+
+		commands = append(commands, pc)
+	}
+
+	return json.Marshal(commands)
+}
+
+// UnmarshalJSON makes the plan of the commands serialized by MarshalJSON
+func (p *Plan) UnmarshalJSON(data []byte) error {
+	var commands []planCommand
+	if err := json.Unmarshal(data, &commands); err != nil {
+		return err
+	}
+
+	plan := make(Plan, 0, len(commands))
+
+	for i, pc := range commands {
+		switch pc.Type {
+		case planCommit:
+			plan = append(plan, &CommandCommit{})
+		case planCleanup:
+			plan = append(plan, &CommandCleanup{final: pc.Final, tagged: pc.Tagged, keep: pc.Keep})
+		default:
+			// The same as parseCommand makes
+			if pc.Args == nil {
+				pc.Args = []string{}
+			}
+			if pc.Flags == nil {
+				pc.Flags = map[string]string{}
+			}
+			cmd, err := NewCommand(ConfigCommand{
+				name:      pc.Type,
+				args:      pc.Args,
+				attrs:     pc.Attrs,
+				flags:     pc.Flags,
+				original:  pc.Original,
+				isOnbuild: pc.Onbuild,
+			})
+			if err != nil {
+				return fmt.Errorf("Cannot read step %d of the plan, error: %s", i+1, err)
+			}
+			plan = append(plan, cmd)
+		}
+	}
+
+	*p = plan
+
+	return nil
+}
+
+// commandConfig returns the configuration the command was made of by NewCommand,
+// every type of commandTypes should be listed here to be serialized
+func commandConfig(cmd Command) (ConfigCommand, bool) {
+	switch c := cmd.(type) {
+	case *CommandOnbuildWrap:
+		return commandConfig(c.cmd)
+	case *CommandFrom:
+		return c.cfg, true
+	case *CommandMaintainer:
+		return c.cfg, true
+	case *CommandRun:
+		return c.cfg, true
+	case *CommandAttach:
+		return c.cfg, true
+	case *CommandEnv:
+		return c.cfg, true
+	case *CommandLabel:
+		return c.cfg, true
+	case *CommandAnnotation:
+		return c.cfg, true
+	case *CommandConfig:
+		return c.cfg, true
+	case *CommandWorkdir:
+		return c.cfg, true
+	case *CommandTag:
+		return c.cfg, true
+	case *CommandPush:
+		return c.cfg, true
+	case *CommandCopy:
+		return c.cfg, true
+	case *CommandAdd:
+		return c.cfg, true
+	case *CommandCmd:
+		return c.cfg, true
+	case *CommandEntrypoint:
+		return c.cfg, true
+	case *CommandExpose:
+		return c.cfg, true
+	case *CommandVolume:
+		return c.cfg, true
+	case *CommandUser:
+		return c.cfg, true
+	case *CommandOnbuild:
+		return c.cfg, true
+	case *CommandMount:
+		return c.cfg, true
+	case *CommandExport:
+		return c.cfg, true
+	case *CommandImport:
+		return c.cfg, true
+	}
+	return ConfigCommand{}, false
+}
@@ -17,6 +17,7 @@
 package build
 
 import (
+	"encoding/json"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -69,7 +70,34 @@ RUN apt-get update
 		&CommandFrom{},
 		&CommandEnv{},
 		&CommandEnv{},
+		&CommandRun{},
+		&CommandCommit{},
+		&CommandCleanup{},
+	}
+
+	assert.Len(t, p, len(expected))
+	for i, c := range expected {
+		assert.IsType(t, c, p[i])
+	}
+}
+
+func TestPlan_EnvCopyEnvRun(t *testing.T) {
+	p := makePlan(t, `
+FROM ubuntu
+ENV name=web
+COPY . /src
+LABEL version=1.2
+WORKDIR /src
+RUN make
+`)
+
+	expected := []Command{
+		&CommandFrom{},
+		&CommandEnv{},
+		&CommandCopy{},
 		&CommandCommit{},
+		&CommandLabel{},
+		&CommandWorkdir{},
 		&CommandRun{},
 		&CommandCommit{},
 		&CommandCleanup{},
@@ -342,3 +370,48 @@ func makePlan(t *testing.T, rockerfileContent string) Plan {
 
 	return p
 }
+
+func TestPlan_JSON(t *testing.T) {
+	p := makePlan(t, `
+FROM ubuntu
+ENV name=web
+COPY --chown=app . /app/
+RUN ["make", "build"]
+ONBUILD RUN make test
+TAG web:latest
+FROM alpine
+EXPORT /app/bin
+`)
+
+	data, err := json.Marshal(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var p2 Plan
+	if err := json.Unmarshal(data, &p2); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, p, p2)
+}
+
+func TestPlan_JSON_UnknownCommand(t *testing.T) {
+	var p Plan
+	err := json.Unmarshal([]byte(`[{"type":"from","args":["ubuntu"]},{"type":"frobnicate"}]`), &p)
+	assert.EqualError(t, err, "Cannot read step 2 of the plan, error: Unknown command: frobnicate")
+}
+
+func TestPlan_CleanupKeepStage(t *testing.T) {
+	p := makePlan(t, `
+FROM golang:1.5 # rocker:keep
+RUN make
+FROM alpine
+RUN make
+`)
+
+	// from, run, commit, cleanup, from, run, commit, cleanup
+	assert.Equal(t, []string{"golang:1.5"}, p[0].(*CommandFrom).cfg.args)
+	assert.True(t, p[3].(*CommandCleanup).keep)
+	assert.False(t, p[7].(*CommandCleanup).keep)
+}
@@ -0,0 +1,76 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"io"
+
+	"github.com/docker/docker/pkg/units"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// uploadProgressMinSize is the size of an upload starting from which
+	// the progress is reported
+	uploadProgressMinSize = 50 * 1024 * 1024
+
+	// uploadProgressSteps is how many times the progress is reported
+	uploadProgressSteps = 10
+)
+
+// progressReader wraps the reader and periodically logs
+// how much data has been read out of the known total
+type progressReader struct {
+	r       io.Reader
+	total   int64
+	current int64
+	next    int64
+	step    int64
+	log     *log.Logger
+}
+
+func newProgressReader(r io.Reader, total int64, logger *log.Logger) *progressReader {
+	step := total / uploadProgressSteps
+	if step < 1 {
+		step = 1
+	}
+	return &progressReader{
+		r:     r,
+		total: total,
+		next:  step,
+		step:  step,
+		log:   logger,
+	}
+}
+
+// Read implements io.Reader
+func (p *progressReader) Read(b []byte) (n int, err error) {
+	n, err = p.r.Read(b)
+	p.current += int64(n)
+
+	if p.current >= p.next {
+		p.log.Infof("| Uploaded %s of %s",
+			units.HumanSize(float64(p.current)), units.HumanSize(float64(p.total)))
+
+		for p.next <= p.current {
+			p.next += p.step
+		}
+	}
+
+	return n, err
+}
@@ -0,0 +1,64 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+func TestProgressReader(t *testing.T) {
+	var (
+		out    = &bytes.Buffer{}
+		total  = int64(10 * 1024 * 1024)
+		logger = &log.Logger{
+			Out:       out,
+			Formatter: &log.TextFormatter{DisableColors: true},
+			Level:     log.InfoLevel,
+		}
+	)
+
+	// Emulate the uploader consuming the stream
+	r := newProgressReader(io.LimitReader(zeroReader{}, total), total, logger)
+	n, err := io.Copy(ioutil.Discard, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+
+	assert.Equal(t, total, n)
+	assert.Len(t, lines, uploadProgressSteps)
+	assert.Contains(t, lines[0], "| Uploaded 1.049 MB of 10.49 MB")
+	assert.Contains(t, lines[len(lines)-1], "| Uploaded 10.49 MB of 10.49 MB")
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = 0
+	}
+	return len(b), nil
+}
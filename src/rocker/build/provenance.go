@@ -0,0 +1,136 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Provenance lists the inputs and outputs of the build. It is written as JSON
+// by the --provenance option:
+//
+//	{
+//	  "image_id": "sha256:...",          // the resulting image
+//	  "from": [                          // base images of FROM steps
+//	    {"command": "FROM ubuntu:14.04", "image_id": "sha256:...", "layers": ["sha256:..."]}
+//	  ],
+//	  "images": [                        // images produced by the steps
+//	    {"command": "RUN make", "image_id": "sha256:...", "layers": ["sha256:...", "sha256:..."]}
+//	  ],
+//	  "pulled": [                        // images pulled from registries
+//	    {"direction": "pull", "image": "ubuntu:14.04", "digest": "sha256:...", "layers": ["sha256:..."]}
+//	  ],
+//	  "pushed": [                        // images pushed to registries
+//	    {"direction": "push", "image": "app:1", "digest": "sha256:...", "layers": ["sha256:...", "sha256:..."]}
+//	  ]
+//	}
+//
+// Layers are the diff IDs of the layers of the image, from the base one, as
+// the daemon reports them in RootFS; images that were taken from the cache
+// are listed as well.
+type Provenance struct {
+	ImageID string            `json:"image_id"`
+	From    []ProvenanceImage `json:"from"`
+	Images  []ProvenanceImage `json:"images"`
+	Pulled  []ImageTransfer   `json:"pulled"`
+	Pushed  []ImageTransfer   `json:"pushed"`
+}
+
+// ProvenanceImage is an image taken or produced by a build step
+type ProvenanceImage struct {
+	Command string   `json:"command"`
+	ImageID string   `json:"image_id"`
+	Layers  []string `json:"layers"`
+}
+
+// Provenance returns the inputs and outputs of the build so far
+func (b *Build) Provenance() Provenance {
+	p := Provenance{
+		ImageID: b.state.ImageID,
+		From:    append([]ProvenanceImage{}, b.provenance.From...),
+		Images:  append([]ProvenanceImage{}, b.provenance.Images...),
+		Pulled:  []ImageTransfer{},
+		Pushed:  []ImageTransfer{},
+	}
+
+	for _, t := range b.client.Transfers() {
+		if t.Direction == TransferPush {
+			p.Pushed = append(p.Pushed, t)
+		} else {
+			p.Pulled = append(p.Pulled, t)
+		}
+	}
+
+	return p
+}
+
+// recordProvenance remembers the image of the step if the step changed it;
+// commits are described by the commands that went into them
+func (b *Build) recordProvenance(c Command, imageBefore string, history []string) {
+	if b.state.ImageID == "" || b.state.ImageID == imageBefore {
+		return
+	}
+
+	img := ProvenanceImage{Command: c.String(), ImageID: b.state.ImageID, Layers: []string{}}
+
+	// Only the build with --provenance pays for the inspection
+	if b.cfg.ProvenancePath != "" {
+		layers, err := b.client.ImageLayers(b.state.ImageID)
+		if err != nil {
+			log.Debugf("Failed to inspect layers of image %.12s, error: %s", b.state.ImageID, err)
+		} else {
+			img.Layers = layers
+		}
+	}
+
+	if _, ok := c.(*CommandCommit); ok && len(history) > 0 {
+		img.Command = strings.Join(history, "; ")
+	}
+
+	if _, ok := c.(*CommandFrom); ok {
+		b.provenance.From = append(b.provenance.From, img)
+	} else {
+		b.provenance.Images = append(b.provenance.Images, img)
+	}
+}
+
+// writeProvenance writes the provenance of the build to a JSON file at ProvenancePath
+func (b *Build) writeProvenance() error {
+	data, err := json.MarshalIndent(b.Provenance(), "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(b.cfg.ProvenancePath), 0755); err != nil {
+		return fmt.Errorf("Failed to create directory for provenance %s, error: %s", b.cfg.ProvenancePath, err)
+	}
+
+	if err := ioutil.WriteFile(b.cfg.ProvenancePath, data, 0644); err != nil {
+		return fmt.Errorf("Failed to write provenance %s, error: %s", b.cfg.ProvenancePath, err)
+	}
+
+	log.Infof("Saved provenance to %s", b.cfg.ProvenancePath)
+
+	return nil
+}
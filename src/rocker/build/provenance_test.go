@@ -0,0 +1,87 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestProvenance_Write(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "rocker-provenance-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	provenancePath := filepath.Join(tmpDir, "out", "provenance.json")
+
+	rockerfile := "FROM ubuntu:14.04\nRUN make\nPUSH app:1"
+	b, c := makeBuild(t, rockerfile, Config{ProvenancePath: provenancePath, Push: true})
+	plan := makePlan(t, rockerfile)
+
+	transfers := []ImageTransfer{
+		{Direction: TransferPull, Image: "ubuntu:14.04", Digest: "sha256:aaaa", Layers: []string{"sha256:layer1"}},
+		{Direction: TransferPush, Image: "app:1", Digest: "sha256:bbbb", Layers: []string{"sha256:layer1", "sha256:layer2"}},
+	}
+
+	c.On("InspectImage", "ubuntu:14.04").Return(&docker.Image{ID: "sha256:base"}, nil).Once()
+	c.On("ImageLayers", "sha256:base").Return([]string{"sha256:layer1"}, nil).Once()
+	c.On("ImageLayers", "sha256:app").Return([]string{"sha256:layer1", "sha256:layer2"}, nil).Once()
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("456", nil).Once()
+	c.On("RunContainer", "456", false).Return(nil).Once()
+	c.On("CommitContainer", mock.AnythingOfType("State"), "RUN make").Return(&docker.Image{ID: "sha256:app"}, nil).Once()
+	c.On("RemoveContainer", "456").Return(nil).Once()
+	c.On("TagImage", "sha256:app", "app:1").Return(nil).Once()
+	c.On("PushImage", "app:1").Return("sha256:bbbb", PushStats{}, nil).Once()
+	c.On("Transfers").Return(transfers).Once()
+
+	if err := b.Run(plan); err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+
+	data, err := ioutil.ReadFile(provenancePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	provenance := Provenance{}
+	if err := json.Unmarshal(data, &provenance); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, Provenance{
+		ImageID: "sha256:app",
+		From: []ProvenanceImage{
+			{Command: "FROM ubuntu:14.04", ImageID: "sha256:base", Layers: []string{"sha256:layer1"}},
+		},
+		Images: []ProvenanceImage{
+			{Command: "RUN make", ImageID: "sha256:app", Layers: []string{"sha256:layer1", "sha256:layer2"}},
+		},
+		Pulled: transfers[:1],
+		Pushed: transfers[1:],
+	}, provenance)
+}
@@ -0,0 +1,154 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"fmt"
+	"strings"
+
+	"rocker/imagename"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Policies of failing the build with PushBestEffort, see Config.PushFailOn
+const (
+	// PushFailOnAll fails the build if all pushes of some image failed
+	PushFailOnAll = "all"
+	// PushFailOnAny fails the build if any push failed
+	PushFailOnAny = "any"
+	// PushFailOnNone never fails the build because of failed pushes
+	PushFailOnNone = "none"
+)
+
+// registryDigest resolves the digest of the image tag in the registry,
+// it is replaced by tests
+var registryDigest = imagename.RegistryDigest
+
+// PushResult is the outcome of a PUSH step, Error is empty if it succeeded;
+// Skipped is set if the registry already had the image with PushChanged
+type PushResult struct {
+	Image   string
+	ImageID string
+	Digest  string
+	Error   string
+	Skipped bool
+
+	// Layers transferred by the push, empty if it is skipped
+	PushStats
+}
+
+// pushedDigest returns the digest of the image tag in the registry if it
+// refers to the current image, which is when the local image has the same
+// repo digest from an earlier push or pull of it; the registries requiring
+// credentials cannot be asked, so their images are pushed anyway
+func (b *Build) pushedDigest(image *imagename.ImageName) (string, bool) {
+	repoDigests, err := b.client.ImageRepoDigests(b.state.ImageID)
+	if err != nil || len(repoDigests) == 0 {
+		return "", false
+	}
+
+	digest, err := registryDigest(image)
+	if err != nil {
+		log.Debugf("Failed to resolve the digest of %s in the registry, push it, error: %s", image, err)
+		return "", false
+	}
+
+	repoDigest := fmt.Sprintf("%s@%s", image.NameWithRegistry(), digest)
+	for _, d := range repoDigests {
+		if d == repoDigest {
+			return digest, true
+		}
+	}
+
+	return "", false
+}
+
+// reportPushes tells which images were pushed and which were skipped
+// because the registry already had them, with PushChanged
+func (b *Build) reportPushes() {
+	var pushed, skipped []string
+	for _, push := range b.Pushes {
+		switch {
+		case push.Skipped:
+			skipped = append(skipped, push.Image)
+		case push.Error == "":
+			pushed = append(pushed, push.Image)
+		}
+	}
+
+	if len(pushed) > 0 {
+		log.Infof("Pushed %d changed images: %s", len(pushed), strings.Join(pushed, ", "))
+	}
+	if len(skipped) > 0 {
+		log.Infof("Skipped %d unchanged images: %s", len(skipped), strings.Join(skipped, ", "))
+	}
+}
+
+// recordPush remembers the outcome of the push for the report of PushBestEffort
+func (b *Build) recordPush(image, imageID, digest string, stats PushStats, err error) {
+	result := PushResult{Image: image, ImageID: imageID, Digest: digest, PushStats: stats}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	b.Pushes = append(b.Pushes, result)
+}
+
+// checkPushes reports the failed pushes at the end of the build and returns
+// an error if they should fail the build according to PushFailOn
+func (b *Build) checkPushes() error {
+	var (
+		failed    = []string{}
+		succeeded = map[string]bool{}
+		images    = []string{}
+		seen      = map[string]bool{}
+	)
+
+	for _, push := range b.Pushes {
+		if !seen[push.ImageID] {
+			seen[push.ImageID] = true
+			images = append(images, push.ImageID)
+		}
+		if push.Error == "" {
+			succeeded[push.ImageID] = true
+			continue
+		}
+		failed = append(failed, push.Image)
+		log.Errorf("Failed to push %s, error: %s", push.Image, push.Error)
+	}
+
+	if len(failed) == 0 {
+		return nil
+	}
+
+	log.Warnf("%d of %d pushes failed: %s", len(failed), len(b.Pushes), strings.Join(failed, ", "))
+
+	switch b.cfg.PushFailOn {
+	case PushFailOnNone:
+		return nil
+	case PushFailOnAny:
+		return fmt.Errorf("Failed to push %s", strings.Join(failed, ", "))
+	}
+
+	for _, imageID := range images {
+		if !succeeded[imageID] {
+			return fmt.Errorf("Failed to push image %.12s to any of the registries", imageID)
+		}
+	}
+
+	return nil
+}
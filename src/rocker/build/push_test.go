@@ -0,0 +1,199 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"fmt"
+	"testing"
+
+	"rocker/imagename"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+const pushRockerfile = `FROM ubuntu
+RUN make
+PUSH a.example.com/app:1.0
+PUSH b.example.com/app:1.0
+PUSH c.example.com/app:1.0`
+
+// runPushBuild builds pushRockerfile, the pushes to the registries listed
+// in failing fail
+func runPushBuild(t *testing.T, cfg Config, failing ...string) (*Build, error) {
+	cfg.Push = true
+	cfg.PushBestEffort = true
+
+	b, c := makeBuild(t, pushRockerfile, cfg)
+	plan := makePlan(t, pushRockerfile)
+
+	c.On("InspectImage", "ubuntu").Return(&docker.Image{ID: "123"}, nil).Once()
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("456", nil).Once()
+	c.On("RunContainer", "456", false).Return(nil).Once()
+	c.On("CommitContainer", mock.AnythingOfType("State"), "RUN make").Return(&docker.Image{ID: "789"}, nil).Once()
+	c.On("RemoveContainer", "456").Return(nil).Once()
+
+	isFailing := map[string]bool{}
+	for _, registry := range failing {
+		isFailing[registry] = true
+	}
+
+	for _, registry := range []string{"a.example.com", "b.example.com", "c.example.com"} {
+		image := registry + "/app:1.0"
+		c.On("TagImage", "789", image).Return(nil).Once()
+		if isFailing[registry] {
+			c.On("PushImage", image).Return("", PushStats{}, fmt.Errorf("denied")).Once()
+		} else {
+			c.On("PushImage", image).Return("sha256:fafa", PushStats{}, nil).Once()
+		}
+	}
+
+	err := b.Run(plan)
+
+	c.AssertExpectations(t)
+
+	return b, err
+}
+
+func TestPush_BestEffort(t *testing.T) {
+	b, err := runPushBuild(t, Config{}, "b.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The build went on after the failed push and reported it
+	assert.Equal(t, []PushResult{
+		{Image: "a.example.com/app:1.0", ImageID: "789", Digest: "sha256:fafa"},
+		{Image: "b.example.com/app:1.0", ImageID: "789", Error: "denied"},
+		{Image: "c.example.com/app:1.0", ImageID: "789", Digest: "sha256:fafa"},
+	}, b.Pushes)
+}
+
+func TestPush_BestEffortAllFailed(t *testing.T) {
+	b, err := runPushBuild(t, Config{}, "a.example.com", "b.example.com", "c.example.com")
+
+	assert.EqualError(t, err, "Failed to push image 789 to any of the registries")
+	assert.Len(t, b.Pushes, 3)
+}
+
+func TestPush_BestEffortFailOnAny(t *testing.T) {
+	_, err := runPushBuild(t, Config{PushFailOn: PushFailOnAny}, "a.example.com", "c.example.com")
+
+	assert.EqualError(t, err, "Failed to push a.example.com/app:1.0, c.example.com/app:1.0")
+}
+
+func TestPush_BestEffortFailOnNone(t *testing.T) {
+	_, err := runPushBuild(t, Config{PushFailOn: PushFailOnNone}, "a.example.com", "b.example.com", "c.example.com")
+
+	assert.Nil(t, err)
+}
+
+func TestPush_CheckPushesPerImage(t *testing.T) {
+	b, _ := makeBuild(t, "", Config{PushBestEffort: true})
+
+	b.Pushes = []PushResult{
+		{Image: "a.example.com/app:1.0", ImageID: "789", Digest: "sha256:fafa"},
+		{Image: "a.example.com/tool:1.0", ImageID: "987", Error: "denied"},
+		{Image: "b.example.com/tool:1.0", ImageID: "987", Error: "denied"},
+	}
+
+	assert.EqualError(t, b.checkPushes(), "Failed to push image 987 to any of the registries")
+}
+
+func TestPush_Changed(t *testing.T) {
+	rockerfile := `FROM ubuntu
+RUN make
+PUSH a.example.com/app:1.0
+PUSH a.example.com/app:latest
+FROM alpine
+RUN make
+PUSH a.example.com/tool:1.0`
+
+	b, c := makeBuild(t, rockerfile, Config{Push: true, PushChanged: true})
+	plan := makePlan(t, rockerfile)
+
+	// app:1.0 was pushed by an earlier build, app:latest refers to an older
+	// image and tool was rebuilt since its last push
+	remote := map[string]string{
+		"a.example.com/app:1.0":    "sha256:aaaa",
+		"a.example.com/app:latest": "sha256:0000",
+		"a.example.com/tool:1.0":   "sha256:bbbb",
+	}
+	defer func() { registryDigest = imagename.RegistryDigest }()
+	registryDigest = func(image *imagename.ImageName) (string, error) {
+		return remote[image.String()], nil
+	}
+
+	c.On("InspectImage", "ubuntu").Return(&docker.Image{ID: "123"}, nil).Once()
+	c.On("InspectImage", "alpine").Return(&docker.Image{ID: "321"}, nil).Once()
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("456", nil).Twice()
+	c.On("RunContainer", "456", false).Return(nil).Twice()
+	c.On("RemoveContainer", "456").Return(nil).Twice()
+	c.On("CommitContainer", mock.AnythingOfType("State"), "RUN make").Return(&docker.Image{ID: "789"}, nil).Once()
+	c.On("CommitContainer", mock.AnythingOfType("State"), "RUN make").Return(&docker.Image{ID: "987"}, nil).Once()
+
+	c.On("ImageRepoDigests", "789").Return([]string{"a.example.com/app@sha256:aaaa"}, nil).Twice()
+	c.On("ImageRepoDigests", "987").Return([]string{"a.example.com/tool@sha256:cccc"}, nil).Once()
+
+	c.On("TagImage", "789", "a.example.com/app:1.0").Return(nil).Once()
+	c.On("TagImage", "789", "a.example.com/app:latest").Return(nil).Once()
+	c.On("TagImage", "987", "a.example.com/tool:1.0").Return(nil).Once()
+	c.On("PushImage", "a.example.com/app:latest").Return("sha256:aaaa", PushStats{}, nil).Once()
+	c.On("PushImage", "a.example.com/tool:1.0").Return("sha256:dddd", PushStats{PushedLayers: 1, PushedBytes: 1024, SkippedLayers: 2}, nil).Once()
+
+	if err := b.Run(plan); err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+	c.AssertNotCalled(t, "PushImage", "a.example.com/app:1.0")
+
+	assert.Equal(t, []PushResult{
+		{Image: "a.example.com/app:1.0", ImageID: "789", Digest: "sha256:aaaa", Skipped: true},
+		{Image: "a.example.com/app:latest", ImageID: "789", Digest: "sha256:aaaa"},
+		{Image: "a.example.com/tool:1.0", ImageID: "987", Digest: "sha256:dddd", PushStats: PushStats{PushedLayers: 1, PushedBytes: 1024, SkippedLayers: 2}},
+	}, b.Pushes)
+}
+
+func TestPush_ChangedRegistryError(t *testing.T) {
+	rockerfile := `FROM ubuntu
+PUSH a.example.com/app:1.0`
+
+	b, c := makeBuild(t, rockerfile, Config{Push: true, PushChanged: true})
+	plan := makePlan(t, rockerfile)
+
+	defer func() { registryDigest = imagename.RegistryDigest }()
+	registryDigest = func(image *imagename.ImageName) (string, error) {
+		return "", fmt.Errorf("unauthorized")
+	}
+
+	// The image is pushed if the registry cannot tell its digest
+	c.On("InspectImage", "ubuntu").Return(&docker.Image{ID: "123"}, nil).Once()
+	c.On("ImageRepoDigests", "123").Return([]string{"a.example.com/app@sha256:aaaa"}, nil).Once()
+	c.On("TagImage", "123", "a.example.com/app:1.0").Return(nil).Once()
+	c.On("PushImage", "a.example.com/app:1.0").Return("sha256:aaaa", PushStats{}, nil).Once()
+
+	if err := b.Run(plan); err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+	assert.Equal(t, []PushResult{
+		{Image: "a.example.com/app:1.0", ImageID: "123", Digest: "sha256:aaaa"},
+	}, b.Pushes)
+}
@@ -0,0 +1,551 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/fsouza/go-dockerclient"
+)
+
+// reproducibleTime is given to files and metadata of the images committed
+// with Reproducible option, so their digests do not depend on the build time
+var reproducibleTime = time.Unix(0, 0).UTC()
+
+// maxImageConfigSize is the size limit of files from `docker save` archives
+// that are kept in memory to find the config of the parent image
+const maxImageConfigSize = 8 * 1024 * 1024
+
+// imageManifest is an entry of manifest.json of `docker save` archives
+type imageManifest struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+// imageConfig is the part of the image config that is kept by reproducible
+// commits, the rest of the parent's metadata is dropped
+type imageConfig struct {
+	Architecture string         `json:"architecture"`
+	OS           string         `json:"os"`
+	Created      time.Time      `json:"created"`
+	Comment      string         `json:"comment,omitempty"`
+	Config       *ImageConfig   `json:"config,omitempty"`
+	History      []imageHistory `json:"history,omitempty"`
+	RootFS       imageRootFS    `json:"rootfs"`
+}
+
+type imageHistory struct {
+	Created    time.Time `json:"created"`
+	CreatedBy  string    `json:"created_by,omitempty"`
+	Author     string    `json:"author,omitempty"`
+	Comment    string    `json:"comment,omitempty"`
+	EmptyLayer bool      `json:"empty_layer,omitempty"`
+}
+
+type imageRootFS struct {
+	Type    string   `json:"type"`
+	DiffIDs []string `json:"diff_ids"`
+}
+
+// reproducibleImage is the manifest and the config of an image loaded by
+// commitReproducible, the layers of which are already in the daemon
+type reproducibleImage struct {
+	ID       string
+	manifest imageManifest
+	config   imageConfig
+}
+
+// commitReproducible commits the container bypassing `docker commit`: the changes
+// of the container are written to a layer with normalized timestamps and metadata,
+// which is then loaded on top of the parent image with a normalized config
+func (b *Build) commitReproducible(s State, message string) (img *docker.Image, err error) {
+	changes, err := b.client.ContainerChanges(s.NoCache.ContainerID)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get changes of container %.12s, error: %s", s.NoCache.ContainerID, err)
+	}
+
+	layer, err := ioutil.TempFile("", "rocker-layer-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(layer.Name())
+	defer layer.Close()
+
+	var diffID string
+
+	if len(changes) > 0 {
+		if diffID, err = b.writeLayer(s.NoCache.ContainerID, changes, layer); err != nil {
+			return nil, fmt.Errorf("Failed to write layer of container %.12s, error: %s", s.NoCache.ContainerID, err)
+		}
+		if _, err = layer.Seek(0, 0); err != nil {
+			return nil, err
+		}
+	}
+
+	// The parent is exported only if it is not the previous reproducible
+	// commit, otherwise the archive has the new layer only: the daemon does
+	// not read the layers it already has, they are found by their diff IDs
+	var (
+		parent io.ReadCloser
+		base   = b.reproducible
+	)
+	if base != nil && base.ID != s.ImageID {
+		base = nil
+	}
+	if s.ImageID != "" && base == nil {
+		if parent, err = b.client.ExportImage(s.ImageID); err != nil {
+			return nil, fmt.Errorf("Failed to export image %.12s, error: %s", s.ImageID, err)
+		}
+		defer parent.Close()
+	}
+
+	created := reproducibleTime
+	if !b.cfg.SourceDateEpoch.IsZero() {
+		created = b.cfg.SourceDateEpoch
+	}
+
+	var next *reproducibleImage
+
+	img, err = b.loadImageArchive(func(w io.Writer) (string, error) {
+		var err error
+		if next, err = writeImageArchive(w, parent, base, layer, diffID, s.Config, message, created); err != nil {
+			return "", err
+		}
+		return next.ID, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	b.reproducible = next
+
+	return img, nil
+}
+
+// setImageCreated rewrites the created time of the image and of its history
+// entries that are later than it, the daemon does not take it on commit;
+// the image is exported and loaded back with the rewritten config
+func (b *Build) setImageCreated(imageID string, created time.Time) (img *docker.Image, err error) {
+	image, err := b.client.ExportImage(imageID)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to export image %.12s, error: %s", imageID, err)
+	}
+	defer image.Close()
+
+	return b.loadImageArchive(func(w io.Writer) (string, error) {
+		return rewriteImageCreated(w, image, created)
+	})
+}
+
+// normalizeCreated replaces the committed image with the one having the
+// created time of SourceDateEpoch, the committed one is removed
+func (b *Build) normalizeCreated(committed *docker.Image) (img *docker.Image, err error) {
+	if img, err = b.setImageCreated(committed.ID, b.cfg.SourceDateEpoch); err != nil {
+		return nil, err
+	}
+
+	if img.ID != committed.ID {
+		if err := b.client.RemoveImage(committed.ID); err != nil {
+			log.Warnf("Failed to remove image %.12s, error: %s", committed.ID, err)
+		}
+	}
+
+	return img, nil
+}
+
+// loadImageArchive loads the image archive written by the given function
+// to the daemon and returns the loaded image
+func (b *Build) loadImageArchive(write func(w io.Writer) (imageID string, err error)) (img *docker.Image, err error) {
+	var (
+		pipeReader, pipeWriter = io.Pipe()
+		result                 = make(chan error, 1)
+		imageID                string
+	)
+
+	go func() {
+		var err error
+		imageID, err = write(pipeWriter)
+		pipeWriter.CloseWithError(err)
+		result <- err
+	}()
+
+	loadErr := b.client.LoadImage(pipeReader)
+	pipeReader.CloseWithError(loadErr)
+
+	if err := <-result; err != nil {
+		return nil, fmt.Errorf("Failed to make image archive, error: %s", err)
+	}
+	if loadErr != nil {
+		return nil, fmt.Errorf("Failed to load image, error: %s", loadErr)
+	}
+
+	if img, err = b.client.InspectImage(imageID); err != nil {
+		return nil, err
+	}
+	if img == nil {
+		return nil, fmt.Errorf("Failed to find image %.12s after load", imageID)
+	}
+
+	return img, nil
+}
+
+// writeLayer writes the changes of the container as a layer tar and returns
+// its digest. Files are taken from the export of the container filesystem,
+// which is ordered, so the same changes always make the same layer
+func (b *Build) writeLayer(containerID string, changes []docker.Change, w io.Writer) (diffID string, err error) {
+	var (
+		changed = map[string]bool{}
+		deleted = []string{}
+		written = map[string]bool{}
+		digest  = sha256.New()
+		tw      = tar.NewWriter(io.MultiWriter(w, digest))
+	)
+
+	for _, change := range changes {
+		name := strings.Trim(change.Path, "/")
+		if change.Kind == docker.ChangeDelete {
+			deleted = append(deleted, name)
+		} else {
+			changed[name] = true
+		}
+	}
+	sort.Strings(deleted)
+
+	stream, err := b.client.ExportContainer(containerID)
+	if err != nil {
+		return "", err
+	}
+	defer stream.Close()
+
+	tr := tar.NewReader(stream)
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+
+		name := strings.Trim(hdr.Name, "/")
+		if !changed[name] {
+			continue
+		}
+
+		if hdr.Typeflag == tar.TypeLink && !written[strings.Trim(hdr.Linkname, "/")] {
+			return "", fmt.Errorf("%s is a hard link to unchanged file %s, that is not supported", name, hdr.Linkname)
+		}
+
+		normalizeHeader(hdr)
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return "", err
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return "", err
+		}
+
+		written[name] = true
+	}
+
+	for _, name := range deleted {
+		hdr := &tar.Header{
+			Name:     path.Join(path.Dir(name), ".wh."+path.Base(name)),
+			Mode:     0600,
+			Typeflag: tar.TypeReg,
+			ModTime:  reproducibleTime,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return "", err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return "", err
+	}
+
+	return "sha256:" + hex.EncodeToString(digest.Sum(nil)), nil
+}
+
+// normalizeHeader drops everything from the tar header that depends
+// on the time of the build or the host
+func normalizeHeader(hdr *tar.Header) {
+	hdr.ModTime = reproducibleTime
+	hdr.AccessTime = time.Time{}
+	hdr.ChangeTime = time.Time{}
+	hdr.Uname = ""
+	hdr.Gname = ""
+	hdr.PAXRecords = nil
+	hdr.Format = tar.FormatUnknown
+}
+
+// writeImageArchive writes the image archive in the format of `docker save`
+// consisting of the parent image and the new layer on top of it; the parent
+// is either the archive of the image or the previous reproducible image, the
+// layers of which are not written. It returns the resulting image
+func writeImageArchive(w io.Writer, parent io.Reader, base *reproducibleImage, layer *os.File, diffID string, config ImageConfig, message string, created time.Time) (image *reproducibleImage, err error) {
+	var (
+		tw       = tar.NewWriter(w)
+		manifest = imageManifest{}
+		imgCfg   = imageConfig{
+			Architecture: runtime.GOARCH,
+			OS:           "linux",
+			RootFS:       imageRootFS{Type: "layers"},
+		}
+	)
+
+	if parent != nil {
+		if manifest, imgCfg, err = copyImageArchive(tw, parent); err != nil {
+			return nil, err
+		}
+	} else if base != nil {
+		// The slices are copied, so the base is left as it is
+		manifest.Layers = append([]string{}, base.manifest.Layers...)
+		imgCfg = base.config
+		imgCfg.History = append([]imageHistory{}, base.config.History...)
+		imgCfg.RootFS.DiffIDs = append([]string{}, base.config.RootFS.DiffIDs...)
+	}
+
+	history := imageHistory{
+		Created:    created,
+		CreatedBy:  message,
+		EmptyLayer: diffID == "",
+	}
+
+	if diffID != "" {
+		info, err := layer.Stat()
+		if err != nil {
+			return nil, err
+		}
+
+		layerPath := strings.TrimPrefix(diffID, "sha256:") + "/layer.tar"
+		if err := writeArchiveFile(tw, layerPath, info.Size(), layer); err != nil {
+			return nil, err
+		}
+
+		manifest.Layers = append(manifest.Layers, layerPath)
+		imgCfg.RootFS.DiffIDs = append(imgCfg.RootFS.DiffIDs, diffID)
+	}
+
+	imgCfg.Created = created
+	imgCfg.Comment = message
+	if imgCfg.Config != nil {
+		config.inherit(*imgCfg.Config)
+	}
+	imgCfg.Config = &config
+	imgCfg.History = append(imgCfg.History, history)
+
+	data, err := json.Marshal(imgCfg)
+	if err != nil {
+		return nil, err
+	}
+
+	imageID, err := writeImageManifest(tw, manifest, data)
+	if err != nil {
+		return nil, err
+	}
+
+	return &reproducibleImage{ID: imageID, manifest: manifest, config: imgCfg}, nil
+}
+
+// rewriteImageCreated copies the `docker save` archive of the image setting
+// the created time of its config, history entries later than the time are
+// set to it as well; it returns the ID of the resulting image
+func rewriteImageCreated(w io.Writer, image io.Reader, created time.Time) (imageID string, err error) {
+	tw := tar.NewWriter(w)
+
+	manifest, data, err := copyImageArchiveRaw(tw, image)
+	if err != nil {
+		return "", err
+	}
+
+	// The config is rewritten field by field, so that the fields rocker does
+	// not know about are kept as they are
+	config := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return "", fmt.Errorf("Failed to parse config of the image, error: %s", err)
+	}
+
+	history := []map[string]json.RawMessage{}
+	if raw, ok := config["history"]; ok {
+		if err := json.Unmarshal(raw, &history); err != nil {
+			return "", fmt.Errorf("Failed to parse history of the image, error: %s", err)
+		}
+	}
+
+	createdJSON, err := json.Marshal(created.UTC())
+	if err != nil {
+		return "", err
+	}
+
+	for _, entry := range history {
+		var t time.Time
+		if raw, ok := entry["created"]; ok && json.Unmarshal(raw, &t) == nil && !t.After(created) {
+			continue
+		}
+		entry["created"] = createdJSON
+	}
+
+	config["created"] = createdJSON
+	if len(history) > 0 {
+		if config["history"], err = json.Marshal(history); err != nil {
+			return "", err
+		}
+	}
+
+	if data, err = json.Marshal(config); err != nil {
+		return "", err
+	}
+
+	return writeImageManifest(tw, manifest, data)
+}
+
+// writeImageManifest writes the config of the image and the manifest
+// referring to it, then closes the archive; it returns the ID of the image
+func writeImageManifest(tw *tar.Writer, manifest imageManifest, config []byte) (imageID string, err error) {
+	digest := sha256.Sum256(config)
+	imageID = hex.EncodeToString(digest[:])
+
+	manifest.Config = imageID + ".json"
+	manifest.RepoTags = nil
+
+	if err := writeArchiveFile(tw, manifest.Config, int64(len(config)), bytes.NewReader(config)); err != nil {
+		return "", err
+	}
+
+	data, err := json.Marshal([]imageManifest{manifest})
+	if err != nil {
+		return "", err
+	}
+	if err := writeArchiveFile(tw, "manifest.json", int64(len(data)), bytes.NewReader(data)); err != nil {
+		return "", err
+	}
+
+	if err := tw.Close(); err != nil {
+		return "", err
+	}
+
+	return "sha256:" + imageID, nil
+}
+
+// copyImageArchive copies the `docker save` archive of the parent image
+// except its manifests, and returns the manifest and the config of the image
+func copyImageArchive(tw *tar.Writer, r io.Reader) (manifest imageManifest, imgCfg imageConfig, err error) {
+	manifest, data, err := copyImageArchiveRaw(tw, r)
+	if err != nil {
+		return manifest, imgCfg, err
+	}
+	if err := json.Unmarshal(data, &imgCfg); err != nil {
+		return manifest, imgCfg, fmt.Errorf("Failed to parse config of the image, error: %s", err)
+	}
+	return manifest, imgCfg, nil
+}
+
+// copyImageArchiveRaw is copyImageArchive returning the config as it is
+func copyImageArchiveRaw(tw *tar.Writer, r io.Reader) (manifest imageManifest, config []byte, err error) {
+	var (
+		tr        = tar.NewReader(r)
+		files     = map[string][]byte{}
+		manifests = []imageManifest{}
+	)
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return manifest, nil, err
+		}
+
+		// Small files are kept, one of them is the config of the image
+		var data []byte
+		if hdr.Typeflag == tar.TypeReg && hdr.Size <= maxImageConfigSize {
+			if data, err = ioutil.ReadAll(tr); err != nil {
+				return manifest, nil, err
+			}
+			files[hdr.Name] = data
+		}
+
+		// The manifests are replaced by ones of the new image
+		switch hdr.Name {
+		case "manifest.json", "repositories", "index.json":
+			continue
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return manifest, nil, err
+		}
+		if data != nil {
+			_, err = tw.Write(data)
+		} else {
+			_, err = io.Copy(tw, tr)
+		}
+		if err != nil {
+			return manifest, nil, err
+		}
+	}
+
+	data, ok := files["manifest.json"]
+	if !ok {
+		return manifest, nil, fmt.Errorf("The image archive has no manifest.json, Docker 1.10 or later is required")
+	}
+	if err := json.Unmarshal(data, &manifests); err != nil {
+		return manifest, nil, fmt.Errorf("Failed to parse manifest.json of the image archive, error: %s", err)
+	}
+	if len(manifests) != 1 {
+		return manifest, nil, fmt.Errorf("Expected a single image in the archive, got %d", len(manifests))
+	}
+	manifest = manifests[0]
+
+	if config, ok = files[manifest.Config]; !ok {
+		return manifest, nil, fmt.Errorf("The image archive has no config %s", manifest.Config)
+	}
+
+	return manifest, config, nil
+}
+
+func writeArchiveFile(tw *tar.Writer, name string, size int64, r io.Reader) error {
+	hdr := &tar.Header{
+		Name:     name,
+		Mode:     0644,
+		Size:     size,
+		Typeflag: tar.TypeReg,
+		ModTime:  reproducibleTime,
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := io.Copy(tw, r)
+	return err
+}
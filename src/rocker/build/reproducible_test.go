@@ -0,0 +1,420 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+type testTarEntry struct {
+	name    string
+	content string
+}
+
+func makeTestTar(t *testing.T, mtime time.Time, entries ...testTarEntry) io.ReadCloser {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for _, entry := range entries {
+		hdr := &tar.Header{
+			Name:     entry.name,
+			Mode:     0644,
+			Size:     int64(len(entry.content)),
+			ModTime:  mtime,
+			Typeflag: tar.TypeReg,
+			Uname:    "builder",
+		}
+		if strings.HasSuffix(entry.name, "/") {
+			hdr.Mode = 0755
+			hdr.Typeflag = tar.TypeDir
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(entry.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return ioutil.NopCloser(buf)
+}
+
+func readTestTar(t *testing.T, r io.Reader) (headers []*tar.Header, files map[string][]byte) {
+	files = map[string][]byte{}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return headers, files
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		headers = append(headers, hdr)
+		files[hdr.Name] = data
+	}
+}
+
+// commitReproducibleTest runs the reproducible commit of a container with
+// files having the given mtime and returns the loaded image archive
+func commitReproducibleTest(t *testing.T, mtime time.Time, cfg Config) (imageID string, archive []byte) {
+	cfg.Reproducible = true
+	b, c := makeBuild(t, "", cfg)
+	cmd := &CommandCommit{}
+
+	b.state = State{ImageID: "123"}
+	b.state.Config.Cmd = []string{"/bin/sh"}
+	b.state.NoCache.ContainerID = "456"
+	b.state.NoCache.History = []string{"RUN make install"}
+	b.state.Commit("RUN make install")
+
+	c.On("ContainerChanges", "456").Return([]docker.Change{
+		{Path: "/app", Kind: docker.ChangeAdd},
+		{Path: "/app/main", Kind: docker.ChangeAdd},
+		{Path: "/etc", Kind: docker.ChangeModify},
+		{Path: "/etc/motd", Kind: docker.ChangeDelete},
+	}, nil).Once()
+
+	c.On("ExportContainer", "456").Return(makeTestTar(t, mtime,
+		testTarEntry{"app/", ""},
+		testTarEntry{"app/main", "binary"},
+		testTarEntry{"bin/", ""},
+		testTarEntry{"bin/sh", "shell"},
+		testTarEntry{"etc/", ""},
+		testTarEntry{"etc/hostname", "localhost"},
+	), nil).Once()
+
+	parentConfig := `{"architecture":"amd64","os":"linux","created":"2016-01-02T03:04:05Z",` +
+		`"history":[{"created":"2016-01-02T03:04:05Z","created_by":"/bin/sh -c #(nop) ADD file:123 in /"}],` +
+		`"rootfs":{"type":"layers","diff_ids":["sha256:789"]}}`
+
+	c.On("ExportImage", "123").Return(makeTestTar(t, mtime,
+		testTarEntry{"789/", ""},
+		testTarEntry{"789/layer.tar", "parent layer"},
+		testTarEntry{"123.json", parentConfig},
+		testTarEntry{"manifest.json", `[{"Config":"123.json","RepoTags":["alpine:3.2"],"Layers":["789/layer.tar"]}]`},
+	), nil).Once()
+
+	c.On("LoadImage", mock.Anything).Return(nil).Run(func(args mock.Arguments) {
+		data, err := ioutil.ReadAll(args.Get(0).(io.Reader))
+		if err != nil {
+			t.Fatal(err)
+		}
+		archive = data
+	}).Once()
+
+	c.On("InspectImage", mock.AnythingOfType("string")).Return(&docker.Image{ID: "abc"}, nil).Run(func(args mock.Arguments) {
+		imageID = args.String(0)
+	}).Once()
+
+	c.On("RemoveContainer", "456").Return(nil).Once()
+
+	state, err := cmd.Execute(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+	assert.Equal(t, "abc", state.ImageID)
+
+	return imageID, archive
+}
+
+func TestCommitReproducible(t *testing.T) {
+	imageID, archive := commitReproducibleTest(t, time.Now(), Config{})
+
+	_, files := readTestTar(t, bytes.NewReader(archive))
+
+	manifests := []imageManifest{}
+	if err := json.Unmarshal(files["manifest.json"], &manifests); err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, manifests, 1)
+	assert.Len(t, manifests[0].Layers, 2)
+	assert.Equal(t, "789/layer.tar", manifests[0].Layers[0])
+	assert.Equal(t, "parent layer", string(files["789/layer.tar"]))
+	assert.Nil(t, manifests[0].RepoTags)
+
+	// The image ID is the digest of the config
+	data := files[manifests[0].Config]
+	digest := sha256.Sum256(data)
+	assert.Equal(t, "sha256:"+hex.EncodeToString(digest[:]), imageID)
+
+	imgCfg := imageConfig{}
+	if err := json.Unmarshal(data, &imgCfg); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, reproducibleTime, imgCfg.Created)
+	assert.Equal(t, "RUN make install", imgCfg.Comment)
+	assert.Equal(t, []string{"/bin/sh"}, imgCfg.Config.Cmd)
+	assert.Len(t, imgCfg.History, 2)
+	assert.Equal(t, reproducibleTime, imgCfg.History[1].Created)
+	assert.Equal(t, "RUN make install", imgCfg.History[1].CreatedBy)
+	assert.Equal(t, 2, len(imgCfg.RootFS.DiffIDs))
+
+	// The layer only has the changes and all of its timestamps are normalized
+	layer := files[manifests[0].Layers[1]]
+	layerDigest := sha256.Sum256(layer)
+	assert.Equal(t, "sha256:"+hex.EncodeToString(layerDigest[:]), imgCfg.RootFS.DiffIDs[1])
+
+	headers, layerFiles := readTestTar(t, bytes.NewReader(layer))
+
+	names := []string{}
+	for _, hdr := range headers {
+		names = append(names, hdr.Name)
+		assert.Equal(t, reproducibleTime.Unix(), hdr.ModTime.Unix(), hdr.Name)
+		assert.Empty(t, hdr.Uname, hdr.Name)
+	}
+	assert.Equal(t, []string{"app/", "app/main", "etc/", "etc/.wh.motd"}, names)
+	assert.Equal(t, "binary", string(layerFiles["app/main"]))
+}
+
+func TestCommitReproducible_SameDigests(t *testing.T) {
+	imageID1, _ := commitReproducibleTest(t, time.Now(), Config{})
+	imageID2, _ := commitReproducibleTest(t, time.Now().Add(-time.Hour), Config{})
+
+	assert.Equal(t, imageID1, imageID2)
+}
+
+func TestCommitReproducible_Chain(t *testing.T) {
+	b, c := makeBuild(t, "", Config{Reproducible: true})
+	cmd := &CommandCommit{}
+
+	base := &reproducibleImage{
+		ID:       "sha256:123",
+		manifest: imageManifest{Layers: []string{"789/layer.tar"}},
+		config: imageConfig{
+			Architecture: "amd64",
+			OS:           "linux",
+			History:      []imageHistory{{CreatedBy: "RUN make"}},
+			RootFS:       imageRootFS{Type: "layers", DiffIDs: []string{"sha256:789"}},
+		},
+	}
+	b.reproducible = base
+
+	b.state = State{ImageID: "sha256:123"}
+	b.state.NoCache.ContainerID = "456"
+	b.state.Commit("RUN make install")
+
+	var (
+		archive []byte
+		imageID string
+	)
+
+	c.On("ContainerChanges", "456").Return([]docker.Change{
+		{Path: "/app", Kind: docker.ChangeAdd},
+	}, nil).Once()
+	c.On("ExportContainer", "456").Return(makeTestTar(t, time.Now(),
+		testTarEntry{"app/", ""},
+	), nil).Once()
+	c.On("LoadImage", mock.Anything).Return(nil).Run(func(args mock.Arguments) {
+		data, err := ioutil.ReadAll(args.Get(0).(io.Reader))
+		if err != nil {
+			t.Fatal(err)
+		}
+		archive = data
+	}).Once()
+	c.On("InspectImage", mock.AnythingOfType("string")).Return(&docker.Image{ID: "abc"}, nil).Run(func(args mock.Arguments) {
+		imageID = args.String(0)
+	}).Once()
+	c.On("RemoveContainer", "456").Return(nil).Once()
+
+	// The parent is the previous reproducible commit, so it is not exported
+	if _, err := cmd.Execute(b); err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+
+	_, files := readTestTar(t, bytes.NewReader(archive))
+
+	manifests := []imageManifest{}
+	if err := json.Unmarshal(files["manifest.json"], &manifests); err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, manifests[0].Layers, 2)
+	assert.Equal(t, "789/layer.tar", manifests[0].Layers[0])
+	_, ok := files["789/layer.tar"]
+	assert.False(t, ok, "expected the parent layers to be omitted")
+	_, ok = files[manifests[0].Layers[1]]
+	assert.True(t, ok, "expected the new layer to be written")
+
+	imgCfg := imageConfig{}
+	if err := json.Unmarshal(files[manifests[0].Config], &imgCfg); err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, imgCfg.History, 2)
+	assert.Len(t, imgCfg.RootFS.DiffIDs, 2)
+
+	assert.Equal(t, imageID, b.reproducible.ID)
+	assert.Len(t, b.reproducible.manifest.Layers, 2)
+	assert.Len(t, base.manifest.Layers, 1)
+	assert.Len(t, base.config.RootFS.DiffIDs, 1)
+}
+
+func TestCommitReproducible_NoManifest(t *testing.T) {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+
+	_, _, err := copyImageArchive(tw, makeTestTar(t, time.Now(), testTarEntry{"123/layer.tar", "layer"}))
+	assert.EqualError(t, err, "The image archive has no manifest.json, Docker 1.10 or later is required")
+}
+
+func TestCommitReproducible_SourceDateEpoch(t *testing.T) {
+	epoch := time.Unix(1450000000, 0).UTC()
+	_, archive := commitReproducibleTest(t, time.Now(), Config{SourceDateEpoch: epoch})
+
+	_, files := readTestTar(t, bytes.NewReader(archive))
+
+	manifests := []imageManifest{}
+	if err := json.Unmarshal(files["manifest.json"], &manifests); err != nil {
+		t.Fatal(err)
+	}
+
+	imgCfg := imageConfig{}
+	if err := json.Unmarshal(files[manifests[0].Config], &imgCfg); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, epoch, imgCfg.Created)
+	assert.Equal(t, epoch, imgCfg.History[1].Created)
+}
+
+func TestCommit_SourceDateEpoch(t *testing.T) {
+	epoch := time.Unix(1450000000, 0).UTC()
+
+	b, c := makeBuild(t, "", Config{SourceDateEpoch: epoch})
+	cmd := &CommandCommit{}
+
+	b.state = State{ImageID: "123"}
+	b.state.NoCache.ContainerID = "456"
+	b.state.Commit("RUN make install")
+
+	committedConfig := `{"architecture":"amd64","os":"linux","created":"2016-10-16T08:00:00Z","docker_version":"1.10.3",` +
+		`"history":[{"created":"2015-01-02T03:04:05Z","created_by":"/bin/sh -c #(nop) ADD file:123 in /"},` +
+		`{"created":"2016-10-16T08:00:00Z","created_by":"/bin/sh -c make install"}],` +
+		`"rootfs":{"type":"layers","diff_ids":["sha256:789","sha256:987"]}}`
+
+	var (
+		archive []byte
+		imageID string
+	)
+
+	c.On("CommitContainer", mock.AnythingOfType("State"), "RUN make install").Return(&docker.Image{ID: "abc"}, nil).Once()
+	c.On("ExportImage", "abc").Return(makeTestTar(t, time.Now(),
+		testTarEntry{"789/layer.tar", "parent layer"},
+		testTarEntry{"987/layer.tar", "layer"},
+		testTarEntry{"abc.json", committedConfig},
+		testTarEntry{"manifest.json", `[{"Config":"abc.json","RepoTags":null,"Layers":["789/layer.tar","987/layer.tar"]}]`},
+	), nil).Once()
+	c.On("LoadImage", mock.Anything).Return(nil).Run(func(args mock.Arguments) {
+		data, err := ioutil.ReadAll(args.Get(0).(io.Reader))
+		if err != nil {
+			t.Fatal(err)
+		}
+		archive = data
+	}).Once()
+	c.On("InspectImage", mock.AnythingOfType("string")).Return(&docker.Image{ID: "def", Created: epoch}, nil).Run(func(args mock.Arguments) {
+		imageID = args.String(0)
+	}).Once()
+	c.On("RemoveImage", "abc").Return(nil).Once()
+	c.On("RemoveContainer", "456").Return(nil).Once()
+
+	state, err := cmd.Execute(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+	assert.Equal(t, "def", state.ImageID)
+
+	_, files := readTestTar(t, bytes.NewReader(archive))
+
+	manifests := []imageManifest{}
+	if err := json.Unmarshal(files["manifest.json"], &manifests); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"789/layer.tar", "987/layer.tar"}, manifests[0].Layers)
+
+	data := files[manifests[0].Config]
+	digest := sha256.Sum256(data)
+	assert.Equal(t, "sha256:"+hex.EncodeToString(digest[:]), imageID)
+
+	imgCfg := struct {
+		imageConfig
+		DockerVersion string `json:"docker_version"`
+	}{}
+	if err := json.Unmarshal(data, &imgCfg); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, epoch, imgCfg.Created)
+	assert.Equal(t, "1.10.3", imgCfg.DockerVersion, "expected the unknown fields to be kept")
+	// History entries made before the epoch keep their time
+	assert.Equal(t, time.Date(2015, 1, 2, 3, 4, 5, 0, time.UTC), imgCfg.History[0].Created)
+	assert.Equal(t, epoch, imgCfg.History[1].Created)
+}
+
+func TestCommit_SourceDateEpochCache(t *testing.T) {
+	epoch := time.Unix(1450000000, 0).UTC()
+
+	b, c := makeBuild(t, "", Config{SourceDateEpoch: epoch})
+	b.cache = NewCacheMemory()
+
+	cached := State{ParentID: "123", ImageID: "789"}
+	cached.Commit("RUN make")
+	if err := b.cache.Put(cached); err != nil {
+		t.Fatal(err)
+	}
+
+	s := State{ImageID: "123"}
+	s.Commit("RUN make")
+
+	c.On("InspectImage", "789").Return(&docker.Image{ID: "789", Created: time.Now()}, nil).Once()
+
+	_, hit, err := b.probeCache(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.False(t, hit)
+	assert.Equal(t, ReasonCreatedMismatch, b.reason)
+
+	c.On("InspectImage", "789").Return(&docker.Image{ID: "789", Created: epoch}, nil).Once()
+
+	s2, hit, err := b.probeCache(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, hit)
+	assert.Equal(t, "789", s2.ImageID)
+}
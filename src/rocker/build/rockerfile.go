@@ -22,11 +22,20 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
+	"regexp"
 	"rocker/parser"
 	"rocker/template"
 	"strings"
 )
 
+// keepStageMarker is the comment marking a FROM whose image is kept by
+// --no-garbage, e.g. FROM golang:1.5 # rocker:keep
+var keepStageMarker = regexp.MustCompile(`\s*#\s*rocker:keep\s*$`)
+
+// flagsDirective is the comment at the top of a Rockerfile setting the
+// default flags of the build, e.g. # rocker:flags pull=true no-cache
+var flagsDirective = regexp.MustCompile(`^#\s*rocker:flags\b(.*)$`)
+
 // Rockerfile represents the data structure of a Rockerfile
 type Rockerfile struct {
 	Name    string
@@ -35,6 +44,10 @@ type Rockerfile struct {
 	Vars    template.Vars
 	Funs    template.Funs
 
+	// Flags are the default flags of the build given by the rocker:flags
+	// directives, the flags given on the command line override them
+	Flags map[string]string
+
 	rootNode *parser.Node
 }
 
@@ -51,6 +64,11 @@ func NewRockerfileFromFile(name string, vars template.Vars, funs template.Funs)
 
 // NewRockerfile reads parses Rockerfile from an io.Reader
 func NewRockerfile(name string, in io.Reader, vars template.Vars, funs template.Funs) (r *Rockerfile, err error) {
+	return NewRockerfileWithOptions(name, in, vars, funs, template.Options{})
+}
+
+// NewRockerfileWithOptions is NewRockerfile with the template rendering options
+func NewRockerfileWithOptions(name string, in io.Reader, vars template.Vars, funs template.Funs, opts template.Options) (r *Rockerfile, err error) {
 	r = &Rockerfile{
 		Name: name,
 		Vars: vars,
@@ -68,12 +86,16 @@ func NewRockerfile(name string, in io.Reader, vars template.Vars, funs template.
 
 	r.Source = string(source)
 
-	if content, err = template.Process(name, bytes.NewReader(source), vars, funs); err != nil {
+	if content, err = template.ProcessWithOptions(name, bytes.NewReader(source), vars, funs, opts); err != nil {
 		return nil, err
 	}
 
 	r.Content = content.String()
 
+	if r.Flags, err = parseFlagsDirectives(r.Content); err != nil {
+		return nil, fmt.Errorf("Failed to parse Rockerfile %s, error: %s", name, err)
+	}
+
 	// TODO: update parser from Docker
 
 	if r.rootNode, err = parser.Parse(content); err != nil {
@@ -83,6 +105,45 @@ func NewRockerfile(name string, in io.Reader, vars template.Vars, funs template.
 	return r, nil
 }
 
+// Render writes the Rockerfile processed by the template to w, it is what
+// `rocker build --print` outputs
+func (r *Rockerfile) Render(w io.Writer) error {
+	_, err := io.WriteString(w, r.Content)
+	return err
+}
+
+// parseFlagsDirectives parses the rocker:flags directives of the comments at the
+// top of the Rockerfile, a flag without a value is "true"
+func parseFlagsDirectives(content string) (flags map[string]string, err error) {
+	flags = map[string]string{}
+
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if !strings.HasPrefix(line, "#") {
+			break
+		}
+		match := flagsDirective.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+		for _, flag := range strings.Fields(match[1]) {
+			parts := strings.SplitN(strings.TrimLeft(flag, "-"), "=", 2)
+			if parts[0] == "" {
+				return nil, fmt.Errorf("Invalid flag %q of rocker:flags, expected name=value", flag)
+			}
+			if len(parts) == 1 {
+				parts = append(parts, "true")
+			}
+			flags[parts[0]] = parts[1]
+		}
+	}
+
+	return flags, nil
+}
+
 // Commands returns the list of command configurations from the Rockerfile
 func (r *Rockerfile) Commands() []ConfigCommand {
 	commands := []ConfigCommand{}
@@ -122,6 +183,15 @@ func parseCommand(node *parser.Node, isOnbuild bool) ConfigCommand {
 		cfg.args = append(cfg.args, n.Value)
 	}
 
+	if cfg.name == "from" && len(cfg.args) == 1 && keepStageMarker.MatchString(cfg.args[0]) {
+		cfg.args[0] = keepStageMarker.ReplaceAllString(cfg.args[0], "")
+		attrs := map[string]bool{"keep": true}
+		for k, v := range cfg.attrs {
+			attrs[k] = v
+		}
+		cfg.attrs = attrs
+	}
+
 	return cfg
 }
 
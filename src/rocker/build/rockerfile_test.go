@@ -17,6 +17,7 @@
 package build
 
 import (
+	"bytes"
 	"rocker/template"
 	"strings"
 	"testing"
@@ -36,6 +37,57 @@ func TestNewRockerfile_Base(t *testing.T) {
 	assert.Equal(t, "FROM ubuntu", r.Content)
 }
 
+func TestRockerfile_Render(t *testing.T) {
+	src := `FROM {{ .BaseImage }}
+{{ range .Packages }}RUN apt-get install {{ . }}
+{{ end }}TAG app:{{ .Version | toUpper }}`
+	vars := template.Vars{"BaseImage": "ubuntu", "Packages": []string{"git", "curl"}, "Version": "v1"}
+	r, err := NewRockerfile("test", strings.NewReader(src), vars, template.Funs{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := r.Render(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "FROM ubuntu\nRUN apt-get install git\nRUN apt-get install curl\nTAG app:V1", buf.String())
+}
+
+func TestNewRockerfile_FlagsDirective(t *testing.T) {
+	src := `# Build of the app
+# rocker:flags pull=true no-cache
+#rocker:flags --no-garbage=false push-fail-on={{ .FailOn }}
+
+FROM ubuntu
+# rocker:flags reproducible
+RUN make`
+	r, err := NewRockerfile("test", strings.NewReader(src), template.Vars{"FailOn": "any"}, template.Funs{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Directives below the first command are plain comments
+	assert.Equal(t, map[string]string{
+		"pull":         "true",
+		"no-cache":     "true",
+		"no-garbage":   "false",
+		"push-fail-on": "any",
+	}, r.Flags)
+}
+
+func TestNewRockerfile_FlagsDirectiveInvalid(t *testing.T) {
+	_, err := NewRockerfile("test", strings.NewReader("# rocker:flags =true\nFROM ubuntu"), template.Vars{}, template.Funs{})
+	assert.EqualError(t, err, `Failed to parse Rockerfile test, error: Invalid flag "=true" of rocker:flags, expected name=value`)
+
+	r, err := NewRockerfile("test", strings.NewReader("# rocker:flagship\nFROM ubuntu"), template.Vars{}, template.Funs{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, r.Flags)
+}
+
 func TestNewRockerfileFromFile(t *testing.T) {
 	r, err := NewRockerfileFromFile("testdata/Rockerfile", template.Vars{}, template.Funs{})
 	if err != nil {
@@ -58,6 +110,20 @@ func TestRockerfileCommands(t *testing.T) {
 	assert.Equal(t, "ubuntu", commands[0].args[0])
 }
 
+func TestRockerfileCommands_RunMount(t *testing.T) {
+	src := "FROM ubuntu\nRUN --mount=type=tmpfs,target=/tmp/work make build"
+	r, err := NewRockerfile("test", strings.NewReader(src), template.Vars{}, template.Funs{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	commands := r.Commands()
+	assert.Len(t, commands, 2)
+	assert.Equal(t, "run", commands[1].name)
+	assert.Equal(t, map[string]string{"mount": "type=tmpfs,target=/tmp/work"}, commands[1].flags)
+	assert.Equal(t, []string{"make build"}, commands[1].args)
+}
+
 func TestRockerfileParseOnbuildCommands(t *testing.T) {
 	triggers := []string{
 		"RUN make",
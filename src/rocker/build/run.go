@@ -0,0 +1,605 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// runFlags is the list of flags supported by RUN, the order is used
+// to make the commit message, so it should never change for existing flags
+var runFlags = []string{"mount", "privileged", "cap-add", "cap-drop", "device", "gpus", "sysctl",
+	"allow-failure", "if-prev-succeeded", "if-prev-failed", "cache-key-file", "security-opt", "read-only"}
+
+// capabilities is the list of Linux capabilities known to Docker,
+// names are given without the CAP_ prefix
+var capabilities = map[string]bool{
+	"ALL":                true,
+	"AUDIT_CONTROL":      true,
+	"AUDIT_READ":         true,
+	"AUDIT_WRITE":        true,
+	"BLOCK_SUSPEND":      true,
+	"BPF":                true,
+	"CHECKPOINT_RESTORE": true,
+	"CHOWN":              true,
+	"DAC_OVERRIDE":       true,
+	"DAC_READ_SEARCH":    true,
+	"FOWNER":             true,
+	"FSETID":             true,
+	"IPC_LOCK":           true,
+	"IPC_OWNER":          true,
+	"KILL":               true,
+	"LEASE":              true,
+	"LINUX_IMMUTABLE":    true,
+	"MAC_ADMIN":          true,
+	"MAC_OVERRIDE":       true,
+	"MKNOD":              true,
+	"NET_ADMIN":          true,
+	"NET_BIND_SERVICE":   true,
+	"NET_BROADCAST":      true,
+	"NET_RAW":            true,
+	"PERFMON":            true,
+	"SETFCAP":            true,
+	"SETGID":             true,
+	"SETPCAP":            true,
+	"SETUID":             true,
+	"SYS_ADMIN":          true,
+	"SYS_BOOT":           true,
+	"SYS_CHROOT":         true,
+	"SYS_MODULE":         true,
+	"SYS_NICE":           true,
+	"SYS_PACCT":          true,
+	"SYS_PTRACE":         true,
+	"SYS_RAWIO":          true,
+	"SYS_RESOURCE":       true,
+	"SYS_TIME":           true,
+	"SYS_TTY_CONFIG":     true,
+	"SYSLOG":             true,
+	"WAKE_ALARM":         true,
+}
+
+// proxyEnvNames are the proxy variables that Config.ProxyEnv may pass to
+// RUN, the same as the predefined build args of `docker build`
+var proxyEnvNames = []string{"HTTP_PROXY", "http_proxy", "HTTPS_PROXY", "https_proxy",
+	"FTP_PROXY", "ftp_proxy", "NO_PROXY", "no_proxy", "ALL_PROXY", "all_proxy"}
+
+// ProxyEnv returns the proxy variables set in the environment, given as
+// os.Environ() does, in the order of proxyEnvNames
+func ProxyEnv(environ []string) (env []string) {
+	values := map[string]string{}
+	for _, kv := range environ {
+		if parts := strings.SplitN(kv, "=", 2); len(parts) == 2 && parts[1] != "" {
+			values[parts[0]] = parts[1]
+		}
+	}
+	for _, name := range proxyEnvNames {
+		if value, ok := values[name]; ok {
+			env = append(env, name+"="+value)
+		}
+	}
+	return env
+}
+
+// runEnv returns the environment of the RUN container: the proxy variables
+// of Config.ProxyEnv are added unless ENV sets them. They are not part of the
+// cache key and are not committed, as the proxy is specific to the host
+func runEnv(b *Build, env []string) []string {
+	if len(b.cfg.ProxyEnv) == 0 {
+		return env
+	}
+
+	set := map[string]bool{}
+	for _, kv := range env {
+		set[strings.SplitN(kv, "=", 2)[0]] = true
+	}
+
+	result := append([]string{}, env...)
+	for _, kv := range b.cfg.ProxyEnv {
+		if name := strings.SplitN(kv, "=", 2)[0]; !set[name] {
+			result = append(result, kv)
+		}
+	}
+	return result
+}
+
+// runFlagValues returns RUN flags merged with the build-wide defaults,
+// the defaults come first so that they are part of the cache key as well
+func runFlagValues(b *Build, flags map[string]string) map[string]string {
+	result := map[string]string{}
+	for k, v := range flags {
+		result[k] = v
+	}
+
+	defaults := map[string][]string{
+		"cap-add":      b.cfg.CapAdd,
+		"cap-drop":     b.cfg.CapDrop,
+		"device":       b.cfg.Devices,
+		"sysctl":       b.cfg.Sysctls,
+		"security-opt": b.cfg.SecurityOpts,
+	}
+	for name, values := range defaults {
+		if len(values) == 0 {
+			continue
+		}
+		value := strings.Join(values, ",")
+		if stepValue := result[name]; stepValue != "" {
+			value += "," + stepValue
+		}
+		result[name] = value
+	}
+
+	// GPUs given to the RUN step override the default ones
+	if _, ok := result["gpus"]; !ok && b.cfg.GPUs != "" {
+		result["gpus"] = b.cfg.GPUs
+	}
+
+	if _, ok := result["read-only"]; !ok && b.cfg.ReadOnly {
+		result["read-only"] = ""
+	}
+
+	return result
+}
+
+// runCacheKeyFiles returns the checksum of the context files given to RUN
+// --cache-key-file as a comma separated list of paths or wildcards, so that
+// changing the files the step depends on invalidates its cache
+func runCacheKeyFiles(b *Build, value string) (string, error) {
+	if value == "" {
+		return "", fmt.Errorf("RUN --cache-key-file requires a path in the context")
+	}
+
+	files := []*uploadFile{}
+	for _, p := range strings.Split(value, ",") {
+		clean := filepath.ToSlash(filepath.Clean(p))
+		if filepath.IsAbs(p) || clean == ".." || strings.HasPrefix(clean, "../") {
+			return "", fmt.Errorf("RUN --cache-key-file %s is outside of the context", p)
+		}
+
+		matched, err := listFiles(b.cfg.ContextDir, []string{p}, b.state.NoCache.Dockerignore)
+		if err != nil {
+			return "", fmt.Errorf("Failed to list RUN --cache-key-file %s, error: %s", p, err)
+		}
+		if len(matched) == 0 {
+			return "", fmt.Errorf("RUN --cache-key-file %s matches no files in the context", p)
+		}
+		files = append(files, matched...)
+	}
+
+	sort.Sort(uploadFilesByPath(files))
+
+	h := sha256.New()
+	if err := hashFiles(h, files); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("sha256:%x", h.Sum(nil)), nil
+}
+
+// runCommitFlags returns RUN flags formatted for the commit message,
+// so the cache is invalidated when the flags change
+func runCommitFlags(flags map[string]string) string {
+	result := ""
+	for _, name := range runFlags {
+		value, ok := flags[name]
+		if !ok {
+			continue
+		}
+		if value == "" {
+			result += fmt.Sprintf(" --%s", name)
+		} else {
+			result += fmt.Sprintf(" --%s=%s", name, value)
+		}
+	}
+	return result
+}
+
+// runBoolFlag tells whether the RUN flag that takes no value is given
+func runBoolFlag(flags map[string]string, name string) (bool, error) {
+	value, ok := flags[name]
+	if !ok {
+		return false, nil
+	}
+	if value != "" && value != "true" {
+		return false, fmt.Errorf("RUN --%s does not take a value, got %q", name, value)
+	}
+	return true, nil
+}
+
+// runConditionMet tells whether the RUN step should be executed according
+// to the exit code of the last executed RUN, see --if-prev-succeeded
+// and --if-prev-failed
+func runConditionMet(b *Build, flags map[string]string) (bool, error) {
+	ifSucceeded, err := runBoolFlag(flags, "if-prev-succeeded")
+	if err != nil {
+		return false, err
+	}
+	ifFailed, err := runBoolFlag(flags, "if-prev-failed")
+	if err != nil {
+		return false, err
+	}
+
+	switch {
+	case !ifSucceeded && !ifFailed:
+		return true, nil
+	case ifSucceeded && ifFailed:
+		return false, fmt.Errorf("RUN --if-prev-succeeded and --if-prev-failed cannot be used together")
+	case b.lastExitCode == noExitCode:
+		return false, fmt.Errorf("RUN --if-prev-succeeded or --if-prev-failed requires a previous RUN step")
+	}
+
+	return ifSucceeded == (b.lastExitCode == 0), nil
+}
+
+// runOutputFilter returns the filter of the container output given by RUN
+// --grep, nil if there is none; the path of --grep-log is relative to the
+// artifacts path if set or to the working directory, the log never goes to
+// the context. The flags are not a part of the cache key, the image is the same
+func runOutputFilter(b *Build, flags map[string]string) (*OutputFilter, error) {
+	pattern, ok := flags["grep"]
+	if !ok {
+		if _, ok := flags["grep-log"]; ok {
+			return nil, fmt.Errorf("RUN --grep-log requires --grep")
+		}
+		return nil, nil
+	}
+	if pattern == "" {
+		return nil, fmt.Errorf("RUN --grep requires a pattern")
+	}
+	if _, err := regexp.Compile(pattern); err != nil {
+		return nil, fmt.Errorf("Invalid RUN --grep %q, error: %s", pattern, err)
+	}
+
+	filter := &OutputFilter{Pattern: pattern}
+
+	if path, ok := flags["grep-log"]; ok {
+		if path == "" {
+			return nil, fmt.Errorf("RUN --grep-log requires a path")
+		}
+		if !filepath.IsAbs(path) && b.cfg.ArtifactsPath != "" {
+			path = filepath.Join(b.cfg.ArtifactsPath, path)
+		}
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to resolve RUN --grep-log %s, error: %s", path, err)
+		}
+		filter.LogFile = abs
+	}
+
+	return filter, nil
+}
+
+// runHostConfig returns a copy of the given host config modified
+// according to the RUN flags; options given by flags are only applied
+// to a single step and never leak to the following ones
+func runHostConfig(b *Build, flags map[string]string, hostConfig HostConfig) (HostConfig, error) {
+	if mount, ok := flags["mount"]; ok {
+		tmpfs, err := parseRunMount(mount)
+		if err != nil {
+			return hostConfig, err
+		}
+		hostConfig.Tmpfs = tmpfs
+	}
+
+	privileged, err := runBoolFlag(flags, "privileged")
+	if err != nil {
+		return hostConfig, err
+	}
+	if privileged {
+		if !b.cfg.AllowPrivileged {
+			return hostConfig, fmt.Errorf("RUN --privileged requires the build to be run with --allow-privileged")
+		}
+		hostConfig.Privileged = true
+	}
+
+	// The step can only write to the tmpfs given with --mount then
+	readOnly, err := runBoolFlag(flags, "read-only")
+	if err != nil {
+		return hostConfig, err
+	}
+	if readOnly {
+		hostConfig.ReadonlyRootfs = true
+	}
+
+	if value, ok := flags["cap-add"]; ok {
+		caps, err := parseCapabilities("cap-add", value)
+		if err != nil {
+			return hostConfig, err
+		}
+		hostConfig.CapAdd = append(append([]string{}, hostConfig.CapAdd...), caps...)
+	}
+
+	if value, ok := flags["cap-drop"]; ok {
+		caps, err := parseCapabilities("cap-drop", value)
+		if err != nil {
+			return hostConfig, err
+		}
+		hostConfig.CapDrop = append(append([]string{}, hostConfig.CapDrop...), caps...)
+	}
+
+	if value, ok := flags["device"]; ok {
+		devices := append([]docker.Device{}, hostConfig.Devices...)
+		for _, spec := range strings.Split(value, ",") {
+			device, err := parseDevice(spec)
+			if err != nil {
+				return hostConfig, err
+			}
+			devices = append(devices, device)
+		}
+		hostConfig.Devices = devices
+	}
+
+	if value, ok := flags["gpus"]; ok {
+		request, err := parseGPUs(value)
+		if err != nil {
+			return hostConfig, err
+		}
+		hostConfig.DeviceRequests = []DeviceRequest{request}
+	}
+
+	if value, ok := flags["sysctl"]; ok {
+		sysctls := map[string]string{}
+		for k, v := range hostConfig.Sysctls {
+			sysctls[k] = v
+		}
+		for _, field := range strings.Split(value, ",") {
+			pair := strings.SplitN(field, "=", 2)
+			if len(pair) != 2 || pair[0] == "" || pair[1] == "" {
+				return hostConfig, fmt.Errorf("Invalid --sysctl %q, expected key=value", field)
+			}
+			sysctls[pair[0]] = pair[1]
+		}
+		hostConfig.Sysctls = sysctls
+	}
+
+	if value, ok := flags["security-opt"]; ok {
+		opts := append([]string{}, hostConfig.SecurityOpt...)
+		for _, field := range strings.Split(value, ",") {
+			opt, err := parseSecurityOpt(b, field)
+			if err != nil {
+				return hostConfig, err
+			}
+			opts = append(opts, opt)
+		}
+		hostConfig.SecurityOpt = opts
+	}
+
+	return hostConfig, nil
+}
+
+// parseSecurityOpt parses a security option in the form of
+// `docker run --security-opt`; the seccomp profile is given by the path of
+// the JSON file, relative to the context, the daemon takes its content.
+// The AppArmor profile is given by its name, it should be loaded on the host
+func parseSecurityOpt(b *Build, opt string) (string, error) {
+	pair := strings.SplitN(opt, "=", 2)
+	if pair[0] == "" {
+		return "", fmt.Errorf("Invalid --security-opt %q", opt)
+	}
+	if pair[0] == "apparmor" && (len(pair) != 2 || pair[1] == "") {
+		return "", fmt.Errorf("Invalid --security-opt %q, expected apparmor=profile", opt)
+	}
+	if pair[0] != "seccomp" || len(pair) != 2 || pair[1] == "unconfined" {
+		return opt, nil
+	}
+
+	filename := pair[1]
+	if !filepath.IsAbs(filename) {
+		filename = filepath.Join(b.cfg.ContextDir, filename)
+	}
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return "", fmt.Errorf("Failed to read seccomp profile %s, error: %s", pair[1], err)
+	}
+
+	profile := &bytes.Buffer{}
+	if err := json.Compact(profile, data); err != nil {
+		return "", fmt.Errorf("Seccomp profile %s is not valid JSON, error: %s", pair[1], err)
+	}
+
+	return "seccomp=" + profile.String(), nil
+}
+
+// securityOptsKey returns the checksum of the seccomp profiles of the security
+// options, the profiles are given by path, so that their content is a part of
+// the cache key; empty if there are no profiles
+func securityOptsKey(opts []string) string {
+	h := sha256.New()
+	found := false
+	for _, opt := range opts {
+		if strings.HasPrefix(opt, "seccomp={") {
+			fmt.Fprintln(h, opt)
+			found = true
+		}
+	}
+	if !found {
+		return ""
+	}
+	return fmt.Sprintf("sha256:%x", h.Sum(nil))
+}
+
+// parseCapabilities parses a comma separated list of capabilities,
+// names are case insensitive and may be given with the CAP_ prefix
+func parseCapabilities(flag, value string) (caps []string, err error) {
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(name)), "CAP_")
+		if !capabilities[name] {
+			return nil, fmt.Errorf("Unknown capability %q given to --%s", name, flag)
+		}
+		caps = append(caps, name)
+	}
+	return caps, nil
+}
+
+// parseDevice parses a device spec in the form of
+// /dev/host[:/dev/container[:permissions]], same as `docker run --device`
+func parseDevice(spec string) (device docker.Device, err error) {
+	parts := strings.Split(spec, ":")
+	if len(parts) > 3 || parts[0] == "" {
+		return device, fmt.Errorf("Invalid device spec %q, expected /dev/host[:/dev/container[:rwm]]", spec)
+	}
+
+	device = docker.Device{
+		PathOnHost:        parts[0],
+		PathInContainer:   parts[0],
+		CgroupPermissions: "rwm",
+	}
+
+	if len(parts) > 1 {
+		// The second part can be either the container path or permissions
+		if isDevicePermissions(parts[1]) && len(parts) == 2 {
+			device.CgroupPermissions = parts[1]
+		} else {
+			device.PathInContainer = parts[1]
+		}
+	}
+	if len(parts) > 2 {
+		if !isDevicePermissions(parts[2]) {
+			return device, fmt.Errorf("Invalid device permissions %q in %q, expected a combination of r, w and m", parts[2], spec)
+		}
+		device.CgroupPermissions = parts[2]
+	}
+
+	if !filepath.IsAbs(device.PathOnHost) || !filepath.IsAbs(device.PathInContainer) {
+		return device, fmt.Errorf("Invalid device spec %q, device paths should be absolute", spec)
+	}
+
+	return device, nil
+}
+
+func isDevicePermissions(value string) bool {
+	if value == "" || len(value) > 3 {
+		return false
+	}
+	for _, c := range value {
+		if c != 'r' && c != 'w' && c != 'm' {
+			return false
+		}
+	}
+	return true
+}
+
+// parseGPUs parses the value of --gpus in the same format as `docker run --gpus`,
+// e.g. all, 2, device=0,device=1 or count=2,capabilities=compute
+func parseGPUs(value string) (request DeviceRequest, err error) {
+	request = DeviceRequest{Count: 1}
+
+	count, countErr := strconv.Atoi(value)
+
+	switch {
+	case value == "all":
+		request.Count = -1
+	case countErr == nil:
+		request.Count = count
+	default:
+		capabilities := []string{}
+		for _, field := range strings.Split(value, ",") {
+			pair := strings.SplitN(field, "=", 2)
+			if len(pair) != 2 || pair[1] == "" {
+				return request, fmt.Errorf("Invalid --gpus option %q, expected key=value", field)
+			}
+			switch pair[0] {
+			case "count":
+				if pair[1] == "all" {
+					request.Count = -1
+				} else if request.Count, err = strconv.Atoi(pair[1]); err != nil {
+					return request, fmt.Errorf("Invalid --gpus count %q, expected a number or all", pair[1])
+				}
+			case "device":
+				request.DeviceIDs = append(request.DeviceIDs, pair[1])
+			case "driver":
+				request.Driver = pair[1]
+			case "capabilities":
+				capabilities = append(capabilities, pair[1])
+			default:
+				return request, fmt.Errorf("Unknown --gpus option %q", pair[0])
+			}
+		}
+		if len(capabilities) > 0 {
+			request.Capabilities = [][]string{capabilities}
+		}
+	}
+
+	if len(request.DeviceIDs) > 0 {
+		if strings.Contains(value, "count=") {
+			return request, fmt.Errorf("Invalid --gpus %q, count and device are mutually exclusive", value)
+		}
+		request.Count = 0
+	}
+	if request.Count < -1 || (request.Count == 0 && len(request.DeviceIDs) == 0) {
+		return request, fmt.Errorf("Invalid --gpus %q, the number of GPUs should be positive", value)
+	}
+	if len(request.Capabilities) == 0 {
+		request.Capabilities = [][]string{{"gpu"}}
+	}
+
+	return request, nil
+}
+
+// runContainerError explains the error of running a container with GPUs
+// on a daemon that has no GPU support, the daemon's message is cryptic
+func runContainerError(hostConfig HostConfig, err error) error {
+	if len(hostConfig.DeviceRequests) > 0 && strings.Contains(err.Error(), "could not select device driver") {
+		return fmt.Errorf("Failed to run container with --gpus, the Docker daemon has no GPU support (is NVIDIA Container Toolkit installed?), error: %s", err)
+	}
+	return err
+}
+
+// parseRunMount parses the value of RUN --mount flag, only tmpfs mounts
+// are supported so far, e.g. type=tmpfs,target=/tmp/work,size=64m
+func parseRunMount(value string) (tmpfs map[string]string, err error) {
+	var (
+		mountType, target string
+		options           = []string{}
+	)
+
+	for _, field := range strings.Split(value, ",") {
+		pair := strings.SplitN(field, "=", 2)
+		if len(pair) != 2 {
+			return nil, fmt.Errorf("Invalid RUN --mount option %q, expected key=value", field)
+		}
+		switch pair[0] {
+		case "type":
+			mountType = pair[1]
+		case "target", "dst", "destination":
+			target = pair[1]
+		case "size", "mode":
+			options = append(options, field)
+		default:
+			return nil, fmt.Errorf("Unknown RUN --mount option %q", pair[0])
+		}
+	}
+
+	if mountType != "tmpfs" {
+		return nil, fmt.Errorf("Unsupported RUN --mount type %q, only tmpfs is supported", mountType)
+	}
+	if !filepath.IsAbs(target) {
+		return nil, fmt.Errorf("RUN --mount target should be an absolute path, got %q", target)
+	}
+
+	return map[string]string{target: strings.Join(options, ",")}, nil
+}
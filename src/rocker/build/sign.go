@@ -0,0 +1,96 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+
+	"rocker/imagename"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Signer signs the pushed images, see Config.Signer
+type Signer interface {
+	// Sign signs the image given by the digest reference,
+	// e.g. registry.example.com/app@sha256:...
+	Sign(ref string) error
+}
+
+// CosignSigner signs the images with the cosign CLI, keyless unless Key
+// is set; cosign takes the password of the key from COSIGN_PASSWORD
+type CosignSigner struct {
+	// Key is the path or the KMS URI of the private key
+	Key string
+	// Binary is the path of cosign, found in PATH by default
+	Binary string
+	// Stdout and Stderr of cosign are both os.Stderr by default, stdout of
+	// rocker is kept for --print-image-id and --events-json
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// Args returns the arguments of cosign signing the image
+func (s *CosignSigner) Args(ref string) []string {
+	args := []string{"sign", "--yes"}
+	if s.Key != "" {
+		args = append(args, "--key", s.Key)
+	}
+	return append(args, ref)
+}
+
+// Sign runs cosign to sign the image
+func (s *CosignSigner) Sign(ref string) error {
+	binary := s.Binary
+	if binary == "" {
+		binary = "cosign"
+	}
+
+	cmd := exec.Command(binary, s.Args(ref)...)
+	cmd.Stdout, cmd.Stderr = s.Stdout, s.Stderr
+	if cmd.Stdout == nil {
+		cmd.Stdout = os.Stderr
+	}
+	if cmd.Stderr == nil {
+		cmd.Stderr = os.Stderr
+	}
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("cosign %s failed, error: %s", ref, err)
+	}
+	return nil
+}
+
+// signImage signs the pushed image by the digest the registry gave for it
+func (b *Build) signImage(image *imagename.ImageName, digest string) error {
+	if digest == "" {
+		return fmt.Errorf("Cannot sign %s, the registry has not given the digest of the push", image)
+	}
+
+	ref := fmt.Sprintf("%s@%s", image.NameWithRegistry(), digest)
+
+	log.Infof("| Sign %s", ref)
+
+	if err := b.cfg.Signer.Sign(ref); err != nil {
+		return fmt.Errorf("Failed to sign %s, error: %s", ref, err)
+	}
+
+	return nil
+}
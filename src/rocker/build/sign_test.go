@@ -0,0 +1,130 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// fakeSigner records the signed references, the ones in failing fail
+type fakeSigner struct {
+	refs    []string
+	failing map[string]bool
+}
+
+func (s *fakeSigner) Sign(ref string) error {
+	s.refs = append(s.refs, ref)
+	if s.failing[ref] {
+		return fmt.Errorf("no identity token")
+	}
+	return nil
+}
+
+func TestPush_Sign(t *testing.T) {
+	rockerfile := `FROM ubuntu
+PUSH a.example.com/app:1.0
+PUSH a.example.com/app:latest`
+
+	signer := &fakeSigner{}
+
+	b, c := makeBuild(t, rockerfile, Config{Push: true, Signer: signer})
+	plan := makePlan(t, rockerfile)
+
+	c.On("InspectImage", "ubuntu").Return(&docker.Image{ID: "123"}, nil).Once()
+	c.On("TagImage", "123", "a.example.com/app:1.0").Return(nil).Once()
+	c.On("TagImage", "123", "a.example.com/app:latest").Return(nil).Once()
+	c.On("PushImage", "a.example.com/app:1.0").Return("sha256:fafa", PushStats{}, nil).Once()
+	c.On("PushImage", "a.example.com/app:latest").Return("sha256:fafa", PushStats{}, nil).Once()
+
+	if err := b.Run(plan); err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+	assert.Equal(t, []string{
+		"a.example.com/app@sha256:fafa",
+		"a.example.com/app@sha256:fafa",
+	}, signer.refs)
+}
+
+func TestPush_SignFailed(t *testing.T) {
+	signer := &fakeSigner{failing: map[string]bool{"b.example.com/app@sha256:fafa": true}}
+
+	// Failed signing is a failed push for --push-best-effort
+	b, err := runPushBuild(t, Config{Signer: signer})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Len(t, signer.refs, 3)
+	assert.Equal(t, "Failed to sign b.example.com/app@sha256:fafa, error: no identity token", b.Pushes[1].Error)
+}
+
+func TestPush_SignNoDigest(t *testing.T) {
+	rockerfile := `FROM ubuntu
+PUSH a.example.com/app:1.0`
+
+	signer := &fakeSigner{}
+
+	b, c := makeBuild(t, rockerfile, Config{Push: true, Signer: signer})
+	plan := makePlan(t, rockerfile)
+
+	c.On("InspectImage", "ubuntu").Return(&docker.Image{ID: "123"}, nil).Once()
+	c.On("TagImage", "123", "a.example.com/app:1.0").Return(nil).Once()
+	c.On("PushImage", "a.example.com/app:1.0").Return("", PushStats{}, nil).Once()
+
+	err := b.Run(plan)
+	assert.EqualError(t, err, "Cannot sign a.example.com/app:1.0, the registry has not given the digest of the push")
+	assert.Empty(t, signer.refs)
+}
+
+func TestPush_NoSignWithoutPush(t *testing.T) {
+	rockerfile := `FROM ubuntu
+PUSH a.example.com/app:1.0`
+
+	signer := &fakeSigner{}
+
+	b, c := makeBuild(t, rockerfile, Config{Signer: signer})
+	plan := makePlan(t, rockerfile)
+
+	c.On("InspectImage", "ubuntu").Return(&docker.Image{ID: "123"}, nil).Once()
+	c.On("TagImage", "123", "a.example.com/app:1.0").Return(nil).Once()
+
+	if err := b.Run(plan); err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertNotCalled(t, "PushImage", mock.Anything)
+	assert.Empty(t, signer.refs)
+}
+
+func TestCosignSigner_Args(t *testing.T) {
+	ref := "a.example.com/app@sha256:fafa"
+
+	assert.Equal(t, []string{"sign", "--yes", ref}, (&CosignSigner{}).Args(ref))
+	assert.Equal(t, []string{"sign", "--yes", "--key", "cosign.key", ref}, (&CosignSigner{Key: "cosign.key"}).Args(ref))
+}
+
+func TestCosignSigner_Failed(t *testing.T) {
+	err := (&CosignSigner{Binary: "false"}).Sign("a.example.com/app@sha256:fafa")
+	assert.EqualError(t, err, "cosign a.example.com/app@sha256:fafa failed, error: exit status 1")
+}
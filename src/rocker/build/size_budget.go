@@ -0,0 +1,81 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/docker/docker/pkg/units"
+	"github.com/fsouza/go-dockerclient"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// sizeReportLayers is the number of the largest layers reported when the
+// image exceeds Config.MaxSize
+const sizeReportLayers = 5
+
+// checkSize returns an error if the virtual size of the current image
+// exceeds Config.MaxSize; the largest layers of the image are reported
+// then, so that it is clear which steps to slim down. It is checked before
+// every PUSH and once the build is done.
+func (b *Build) checkSize() error {
+	if b.cfg.MaxSize <= 0 || b.VirtualSize <= b.cfg.MaxSize {
+		return nil
+	}
+
+	imageID := b.GetImageID()
+
+	history, err := b.client.ImageHistory(imageID)
+	if err != nil {
+		return fmt.Errorf("Failed to get history of image %.12s, error: %s", imageID, err)
+	}
+
+	log.Errorf("Largest layers of image %.12s:", imageID)
+	for _, layer := range largestLayers(history, sizeReportLayers) {
+		log.Errorf("| %10s  %s", units.HumanSize(float64(layer.Size)), layer.CreatedBy)
+	}
+
+	return fmt.Errorf("Image %.12s is %s, it exceeds the size budget of %s",
+		imageID, units.HumanSize(float64(b.VirtualSize)), units.HumanSize(float64(b.cfg.MaxSize)))
+}
+
+// largestLayers returns up to n largest layers of the image history, the
+// empty layers made by the config commands are left out
+func largestLayers(history []docker.ImageHistory, n int) []docker.ImageHistory {
+	layers := []docker.ImageHistory{}
+	for _, layer := range history {
+		if layer.Size > 0 {
+			layers = append(layers, layer)
+		}
+	}
+
+	sort.Stable(layersBySize(layers))
+
+	if len(layers) > n {
+		layers = layers[:n]
+	}
+	return layers
+}
+
+// layersBySize sorts the layers from the largest
+type layersBySize []docker.ImageHistory
+
+func (l layersBySize) Len() int           { return len(l) }
+func (l layersBySize) Less(i, j int) bool { return l[i].Size > l[j].Size }
+func (l layersBySize) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
@@ -0,0 +1,113 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"testing"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+const sizeRockerfile = `FROM ubuntu
+RUN make`
+
+// makeSizeBuild prepares the build of sizeRockerfile, RUN adds 250MB to the
+// 300MB base image
+func makeSizeBuild(t *testing.T, maxSize int64) (*Build, *MockClient, Plan) {
+	b, c := makeBuild(t, sizeRockerfile, Config{MaxSize: maxSize})
+	plan := makePlan(t, sizeRockerfile)
+
+	c.On("InspectImage", "ubuntu").Return(&docker.Image{ID: "123", VirtualSize: 300000000}, nil).Once()
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("456", nil).Once()
+	c.On("RunContainer", "456", false).Return(nil).Once()
+	c.On("CommitContainer", mock.AnythingOfType("State"), "RUN make").Return(&docker.Image{ID: "789", Size: 250000000, VirtualSize: 550000000}, nil).Once()
+	c.On("RemoveContainer", "456").Return(nil).Once()
+
+	return b, c, plan
+}
+
+func TestCheckSize_UnderBudget(t *testing.T) {
+	b, c, plan := makeSizeBuild(t, 600000000)
+	if err := b.Run(plan); err != nil {
+		t.Fatal(err)
+	}
+
+	// The history is only asked for the report
+	c.AssertExpectations(t)
+	c.AssertNotCalled(t, "ImageHistory", "789")
+}
+
+func TestCheckSize_OverBudget(t *testing.T) {
+	b, c := makeBuild(t, sizeRockerfile, Config{MaxSize: 500000000})
+	b.state.ImageID = "789"
+	b.VirtualSize = 550000000
+
+	c.On("ImageHistory", "789").Return([]docker.ImageHistory{
+		{ID: "789", CreatedBy: "/bin/sh -c make", Size: 250000000},
+		{ID: "<missing>", CreatedBy: `/bin/sh -c #(nop) CMD ["bash"]`},
+		{ID: "<missing>", CreatedBy: "/bin/sh -c #(nop) ADD file:abc in /", Size: 300000000},
+	}, nil).Once()
+
+	assert.EqualError(t, b.checkSize(), "Image 789 is 550 MB, it exceeds the size budget of 500 MB")
+	c.AssertExpectations(t)
+}
+
+func TestCheckSize_OverBudgetBuild(t *testing.T) {
+	b, c, plan := makeSizeBuild(t, 500000000)
+	c.On("ImageHistory", "789").Return([]docker.ImageHistory{}, nil).Once()
+
+	assert.EqualError(t, b.Run(plan), "Image 789 is 550 MB, it exceeds the size budget of 500 MB")
+	c.AssertExpectations(t)
+}
+
+func TestCheckSize_OverBudgetPush(t *testing.T) {
+	rockerfile := sizeRockerfile + "\nPUSH grammarly/app:1.0"
+	b, c := makeBuild(t, rockerfile, Config{MaxSize: 500000000, Push: true})
+	plan := makePlan(t, rockerfile)
+
+	c.On("InspectImage", "ubuntu").Return(&docker.Image{ID: "123", VirtualSize: 300000000}, nil).Once()
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("456", nil).Once()
+	c.On("RunContainer", "456", false).Return(nil).Once()
+	c.On("CommitContainer", mock.AnythingOfType("State"), "RUN make").Return(&docker.Image{ID: "789", Size: 250000000, VirtualSize: 550000000}, nil).Once()
+	c.On("RemoveContainer", "456").Return(nil).Once()
+	c.On("ImageHistory", "789").Return([]docker.ImageHistory{}, nil).Once()
+
+	assert.EqualError(t, b.Run(plan), "Image 789 is 550 MB, it exceeds the size budget of 500 MB")
+	c.AssertExpectations(t)
+	c.AssertNotCalled(t, "TagImage", "789", "grammarly/app:1.0")
+	c.AssertNotCalled(t, "PushImage", "grammarly/app:1.0")
+}
+
+func TestLargestLayers(t *testing.T) {
+	history := []docker.ImageHistory{
+		{CreatedBy: "RUN a", Size: 10},
+		{CreatedBy: "ENV b"},
+		{CreatedBy: "RUN c", Size: 30},
+		{CreatedBy: "RUN d", Size: 20},
+		{CreatedBy: "RUN e", Size: 30},
+	}
+
+	layers := largestLayers(history, 3)
+
+	assert.Equal(t, []docker.ImageHistory{
+		{CreatedBy: "RUN c", Size: 30},
+		{CreatedBy: "RUN e", Size: 30},
+		{CreatedBy: "RUN d", Size: 20},
+	}, layers)
+}
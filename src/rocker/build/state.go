@@ -20,14 +20,12 @@ import (
 	"fmt"
 	"sort"
 	"strings"
-
-	"github.com/fsouza/go-dockerclient"
 )
 
 // State is the build state
 // TODO: document
 type State struct {
-	Config         docker.Config
+	Config         ImageConfig
 	ImageID        string
 	ParentID       string
 	ExportsID      string
@@ -45,7 +43,18 @@ type StateNoCache struct {
 	CacheBusted  bool
 	CmdSet       bool
 	ContainerID  string
-	HostConfig   docker.HostConfig
+	HostConfig   HostConfig
+
+	// OutputFilter of the container of the RUN step, see RUN --grep
+	OutputFilter *OutputFilter
+
+	// History is the list of commands, as written in the Rockerfile, that
+	// are going to the next commit; used as a human readable commit message
+	History []string
+
+	// Annotations are set by ANNOTATION to the manifest of the image, they
+	// are not a part of the image config and so never come from the cache
+	Annotations map[string]string
 }
 
 // NewState makes a fresh state
@@ -65,6 +74,7 @@ func (s *State) Commit(msg string, args ...interface{}) *State {
 // CleanCommits resets the commits struct
 func (s *State) CleanCommits() *State {
 	s.Commits = []string{}
+	s.NoCache.History = nil
 	return s
 }
 
@@ -79,3 +89,14 @@ func (s State) Equals(s2 State) bool {
 	// TODO: compare other properties?
 	return s.GetCommits() == s2.GetCommits()
 }
+
+// emptyLayer returns a bare copy of the state that keeps only the base image.
+// It is used to create marker containers for metadata-only commits, so the
+// daemon has no reason to touch the container filesystem (e.g. create volume
+// mount points, WORKDIR or bind targets) and the committed layer stays empty.
+func (s State) emptyLayer() State {
+	return State{
+		ImageID:     s.ImageID,
+		NoBaseImage: s.NoBaseImage,
+	}
+}
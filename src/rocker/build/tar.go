@@ -54,6 +54,8 @@ func (ta *tarAppender) addTarFile(path, name string) error {
 		}
 	}
 
+	// The header carries the source mtime, so files in the container keep
+	// their original timestamps; tarsum ignores mtime, so it does not bust the cache
 	hdr, err := tar.FileInfoHeader(fi, link)
 	if err != nil {
 		return err
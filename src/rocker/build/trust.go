@@ -0,0 +1,165 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"path"
+	"strings"
+
+	"rocker/imagename"
+
+	"github.com/go-yaml/yaml"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Verifier verifies the signatures of the base images, see Config.BaseVerifier
+type Verifier interface {
+	// Verify returns an error unless the image given by the digest
+	// reference, e.g. registry.example.com/app@sha256:..., is signed
+	// by a trusted signer
+	Verify(ref string) error
+}
+
+// TrustPolicy tells whom the base images should be signed by, it is read
+// from the file given with --trust-policy, e.g.
+//
+//	key: cosign.pub
+//	skip:
+//	  - registry.example.com/stages/*
+type TrustPolicy struct {
+	// Key is the path or the KMS URI of the public key of the signer
+	Key string `yaml:"key"`
+	// Identity and Issuer are the regexps of the certificate identity and
+	// its OIDC issuer the keyless signatures should have, used without Key
+	Identity string `yaml:"identity"`
+	Issuer   string `yaml:"issuer"`
+	// Skip lists the images that are not verified, e.g. the stages built
+	// locally; the patterns match the names with registry, e.g. golang or
+	// registry.example.com/team/*
+	Skip []string `yaml:"skip"`
+}
+
+// ReadTrustPolicy reads the trust policy from the YAML file
+func ReadTrustPolicy(filename string) (*TrustPolicy, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read trust policy %s, error: %s", filename, err)
+	}
+
+	policy := &TrustPolicy{}
+	if err := yaml.Unmarshal(data, policy); err != nil {
+		return nil, fmt.Errorf("Failed to parse trust policy %s, error: %s", filename, err)
+	}
+
+	if policy.Key == "" && (policy.Identity == "" || policy.Issuer == "") {
+		return nil, fmt.Errorf("Trust policy %s should have either key or both identity and issuer", filename)
+	}
+
+	return policy, nil
+}
+
+// Skips tells whether the base image is not verified by the policy
+func (p *TrustPolicy) Skips(image *imagename.ImageName) bool {
+	for _, pattern := range p.Skip {
+		if ok, _ := path.Match(pattern, image.NameWithRegistry()); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// CosignVerifier verifies the signatures with the cosign CLI
+type CosignVerifier struct {
+	Policy TrustPolicy
+	// Binary is the path of cosign, found in PATH by default
+	Binary string
+}
+
+// Args returns the arguments of cosign verifying the image
+func (v *CosignVerifier) Args(ref string) []string {
+	args := []string{"verify"}
+	if v.Policy.Key != "" {
+		args = append(args, "--key", v.Policy.Key)
+	} else {
+		args = append(args,
+			"--certificate-identity-regexp", v.Policy.Identity,
+			"--certificate-oidc-issuer-regexp", v.Policy.Issuer,
+		)
+	}
+	return append(args, ref)
+}
+
+// Verify runs cosign to verify the image, the output of cosign is the error
+func (v *CosignVerifier) Verify(ref string) error {
+	binary := v.Binary
+	if binary == "" {
+		binary = "cosign"
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.Command(binary, v.Args(ref)...)
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return fmt.Errorf("%s", msg)
+		}
+		return err
+	}
+	return nil
+}
+
+// verifyBase verifies the signature of the base image of FROM; the image
+// is verified by its digest in the registry it was pulled from, so the
+// images that never came from a registry are not trusted
+func (b *Build) verifyBase(name, imageID string) error {
+	image := imagename.NewFromString(name)
+
+	if b.cfg.TrustPolicy != nil && b.cfg.TrustPolicy.Skips(image) {
+		log.Infof("| Skip the signature verification of %s, allowed by the trust policy", image)
+		return nil
+	}
+
+	repoDigests, err := b.client.ImageRepoDigests(imageID)
+	if err != nil {
+		return fmt.Errorf("Failed to get the digest of base image %s, error: %s", image, err)
+	}
+
+	var ref string
+	for _, d := range repoDigests {
+		if strings.HasPrefix(d, image.NameWithRegistry()+"@") {
+			ref = d
+			break
+		}
+	}
+	if ref == "" {
+		return fmt.Errorf("Base image %s has no digest from the registry, its signature cannot be verified", image)
+	}
+
+	log.Infof("| Verify the signature of %s", ref)
+
+	if err := b.cfg.BaseVerifier.Verify(ref); err != nil {
+		return fmt.Errorf("Base image %s is not trusted, error: %s", ref, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,144 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"rocker/imagename"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeVerifier trusts the references in trusted
+type fakeVerifier struct {
+	trusted map[string]bool
+	refs    []string
+}
+
+func (v *fakeVerifier) Verify(ref string) error {
+	v.refs = append(v.refs, ref)
+	if !v.trusted[ref] {
+		return fmt.Errorf("no matching signatures")
+	}
+	return nil
+}
+
+func runVerifiedFrom(t *testing.T, cfg Config, repoDigests []string) error {
+	rockerfile := `FROM golang:1.5`
+
+	b, c := makeBuild(t, rockerfile, cfg)
+	plan := makePlan(t, rockerfile)
+
+	c.On("InspectImage", "golang:1.5").Return(&docker.Image{ID: "123"}, nil).Once()
+	c.On("ImageRepoDigests", "123").Return(repoDigests, nil)
+
+	return b.Run(plan)
+}
+
+func TestFrom_VerifyTrusted(t *testing.T) {
+	verifier := &fakeVerifier{trusted: map[string]bool{"golang@sha256:fafa": true}}
+
+	err := runVerifiedFrom(t, Config{BaseVerifier: verifier}, []string{"other@sha256:0000", "golang@sha256:fafa"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, []string{"golang@sha256:fafa"}, verifier.refs)
+}
+
+func TestFrom_VerifyUntrusted(t *testing.T) {
+	verifier := &fakeVerifier{}
+
+	err := runVerifiedFrom(t, Config{BaseVerifier: verifier}, []string{"golang@sha256:fafa"})
+
+	assert.EqualError(t, err, "FROM error: Base image golang@sha256:fafa is not trusted, error: no matching signatures")
+	assert.Equal(t, []string{"golang@sha256:fafa"}, verifier.refs)
+}
+
+func TestFrom_VerifyNoDigest(t *testing.T) {
+	verifier := &fakeVerifier{}
+
+	// The image was built locally
+	err := runVerifiedFrom(t, Config{BaseVerifier: verifier}, []string{})
+
+	assert.EqualError(t, err, "FROM error: Base image golang:1.5 has no digest from the registry, its signature cannot be verified")
+	assert.Empty(t, verifier.refs)
+}
+
+func TestFrom_VerifySkipped(t *testing.T) {
+	verifier := &fakeVerifier{}
+	policy := &TrustPolicy{Key: "cosign.pub", Skip: []string{"golang"}}
+
+	err := runVerifiedFrom(t, Config{BaseVerifier: verifier, TrustPolicy: policy}, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Empty(t, verifier.refs)
+}
+
+func TestTrustPolicy_Skips(t *testing.T) {
+	policy := &TrustPolicy{Skip: []string{"golang", "registry.example.com/stages/*"}}
+
+	assert.True(t, policy.Skips(imagename.NewFromString("golang:1.5")))
+	assert.True(t, policy.Skips(imagename.NewFromString("registry.example.com/stages/build:1")))
+	assert.False(t, policy.Skips(imagename.NewFromString("registry.example.com/app:1")))
+	assert.False(t, policy.Skips(imagename.NewFromString("ubuntu")))
+}
+
+func TestReadTrustPolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rocker-trust-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "policy.yml")
+	policy := "identity: ^https://github.com/grammarly/\nissuer: ^https://token.actions.githubusercontent.com$\nskip:\n  - golang\n"
+	if err := ioutil.WriteFile(filename, []byte(policy), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := ReadTrustPolicy(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, &TrustPolicy{
+		Identity: "^https://github.com/grammarly/",
+		Issuer:   "^https://token.actions.githubusercontent.com$",
+		Skip:     []string{"golang"},
+	}, p)
+
+	assert.Equal(t, []string{
+		"verify",
+		"--certificate-identity-regexp", "^https://github.com/grammarly/",
+		"--certificate-oidc-issuer-regexp", "^https://token.actions.githubusercontent.com$",
+		"golang@sha256:fafa",
+	}, (&CosignVerifier{Policy: *p}).Args("golang@sha256:fafa"))
+
+	if err := ioutil.WriteFile(filename, []byte("skip: [golang]\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err = ReadTrustPolicy(filename)
+	assert.EqualError(t, err, fmt.Sprintf("Trust policy %s should have either key or both identity and issuer", filename))
+}
@@ -20,6 +20,9 @@ import (
 	"crypto/md5"
 	"fmt"
 	"io"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/fsouza/go-dockerclient"
 )
@@ -31,18 +34,72 @@ func (b *Build) mountsContainerName(path string) string {
 	return fmt.Sprintf("rocker_mount_%.6x", md5.Sum([]byte(mountID)))
 }
 
+// freshMountsContainerName returns the name of volume container that is used
+// for a MOUNT with no reuse, it is unique to the current build
+func (b *Build) freshMountsContainerName(path string) string {
+	if b.freshMountsID == "" {
+		b.freshMountsID = fmt.Sprintf("%d", time.Now().UnixNano())
+	}
+	mountID := b.getIdentifier() + ":" + path + ":" + b.freshMountsID
+	return fmt.Sprintf("rocker_mount_fresh_%.6x", md5.Sum([]byte(mountID)))
+}
+
 // exportsContainerName return the name of volume container that will be used for EXPORTs
 func (b *Build) exportsContainerName() string {
 	mountID := b.getIdentifier()
 	return fmt.Sprintf("rocker_exports_%.6x", md5.Sum([]byte(mountID)))
 }
 
+// LockFileName returns the name of the lock file that excludes concurrent
+// builds of the same Rockerfile (or the same --id) on the host
+func (b *Build) LockFileName() string {
+	return fmt.Sprintf("rocker_build_%.6x.lock", md5.Sum([]byte(b.getIdentifier())))
+}
+
 // getIdentifier returns the sequence that is unique to the current Rockerfile
 func (b *Build) getIdentifier() string {
 	if b.cfg.ID != "" {
 		return b.cfg.ID
 	}
-	return b.cfg.ContextDir + ":" + b.rockerfile.Name
+	return DefaultID(b.cfg.ContextDir, b.rockerfile.Name)
+}
+
+// DefaultID returns the id of the build that is not given Config.ID
+func DefaultID(contextDir, rockerfileName string) string {
+	return contextDir + ":" + rockerfileName
+}
+
+// CompoundID joins the id and the components given as key=value, e.g. the
+// dimensions of a matrix build, into a single id. The components are sorted
+// by the keys, so the same set of them always makes the same id
+func CompoundID(id string, components []string) (string, error) {
+	if len(components) == 0 {
+		return id, nil
+	}
+
+	values := map[string]string{}
+	keys := make([]string, 0, len(components))
+
+	for _, component := range components {
+		parts := strings.SplitN(component, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return "", fmt.Errorf("Invalid id component %q, expected key=value", component)
+		}
+		if _, ok := values[parts[0]]; ok {
+			return "", fmt.Errorf("Duplicate id component %s", parts[0])
+		}
+		values[parts[0]] = parts[1]
+		keys = append(keys, parts[0])
+	}
+
+	sort.Strings(keys)
+
+	pairs := make([]string, len(keys))
+	for i, key := range keys {
+		pairs[i] = key + "=" + values[key]
+	}
+
+	return id + "@" + strings.Join(pairs, ","), nil
 }
 
 // mountsToBinds turns the list of mounts to the list of binds
@@ -0,0 +1,63 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompoundID(t *testing.T) {
+	id1, err := CompoundID("app", []string{"os=linux", "arch=amd64", "variant=v8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id2, err := CompoundID("app", []string{"variant=v8", "os=linux", "arch=amd64"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "app@arch=amd64,os=linux,variant=v8", id1)
+	assert.Equal(t, id1, id2)
+
+	id, err := CompoundID("app", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "app", id)
+}
+
+func TestCompoundID_Invalid(t *testing.T) {
+	_, err := CompoundID("app", []string{"os"})
+	assert.EqualError(t, err, `Invalid id component "os", expected key=value`)
+
+	_, err = CompoundID("app", []string{"os=linux", "os=darwin"})
+	assert.EqualError(t, err, "Duplicate id component os")
+}
+
+func TestBuild_CompoundIDContainerNames(t *testing.T) {
+	name := func(components ...string) string {
+		id, err := CompoundID("app", components)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := makeBuild(t, "", Config{ID: id})
+		return b.exportsContainerName()
+	}
+
+	assert.Equal(t, name("os=linux", "arch=amd64"), name("arch=amd64", "os=linux"))
+	assert.NotEqual(t, name("os=linux", "arch=amd64"), name("os=linux", "arch=arm64"))
+}
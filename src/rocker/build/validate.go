@@ -0,0 +1,147 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// commandArity is the allowed number of arguments for every command,
+// max < 0 means there is no upper limit
+var commandArity = map[string]struct{ min, max int }{
+	"from":       {1, 1},
+	"maintainer": {1, 1},
+	"run":        {0, -1},
+	"attach":     {0, -1},
+	"env":        {1, -1},
+	"label":      {1, -1},
+	"annotation": {1, -1},
+	"config":     {1, 1},
+	"workdir":    {1, 1},
+	"tag":        {1, 1},
+	"push":       {1, 1},
+	"copy":       {2, -1},
+	"add":        {2, -1},
+	"cmd":        {0, -1},
+	"entrypoint": {0, -1},
+	"expose":     {1, -1},
+	"volume":     {1, -1},
+	"user":       {1, 1},
+	"onbuild":    {1, -1},
+	"mount":      {1, -1},
+	"export":     {1, -1},
+	"import":     {1, -1},
+}
+
+// singleWordCommands are the commands whose only argument cannot contain spaces
+var singleWordCommands = map[string]bool{
+	"from": true,
+	"tag":  true,
+	"push": true,
+	"user": true,
+}
+
+var onbuildPrefix = regexp.MustCompile(`(?i)^\s*ONBUILD\s*`)
+
+// commandFlags is the set of --flags every command accepts
+var commandFlags = map[string]map[string]bool{
+	"copy":  {"from-context": true},
+	"mount": {"no-reuse": true},
+	"run": {
+		"mount": true, "privileged": true, "cap-add": true, "cap-drop": true, "device": true, "gpus": true, "sysctl": true,
+		"allow-failure": true, "if-prev-succeeded": true, "if-prev-failed": true, "cache-key-file": true,
+		"security-opt": true, "read-only": true, "grep": true, "grep-log": true,
+	},
+}
+
+// Validate parses the Rockerfile into a Plan and checks the arguments
+// of every command. It does not need the docker daemon.
+func (r *Rockerfile) Validate() error {
+	commands := r.Commands()
+
+	for _, cfg := range commands {
+		if err := ValidateCommand(cfg); err != nil {
+			return fmt.Errorf("Invalid command %s, error: %s", strings.TrimSpace(cfg.original), err)
+		}
+	}
+
+	_, err := NewPlan(commands, true)
+	return err
+}
+
+// ValidateCommand checks the arity and the flags of the command
+// without executing it
+func ValidateCommand(cfg ConfigCommand) error {
+	arity, ok := commandArity[cfg.name]
+	if !ok {
+		return fmt.Errorf("Unknown command: %s", cfg.name)
+	}
+
+	name := strings.ToUpper(cfg.name)
+	n := len(cfg.args)
+
+	// These commands are parsed as a single string, but actually take a single word
+	if singleWordCommands[cfg.name] && n == 1 {
+		n = len(strings.Fields(cfg.args[0]))
+	}
+
+	switch {
+	case arity.min == arity.max && n != arity.min:
+		return fmt.Errorf("%s requires exactly %d argument(s), got %d", name, arity.min, n)
+	case n < arity.min:
+		return fmt.Errorf("%s requires at least %d argument(s), got %d", name, arity.min, n)
+	case arity.max >= 0 && n > arity.max:
+		return fmt.Errorf("%s accepts at most %d argument(s), got %d", name, arity.max, n)
+	}
+
+	if (cfg.name == "env" || cfg.name == "label" || cfg.name == "annotation") && n%2 != 0 {
+		return fmt.Errorf("Bad input to %s, too many args", name)
+	}
+
+	if cfg.name == "mount" {
+		if _, err := normalizeMounts(cfg.args); err != nil {
+			return err
+		}
+	}
+
+	if cfg.name == "config" {
+		if err := validateConfigBlob(cfg.args[0]); err != nil {
+			return err
+		}
+	}
+
+	for flag := range cfg.flags {
+		if !commandFlags[cfg.name][flag] {
+			return fmt.Errorf("Unknown flag --%s for %s", flag, name)
+		}
+	}
+
+	if cfg.name == "onbuild" {
+		// The trigger is parsed as a nested node, so take it from the original line
+		trigger := strings.ToUpper(strings.Fields(onbuildPrefix.ReplaceAllString(cfg.original, ""))[0])
+		switch trigger {
+		case "ONBUILD":
+			return fmt.Errorf("Chaining ONBUILD via `ONBUILD ONBUILD` isn't allowed")
+		case "MAINTAINER", "FROM":
+			return fmt.Errorf("%s isn't allowed as an ONBUILD trigger", trigger)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,108 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"rocker/template"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidate_Valid(t *testing.T) {
+	err := validateRockerfile(t, `FROM {{ .base }}
+ENV foo=bar
+COPY . /src
+RUN make
+ONBUILD RUN make test
+TAG app:latest`, template.Vars{"base": "ubuntu"})
+
+	assert.Nil(t, err)
+}
+
+func TestValidate_Arity(t *testing.T) {
+	tests := map[string]string{
+		"FROM ubuntu debian":    "FROM requires exactly 1 argument(s), got 2",
+		"COPY {{ .src }}":       "COPY requires at least 2 argument(s), got 1",
+		"USER app root":         "USER requires exactly 1 argument(s), got 2",
+		"TAG {{ .a }} {{ .b }}": "TAG requires exactly 1 argument(s), got 2",
+		"EXPOSE {{ .port }}":    "EXPOSE requires at least 1 argument(s), got 0",
+		"WORKDIR":               "WORKDIR requires exactly 1 argument(s), got 0",
+	}
+
+	vars := template.Vars{"src": "/src", "a": "app:1", "b": "app:2", "port": ""}
+
+	for line, expected := range tests {
+		err := validateRockerfile(t, "FROM ubuntu\n"+line, vars)
+		if assert.Error(t, err, line) {
+			assert.Contains(t, err.Error(), expected, line)
+		}
+	}
+}
+
+func TestValidate_UnknownFlag(t *testing.T) {
+	err := validateRockerfile(t, "FROM ubuntu\nCOPY --chown=app . /src", template.Vars{})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "Unknown flag --chown for COPY")
+	}
+}
+
+func TestValidate_Onbuild(t *testing.T) {
+	err := validateRockerfile(t, "FROM ubuntu\nONBUILD FROM debian", template.Vars{})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "FROM isn't allowed as an ONBUILD trigger")
+	}
+}
+
+func TestValidate_Config(t *testing.T) {
+	tests := map[string]string{
+		`CONFIG [1, 2]`:                  "CONFIG requires a JSON object",
+		`CONFIG {"Platform": "linux"}`:   `CONFIG has unknown field "Platform"`,
+		`CONFIG {"Hostname": 15}`:        "Bad input to CONFIG",
+		`CONFIG {"User": "app"} {"a":1}`: "CONFIG requires a JSON object",
+	}
+
+	for line, expected := range tests {
+		err := validateRockerfile(t, "FROM ubuntu\n"+line, template.Vars{})
+		if assert.Error(t, err, line) {
+			assert.Contains(t, err.Error(), expected, line)
+		}
+	}
+
+	assert.Nil(t, validateRockerfile(t, `FROM ubuntu
+CONFIG {{ .config | json }}`, template.Vars{"config": map[string]interface{}{"Hostname": "web"}}))
+	assert.Nil(t, validateRockerfile(t, `FROM ubuntu
+CONFIG {"Healthcheck": {"Test": ["CMD", "true"]}, "Shell": ["/bin/bash", "-c"], "StopSignal": "SIGINT", "StopTimeout": 5}`, template.Vars{}))
+}
+
+func validateRockerfile(t *testing.T, content string, vars template.Vars) error {
+	r, err := NewRockerfile("Rockerfile", strings.NewReader(content), vars, template.Funs{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r.Validate()
+}
+
+func TestValidate_Annotation(t *testing.T) {
+	_, err := NewRockerfile("Rockerfile", strings.NewReader("FROM ubuntu\nANNOTATION a"), template.Vars{}, template.Funs{})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "ANNOTATION must have two arguments")
+	}
+
+	assert.Nil(t, validateRockerfile(t, "FROM ubuntu\nANNOTATION a=1 b=2", template.Vars{}))
+}
@@ -0,0 +1,88 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"rocker/parser"
+)
+
+// checkpointMarker is the comment ending the part of the Rockerfile built
+// by rocker warm, e.g. after the step installing the dependencies
+var checkpointMarker = regexp.MustCompile(`^\s*#\s*rocker:cache-checkpoint\s*$`)
+
+// WarmPlan makes the plan of rocker warm, which only fills the cache: the
+// commands of the Rockerfile up to the checkpoint, that is either the
+// "# rocker:cache-checkpoint" comment if until is empty or the number of the
+// last instruction to run; TAG and PUSH are left out, and the last state is
+// committed without the final cleanup
+func WarmPlan(r *Rockerfile, until string) (Plan, error) {
+	commands := r.Commands()
+
+	n, err := r.checkpoint(until, len(commands))
+	if err != nil {
+		return nil, err
+	}
+
+	warm := []ConfigCommand{}
+	for _, cfg := range commands[:n] {
+		if cfg.name == "tag" || cfg.name == "push" {
+			continue
+		}
+		warm = append(warm, cfg)
+	}
+
+	if len(warm) == 0 {
+		return nil, fmt.Errorf("Rockerfile %s has nothing to build before the checkpoint", r.Name)
+	}
+
+	return NewPlan(warm, false)
+}
+
+// checkpoint returns the number of the instructions before the checkpoint
+func (r *Rockerfile) checkpoint(until string, total int) (int, error) {
+	if until != "" {
+		n, err := strconv.Atoi(until)
+		if err != nil {
+			return 0, fmt.Errorf("Invalid checkpoint %q, expected the number of the instruction", until)
+		}
+		if n < 1 || n > total {
+			return 0, fmt.Errorf("Invalid checkpoint %d, Rockerfile %s has %d instructions", n, r.Name, total)
+		}
+		return n, nil
+	}
+
+	lines := strings.Split(r.Content, "\n")
+	for i, line := range lines {
+		if !checkpointMarker.MatchString(line) {
+			continue
+		}
+		// The instructions before the comment are the ones the parser
+		// makes of the lines before it
+		node, err := parser.Parse(strings.NewReader(strings.Join(lines[:i], "\n")))
+		if err != nil {
+			return 0, err
+		}
+		return len(node.Children), nil
+	}
+
+	return 0, fmt.Errorf("Rockerfile %s has no # rocker:cache-checkpoint comment", r.Name)
+}
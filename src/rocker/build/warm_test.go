@@ -0,0 +1,142 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"testing"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+const warmRockerfile = `FROM ubuntu
+ENV DEBIAN_FRONTEND=noninteractive
+RUN apt-get install -y build-essential \
+    git
+TAG app:deps
+# rocker:cache-checkpoint
+COPY . /src
+RUN make
+TAG app:1.0`
+
+func makeWarmPlan(t *testing.T, rockerfile, until string) Plan {
+	b, _ := makeBuild(t, rockerfile, Config{})
+	plan, err := WarmPlan(b.rockerfile, until)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return plan
+}
+
+func TestWarmPlan_Checkpoint(t *testing.T) {
+	plan := makeWarmPlan(t, warmRockerfile, "")
+
+	expected := []Command{
+		&CommandFrom{},
+		&CommandEnv{},
+		&CommandRun{},
+		&CommandCommit{},
+	}
+
+	assert.Len(t, plan, len(expected))
+	for i, c := range expected {
+		assert.IsType(t, c, plan[i])
+	}
+}
+
+func TestWarmPlan_Step(t *testing.T) {
+	plan := makeWarmPlan(t, warmRockerfile, "2")
+
+	expected := []Command{
+		&CommandFrom{},
+		&CommandEnv{},
+		&CommandCommit{},
+	}
+
+	assert.Len(t, plan, len(expected))
+	for i, c := range expected {
+		assert.IsType(t, c, plan[i])
+	}
+}
+
+func TestWarmPlan_Errors(t *testing.T) {
+	b, _ := makeBuild(t, "FROM ubuntu\nRUN make", Config{})
+
+	_, err := WarmPlan(b.rockerfile, "")
+	assert.EqualError(t, err, "Rockerfile rocker/build.TestWarmPlan_Errors has no # rocker:cache-checkpoint comment")
+
+	_, err = WarmPlan(b.rockerfile, "3")
+	assert.EqualError(t, err, "Invalid checkpoint 3, Rockerfile rocker/build.TestWarmPlan_Errors has 2 instructions")
+
+	_, err = WarmPlan(b.rockerfile, "make")
+	assert.EqualError(t, err, `Invalid checkpoint "make", expected the number of the instruction`)
+}
+
+func TestWarm_Cache(t *testing.T) {
+	rockerfile := `FROM ubuntu
+RUN apt-get install -y build-essential
+# rocker:cache-checkpoint
+RUN make
+TAG app:1.0`
+
+	cache := NewCacheMemory()
+
+	b, c := makeBuild(t, rockerfile, Config{})
+	b.cfg.NoCache = false
+	b.cache = cache
+
+	plan, err := WarmPlan(b.rockerfile, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.On("InspectImage", "ubuntu").Return(&docker.Image{ID: "123", Config: &docker.Config{}}, nil).Once()
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("456", nil).Once()
+	c.On("RunContainer", "456", false).Return(nil).Once()
+	c.On("CommitContainer", mock.AnythingOfType("State"), "RUN apt-get install -y build-essential").Return(&docker.Image{ID: "789"}, nil).Once()
+	c.On("RemoveContainer", "456").Return(nil).Once()
+
+	if err := b.Run(plan); err != nil {
+		t.Fatal(err)
+	}
+
+	// The build stops at the checkpoint without tagging anything
+	c.AssertExpectations(t)
+	c.AssertNotCalled(t, "TagImage", mock.Anything, mock.Anything)
+	assert.Equal(t, "789", b.GetImageID())
+
+	// The next build takes the warmed step from the cache
+	b, c = makeBuild(t, rockerfile, Config{})
+	b.cfg.NoCache = false
+	b.cache = cache
+
+	c.On("InspectImage", "ubuntu").Return(&docker.Image{ID: "123", Config: &docker.Config{}}, nil).Once()
+	c.On("InspectImage", "789").Return(&docker.Image{ID: "789", Config: &docker.Config{}}, nil).Once()
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("654", nil).Once()
+	c.On("RunContainer", "654", false).Return(nil).Once()
+	c.On("CommitContainer", mock.AnythingOfType("State"), "RUN make").Return(&docker.Image{ID: "987"}, nil).Once()
+	c.On("RemoveContainer", "654").Return(nil).Once()
+	c.On("TagImage", "987", "app:1.0").Return(nil).Once()
+
+	if err := b.Run(makePlan(t, rockerfile)); err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+	assert.Equal(t, "cache hit (image 789)", b.Explanations[1].Reason)
+}
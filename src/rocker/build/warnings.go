@@ -0,0 +1,79 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"fmt"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Warning is a problem that does not fail the build, e.g. a deprecated
+// command or a failed best-effort push; the warnings are collected in
+// Build.Warnings and reported once at the end of the build
+type Warning struct {
+	Step    int    `json:"step,omitempty"`
+	Message string `json:"message"`
+}
+
+// String returns the human readable string representation of the warning
+func (w Warning) String() string {
+	if w.Step == 0 {
+		return w.Message
+	}
+	return fmt.Sprintf("Step %d: %s", w.Step, w.Message)
+}
+
+// warnf logs the warning and collects it for the current step, the same
+// message is collected once even if it comes from several steps
+func (b *Build) warnf(format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+
+	if b.step == 0 {
+		log.Warn(message)
+	} else {
+		log.Warnf("| %s", message)
+	}
+
+	for _, w := range b.Warnings {
+		if w.Message == message {
+			return
+		}
+	}
+	b.Warnings = append(b.Warnings, Warning{Step: b.step, Message: message})
+}
+
+// warnUnusedVars warns about the vars given to the build that the
+// Rockerfile does not refer to, they are likely misspelled
+func (b *Build) warnUnusedVars() {
+	if unused := b.rockerfile.Vars.Unused(b.rockerfile.Source); len(unused) > 0 {
+		b.warnf("Vars not used by the Rockerfile: %s", strings.Join(unused, ", "))
+	}
+}
+
+// reportWarnings prints the warnings collected during the build, so that
+// they are not lost in the output of the steps
+func (b *Build) reportWarnings() {
+	if len(b.Warnings) == 0 {
+		return
+	}
+	log.Warnf("Warnings:")
+	for _, w := range b.Warnings {
+		log.Warnf("  %s", w)
+	}
+}
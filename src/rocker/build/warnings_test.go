@@ -0,0 +1,80 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"strings"
+	"testing"
+
+	"rocker/template"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWarnings_Build(t *testing.T) {
+	b, err := runPushBuild(t, Config{}, "a.example.com", "b.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, []Warning{
+		{Step: 1, Message: "Image ubuntu:latest is not pinned to a version"},
+		{Step: 4, Message: "Failed to push a.example.com/app:1.0, continue because of --push-best-effort, error: denied"},
+		{Step: 5, Message: "Failed to push b.example.com/app:1.0, continue because of --push-best-effort, error: denied"},
+	}, b.Warnings)
+}
+
+func TestWarnings_Config(t *testing.T) {
+	rockerfile := "FROM scratch"
+	b, _ := makeBuild(t, rockerfile, Config{Warnings: []string{"--auth is deprecated"}})
+
+	if err := b.Run(makePlan(t, rockerfile)); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, []Warning{{Message: "--auth is deprecated"}}, b.Warnings)
+}
+
+func TestWarnings_Once(t *testing.T) {
+	b, _ := makeBuild(t, "", Config{})
+	cmd := &CommandMaintainer{ConfigCommand{args: []string{"ops@example.com"}}}
+
+	for step := 1; step <= 2; step++ {
+		b.step = step
+		if _, err := cmd.Execute(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	assert.Equal(t, []Warning{
+		{Step: 1, Message: `MAINTAINER is deprecated, use LABEL maintainer="ops@example.com" instead`},
+	}, b.Warnings)
+}
+
+func TestWarnings_UnusedVars(t *testing.T) {
+	vars := template.Vars{"Version": "1.0", "Verison": "1.1", "Mirror": "http://mirror"}
+	r, err := NewRockerfile("Rockerfile", strings.NewReader("FROM app:{{ .Version }}\nRUN fetch {{ .Mirror }}"), vars, template.Funs{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := New(&MockClient{}, r, nil, Config{})
+	b.warnUnusedVars()
+
+	assert.Equal(t, []Warning{{Message: "Vars not used by the Rockerfile: Verison"}}, b.Warnings)
+	assert.Equal(t, "Vars not used by the Rockerfile: Verison", b.Warnings[0].String())
+}
@@ -0,0 +1,89 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dockerclient
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+)
+
+func apiVersionServer(paths *[]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*paths = append(*paths, r.URL.Path)
+		switch r.URL.Path {
+		case "/version", "/v1.22/version":
+			w.Write([]byte(`{"Version":"1.12.0","ApiVersion":"1.24"}`))
+		default:
+			w.Write([]byte("OK"))
+		}
+	}))
+}
+
+func TestNewFromConfig_APIVersion(t *testing.T) {
+	paths := []string{}
+	server := apiVersionServer(&paths)
+	defer server.Close()
+
+	config := &Config{Host: server.URL, APIVersion: "1.22"}
+	client, err := NewFromConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "/v1.22/_ping", paths[len(paths)-1])
+
+	version, err := NegotiatedAPIVersion(client, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, docker.APIVersion{1, 22}, version)
+}
+
+func TestNewFromConfig_DaemonAPIVersion(t *testing.T) {
+	paths := []string{}
+	server := apiVersionServer(&paths)
+	defer server.Close()
+
+	config := &Config{Host: server.URL}
+	client, err := NewFromConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "/_ping", paths[len(paths)-1])
+
+	version, err := NegotiatedAPIVersion(client, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, docker.APIVersion{1, 24}, version)
+}
+
+func TestNewFromConfig_InvalidAPIVersion(t *testing.T) {
+	for _, version := range []string{"1", "1.x", "latest"} {
+		_, err := NewFromConfig(&Config{Host: "unix:///var/run/docker.sock", APIVersion: version})
+		assert.EqualError(t, err, `Invalid docker API version "`+version+`", expected major.minor`)
+	}
+}
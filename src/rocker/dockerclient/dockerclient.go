@@ -44,6 +44,9 @@ type Config struct {
 	Tlscacert string
 	Tlscert   string
 	Tlskey    string
+	// APIVersion forces the API version of the client, the version of the
+	// daemon is used if empty
+	APIVersion string
 }
 
 // NewConfig returns new config with resolved options from current ENV
@@ -67,6 +70,8 @@ func NewConfig() *Config {
 		Tlscacert: certPath + "/ca.pem",
 		Tlscert:   certPath + "/cert.pem",
 		Tlskey:    certPath + "/key.pem",
+
+		APIVersion: os.Getenv("DOCKER_API_VERSION"),
 	}
 }
 
@@ -80,6 +85,9 @@ func NewConfigFromCli(c *cli.Context) *Config {
 		config.Tlscert = globalCliString(c, "tlscert")
 		config.Tlskey = globalCliString(c, "tlskey")
 	}
+	if version := globalCliString(c, "docker-api-version"); version != "" {
+		config.APIVersion = version
+	}
 	return config
 }
 
@@ -90,10 +98,16 @@ func New() (*docker.Client, error) {
 
 // NewFromConfig returns a new docker client connection with given config
 func NewFromConfig(config *Config) (*docker.Client, error) {
+	// go-dockerclient silently ignores the versions it cannot parse
+	if config.APIVersion != "" {
+		if _, err := docker.NewAPIVersion(config.APIVersion); err != nil {
+			return nil, fmt.Errorf("Invalid docker API version %q, expected major.minor", config.APIVersion)
+		}
+	}
 	if config.Tlsverify {
-		return docker.NewTLSClient(config.Host, config.Tlscert, config.Tlskey, config.Tlscacert)
+		return docker.NewVersionedTLSClient(config.Host, config.Tlscert, config.Tlskey, config.Tlscacert, config.APIVersion)
 	}
-	return docker.NewClient(config.Host)
+	return docker.NewVersionedClient(config.Host, config.APIVersion)
 }
 
 // NewFromCli returns a new docker client connection with config built from cli params
@@ -121,6 +135,28 @@ func Ping(client *docker.Client, timeoutMs int) error {
 	}
 }
 
+// NegotiatedAPIVersion returns the API version the client talks to the
+// daemon with, it is either forced by the config or the daemon's one
+func NegotiatedAPIVersion(client *docker.Client, config *Config) (docker.APIVersion, error) {
+	if config.APIVersion != "" {
+		return docker.NewAPIVersion(config.APIVersion)
+	}
+	version, err := client.Version()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get docker version, error: %s", err)
+	}
+	return docker.NewAPIVersion(version.Get("ApiVersion"))
+}
+
+// DaemonID returns the unique identifier of the docker daemon
+func DaemonID(client *docker.Client) (string, error) {
+	info, err := client.Info()
+	if err != nil {
+		return "", err
+	}
+	return info.Get("ID"), nil
+}
+
 // GlobalCliParams returns global params that configures docker client connection
 func GlobalCliParams() []cli.Flag {
 	return []cli.Flag{
@@ -149,6 +185,11 @@ func GlobalCliParams() []cli.Flag {
 			Value: "~/.docker/key.pem",
 			Usage: "Path to TLS key file",
 		},
+		cli.StringFlag{
+			Name:   "docker-api-version",
+			Usage:  "Force the docker API version of the client, e.g. 1.24",
+			EnvVar: "DOCKER_API_VERSION",
+		},
 	}
 }
 
@@ -172,6 +213,9 @@ func infoCommand(c *cli.Context) {
 	config := NewConfigFromCli(c)
 
 	fmt.Printf("Docker host: %s\n", config.Host)
+	if config.APIVersion != "" {
+		fmt.Printf("Docker API version: %s\n", config.APIVersion)
+	}
 	fmt.Printf("Docker use TLS: %s\n", strconv.FormatBool(config.Tlsverify))
 	if config.Tlsverify {
 		fmt.Printf("  TLS CA cert: %s\n", config.Tlscacert)
@@ -0,0 +1,118 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dockerclient
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// RawClient sends requests to the Docker API that go-dockerclient cannot
+// make, its types lack the fields added by the later API versions, e.g.
+// HostConfig.Tmpfs or Image.RootFS. It talks to the same daemon and with
+// the same API version as the client made from the same Config.
+type RawClient struct {
+	http    *http.Client
+	baseURL string
+}
+
+// NewRawClient makes a raw client that reuses the transport of the given client
+func NewRawClient(client *docker.Client, config *Config) (*RawClient, error) {
+	u, err := url.Parse(config.Host)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid docker host %q, error: %s", config.Host, err)
+	}
+
+	r := &RawClient{http: client.HTTPClient}
+
+	switch u.Scheme {
+	case "unix":
+		// The host part of the URL is ignored by the dialer
+		socket := u.Path
+		r.http = &http.Client{Transport: &http.Transport{
+			Dial: func(string, string) (net.Conn, error) {
+				return client.Dialer.Dial("unix", socket)
+			},
+		}}
+		u = &url.URL{Scheme: "http", Host: "docker"}
+	case "tcp":
+		u.Scheme = "http"
+		if config.Tlsverify || u.Port() == "2376" {
+			u.Scheme = "https"
+		}
+	case "http", "https":
+	default:
+		return nil, fmt.Errorf("Invalid docker host %q, expected unix:// or tcp://", config.Host)
+	}
+
+	r.baseURL = strings.TrimRight(u.String(), "/")
+	if config.APIVersion != "" {
+		r.baseURL += "/v" + config.APIVersion
+	}
+
+	return r, nil
+}
+
+// Do sends the request with the JSON of in as the body, unless it is nil,
+// and decodes the JSON response into out, unless it is nil; the errors of
+// the daemon are *docker.Error as those of go-dockerclient
+func (r *RawClient) Do(method, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, r.baseURL+path, body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := r.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+		return &docker.Error{Status: resp.StatusCode, Message: string(data)}
+	}
+
+	if out == nil || len(data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
@@ -0,0 +1,89 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dockerclient
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRawClient_Do(t *testing.T) {
+	var path, body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		path, body = r.URL.Path, string(data)
+		w.Write([]byte(`{"Id":"123"}`))
+	}))
+	defer server.Close()
+
+	config := &Config{Host: server.URL, APIVersion: "1.24"}
+	client, err := NewFromConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := NewRawClient(client, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := struct {
+		ID string `json:"Id"`
+	}{}
+	if err := raw.Do("POST", "/containers/create", map[string]interface{}{"Tmpfs": map[string]string{"/tmp": ""}}, &out); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "/v1.24/containers/create", path)
+	assert.Equal(t, `{"Tmpfs":{"/tmp":""}}`, body)
+	assert.Equal(t, "123", out.ID)
+}
+
+func TestRawClient_DoError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "no such image", http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	config := &Config{Host: server.URL}
+	client, err := NewFromConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := NewRawClient(client, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = raw.Do("GET", "/images/ubuntu/json", nil, nil)
+	if assert.IsType(t, &docker.Error{}, err) {
+		assert.Equal(t, 404, err.(*docker.Error).Status)
+	}
+}
+
+func TestNewRawClient_InvalidHost(t *testing.T) {
+	client, err := NewFromConfig(&Config{Host: "unix:///var/run/docker.sock"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = NewRawClient(client, &Config{Host: "ftp://docker"})
+	assert.EqualError(t, err, `Invalid docker host "ftp://docker", expected unix:// or tcp://`)
+}
@@ -26,13 +26,14 @@ import (
 // Artifact represents the artifact that is the result of image build
 // It holds information about the pushed image and may be saved as a file
 type Artifact struct {
-	Name        *ImageName `yaml:"Name"`
-	Pushed      bool       `yaml:"Pushed"`
-	Tag         string     `yaml:"Tag"`
-	Digest      string     `yaml:"Digest"`
-	ImageID     string     `yaml:"ImageID"`
-	Addressable string     `yaml:"Addressable"`
-	BuildTime   time.Time  `yaml:"BuildTime"`
+	Name            *ImageName `yaml:"Name"`
+	Pushed          bool       `yaml:"Pushed"`
+	Tag             string     `yaml:"Tag"`
+	Digest          string     `yaml:"Digest"`
+	ImageID         string     `yaml:"ImageID"`
+	Addressable     string     `yaml:"Addressable"`
+	BuildTime       time.Time  `yaml:"BuildTime"`
+	ContextChecksum string     `yaml:"ContextChecksum,omitempty"`
 }
 
 // Artifacts is a collection of Artifact entities
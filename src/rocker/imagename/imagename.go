@@ -120,6 +120,16 @@ func (img ImageName) GetTag() string {
 	return Latest
 }
 
+// IsLatest returns true if the image refers to the latest tag, explicitly or
+// by having no tag at all
+// Example:
+// golang:latest == true
+// golang        == true
+// golang:1.5.1  == false
+func (img ImageName) IsLatest() bool {
+	return img.GetTag() == Latest
+}
+
 // SetTag sets the new tag for the imagename
 func (img *ImageName) SetTag(tag string) {
 	img.Version = nil
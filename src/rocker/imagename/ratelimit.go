@@ -0,0 +1,78 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package imagename
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RateLimitMaxWait is how long in total a request limited by the registry
+// with 429 Too Many Requests is retried before it fails, 0 disables retries
+var RateLimitMaxWait = 2 * time.Minute
+
+// RateLimitBackoff is the first wait before a retry if the registry does not
+// tell when to retry with Retry-After, it is doubled on every next retry
+var RateLimitBackoff = time.Second
+
+// rateLimitSleep waits before a retry, it is replaced by tests
+var rateLimitSleep = time.Sleep
+
+// RateLimitWait returns how long to wait before the attempt (counting from 0)
+// to repeat a rate limited request, given the Retry-After header of the response
+// and the time already waited for the request; ok is false if the wait would
+// exceed RateLimitMaxWait and the request should fail
+func RateLimitWait(retryAfter string, attempt int, waited time.Duration) (wait time.Duration, ok bool) {
+	wait = RateLimitBackoff << uint(attempt)
+	if d, ok := parseRetryAfter(retryAfter, time.Now()); ok {
+		wait = d
+	}
+	return wait, waited+wait <= RateLimitMaxWait
+}
+
+// IsRateLimited tells whether the error of the Docker daemon is caused by the
+// registry rate limit, the daemon does not pass Retry-After of the registry
+func IsRateLimited(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "toomanyrequests") || strings.Contains(msg, "429 too many requests")
+}
+
+// parseRetryAfter parses Retry-After given either in seconds or as HTTP date
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+	if sec, err := strconv.Atoi(value); err == nil {
+		if sec < 0 {
+			sec = 0
+		}
+		return time.Duration(sec) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if wait := date.Sub(now); wait > 0 {
+			return wait, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
@@ -17,15 +17,71 @@
 package imagename
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"regexp"
 	"strings"
+	"sync"
+	"time"
 
+	log "github.com/Sirupsen/logrus"
 	"github.com/fsouza/go-dockerclient"
 )
 
+const (
+	// dockerHubRegistry serves the images that have no registry in their names
+	dockerHubRegistry = "registry-1.docker.io"
+)
+
+// manifestMediaTypes are accepted when the manifest digest is resolved, the
+// lists come first so multi-platform images are pinned to the list itself
+var manifestMediaTypes = []string{
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+	"application/vnd.oci.image.manifest.v1+json",
+}
+
+// registryClient makes requests to registries, it is replaced by tests
+var registryClient = http.DefaultClient
+
+var bearerParam = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// RegistryConcurrency is how many requests to registries may be in flight
+// at once, the others wait for a free slot; 0 removes the limit
+var RegistryConcurrency = 4
+
+var registrySlots struct {
+	mu   sync.Mutex
+	ch   chan struct{}
+	size int
+}
+
+// acquireRegistrySlot waits for a free slot of RegistryConcurrency,
+// the returned function releases it
+func acquireRegistrySlot() (release func()) {
+	registrySlots.mu.Lock()
+	if RegistryConcurrency <= 0 {
+		registrySlots.mu.Unlock()
+		return func() {}
+	}
+	// The limit is set by the flag after the package is initialized
+	if registrySlots.ch == nil || registrySlots.size != RegistryConcurrency {
+		registrySlots.ch = make(chan struct{}, RegistryConcurrency)
+		registrySlots.size = RegistryConcurrency
+	}
+	ch := registrySlots.ch
+	registrySlots.mu.Unlock()
+
+	ch <- struct{}{}
+	return func() { <-ch }
+}
+
 type tags struct {
 	Name string   `json:"name,omitempty"`
 	Tags []string `json:"tags,omitempty"`
@@ -131,22 +187,191 @@ func registryListTags(image *ImageName) (images []*ImageName, err error) {
 	return
 }
 
+// RegistryDigest returns the digest of the manifest the image tag refers to
+// in the registry, e.g. sha256:ead434cd278824865d6e3b67e5d4579ded02eb2e8367fc165efa21138b225f11
+func RegistryDigest(image *ImageName) (digest string, err error) {
+	registry, name := image.Registry, image.Name
+	if registry == "" {
+		registry = dockerHubRegistry
+		if !strings.Contains(name, "/") {
+			name = "library/" + name
+		}
+	}
+
+	manifestURL := fmt.Sprintf("https://%s/v2/%s/manifests/%s", registry, name, image.GetTag())
+
+	// HEAD is enough if the registry gives the digest in the headers,
+	// otherwise it is the digest of the manifest itself
+	for _, method := range []string{"HEAD", "GET"} {
+		req, err := http.NewRequest(method, manifestURL, nil)
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Accept", strings.Join(manifestMediaTypes, ", "))
+
+		release := acquireRegistrySlot()
+		res, err := registryDo(req)
+		if err != nil {
+			release()
+			return "", fmt.Errorf("Request to %s failed with %s", manifestURL, err)
+		}
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		release()
+		if err != nil {
+			return "", fmt.Errorf("Response from %s cannot be read due to error %s", manifestURL, err)
+		}
+
+		switch {
+		case res.StatusCode == http.StatusNotFound:
+			return "", fmt.Errorf("Image %s is not found in the registry", image)
+		case res.StatusCode != http.StatusOK:
+			return "", fmt.Errorf("Request to %s failed with status %s", manifestURL, res.Status)
+		}
+
+		if digest := res.Header.Get("Docker-Content-Digest"); digest != "" {
+			return digest, nil
+		}
+		if method == "GET" {
+			sum := sha256.Sum256(body)
+			return "sha256:" + hex.EncodeToString(sum[:]), nil
+		}
+	}
+
+	return "", nil
+}
+
+// registryDo executes the request to a registry; if the registry responds
+// with 429 Too Many Requests, the request is repeated after the time the
+// registry tells with Retry-After or with exponential backoff, until the
+// total wait exceeds RateLimitMaxWait
+func registryDo(req *http.Request) (*http.Response, error) {
+	var waited time.Duration
+
+	for attempt := 0; ; attempt++ {
+		res, err := registryDoAuth(req)
+		if err != nil || res.StatusCode != http.StatusTooManyRequests {
+			return res, err
+		}
+
+		wait, ok := RateLimitWait(res.Header.Get("Retry-After"), attempt, waited)
+		if !ok {
+			return res, nil
+		}
+		res.Body.Close()
+
+		log.Warnf("Registry %s limits the rate of requests, retry in %s", req.URL.Host, wait)
+		rateLimitSleep(wait)
+		waited += wait
+	}
+}
+
+// registryDoAuth executes the request to a registry; if the registry responds
+// with a Bearer challenge, the request is repeated with an anonymous token
+// issued by the authorization service the registry refers to
+func registryDoAuth(req *http.Request) (*http.Response, error) {
+	res, err := registryClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	challenge := res.Header.Get("WWW-Authenticate")
+	if res.StatusCode != http.StatusUnauthorized || !strings.HasPrefix(strings.ToLower(challenge), "bearer ") {
+		return res, nil
+	}
+	res.Body.Close()
+
+	token, err := registryToken(challenge)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Authorization", "Bearer "+token)
+	return registryClient.Do(req)
+}
+
+// registryToken obtains the token for the Bearer challenge, e.g.
+// Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:library/ubuntu:pull"
+func registryToken(challenge string) (string, error) {
+	params := map[string]string{}
+	for _, match := range bearerParam.FindAllStringSubmatch(challenge, -1) {
+		params[match[1]] = match[2]
+	}
+
+	realm := params["realm"]
+	if realm == "" {
+		return "", fmt.Errorf("Bearer challenge has no realm: %s", challenge)
+	}
+
+	query := url.Values{}
+	for _, key := range []string{"service", "scope"} {
+		if value := params[key]; value != "" {
+			query.Set(key, value)
+		}
+	}
+
+	tokenURL := realm
+	if len(query) > 0 {
+		tokenURL += "?" + query.Encode()
+	}
+
+	res, err := registryClient.Get(tokenURL)
+	if err != nil {
+		return "", fmt.Errorf("Request to %s failed with %s", tokenURL, err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Request to %s failed with status %s", tokenURL, res.Status)
+	}
+
+	var result struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("Response from %s cannot be unmarshalled due to error %s", tokenURL, err)
+	}
+
+	if result.Token != "" {
+		return result.Token, nil
+	}
+	if result.AccessToken != "" {
+		return result.AccessToken, nil
+	}
+	return "", fmt.Errorf("Response from %s has no token", tokenURL)
+}
+
 // registryGet executes HTTP get to a given registry
 func registryGet(url string, obj interface{}) (err error) {
 	var res *http.Response
 	var body []byte
 
-	res, err = http.Get(url)
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+
+	release := acquireRegistrySlot()
+	defer release()
+
+	res, err = registryDo(req)
 	if err != nil {
 		err = fmt.Errorf("Request to %s failed with %s\n", url, err)
 		return
 	}
+	defer res.Body.Close()
 
 	if res.StatusCode == 404 {
 		err = fmt.Errorf("Not found")
 		return
 	}
 
+	if res.StatusCode == http.StatusTooManyRequests {
+		err = fmt.Errorf("Request to %s is rate limited by the registry, gave up after waiting for %s\n", url, RateLimitMaxWait)
+		return
+	}
+
 	if body, err = ioutil.ReadAll(res.Body); err != nil {
 		err = fmt.Errorf("Response from %s cannot be read due to error %s\n", url, err)
 		return
@@ -0,0 +1,252 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package imagename
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testManifestDigest = "sha256:ead434cd278824865d6e3b67e5d4579ded02eb2e8367fc165efa21138b225f11"
+
+// startFakeRegistry serves the manifest of app:1.0 to the clients having
+// the token issued by its /token endpoint; the digest header is only given
+// if withDigestHeader is set; stop shuts it down
+func startFakeRegistry(t *testing.T, withDigestHeader bool) (registry string, requests *[]string, stop func()) {
+	requests = &[]string{}
+
+	var server *httptest.Server
+	server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*requests = append(*requests, r.Method+" "+r.URL.Path)
+
+		if r.URL.Path == "/token" {
+			assert.Equal(t, "repository:app:pull", r.URL.Query().Get("scope"))
+			assert.Equal(t, "fake-registry", r.URL.Query().Get("service"))
+			fmt.Fprint(w, `{"token":"secret-token"}`)
+			return
+		}
+
+		if r.Header.Get("Authorization") != "Bearer secret-token" {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="fake-registry",scope="repository:app:pull"`, server.URL))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		if r.URL.Path != "/v2/app/manifests/1.0" {
+			http.NotFound(w, r)
+			return
+		}
+
+		assert.Contains(t, r.Header.Get("Accept"), "application/vnd.docker.distribution.manifest.list.v2+json")
+
+		w.Header().Set("Content-Type", "application/vnd.docker.distribution.manifest.v2+json")
+		if withDigestHeader {
+			w.Header().Set("Docker-Content-Digest", testManifestDigest)
+		}
+		if r.Method == "GET" {
+			fmt.Fprint(w, `{"schemaVersion":2}`)
+		}
+	}))
+
+	registryClient = server.Client()
+
+	stop = func() {
+		server.Close()
+		registryClient = http.DefaultClient
+	}
+
+	return strings.TrimPrefix(server.URL, "https://"), requests, stop
+}
+
+func TestRegistryDigest(t *testing.T) {
+	registry, requests, stop := startFakeRegistry(t, true)
+	defer stop()
+
+	digest, err := RegistryDigest(NewFromString(registry + "/app:1.0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, testManifestDigest, digest)
+	assert.Equal(t, []string{
+		"HEAD /v2/app/manifests/1.0",
+		"GET /token",
+		"HEAD /v2/app/manifests/1.0",
+	}, *requests)
+}
+
+func TestRegistryDigest_NoHeader(t *testing.T) {
+	registry, _, stop := startFakeRegistry(t, false)
+	defer stop()
+
+	digest, err := RegistryDigest(NewFromString(registry + "/app:1.0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sum := sha256.Sum256([]byte(`{"schemaVersion":2}`))
+	assert.Equal(t, "sha256:"+hex.EncodeToString(sum[:]), digest)
+}
+
+func TestRegistryDigest_NotFound(t *testing.T) {
+	registry, _, stop := startFakeRegistry(t, true)
+	defer stop()
+
+	_, err := RegistryDigest(NewFromString(registry + "/app:2.0"))
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "is not found in the registry")
+	}
+}
+
+// startRateLimitedRegistry serves the tags of app, responding to the first
+// `limited` requests with 429 Too Many Requests and the given Retry-After
+func startRateLimitedRegistry(t *testing.T, limited int, retryAfter string) (registry string, waits *[]time.Duration, stop func()) {
+	waits = &[]time.Duration{}
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if limited > 0 {
+			limited--
+			if retryAfter != "" {
+				w.Header().Set("Retry-After", retryAfter)
+			}
+			http.Error(w, "toomanyrequests: You have reached your pull rate limit", http.StatusTooManyRequests)
+			return
+		}
+		fmt.Fprint(w, `{"name":"app","tags":["1.0"]}`)
+	}))
+
+	registryClient = server.Client()
+	rateLimitSleep = func(d time.Duration) { *waits = append(*waits, d) }
+
+	stop = func() {
+		server.Close()
+		registryClient = http.DefaultClient
+		rateLimitSleep = time.Sleep
+	}
+
+	return strings.TrimPrefix(server.URL, "https://"), waits, stop
+}
+
+func TestRegistry_RateLimitRetryAfter(t *testing.T) {
+	registry, waits, stop := startRateLimitedRegistry(t, 2, "3")
+	defer stop()
+
+	images, err := RegistryListTags(NewFromString(registry + "/app"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Len(t, images, 1)
+	assert.Equal(t, []time.Duration{3 * time.Second, 3 * time.Second}, *waits)
+}
+
+func TestRegistry_RateLimitBackoff(t *testing.T) {
+	registry, waits, stop := startRateLimitedRegistry(t, 3, "")
+	defer stop()
+
+	if _, err := RegistryListTags(NewFromString(registry + "/app")); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, []time.Duration{time.Second, 2 * time.Second, 4 * time.Second}, *waits)
+}
+
+func TestRegistry_RateLimitMaxWait(t *testing.T) {
+	registry, waits, stop := startRateLimitedRegistry(t, 10, "60")
+	defer stop()
+
+	defer func(maxWait time.Duration) { RateLimitMaxWait = maxWait }(RateLimitMaxWait)
+	RateLimitMaxWait = 90 * time.Second
+
+	_, err := RegistryListTags(NewFromString(registry + "/app"))
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "rate limited")
+	}
+	assert.Equal(t, []time.Duration{60 * time.Second}, *waits)
+}
+
+func TestRegistry_Concurrency(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		inFlight int
+		maxSeen  int
+	)
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		inFlight++
+		if inFlight > maxSeen {
+			maxSeen = inFlight
+		}
+		mu.Unlock()
+
+		time.Sleep(20 * time.Millisecond)
+
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+
+		fmt.Fprint(w, `{"name":"app","tags":["1.0"]}`)
+	}))
+	defer server.Close()
+
+	registryClient = server.Client()
+	defer func() { registryClient = http.DefaultClient }()
+
+	defer func(n int) { RegistryConcurrency = n }(RegistryConcurrency)
+	RegistryConcurrency = 2
+
+	registry := strings.TrimPrefix(server.URL, "https://")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			images, err := RegistryListTags(NewFromString(fmt.Sprintf("%s/app%d", registry, i)))
+			assert.NoError(t, err)
+			assert.Len(t, images, 1)
+		}(i)
+	}
+	wg.Wait()
+
+	assert.Equal(t, 2, maxSeen)
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2015, 12, 13, 9, 46, 40, 0, time.UTC)
+
+	wait, ok := parseRetryAfter("120", now)
+	assert.True(t, ok)
+	assert.Equal(t, 2*time.Minute, wait)
+
+	wait, ok = parseRetryAfter("Sun, 13 Dec 2015 09:47:10 GMT", now)
+	assert.True(t, ok)
+	assert.Equal(t, 30*time.Second, wait)
+
+	_, ok = parseRetryAfter("soon", now)
+	assert.False(t, ok)
+}
@@ -74,6 +74,10 @@ func init() {
 		"require": parseMaybeJSONToList,
 		"include": parseString,
 		"attach":  parseMaybeJSON,
+		"config":  parseString,
+		"annotation": func(cmd string) (*Node, map[string]bool, error) {
+			return parseNameVal(cmd, "ANNOTATION")
+		},
 		"var": func(cmd string) (*Node, map[string]bool, error) {
 			return parseNameVal(cmd, "VAR")
 		},
@@ -0,0 +1,169 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"rocker/build"
+	"rocker/dockerclient"
+	"rocker/template"
+	"rocker/util"
+
+	"github.com/fsouza/go-dockerclient"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// DockerBuilder runs the builds with the Docker daemon, one at a time
+type DockerBuilder struct {
+	Client *docker.Client
+	Raw    *dockerclient.RawClient
+	Auth   docker.AuthConfiguration
+	Cache  build.Cache
+
+	// Config is the base config of the builds, e.g. with Pull set
+	Config build.Config
+
+	mu sync.Mutex
+}
+
+// Build runs the build of the request, the result is returned even if
+// the build has failed; the build is cancelled once cancel is closed
+func (d *DockerBuilder) Build(req BuildRequest, cancel <-chan struct{}) (*BuildResult, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// The build could be cancelled while waiting for the previous one
+	select {
+	case <-cancel:
+		return nil, build.ErrCancelled
+	default:
+	}
+
+	if !filepath.IsAbs(req.ContextDir) {
+		return nil, fmt.Errorf("The context %s is not an absolute path", req.ContextDir)
+	}
+	if err := build.ValidateContextDir(req.ContextDir); err != nil {
+		return nil, err
+	}
+
+	name := req.Rockerfile
+	if name == "" {
+		name = "Rockerfile"
+	}
+	vars := req.Vars
+	if vars == nil {
+		vars = template.Vars{}
+	}
+
+	rockerfile, err := build.NewRockerfileFromFile(filepath.Join(req.ContextDir, name), vars, template.Funs{})
+	if err != nil {
+		return nil, err
+	}
+	plan, err := build.NewPlan(rockerfile.Commands(), true)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := d.Config
+	cfg.ContextDir = req.ContextDir
+	cfg.ID = req.ID
+	cfg.Push = req.Push
+	cfg.NoCache = req.NoCache
+
+	dockerignoreFilename := filepath.Join(req.ContextDir, ".dockerignore")
+	if _, err := os.Stat(dockerignoreFilename); err == nil {
+		if cfg.Dockerignore, err = build.ReadDockerignoreFile(dockerignoreFilename); err != nil {
+			return nil, err
+		}
+	}
+
+	cache := d.Cache
+	if req.NoCache {
+		cache = nil
+	}
+
+	// Every build has its own client to tell its own transfers
+	client := build.NewDockerClient(d.Client, d.Auth, log.StandardLogger())
+	client.Raw = d.Raw
+	builder := build.New(client, rockerfile, cache, cfg)
+
+	// Guard the helper containers from the builds of the same Rockerfile
+	// run by rocker build on the host
+	lock := util.NewFileLock(filepath.Join(os.TempDir(), builder.LockFileName()))
+	if err := lock.Lock(-1); err != nil {
+		return nil, fmt.Errorf("Failed to acquire lock %s, error: %s", lock.Path(), err)
+	}
+	defer lock.Unlock()
+
+	// Wait for the cancellation to finish its cleanup before returning
+	done := make(chan struct{})
+	watched := make(chan struct{})
+
+	go func() {
+		defer close(watched)
+		select {
+		case <-cancel:
+			builder.Cancel()
+		case <-done:
+		}
+	}()
+
+	err = builder.Run(plan)
+
+	close(done)
+	<-watched
+
+	return NewBuildResult(builder, client.Transfers()), err
+}
+
+// NewBuildResult returns the result of the build, the transfers are the
+// images pulled and pushed by its client
+func NewBuildResult(b *build.Build, transfers []build.ImageTransfer) *BuildResult {
+	result := &BuildResult{
+		ImageID:  b.GetImageID(),
+		Steps:    b.Explanations,
+		Pushes:   b.Pushes,
+		Warnings: b.Warnings,
+	}
+
+	for _, step := range b.Explanations {
+		switch {
+		case strings.HasPrefix(step.Reason, "cache hit"):
+			result.CacheHits++
+		case step.Reason == build.ReasonNotCached,
+			step.Reason == build.ReasonCacheBusted,
+			step.Reason == build.ReasonImageGone,
+			step.Reason == build.ReasonCreatedMismatch,
+			step.Reason == build.ReasonCacheReloaded:
+			result.CacheMisses++
+		}
+	}
+
+	for _, t := range transfers {
+		if t.Direction == build.TransferPush {
+			result.PushedBytes += t.Bytes
+		}
+	}
+
+	return result
+}
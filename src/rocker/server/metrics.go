@@ -0,0 +1,97 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"rocker/build"
+)
+
+// Metrics are the counters of the builds run by the server
+type Metrics struct {
+	mu sync.Mutex
+
+	buildsSucceeded int64
+	buildsFailed    int64
+	buildsCancelled int64
+	durationSum     float64
+	durationCount   int64
+	cacheHits       int64
+	cacheMisses     int64
+	pushedBytes     int64
+}
+
+// Observe adds the build to the counters, err is the error of the build
+func (m *Metrics) Observe(result *BuildResult, duration time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	switch err {
+	case nil:
+		m.buildsSucceeded++
+	case build.ErrCancelled:
+		m.buildsCancelled++
+	default:
+		m.buildsFailed++
+	}
+	m.durationSum += duration.Seconds()
+	m.durationCount++
+	m.cacheHits += int64(result.CacheHits)
+	m.cacheMisses += int64(result.CacheMisses)
+	m.pushedBytes += result.PushedBytes
+}
+
+// Write writes the metrics in the Prometheus text format
+func (m *Metrics) Write(w io.Writer) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ratio := 0.0
+	if total := m.cacheHits + m.cacheMisses; total > 0 {
+		ratio = float64(m.cacheHits) / float64(total)
+	}
+
+	_, err := fmt.Fprintf(w, `# HELP rocker_builds_total Number of the builds run by the server.
+# TYPE rocker_builds_total counter
+rocker_builds_total{status="succeeded"} %d
+rocker_builds_total{status="failed"} %d
+rocker_builds_total{status="cancelled"} %d
+# HELP rocker_build_duration_seconds Duration of the builds.
+# TYPE rocker_build_duration_seconds summary
+rocker_build_duration_seconds_sum %g
+rocker_build_duration_seconds_count %d
+# HELP rocker_cache_hits_total Number of the steps taken from the cache.
+# TYPE rocker_cache_hits_total counter
+rocker_cache_hits_total %d
+# HELP rocker_cache_misses_total Number of the steps executed because they were not cached.
+# TYPE rocker_cache_misses_total counter
+rocker_cache_misses_total %d
+# HELP rocker_cache_hit_ratio Ratio of the cache hits to the steps using the cache.
+# TYPE rocker_cache_hit_ratio gauge
+rocker_cache_hit_ratio %g
+# HELP rocker_push_bytes_total Size of the layers pushed to the registries.
+# TYPE rocker_push_bytes_total counter
+rocker_push_bytes_total %d
+`, m.buildsSucceeded, m.buildsFailed, m.buildsCancelled, m.durationSum, m.durationCount,
+		m.cacheHits, m.cacheMisses, ratio, m.pushedBytes)
+
+	return err
+}
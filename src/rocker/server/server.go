@@ -0,0 +1,233 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package server runs rocker as a build service: builds are triggered with
+// an HTTP API and the metrics of the builds are exposed to Prometheus
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"rocker/build"
+	"rocker/template"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// BuildRequest is the body of POST /builds
+type BuildRequest struct {
+	// BuildID identifies the running build for DELETE /builds/{id},
+	// a random one is generated if it is empty
+	BuildID string `json:"build_id,omitempty"`
+	// ContextDir is the absolute path of the build context on the host
+	ContextDir string `json:"context"`
+	// Rockerfile is the path relative to ContextDir, "Rockerfile" by default
+	Rockerfile string        `json:"rockerfile,omitempty"`
+	Vars       template.Vars `json:"vars,omitempty"`
+	ID         string        `json:"id,omitempty"`
+	Push       bool          `json:"push,omitempty"`
+	NoCache    bool          `json:"no_cache,omitempty"`
+}
+
+// BuildResult is the response of POST /builds, Error is set if the build
+// has failed
+type BuildResult struct {
+	BuildID     string                  `json:"build_id"`
+	ImageID     string                  `json:"image_id,omitempty"`
+	DurationMs  int64                   `json:"duration_ms"`
+	CacheHits   int                     `json:"cache_hits"`
+	CacheMisses int                     `json:"cache_misses"`
+	PushedBytes int64                   `json:"pushed_bytes"`
+	Steps       []build.StepExplanation `json:"steps,omitempty"`
+	Pushes      []build.PushResult      `json:"pushes,omitempty"`
+	Warnings    []build.Warning         `json:"warnings,omitempty"`
+	Error       string                  `json:"error,omitempty"`
+}
+
+// Builder runs the builds requested from the server; the build should stop
+// once cancel is closed and return build.ErrCancelled after its cleanup
+type Builder interface {
+	Build(req BuildRequest, cancel <-chan struct{}) (*BuildResult, error)
+}
+
+// Server is the HTTP API of the build service
+type Server struct {
+	builder Builder
+	metrics *Metrics
+
+	mu      sync.Mutex
+	running map[string]*runningBuild
+}
+
+// runningBuild is the build in progress, done is closed once it returns
+type runningBuild struct {
+	cancel     chan struct{}
+	cancelOnce sync.Once
+	done       chan struct{}
+}
+
+// New returns the server running the builds with the builder
+func New(builder Builder) *Server {
+	return &Server{
+		builder: builder,
+		metrics: &Metrics{},
+		running: map[string]*runningBuild{},
+	}
+}
+
+// Handler returns the handler of the API: POST /builds runs a build,
+// DELETE /builds/{id} cancels it, GET /metrics returns the metrics and
+// GET /health tells that the server is up
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/builds", s.handleBuild)
+	mux.HandleFunc("/builds/", s.handleCancel)
+	mux.Handle("/metrics", s.MetricsHandler())
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	return mux
+}
+
+// MetricsHandler returns the handler of GET /metrics, it can be served
+// on a separate address
+func (s *Server) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		if err := s.metrics.Write(w); err != nil {
+			log.Errorf("Failed to write metrics, error: %s", err)
+		}
+	})
+}
+
+func (s *Server) handleBuild(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed, expected POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	req := BuildRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to parse the build request, error: %s", err), http.StatusBadRequest)
+		return
+	}
+	if req.ContextDir == "" {
+		http.Error(w, "The build request has no context", http.StatusBadRequest)
+		return
+	}
+
+	if req.BuildID == "" {
+		req.BuildID = newBuildID()
+	}
+
+	running, ok := s.start(req.BuildID)
+	if !ok {
+		http.Error(w, fmt.Sprintf("Build %s is already running", req.BuildID), http.StatusConflict)
+		return
+	}
+	defer s.finish(req.BuildID, running)
+
+	started := time.Now()
+	result, err := s.builder.Build(req, running.cancel)
+	if result == nil {
+		result = &BuildResult{}
+	}
+	result.BuildID = req.BuildID
+	result.DurationMs = int64(time.Since(started) / time.Millisecond)
+
+	status := http.StatusOK
+	if err != nil {
+		log.Errorf("Build of %s has failed, error: %s", req.ContextDir, err)
+		result.Error = err.Error()
+		status = http.StatusInternalServerError
+	}
+
+	s.metrics.Observe(result, time.Since(started), err)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		log.Errorf("Failed to write the build result, error: %s", err)
+	}
+}
+
+// handleCancel cancels the running build and responds once the build
+// has returned, so its containers are removed by then
+func (s *Server) handleCancel(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "DELETE" {
+		w.Header().Set("Allow", "DELETE")
+		http.Error(w, "Method not allowed, expected DELETE", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/builds/")
+
+	s.mu.Lock()
+	running, ok := s.running[id]
+	s.mu.Unlock()
+
+	if !ok {
+		http.Error(w, fmt.Sprintf("Build %s is not running", id), http.StatusNotFound)
+		return
+	}
+
+	log.Infof("Cancelling build %s", id)
+	running.cancelOnce.Do(func() { close(running.cancel) })
+	<-running.done
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// start registers the running build, false is returned if the build with
+// the same id is running already
+func (s *Server) start(id string) (*runningBuild, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.running[id]; ok {
+		return nil, false
+	}
+	running := &runningBuild{
+		cancel: make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	s.running[id] = running
+	return running, true
+}
+
+func (s *Server) finish(id string, running *runningBuild) {
+	s.mu.Lock()
+	delete(s.running, id)
+	s.mu.Unlock()
+
+	close(running.done)
+}
+
+func newBuildID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,237 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"rocker/build"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeBuilder returns the results in turn, an error if the result has one
+type fakeBuilder struct {
+	results  []BuildResult
+	requests []BuildRequest
+}
+
+func (f *fakeBuilder) Build(req BuildRequest, cancel <-chan struct{}) (*BuildResult, error) {
+	f.requests = append(f.requests, req)
+	result := f.results[0]
+	f.results = f.results[1:]
+	if result.Error != "" {
+		return &result, fmt.Errorf("%s", result.Error)
+	}
+	return &result, nil
+}
+
+func postBuild(t *testing.T, handler http.Handler, body string) (*httptest.ResponseRecorder, BuildResult) {
+	r, err := http.NewRequest("POST", "/builds", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	result := BuildResult{}
+	if w.Code == http.StatusOK || w.Code == http.StatusInternalServerError {
+		if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return w, result
+}
+
+func getMetrics(t *testing.T, handler http.Handler) string {
+	r, err := http.NewRequest("GET", "/metrics", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	return w.Body.String()
+}
+
+func TestServer_Build(t *testing.T) {
+	builder := &fakeBuilder{results: []BuildResult{
+		{ImageID: "123", CacheHits: 3, CacheMisses: 1, PushedBytes: 1024},
+		{CacheMisses: 1, Error: "RUN make: exit code 2"},
+	}}
+	handler := New(builder).Handler()
+
+	w, result := postBuild(t, handler, `{"context": "/src/app", "vars": {"Version": "1.0"}, "push": true}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "123", result.ImageID)
+	assert.Equal(t, "/src/app", builder.requests[0].ContextDir)
+	assert.Equal(t, "1.0", builder.requests[0].Vars["Version"])
+	assert.True(t, builder.requests[0].Push)
+
+	w, result = postBuild(t, handler, `{"context": "/src/app"}`)
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.Equal(t, "RUN make: exit code 2", result.Error)
+	assert.NotEmpty(t, result.BuildID)
+
+	metrics := getMetrics(t, handler)
+	for _, line := range []string{
+		`rocker_builds_total{status="succeeded"} 1`,
+		`rocker_builds_total{status="failed"} 1`,
+		`rocker_builds_total{status="cancelled"} 0`,
+		`rocker_build_duration_seconds_count 2`,
+		`rocker_cache_hits_total 3`,
+		`rocker_cache_misses_total 2`,
+		`rocker_cache_hit_ratio 0.6`,
+		`rocker_push_bytes_total 1024`,
+	} {
+		assert.Contains(t, metrics, line+"\n")
+	}
+}
+
+func TestServer_BadRequest(t *testing.T) {
+	builder := &fakeBuilder{}
+	handler := New(builder).Handler()
+
+	w, _ := postBuild(t, handler, `{"context":`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w, _ = postBuild(t, handler, `{"push": true}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	r, _ := http.NewRequest("GET", "/builds", nil)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, r)
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+
+	// No build was run
+	assert.Empty(t, builder.requests)
+	assert.Contains(t, getMetrics(t, handler), `rocker_builds_total{status="succeeded"} 0`)
+}
+
+// blockingBuilder runs the build until it is cancelled, then removes
+// its containers
+type blockingBuilder struct {
+	started    chan struct{}
+	containers []string
+	removed    []string
+}
+
+func (f *blockingBuilder) Build(req BuildRequest, cancel <-chan struct{}) (*BuildResult, error) {
+	f.containers = append(f.containers, "456")
+	close(f.started)
+
+	<-cancel
+
+	// The cleanup takes a while
+	time.Sleep(10 * time.Millisecond)
+	f.removed = append(f.removed, f.containers...)
+
+	return &BuildResult{CacheMisses: 1}, build.ErrCancelled
+}
+
+func deleteBuild(handler http.Handler, id string) *httptest.ResponseRecorder {
+	r, _ := http.NewRequest("DELETE", "/builds/"+id, nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w
+}
+
+func TestServer_Cancel(t *testing.T) {
+	builder := &blockingBuilder{started: make(chan struct{})}
+	handler := New(builder).Handler()
+
+	type response struct {
+		w      *httptest.ResponseRecorder
+		result BuildResult
+	}
+	responses := make(chan response)
+	go func() {
+		w, result := postBuild(t, handler, `{"context": "/src/app", "build_id": "b1"}`)
+		responses <- response{w, result}
+	}()
+
+	<-builder.started
+
+	// The build with the same id cannot be started twice
+	w, _ := postBuild(t, handler, `{"context": "/src/app", "build_id": "b1"}`)
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	w = deleteBuild(handler, "b1")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	// DELETE returns once the build has removed its containers
+	assert.Equal(t, []string{"456"}, builder.removed)
+
+	resp := <-responses
+	assert.Equal(t, http.StatusInternalServerError, resp.w.Code)
+	assert.Equal(t, "b1", resp.result.BuildID)
+	assert.Equal(t, build.ErrCancelled.Error(), resp.result.Error)
+
+	// The build is not running anymore
+	assert.Equal(t, http.StatusNotFound, deleteBuild(handler, "b1").Code)
+
+	metrics := getMetrics(t, handler)
+	assert.Contains(t, metrics, `rocker_builds_total{status="cancelled"} 1`+"\n")
+	assert.Contains(t, metrics, `rocker_builds_total{status="failed"} 0`+"\n")
+}
+
+func TestServer_CancelNotRunning(t *testing.T) {
+	handler := New(&fakeBuilder{}).Handler()
+
+	assert.Equal(t, http.StatusNotFound, deleteBuild(handler, "b1").Code)
+
+	r, _ := http.NewRequest("GET", "/builds/b1", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+}
+
+func TestServer_Health(t *testing.T) {
+	r, _ := http.NewRequest("GET", "/health", nil)
+	w := httptest.NewRecorder()
+	New(&fakeBuilder{}).Handler().ServeHTTP(w, r)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "ok\n", w.Body.String())
+}
+
+func TestNewBuildResult(t *testing.T) {
+	b := &build.Build{Explanations: []build.StepExplanation{
+		{Step: 1, Command: "FROM alpine", Reason: build.ReasonExecuted},
+		{Step: 2, Command: "RUN make", Reason: "cache hit (image 123)"},
+		{Step: 3, Command: "RUN make install", Reason: build.ReasonNotCached},
+		{Step: 4, Command: "RUN make test", Reason: build.ReasonCacheBusted},
+	}}
+	b.Warnings = []build.Warning{{Step: 1, Message: "Image alpine:latest is not pinned to a version"}}
+
+	result := NewBuildResult(b, []build.ImageTransfer{
+		{Direction: build.TransferPull, Image: "alpine", Bytes: 100},
+		{Direction: build.TransferPush, Image: "app:1", Bytes: 1024},
+		{Direction: build.TransferPush, Image: "app:latest", Bytes: 512},
+	})
+
+	assert.Equal(t, 1, result.CacheHits)
+	assert.Equal(t, 2, result.CacheMisses)
+	assert.Equal(t, int64(1536), result.PushedBytes)
+	assert.Equal(t, b.Warnings, result.Warnings)
+}
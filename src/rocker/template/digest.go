@@ -0,0 +1,63 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package template
+
+import (
+	"fmt"
+	"rocker/imagename"
+)
+
+// DigestResolver returns the digest of the manifest the image refers to
+// in the registry, imagename.RegistryDigest is the one querying registries
+type DigestResolver func(image *imagename.ImageName) (digest string, err error)
+
+// DigestHelper makes the `resolveDigest` helper that pins the image to the
+// digest of its manifest, e.g. `{{ resolveDigest "ubuntu:22.04" }}` renders
+// ubuntu:22.04@sha256:...; every image is resolved once per helper, so make
+// a new helper for every render
+func DigestHelper(resolve DigestResolver) func(string) (string, error) {
+	resolved := map[string]string{}
+
+	return func(name string) (string, error) {
+		image := imagename.NewFromString(name)
+
+		// Already pinned
+		if image.TagIsSha() {
+			return name, nil
+		}
+
+		if pinned, ok := resolved[image.String()]; ok {
+			return pinned, nil
+		}
+
+		digest, err := resolve(image)
+		if err != nil {
+			return "", fmt.Errorf("Failed to resolve digest of %s, error: %s", image, err)
+		}
+
+		pinned := image.String() + "@" + digest
+		resolved[image.String()] = pinned
+
+		return pinned, nil
+	}
+}
+
+// resolveDigestDisabled is the `resolveDigest` helper of the renders that
+// are not allowed to make network requests
+func resolveDigestDisabled(name string) (string, error) {
+	return "", fmt.Errorf("resolveDigest %s needs to query the registry, network access of templates is allowed with --allow-template-network", name)
+}
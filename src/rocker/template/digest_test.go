@@ -0,0 +1,67 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package template
+
+import (
+	"fmt"
+	"rocker/imagename"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProcess_ResolveDigest(t *testing.T) {
+	resolved := []string{}
+	resolve := func(image *imagename.ImageName) (string, error) {
+		resolved = append(resolved, image.String())
+		if image.Name == "missing" {
+			return "", fmt.Errorf("Not found")
+		}
+		return "sha256:ead434", nil
+	}
+
+	funs := Funs{"resolveDigest": DigestHelper(resolve)}
+
+	result, err := Process("test", strings.NewReader(`FROM {{ resolveDigest "ubuntu:22.04" }}
+FROM {{ resolveDigest "ubuntu:22.04" }}
+FROM {{ resolveDigest "registry.example.com/app" }}
+FROM {{ resolveDigest "golang@sha256:fafe14" }}`), Vars{}, funs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, `FROM ubuntu:22.04@sha256:ead434
+FROM ubuntu:22.04@sha256:ead434
+FROM registry.example.com/app:latest@sha256:ead434
+FROM golang@sha256:fafe14`, result.String())
+
+	// Every image is resolved once, pinned ones are not resolved at all
+	assert.Equal(t, []string{"ubuntu:22.04", "registry.example.com/app:latest"}, resolved)
+
+	_, err = Process("test", strings.NewReader(`FROM {{ resolveDigest "missing:1" }}`), Vars{}, funs)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "Failed to resolve digest of missing:1, error: Not found")
+	}
+}
+
+func TestProcess_ResolveDigestDisabled(t *testing.T) {
+	_, err := Process("test", strings.NewReader(`FROM {{ resolveDigest "ubuntu:22.04" }}`), Vars{}, Funs{})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "--allow-template-network")
+	}
+}
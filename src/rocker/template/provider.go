@@ -0,0 +1,193 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package template
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// VarsProvider is a source of build variables
+type VarsProvider interface {
+	Load() (Vars, error)
+}
+
+// LoadVars loads variables from the providers and merges them in the given
+// order, so a variable of a later provider overrides the one of an earlier provider.
+//
+// rocker passes the providers in the following order, from the lowest to the
+// highest precedence: Consul KV (--vars-consul), files (--vars), command line (--var)
+func LoadVars(providers ...VarsProvider) (Vars, error) {
+	varsList := make([]Vars, 0, len(providers))
+	for _, p := range providers {
+		vars, err := p.Load()
+		if err != nil {
+			return nil, err
+		}
+		varsList = append(varsList, vars)
+	}
+	return Vars{}.Merge(varsList...), nil
+}
+
+// FileVarsProvider loads variables from JSON or YAML files,
+// the file names may contain wildcards
+type FileVarsProvider []string
+
+// Load implements VarsProvider
+func (files FileVarsProvider) Load() (Vars, error) {
+	return VarsFromFileMulti(files)
+}
+
+// StringVarsProvider loads variables from "key=value" pairs, see VarsFromStrings
+type StringVarsProvider []string
+
+// Load implements VarsProvider
+func (pairs StringVarsProvider) Load() (Vars, error) {
+	return VarsFromStrings(pairs)
+}
+
+// ConsulVarsProvider loads variables from the Consul KV store. Every key under
+// the prefix becomes a variable named by the rest of the key path; nested
+// paths become nested maps, e.g. "app/db/host" with prefix "app" is {{ .db.host }}
+type ConsulVarsProvider struct {
+	Addr   string
+	Prefix string
+	Token  string
+	Client *http.Client
+}
+
+// consulKV is an entry of the Consul KV API response
+type consulKV struct {
+	Key   string
+	Value []byte
+}
+
+// NewConsulVarsProvider makes a Consul provider from the "addr/prefix" string,
+// e.g. "consul.service:8500/config/myapp"; the scheme is http unless given
+func NewConsulVarsProvider(spec string) (*ConsulVarsProvider, error) {
+	scheme := "http"
+	if i := strings.Index(spec, "://"); i != -1 {
+		scheme, spec = spec[:i], spec[i+3:]
+	}
+
+	parts := strings.SplitN(spec, "/", 2)
+	if parts[0] == "" {
+		return nil, fmt.Errorf("Invalid Consul vars source %q, expected addr/prefix", spec)
+	}
+
+	p := &ConsulVarsProvider{
+		Addr:   scheme + "://" + parts[0],
+		Client: &http.Client{Timeout: 30 * time.Second},
+	}
+	if len(parts) > 1 {
+		p.Prefix = strings.Trim(parts[1], "/")
+	}
+
+	return p, nil
+}
+
+// Load implements VarsProvider
+func (p *ConsulVarsProvider) Load() (Vars, error) {
+	log.Debugf("Load vars from Consul %s/%s", p.Addr, p.Prefix)
+
+	u := fmt.Sprintf("%s/v1/kv/%s?recurse", strings.TrimRight(p.Addr, "/"), (&url.URL{Path: p.Prefix}).EscapedPath())
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if p.Token != "" {
+		req.Header.Set("X-Consul-Token", p.Token)
+	}
+
+	client := p.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load vars from Consul %s, error: %s", p.Addr, err)
+	}
+	defer res.Body.Close()
+
+	vars := Vars{}
+
+	// Consul responds 404 when there are no keys under the prefix
+	if res.StatusCode == http.StatusNotFound {
+		log.Warnf("No vars found in Consul %s under %q", p.Addr, p.Prefix)
+		return vars, nil
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Failed to load vars from Consul %s, status: %s", p.Addr, res.Status)
+	}
+
+	var kvs []consulKV
+	if err := json.NewDecoder(res.Body).Decode(&kvs); err != nil {
+		return nil, fmt.Errorf("Failed to parse Consul response from %s, error: %s", p.Addr, err)
+	}
+
+	for _, kv := range kvs {
+		key := kv.Key
+		if p.Prefix != "" {
+			// The KV API matches the prefix as a string, "app" also gives "application/..."
+			if !strings.HasPrefix(key, p.Prefix+"/") {
+				continue
+			}
+			key = key[len(p.Prefix)+1:]
+		}
+		// Skip the "folder" entries
+		if key == "" || strings.HasSuffix(key, "/") {
+			continue
+		}
+		if err := setNested(vars, strings.Split(key, "/"), string(kv.Value)); err != nil {
+			return nil, fmt.Errorf("Failed to load Consul key %s, error: %s", kv.Key, err)
+		}
+	}
+
+	return vars, nil
+}
+
+// setNested sets the value by the path of keys creating the intermediate maps
+func setNested(vars Vars, path []string, value string) error {
+	m := map[string]interface{}(vars)
+	for i, k := range path[:len(path)-1] {
+		switch next := m[k].(type) {
+		case map[string]interface{}:
+			m = next
+		case nil:
+			n := map[string]interface{}{}
+			m[k] = n
+			m = n
+		default:
+			return fmt.Errorf("%s is both a value and a folder", strings.Join(path[:i+1], "/"))
+		}
+	}
+
+	last := path[len(path)-1]
+	if _, ok := m[last].(map[string]interface{}); ok {
+		return fmt.Errorf("%s is both a value and a folder", strings.Join(path, "/"))
+	}
+	m[last] = value
+
+	return nil
+}
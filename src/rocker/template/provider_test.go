@@ -0,0 +1,143 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package template
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeVarsProvider struct {
+	vars Vars
+	err  error
+}
+
+func (p fakeVarsProvider) Load() (Vars, error) {
+	return p.vars, p.err
+}
+
+func TestLoadVars_Precedence(t *testing.T) {
+	tempDir, rm := tplMkFiles(t, map[string]string{
+		"vars.yml": "Foo: file\nBar: file\n",
+	})
+	defer rm()
+
+	consul := fakeVarsProvider{vars: Vars{"Foo": "consul", "Bar": "consul", "Baz": "consul"}}
+
+	vars, err := LoadVars(
+		consul,
+		FileVarsProvider{tempDir + "/vars.yml"},
+		StringVarsProvider{"Foo=cli"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, Vars{"Foo": "cli", "Bar": "file", "Baz": "consul"}, vars)
+}
+
+func TestLoadVars_Error(t *testing.T) {
+	_, err := LoadVars(fakeVarsProvider{err: fmt.Errorf("connection refused")})
+	assert.EqualError(t, err, "connection refused")
+}
+
+func TestNewConsulVarsProvider(t *testing.T) {
+	p, err := NewConsulVarsProvider("consul.service:8500/config/myapp/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "http://consul.service:8500", p.Addr)
+	assert.Equal(t, "config/myapp", p.Prefix)
+
+	p, err = NewConsulVarsProvider("https://consul.service")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "https://consul.service", p.Addr)
+	assert.Equal(t, "", p.Prefix)
+
+	_, err = NewConsulVarsProvider("/config")
+	assert.Error(t, err)
+}
+
+func TestConsulVarsProvider_Load(t *testing.T) {
+	server := fakeConsul(t, []consulKV{
+		{Key: "config/myapp/", Value: nil},
+		{Key: "config/myapp/Version", Value: []byte("1.2.3")},
+		{Key: "config/myapp/db/", Value: nil},
+		{Key: "config/myapp/db/host", Value: []byte("db.local")},
+		{Key: "config/myapp/db/port", Value: []byte("5432")},
+		{Key: "config/myapplication/Version", Value: []byte("3.2.1")},
+	})
+	defer server.Close()
+
+	vars, err := (&ConsulVarsProvider{Addr: server.URL, Prefix: "config/myapp", Token: "secret"}).Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, Vars{
+		"Version": "1.2.3",
+		"db": map[string]interface{}{
+			"host": "db.local",
+			"port": "5432",
+		},
+	}, vars)
+}
+
+func TestConsulVarsProvider_Load_NotFound(t *testing.T) {
+	server := fakeConsul(t, nil)
+	defer server.Close()
+
+	vars, err := (&ConsulVarsProvider{Addr: server.URL, Prefix: "config/other"}).Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, Vars{}, vars)
+}
+
+func TestConsulVarsProvider_Load_Conflict(t *testing.T) {
+	server := fakeConsul(t, []consulKV{
+		{Key: "config/db", Value: []byte("x")},
+		{Key: "config/db/host", Value: []byte("db.local")},
+	})
+	defer server.Close()
+
+	_, err := (&ConsulVarsProvider{Addr: server.URL, Prefix: "config"}).Load()
+	assert.Error(t, err)
+}
+
+// fakeConsul serves the KV API with the given entries, it responds 404 when there are no entries
+func fakeConsul(t *testing.T, kvs []consulKV) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := r.URL.Query()["recurse"]; !ok {
+			t.Errorf("Expected recurse request, got: %s", r.URL)
+		}
+		if len(kvs) == 0 {
+			http.NotFound(w, r)
+			return
+		}
+		if err := json.NewEncoder(w).Encode(kvs); err != nil {
+			t.Error(err)
+		}
+	}))
+}
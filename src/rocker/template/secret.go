@@ -0,0 +1,73 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package template
+
+import (
+	"fmt"
+	"os"
+)
+
+const (
+	// SecretsEnvPrefix is the prefix of environment variables that are
+	// read by the default secrets provider, e.g. `{{ secret "db_pass" }}`
+	// resolves to the value of $ROCKER_SECRET_db_pass
+	SecretsEnvPrefix = "ROCKER_SECRET_"
+)
+
+// SecretProvider describes a source of secret values for the `secret` helper.
+// Get returns ok=false if the secret does not exist.
+type SecretProvider interface {
+	Get(name string) (value string, ok bool, err error)
+}
+
+// EnvSecretProvider reads secrets from environment variables with a prefix
+type EnvSecretProvider struct {
+	Prefix string
+}
+
+// NewEnvSecretProvider returns a new provider that reads secrets from the
+// environment variables that have the given prefix
+func NewEnvSecretProvider(prefix string) *EnvSecretProvider {
+	return &EnvSecretProvider{
+		Prefix: prefix,
+	}
+}
+
+// Get returns the value of the environment variable
+func (p *EnvSecretProvider) Get(name string) (string, bool, error) {
+	value, ok := os.LookupEnv(p.Prefix + name)
+	return value, ok, nil
+}
+
+// SecretHelper makes the `secret` helper that resolves secrets with the given
+// provider. onResolve is called for every resolved value, so the caller may
+// mask it in the log output; it can be nil.
+func SecretHelper(provider SecretProvider, onResolve func(value string)) func(string) (string, error) {
+	return func(name string) (string, error) {
+		value, ok, err := provider.Get(name)
+		if err != nil {
+			return "", fmt.Errorf("Failed to read secret %s, error: %s", name, err)
+		}
+		if !ok {
+			return "", fmt.Errorf("Secret %s is not found", name)
+		}
+		if onResolve != nil {
+			onResolve(value)
+		}
+		return value, nil
+	}
+}
@@ -39,9 +39,21 @@ import (
 // Funs is the list of additional helpers that may be given to the template
 type Funs map[string]interface{}
 
+// Options change the way templates are rendered by ProcessWithOptions
+type Options struct {
+	// Strict fails the rendering on references to the keys missing in
+	// vars, e.g. {{ .Version }}, instead of rendering them as "<no value>"
+	Strict bool
+}
+
 // Process renders config through the template processor.
 // vars and additional functions are acceptable.
 func Process(name string, reader io.Reader, vars Vars, funs Funs) (*bytes.Buffer, error) {
+	return ProcessWithOptions(name, reader, vars, funs, Options{})
+}
+
+// ProcessWithOptions is Process with the rendering options
+func ProcessWithOptions(name string, reader io.Reader, vars Vars, funs Funs, opts Options) (*bytes.Buffer, error) {
 
 	var buf bytes.Buffer
 	// read template
@@ -66,6 +78,10 @@ func Process(name string, reader io.Reader, vars Vars, funs Funs) (*bytes.Buffer
 		"shell":  EscapeShellarg,
 		"yaml":   yamlFn,
 		"image":  makeImageHelper(vars), // `image` helper needs to make a closure on Vars
+		"secret": SecretHelper(NewEnvSecretProvider(SecretsEnvPrefix), nil),
+
+		// Requests to the network are only made if the caller allows them
+		"resolveDigest": resolveDigestDisabled,
 
 		// strings functions
 		"compare":      strings.Compare,
@@ -101,7 +117,12 @@ func Process(name string, reader io.Reader, vars Vars, funs Funs) (*bytes.Buffer
 		funcMap[k] = f
 	}
 
-	tmpl, err := template.New(name).Funcs(funcMap).Parse(string(data))
+	tmpl := template.New(name).Funcs(funcMap)
+	if opts.Strict {
+		tmpl = tmpl.Option("missingkey=error")
+	}
+
+	tmpl, err = tmpl.Parse(string(data))
 	if err != nil {
 		return nil, fmt.Errorf("Error parsing template %s, error: %s", name, err)
 	}
@@ -213,6 +213,47 @@ func TestProcess_Image_Advanced(t *testing.T) {
 	}
 }
 
+func TestProcess_Secret(t *testing.T) {
+	os.Setenv("ROCKER_SECRET_db_pass", "s3cr3t")
+	defer os.Unsetenv("ROCKER_SECRET_db_pass")
+
+	assert.Equal(t, "pass=s3cr3t", processTemplate(t, "pass={{ secret `db_pass` }}"))
+}
+
+func TestProcess_SecretNotFound(t *testing.T) {
+	err := processTemplateReturnError(t, "pass={{ secret `not_existing` }}")
+	assert.Error(t, err)
+	if err != nil {
+		assert.Contains(t, err.Error(), "Secret not_existing is not found")
+	}
+}
+
+func TestProcess_SecretCustomProvider(t *testing.T) {
+	resolved := []string{}
+	provider := &mapSecretProvider{"token": "abc123"}
+
+	funs := Funs{
+		"secret": SecretHelper(provider, func(value string) {
+			resolved = append(resolved, value)
+		}),
+	}
+
+	result, err := Process("test", strings.NewReader("{{ secret `token` }}"), Vars{}, funs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "abc123", result.String())
+	assert.Equal(t, []string{"abc123"}, resolved)
+}
+
+type mapSecretProvider map[string]string
+
+func (p *mapSecretProvider) Get(name string) (string, bool, error) {
+	value, ok := (*p)[name]
+	return value, ok, nil
+}
+
 func processTemplate(t *testing.T, tpl string) string {
 	result, err := Process("test", strings.NewReader(tpl), configTemplateVars, map[string]interface{}{})
 	if err != nil {
@@ -225,3 +266,32 @@ func processTemplateReturnError(t *testing.T, tpl string) error {
 	_, err := Process("test", strings.NewReader(tpl), configTemplateVars, map[string]interface{}{})
 	return err
 }
+
+func TestProcess_Strict(t *testing.T) {
+	strict := Options{Strict: true}
+
+	result, err := ProcessWithOptions("test", strings.NewReader("FROM {{ .mykey }}"), configTemplateVars, Funs{}, strict)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "FROM myval", result.String())
+
+	_, err = ProcessWithOptions("test", strings.NewReader("FROM ubuntu\nENV V={{ .Version }}"), configTemplateVars, Funs{}, strict)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), `test:2:9`)
+		assert.Contains(t, err.Error(), `"Version"`)
+	}
+
+	result, err = ProcessWithOptions("test", strings.NewReader(`{{ if .IsSet "Version" }}{{ .Version }}{{ else }}dev{{ end }}`), configTemplateVars, Funs{}, strict)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "dev", result.String())
+
+	// Not strict by default
+	result, err = Process("test", strings.NewReader("ENV V={{ .Version }}"), configTemplateVars, Funs{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "ENV V=<no value>", result.String())
+}
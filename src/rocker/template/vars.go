@@ -19,6 +19,7 @@ package template
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path"
@@ -29,6 +30,7 @@ import (
 	"sort"
 	"strings"
 
+	"github.com/BurntSushi/toml"
 	"github.com/go-yaml/yaml"
 
 	log "github.com/Sirupsen/logrus"
@@ -37,16 +39,44 @@ import (
 // Vars describes the data structure of the build variables
 type Vars map[string]interface{}
 
-// Merge the current Vars structure with the list of other Vars structs
+// MergeMode defines how Merge combines the slices of the same type
+type MergeMode string
+
+// Merge modes of the slices, see SliceMergeMode
+const (
+	MergeAppend   MergeMode = "append"
+	MergeOverride MergeMode = "override"
+)
+
+// SliceMergeMode is how Merge combines the slices of the same type: either
+// they are appended to each other (default) or the last one wins as any
+// other value does
+var SliceMergeMode = MergeAppend
+
+// ParseMergeMode parses the merge mode given by its name
+func ParseMergeMode(name string) (MergeMode, error) {
+	switch mode := MergeMode(strings.ToLower(name)); mode {
+	case MergeAppend, MergeOverride:
+		return mode, nil
+	}
+	return "", fmt.Errorf("Invalid merge mode %q, expected %s or %s", name, MergeAppend, MergeOverride)
+}
+
+// Merge the current Vars structure with the list of other Vars structs;
+// the receiver is modified, slices of the same type are appended to each
+// other unless SliceMergeMode is MergeOverride and the other values are
+// overridden, see Override
 func (vars Vars) Merge(varsList ...Vars) Vars {
 	for _, mergeWith := range varsList {
 		for k, v := range mergeWith {
 			// We want to merge slices of the same type by appending them to each other
-			// instead of overwriting
+			// instead of overwriting; nil values, e.g. of YAML `key:` with no value,
+			// have no type and always overwrite or get overwritten
 			rv1 := reflect.ValueOf(vars[k])
 			rv2 := reflect.ValueOf(v)
 
-			if rv1.Kind() == reflect.Slice && rv2.Kind() == reflect.Slice && rv1.Type() == rv2.Type() {
+			if SliceMergeMode == MergeAppend && rv1.IsValid() && rv2.IsValid() &&
+				rv1.Kind() == reflect.Slice && rv2.Kind() == reflect.Slice && rv1.Type() == rv2.Type() {
 				vars[k] = reflect.AppendSlice(rv1, rv2).Interface()
 			} else {
 				vars[k] = v
@@ -56,22 +86,91 @@ func (vars Vars) Merge(varsList ...Vars) Vars {
 	return vars
 }
 
+// Override returns new Vars with the values of the given Vars set over the
+// current ones, the last wins for all types including slices; unlike Merge,
+// the current Vars are not modified
+func (vars Vars) Override(varsList ...Vars) Vars {
+	result := Vars{}
+	for _, v := range append([]Vars{vars}, varsList...) {
+		for k, value := range v {
+			result[k] = value
+		}
+	}
+	return result
+}
+
 // IsSet returns true if the given key is set
 func (vars Vars) IsSet(key string) bool {
 	_, ok := vars[key]
 	return ok
 }
 
-// ToStrings converts Vars to a slice of strings line []string{"KEY=VALUE"}
+// ToStrings converts Vars to a slice of strings line []string{"KEY=VALUE"},
+// sorted by the keys; nested maps are printed with sorted keys as well, so
+// the same Vars always give the same strings
 func (vars Vars) ToStrings() (result []string) {
+	for _, k := range vars.Keys() {
+		result = append(result, fmt.Sprintf("%s=%v", k, vars[k]))
+	}
+	return result
+}
+
+// Keys returns the sorted names of the variables
+func (vars Vars) Keys() []string {
+	keys := make([]string, 0, len(vars))
+	for k := range vars {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// implicitVars are read by the template helpers rather than the templates,
+// e.g. the `image` helper reads DemandArtifacts and RockerArtifacts
+var implicitVars = map[string]bool{"DemandArtifacts": true, "RockerArtifacts": true}
+
+// Unused returns the sorted names of the variables the template source does
+// not refer to either as .Name, which includes $.Name and .Name.Field, or as
+// "Name" given to index; it is a fair guess rather than a proof
+func (vars Vars) Unused(source string) []string {
+	unused := []string{}
+	for _, k := range vars.Keys() {
+		if implicitVars[k] || strings.Contains(source, `"`+k+`"`) {
+			continue
+		}
+		if !regexp.MustCompile(`\.` + regexp.QuoteMeta(k) + `\b`).MatchString(source) {
+			unused = append(unused, k)
+		}
+	}
+	return unused
+}
+
+// SensitiveKeys is the list of substrings that make a variable considered
+// as a credential, if its name contains any of them (case insensitive)
+var SensitiveKeys = []string{"PASSWORD", "TOKEN", "SECRET"}
+
+// SensitiveValues returns string values of the variables that look like
+// credentials according to SensitiveKeys
+func (vars Vars) SensitiveValues() (result []string) {
 	for k, v := range vars {
-		result = append(result, fmt.Sprintf("%s=%s", k, v))
+		str, ok := v.(string)
+		if !ok || str == "" {
+			continue
+		}
+		key := strings.ToUpper(k)
+		for _, s := range SensitiveKeys {
+			if strings.Contains(key, s) {
+				result = append(result, str)
+				break
+			}
+		}
 	}
 	sort.Strings(result)
 	return result
 }
 
-// ToMapOfInterface casts Vars to map[string]interface{}
+// ToMapOfInterface casts Vars to map[string]interface{}; the map has no
+// order, but the JSON and YAML encoders write its keys sorted
 func (vars Vars) ToMapOfInterface() map[string]interface{} {
 	result := map[string]interface{}{}
 	for k, v := range vars {
@@ -80,7 +179,7 @@ func (vars Vars) ToMapOfInterface() map[string]interface{} {
 	return result
 }
 
-// MarshalJSON serialize Vars to JSON
+// MarshalJSON serialize Vars to JSON, the list of ToStrings sorted by the keys
 func (vars Vars) MarshalJSON() ([]byte, error) {
 	return json.Marshal(vars.ToStrings())
 }
@@ -128,13 +227,23 @@ func (vars *Vars) UnmarshalYAML(unmarshal func(interface{}) error) (err error) {
 }
 
 // VarsFromStrings parses Vars through ParseKvPairs and then loads content from files
-// for vars values with "@" prefix
+// for vars values with "@" prefix; the values "true" and "false" are booleans,
+// so are the flags without "=", e.g. "DEBUG" is the same as "DEBUG=true"
 func VarsFromStrings(pairs []string) (vars Vars, err error) {
 	vars = ParseKvPairs(pairs)
+	for _, pair := range pairs {
+		if !strings.Contains(pair, "=") {
+			vars[pair] = true
+		}
+	}
 	for k, v := range vars {
 		// We care only about strings
 		switch v := v.(type) {
 		case string:
+			if b, ok := map[string]bool{"true": true, "false": false}[v]; ok {
+				vars[k] = b
+				continue
+			}
 			// Read variable content from a file if "@" prefix is given
 			if strings.HasPrefix(v, "@") {
 				f := v[1:]
@@ -151,7 +260,8 @@ func VarsFromStrings(pairs []string) (vars Vars, err error) {
 	return vars, nil
 }
 
-// VarsFromFile reads variables from either JSON or YAML file
+// VarsFromFile reads variables from JSON, YAML or TOML file, the format is
+// defined by the file extension
 func VarsFromFile(filename string) (vars Vars, err error) {
 	log.Debugf("Load vars from file %s", filename)
 
@@ -159,28 +269,69 @@ func VarsFromFile(filename string) (vars Vars, err error) {
 		return nil, err
 	}
 
-	data, err := ioutil.ReadFile(filename)
+	format := strings.TrimPrefix(filepath.Ext(filename), ".")
+	if format == "" {
+		format = "yaml"
+	}
+
+	fd, err := os.Open(filename)
 	if err != nil {
 		return nil, err
 	}
+	defer fd.Close()
 
-	vars = Vars{}
+	if vars, err = VarsFromReader(fd, format); err != nil {
+		return nil, fmt.Errorf("Failed to read vars from %s, error: %s", filename, err)
+	}
 
-	switch filepath.Ext(filename) {
-	case ".yaml", ".yml", ".":
-		if err := yaml.Unmarshal(data, &vars); err != nil {
-			return nil, err
-		}
-	case ".json":
-		if err := json.Unmarshal(data, &vars); err != nil {
-			return nil, err
+	return vars, nil
+}
+
+// VarsFromReader reads variables of the given format from the reader,
+// the format is one of "json", "yaml" (or "yml") and "toml"; the empty
+// format is detected by the content, either JSON or YAML
+func VarsFromReader(r io.Reader, format string) (vars Vars, err error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if format == "" {
+		format = "yaml"
+		if trimmed := strings.TrimSpace(string(data)); strings.HasPrefix(trimmed, "{") || strings.HasPrefix(trimmed, "[") {
+			format = "json"
 		}
 	}
 
+	vars = Vars{}
+
+	switch strings.ToLower(format) {
+	case "yaml", "yml":
+		err = yaml.Unmarshal(data, &vars)
+	case "json":
+		err = json.Unmarshal(data, &vars)
+	case "toml":
+		err = toml.Unmarshal(data, &vars)
+	default:
+		return nil, fmt.Errorf("Unknown vars format %q, expected json, yaml or toml", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+
 	return vars, nil
 }
 
-// VarsFromFileMulti reads multiple files and merge vars
+// StdinVarsFormat is the format of the vars read from stdin with the "-" file
+// name, see VarsFromReader; it is detected by the content if empty
+var StdinVarsFormat = ""
+
+// stdin is where the "-" vars are read from, it is replaced by tests
+var stdin io.Reader = os.Stdin
+
+// VarsFromFileMulti reads multiple files and merge vars, "-" reads vars from stdin;
+// the files are merged in the given order, the files matching a wildcard
+// pattern are merged in the lexical order of their paths
 func VarsFromFileMulti(files []string) (Vars, error) {
 	var (
 		varsList = []Vars{}
@@ -196,9 +347,18 @@ func VarsFromFileMulti(files []string) (Vars, error) {
 			if matches, err = filepath.Glob(pat); err != nil {
 				return nil, err
 			}
+			// Glob sorts the matches of each directory only, e.g. of "*/vars.yml"
+			sort.Strings(matches)
 		}
 
 		for _, f := range matches {
+			if f == "-" {
+				if vars, err = VarsFromReader(stdin, StdinVarsFormat); err != nil {
+					return nil, fmt.Errorf("Failed to read vars from stdin, error: %s", err)
+				}
+				varsList = append(varsList, vars)
+				continue
+			}
 			if vars, err = VarsFromFile(f); err != nil {
 				return nil, err
 			}
@@ -209,11 +369,16 @@ func VarsFromFileMulti(files []string) (Vars, error) {
 	return Vars{}.Merge(varsList...), nil
 }
 
-// ParseKvPairs parses Vars from a slice of strings e.g. []string{"KEY=VALUE"}
+// ParseKvPairs parses Vars from a slice of strings e.g. []string{"KEY=VALUE"},
+// a pair without "=" sets the variable to an empty string
 func ParseKvPairs(pairs []string) (vars Vars) {
 	vars = make(Vars)
 	for _, varPair := range pairs {
 		tmp := strings.SplitN(varPair, "=", 2)
+		if len(tmp) < 2 {
+			vars[tmp[0]] = ""
+			continue
+		}
 		vars[tmp[0]] = tmp[1]
 	}
 	return vars
@@ -281,6 +446,24 @@ func (vars Vars) ReplaceString(str string) string {
 	return str
 }
 
+// ReplaceStringStrict is ReplaceString that fails on the variables it
+// cannot replace, those that are not set or are not strings, telling the
+// name and the position of the first one
+func (vars Vars) ReplaceStringStrict(str string) (string, error) {
+	for _, m := range tokenVarsInterpolation.FindAllStringSubmatchIndex(str, -1) {
+		match := str[m[0]:m[1]]
+		if strings.Contains(match, "\\$") {
+			continue
+		}
+		// The name starts right after the $
+		name := strings.Trim(str[m[4]:m[5]], "{}")
+		if _, ok := vars[name].(string); !ok {
+			return "", fmt.Errorf("Unresolved variable $%s at position %d of %q", name, m[4]-1, str)
+		}
+	}
+	return vars.ReplaceString(str), nil
+}
+
 func containsWildcards(name string) bool {
 	for i := 0; i < len(name); i++ {
 		ch := name[i]
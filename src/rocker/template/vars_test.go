@@ -19,13 +19,16 @@ package template
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path"
 	"rocker/imagename"
 	"rocker/test"
+	"strings"
 	"testing"
 
+	"github.com/go-yaml/yaml"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -41,6 +44,117 @@ func TestVars_MergeSlices(t *testing.T) {
 	assert.Equal(t, []string{"banana", "apple", "pear", "orange"}, v3["fruits"].([]string))
 }
 
+func TestVarsFromFileMulti_GlobMergeModes(t *testing.T) {
+	tempDir, rm := tplMkFiles(t, map[string]string{
+		"b/vars.yml":   "Env: b\nHosts: [b1]\n",
+		"a/vars.yml":   "Env: a\nHosts: [a1, a2]\n",
+		"c/vars.yml":   "Hosts: [c1]\n",
+		"override.yml": "Env: prod\n",
+	})
+	defer rm()
+
+	defer func(mode MergeMode) { SliceMergeMode = mode }(SliceMergeMode)
+
+	files := []string{tempDir + "/*/vars.yml", tempDir + "/override.yml"}
+
+	SliceMergeMode = MergeAppend
+	vars, err := VarsFromFileMulti(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "prod", vars["Env"])
+	assert.Equal(t, []interface{}{"a1", "a2", "b1", "c1"}, vars["Hosts"])
+
+	SliceMergeMode = MergeOverride
+	vars, err = VarsFromFileMulti(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "prod", vars["Env"])
+	assert.Equal(t, []interface{}{"c1"}, vars["Hosts"])
+
+	// Without the override the last of the sorted matches wins
+	vars, err = VarsFromFileMulti(files[:1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "b", vars["Env"])
+}
+
+func TestParseMergeMode(t *testing.T) {
+	mode, err := ParseMergeMode("Override")
+	assert.NoError(t, err)
+	assert.Equal(t, MergeOverride, mode)
+
+	mode, err = ParseMergeMode("append")
+	assert.NoError(t, err)
+	assert.Equal(t, MergeAppend, mode)
+
+	_, err = ParseMergeMode("replace")
+	assert.EqualError(t, err, `Invalid merge mode "replace", expected append or override`)
+}
+
+func TestVars_MergeNil(t *testing.T) {
+	tempDir, rm := tplMkFiles(t, map[string]string{
+		"a.yml": "Foo:\nList: [a]\nEmpty: null\n",
+		"b.yml": "Foo: [x]\nList:\nEmpty: ~\n",
+	})
+	defer rm()
+
+	vars, err := VarsFromFileMulti([]string{tempDir + "/a.yml", tempDir + "/b.yml"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []interface{}{"x"}, vars["Foo"])
+	assert.Nil(t, vars["List"])
+	assert.True(t, vars.IsSet("Empty"))
+	assert.Nil(t, vars["Empty"])
+
+	vars, err = VarsFromFileMulti([]string{tempDir + "/b.yml", tempDir + "/a.yml"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, vars["Foo"])
+	assert.Equal(t, []interface{}{"a"}, vars["List"])
+
+	// Typed nil slices are still appended to
+	merged := Vars{"List": []string(nil), "Nil": nil}.Merge(Vars{"List": []string{"a"}, "Nil": nil})
+	assert.Equal(t, []string{"a"}, merged["List"])
+	assert.Nil(t, merged["Nil"])
+}
+
+func TestVars_MergeOverride(t *testing.T) {
+	base := Vars{
+		"fruits": []string{"banana", "apple"},
+		"color":  "red",
+		"size":   1,
+	}
+	other := Vars{
+		"fruits": []string{"pear"},
+		"color":  "green",
+	}
+
+	overridden := base.Override(other)
+	assert.Equal(t, []string{"pear"}, overridden["fruits"])
+	assert.Equal(t, "green", overridden["color"])
+	assert.Equal(t, 1, overridden["size"])
+
+	// Override does not modify the receiver
+	assert.Equal(t, []string{"banana", "apple"}, base["fruits"])
+	assert.Equal(t, "red", base["color"])
+
+	merged := base.Merge(other)
+	assert.Equal(t, []string{"banana", "apple", "pear"}, merged["fruits"])
+	assert.Equal(t, "green", merged["color"])
+	assert.Equal(t, 1, merged["size"])
+
+	// Merge does
+	assert.Equal(t, []string{"banana", "apple", "pear"}, base["fruits"])
+
+	// The last wins
+	assert.Equal(t, "blue", Vars{}.Override(Vars{"color": "red"}, Vars{"color": "blue"})["color"])
+}
+
 func TestVarsToStrings(t *testing.T) {
 	t.Parallel()
 
@@ -77,6 +191,35 @@ func TestVarsToStrings(t *testing.T) {
 	}
 }
 
+func TestVars_SensitiveValues(t *testing.T) {
+	vars := Vars{
+		"DB_PASSWORD":  "pass1",
+		"githubToken":  "tok1",
+		"aws_secret":   "sec1",
+		"Version":      "1.2.3",
+		"SECRET_EMPTY": "",
+		"TOKENS":       []string{"a", "b"},
+	}
+
+	assert.Equal(t, []string{"pass1", "sec1", "tok1"}, vars.SensitiveValues())
+}
+
+func TestVars_Unused(t *testing.T) {
+	vars := Vars{
+		"Version":         "1.2.3",
+		"Versions":        "1.2",
+		"Registry":        "quay.io",
+		"Opts":            map[string]interface{}{"debug": true},
+		"Mirror":          "http://mirror",
+		"Unused":          "x",
+		"DemandArtifacts": true,
+	}
+	source := `FROM {{ $.Registry }}/app:{{ .Version }}
+RUN {{ if .Opts.debug }}make debug{{ end }} {{ index . "Mirror" }}`
+
+	assert.Equal(t, []string{"Unused", "Versions"}, vars.Unused(source))
+}
+
 func TestVarsFromStrings(t *testing.T) {
 	t.Parallel()
 
@@ -113,6 +256,32 @@ func TestVarsFromStrings(t *testing.T) {
 	}
 }
 
+func TestParseKvPairs(t *testing.T) {
+	vars := ParseKvPairs([]string{"FOO", "BAR=", "BAZ=bar=baz"})
+	assert.Equal(t, Vars{"FOO": "", "BAR": "", "BAZ": "bar=baz"}, vars)
+}
+
+func TestVarsFromStrings_Bool(t *testing.T) {
+	vars, err := VarsFromStrings([]string{"DEBUG", "VERBOSE=true", "COLOR=false", "EMPTY=", "BAZ=bar=baz", "NAME=False"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, Vars{
+		"DEBUG":   true,
+		"VERBOSE": true,
+		"COLOR":   false,
+		"EMPTY":   "",
+		"BAZ":     "bar=baz",
+		"NAME":    "False",
+	}, vars)
+
+	result, err := Process("test", strings.NewReader(`{{ if .DEBUG }}debug{{ end }}{{ if .COLOR }}color{{ end }}`), vars, Funs{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "debug", result.String())
+}
+
 // TODO: test VarsFromFileMulti
 
 func TestVarsFromFile_Yaml(t *testing.T) {
@@ -172,6 +341,102 @@ func TestVarsFromFile_Json(t *testing.T) {
 	assert.Equal(t, true, vars["Bar"])
 }
 
+func TestVarsFromFile_Toml(t *testing.T) {
+	tempDir, rm := tplMkFiles(t, map[string]string{
+		"vars.toml": `
+Foo = "x"
+Bar = true
+`,
+	})
+	defer rm()
+
+	vars, err := VarsFromFile(tempDir + "/vars.toml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "x", vars["Foo"])
+	assert.Equal(t, true, vars["Bar"])
+}
+
+func TestVarsFromReader(t *testing.T) {
+	tests := map[string]string{
+		"json": `{"Foo": "x", "Bar": true, "Num": 1, "Nested": {"Key": "nested"}}`,
+		"yaml": "Foo: x\nBar: true\nNum: 1\nNested:\n  Key: nested\n",
+		"toml": "Foo = \"x\"\nBar = true\nNum = 1\n[Nested]\nKey = \"nested\"\n",
+	}
+
+	for format, data := range tests {
+		vars, err := VarsFromReader(strings.NewReader(data), format)
+		if err != nil {
+			t.Fatalf("%s: %s", format, err)
+		}
+
+		assert.Equal(t, "x", vars["Foo"], format)
+		assert.Equal(t, true, vars["Bar"], format)
+		assert.EqualValues(t, 1, vars["Num"], format)
+
+		result, err := Process(format, strings.NewReader("{{ .Nested.Key }}"), vars, Funs{})
+		if err != nil {
+			t.Fatalf("%s: %s", format, err)
+		}
+		assert.Equal(t, "nested", result.String(), format)
+	}
+}
+
+func TestVarsFromFileMulti_Stdin(t *testing.T) {
+	tempDir, rm := tplMkFiles(t, map[string]string{
+		"a.yml": "Foo: file\nBar: file\n",
+	})
+	defer rm()
+
+	defer func(r io.Reader, format string) {
+		stdin, StdinVarsFormat = r, format
+	}(stdin, StdinVarsFormat)
+
+	tests := []struct {
+		input, format string
+	}{
+		{`{"Bar": "stdin", "Num": 1}`, ""},
+		{"\n  [\"Bar=stdin\", \"Num=1\"]", ""},
+		{"Bar: stdin\nNum: 1\n", ""},
+		{"Bar = \"stdin\"\nNum = 1\n", "toml"},
+	}
+
+	for _, tt := range tests {
+		stdin, StdinVarsFormat = strings.NewReader(tt.input), tt.format
+
+		vars, err := VarsFromFileMulti([]string{tempDir + "/a.yml", "-"})
+		if err != nil {
+			t.Fatalf("%q: %s", tt.input, err)
+		}
+
+		assert.Equal(t, "file", vars["Foo"], tt.input)
+		assert.Equal(t, "stdin", vars["Bar"], tt.input)
+		assert.Equal(t, "1", fmt.Sprintf("%v", vars["Num"]), tt.input)
+	}
+}
+
+func TestVarsFromFileMulti_StdinError(t *testing.T) {
+	defer func(r io.Reader) { stdin = r }(stdin)
+	stdin = strings.NewReader(`{"Bar": `)
+
+	_, err := VarsFromFileMulti([]string{"-"})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "Failed to read vars from stdin")
+	}
+}
+
+func TestVarsFromReader_UnknownFormat(t *testing.T) {
+	_, err := VarsFromReader(strings.NewReader("Foo=x"), "ini")
+	assert.EqualError(t, err, `Unknown vars format "ini", expected json, yaml or toml`)
+}
+
+func TestVarsFromReader_Invalid(t *testing.T) {
+	_, err := VarsFromReader(strings.NewReader("Foo = "), "toml")
+	assert.Error(t, err)
+}
+
 func TestVarsReplaceString(t *testing.T) {
 	t.Parallel()
 
@@ -317,3 +582,66 @@ func tplMkFiles(t *testing.T, files map[string]string) (string, func()) {
 		os.RemoveAll(tempDir)
 	}
 }
+
+func TestVars_DeterministicMarshal(t *testing.T) {
+	vars := Vars{}
+	for i := 0; i < 50; i++ {
+		vars[fmt.Sprintf("key%d", i)] = i
+	}
+	vars["a"] = "1"
+	vars["a-b"] = "2"
+	vars["nested"] = map[string]interface{}{"z": 1, "y": 2, "x": map[string]interface{}{"c": 3, "b": 4}}
+	vars["yaml"] = map[interface{}]interface{}{"z": 1, "y": 2, "x": 3}
+	vars["list"] = []interface{}{map[string]interface{}{"b": 1, "a": 2}}
+
+	first := vars.ToStrings()
+	assert.Equal(t, "a=1", first[0])
+	assert.Equal(t, "a-b=2", first[1])
+	assert.Contains(t, first, "nested=map[x:map[b:4 c:3] y:2 z:1]")
+	assert.Contains(t, first, "key7=7")
+
+	firstJSON, err := json.Marshal(vars)
+	if err != nil {
+		t.Fatal(err)
+	}
+	firstYAML, err := yaml.Marshal(vars.ToMapOfInterface())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 20; i++ {
+		assert.Equal(t, first, vars.ToStrings())
+
+		data, err := json.Marshal(vars)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, string(firstJSON), string(data))
+
+		if data, err = yaml.Marshal(vars.ToMapOfInterface()); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, string(firstYAML), string(data))
+	}
+}
+
+func TestVarsReplaceStringStrict(t *testing.T) {
+	vars := Vars{"GREETING": "Hello", "COUNT": 3}
+
+	result, err := vars.ReplaceStringStrict("${GREETING}, \\$NAME")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "Hello, $NAME", result)
+
+	_, err = vars.ReplaceStringStrict("$GREETING, ${NAME}!")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "Unresolved variable $NAME at position 11")
+	}
+
+	// Only strings are replaced
+	_, err = vars.ReplaceStringStrict("$COUNT times")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "Unresolved variable $COUNT at position 0")
+	}
+}
@@ -0,0 +1,101 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package textformatter
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// MaskReplacement is the string that is printed in place of masked values
+const MaskReplacement = "****"
+
+// DefaultMasker is the list of sensitive values that rocker hides from its log output
+var DefaultMasker = NewMasker()
+
+// Masker keeps the list of sensitive values that should never appear in the output
+type Masker struct {
+	values []string
+	mu     sync.RWMutex
+}
+
+// NewMasker returns a new empty Masker
+func NewMasker() *Masker {
+	return &Masker{
+		values: []string{},
+	}
+}
+
+// Add adds the value to be masked, empty values are ignored
+func (m *Masker) Add(value string) {
+	if value == "" {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.values = append(m.values, value)
+
+	// Replace longer values first, so the one that is a substring of another
+	// does not leave the rest of the longer value unmasked
+	sort.Sort(byLengthDesc(m.values))
+}
+
+// Mask replaces all known sensitive values in the given string
+func (m *Masker) Mask(s string) string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, v := range m.values {
+		s = strings.Replace(s, v, MaskReplacement, -1)
+	}
+	return s
+}
+
+// MaskFormatter is a formatter for logrus that masks sensitive values in the
+// output of another formatter
+type MaskFormatter struct {
+	Formatter log.Formatter
+	Masker    *Masker
+}
+
+// NewMaskFormatter wraps the formatter so it masks values known by the masker
+func NewMaskFormatter(formatter log.Formatter, masker *Masker) *MaskFormatter {
+	return &MaskFormatter{
+		Formatter: formatter,
+		Masker:    masker,
+	}
+}
+
+// Format formats the log entry with the underlying formatter and masks the result
+func (f *MaskFormatter) Format(entry *log.Entry) ([]byte, error) {
+	data, err := f.Formatter.Format(entry)
+	if err != nil {
+		return data, err
+	}
+	return []byte(f.Masker.Mask(string(data))), nil
+}
+
+type byLengthDesc []string
+
+func (s byLengthDesc) Len() int           { return len(s) }
+func (s byLengthDesc) Less(i, j int) bool { return len(s[i]) > len(s[j]) }
+func (s byLengthDesc) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
@@ -0,0 +1,81 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package textformatter
+
+import (
+	"bytes"
+	"testing"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/kr/pretty"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMasker_Mask(t *testing.T) {
+	m := NewMasker()
+	m.Add("secret")
+	m.Add("")
+	m.Add("my-secret-token")
+
+	assert.Equal(t, "token=**** pass=****", m.Mask("token=my-secret-token pass=secret"))
+	assert.Equal(t, "nothing to hide", m.Mask("nothing to hide"))
+}
+
+func TestMaskFormatter_Logger(t *testing.T) {
+	var (
+		buf    bytes.Buffer
+		masker = NewMasker()
+		logger = log.New()
+	)
+
+	masker.Add("s3cr3t")
+
+	logger.Out = &buf
+	logger.Formatter = NewMaskFormatter(&TextFormatter{DisableColors: true}, masker)
+
+	logger.WithField("password", "s3cr3t").Infof("Run with s3cr3t password")
+	logger.Infof("Nothing to hide")
+
+	assert.NotContains(t, buf.String(), "s3cr3t")
+	assert.Contains(t, buf.String(), "Run with **** password")
+	assert.Contains(t, buf.String(), "password=****")
+	assert.Contains(t, buf.String(), "Nothing to hide")
+}
+
+func TestMaskFormatter_PrettyDump(t *testing.T) {
+	var (
+		buf    bytes.Buffer
+		masker = NewMasker()
+		logger = log.New()
+	)
+
+	masker.Add("user:p4ss")
+
+	logger.Out = &buf
+	logger.Level = log.DebugLevel
+	logger.Formatter = NewMaskFormatter(&log.JSONFormatter{}, masker)
+
+	opts := struct {
+		Name string
+		Auth string
+	}{"ubuntu", "user:p4ss"}
+
+	logger.Debugf("Pull image with options: %# v", pretty.Formatter(opts))
+
+	assert.NotContains(t, buf.String(), "p4ss")
+	assert.Contains(t, buf.String(), "****")
+}
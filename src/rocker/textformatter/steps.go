@@ -0,0 +1,58 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package textformatter
+
+import (
+	"fmt"
+	"sync"
+)
+
+// DefaultStepCounter keeps the build step that rocker is executing
+var DefaultStepCounter = &StepCounter{}
+
+// StepCounter keeps the number of the build step being executed and the
+// total number of steps, so they can be printed with every log line
+type StepCounter struct {
+	current int
+	total   int
+	mu      sync.RWMutex
+}
+
+// Set sets the number of the current step out of total;
+// zero current means no step is being executed
+func (s *StepCounter) Set(current, total int) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.current, s.total = current, total
+}
+
+// Prefix returns the message prefix like "[3/10] ", or empty string
+// if no step is being executed
+func (s *StepCounter) Prefix() string {
+	if s == nil {
+		return ""
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.current == 0 {
+		return ""
+	}
+	return fmt.Sprintf("[%d/%d] ", s.current, s.total)
+}
@@ -0,0 +1,69 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package textformatter
+
+import (
+	"bytes"
+	"regexp"
+	"testing"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStepCounter_Prefix(t *testing.T) {
+	var nilCounter *StepCounter
+	nilCounter.Set(1, 2)
+	assert.Equal(t, "", nilCounter.Prefix())
+
+	steps := &StepCounter{}
+	assert.Equal(t, "", steps.Prefix())
+
+	steps.Set(3, 10)
+	assert.Equal(t, "[3/10] ", steps.Prefix())
+
+	steps.Set(0, 0)
+	assert.Equal(t, "", steps.Prefix())
+}
+
+func TestTextFormatter_StepsAndTimestamps(t *testing.T) {
+	steps := &StepCounter{}
+	steps.Set(2, 5)
+
+	tests := []struct {
+		formatter *TextFormatter
+		expected  string
+	}{
+		{&TextFormatter{}, `^INFO\[\d{4}\] hello`},
+		{&TextFormatter{Steps: steps}, `^INFO\[\d{4}\] \[2/5\] hello`},
+		{&TextFormatter{Steps: steps, DisableTimestamp: true}, `^INFO \[2/5\] hello`},
+		{&TextFormatter{FullTimestamp: true, TimestampFormat: time.RFC3339}, `^INFO\[\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}(Z|[+-]\d{2}:\d{2})\] hello`},
+	}
+
+	for _, test := range tests {
+		var buf bytes.Buffer
+
+		logger := log.New()
+		logger.Out = &buf
+		test.formatter.DisableColors = true
+		logger.Formatter = test.formatter
+
+		logger.Info("hello")
+		assert.Regexp(t, regexp.MustCompile(test.expected), buf.String())
+	}
+}
@@ -16,12 +16,16 @@ import (
 )
 
 const (
-	nocolor = 0
-	red     = 31
-	green   = 32
-	yellow  = 33
-	blue    = 34
-	gray    = 37
+	nocolor  = 0
+	black    = 30
+	red      = 31
+	green    = 32
+	yellow   = 33
+	blue     = 34
+	magenta  = 35
+	cyan     = 36
+	gray     = 37
+	darkgray = 90
 )
 
 var (
@@ -61,6 +65,13 @@ type TextFormatter struct {
 	// that log extremely frequently and don't use the JSON formatter this may not
 	// be desired.
 	DisableSorting bool
+
+	// Theme is the palette of level colors, DefaultTheme is used if not set
+	Theme *Theme
+
+	// Steps, if set, prefixes every message with the number of the build step
+	// being executed, e.g. [3/10]
+	Steps *StepCounter
 }
 
 // Format formats log message string, it checks if the output should be colored
@@ -96,25 +107,15 @@ func (f *TextFormatter) Format(entry *log.Entry) ([]byte, error) {
 }
 
 func (f *TextFormatter) printColored(b *bytes.Buffer, entry *log.Entry, keys []string) {
-	var levelColor int
-	switch entry.Level {
-	case log.DebugLevel:
-		levelColor = gray
-	case log.WarnLevel:
-		levelColor = yellow
-	case log.ErrorLevel, log.FatalLevel, log.PanicLevel:
-		levelColor = red
-	default:
-		levelColor = blue
+	theme := DefaultTheme
+	if f.Theme != nil {
+		theme = *f.Theme
 	}
+	levelColor := theme.levelColor(entry.Level)
 
 	levelText := strings.ToUpper(entry.Level.String())[0:4]
 
-	if !f.FullTimestamp {
-		fmt.Fprintf(b, "\x1b[%dm%s\x1b[0m[%04d] %-44s ", levelColor, levelText, miniTS(), entry.Message)
-	} else {
-		fmt.Fprintf(b, "\x1b[%dm%s\x1b[0m[%s] %-44s ", levelColor, levelText, entry.Time.Format(f.TimestampFormat), entry.Message)
-	}
+	fmt.Fprintf(b, "\x1b[%dm%s\x1b[0m%s %-44s ", levelColor, levelText, f.timestamp(entry), f.Steps.Prefix()+entry.Message)
 	for _, k := range keys {
 		v := entry.Data[k]
 		fmt.Fprintf(b, " \x1b[%dm%s\x1b[0m=%+v", levelColor, k, v)
@@ -124,17 +125,26 @@ func (f *TextFormatter) printColored(b *bytes.Buffer, entry *log.Entry, keys []s
 func (f *TextFormatter) printUncolored(b *bytes.Buffer, entry *log.Entry, keys []string) {
 	levelText := strings.ToUpper(entry.Level.String())[0:4]
 
-	if !f.FullTimestamp {
-		fmt.Fprintf(b, "%s[%04d] %-44s ", levelText, miniTS(), entry.Message)
-	} else {
-		fmt.Fprintf(b, "%s[%s] %-44s ", levelText, entry.Time.Format(f.TimestampFormat), entry.Message)
-	}
+	fmt.Fprintf(b, "%s%s %-44s ", levelText, f.timestamp(entry), f.Steps.Prefix()+entry.Message)
 	for _, k := range keys {
 		v := entry.Data[k]
 		fmt.Fprintf(b, " %s=%+v", k, v)
 	}
 }
 
+// timestamp returns the bracketed time of the entry: seconds since the start
+// of execution, the full timestamp or nothing at all
+func (f *TextFormatter) timestamp(entry *log.Entry) string {
+	switch {
+	case f.DisableTimestamp:
+		return ""
+	case f.FullTimestamp:
+		return fmt.Sprintf("[%s]", entry.Time.Format(f.TimestampFormat))
+	default:
+		return fmt.Sprintf("[%04d]", miniTS())
+	}
+}
+
 // This is to not silently overwrite `time`, `msg` and `level` fields when
 // dumping it. If this code wasn't there doing:
 //
@@ -0,0 +1,135 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package textformatter
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// ColorEnvPrefix is the prefix of environment variables that override the
+// color of a particular level, e.g. ROCKER_COLOR_INFO=cyan
+const ColorEnvPrefix = "ROCKER_COLOR_"
+
+// Theme is a palette of ANSI colors for the levels of log messages
+type Theme struct {
+	Debug int
+	Info  int
+	Warn  int
+	Error int
+}
+
+// DefaultTheme is the palette used when no theme is chosen
+var DefaultTheme = Theme{Debug: gray, Info: blue, Warn: yellow, Error: red}
+
+// Themes are the predefined palettes that can be chosen by name
+var Themes = map[string]Theme{
+	"default": DefaultTheme,
+	// blue is hard to read on a dark background
+	"dark": {Debug: gray, Info: cyan, Warn: yellow, Error: red},
+	// gray and yellow are hard to read on a light background
+	"light": {Debug: darkgray, Info: blue, Warn: magenta, Error: red},
+	// avoids telling levels apart by red and green
+	"colorblind": {Debug: gray, Info: blue, Warn: yellow, Error: magenta},
+}
+
+var colorNames = map[string]int{
+	"none":     nocolor,
+	"black":    black,
+	"red":      red,
+	"green":    green,
+	"yellow":   yellow,
+	"blue":     blue,
+	"magenta":  magenta,
+	"cyan":     cyan,
+	"gray":     gray,
+	"darkgray": darkgray,
+}
+
+// ThemeByName returns one of the predefined themes, empty name means the default one
+func ThemeByName(name string) (Theme, error) {
+	if name == "" {
+		return DefaultTheme, nil
+	}
+	theme, ok := Themes[strings.ToLower(name)]
+	if !ok {
+		return theme, fmt.Errorf("Unknown color theme %q, available themes: %s", name, strings.Join(themeNames(), ", "))
+	}
+	return theme, nil
+}
+
+// WithEnv returns a copy of the theme with the level colors overridden by
+// ROCKER_COLOR_<LEVEL> variables; getenv is usually os.Getenv
+func (t Theme) WithEnv(getenv func(string) string) (Theme, error) {
+	levels := []struct {
+		name  string
+		color *int
+	}{
+		{"DEBUG", &t.Debug},
+		{"INFO", &t.Info},
+		{"WARN", &t.Warn},
+		{"ERROR", &t.Error},
+	}
+
+	for _, l := range levels {
+		value := getenv(ColorEnvPrefix + l.name)
+		if value == "" {
+			continue
+		}
+		color, ok := colorNames[strings.ToLower(value)]
+		if !ok {
+			return t, fmt.Errorf("Unknown color %q in %s%s, available colors: %s",
+				value, ColorEnvPrefix, l.name, strings.Join(colorNamesList(), ", "))
+		}
+		*l.color = color
+	}
+
+	return t, nil
+}
+
+// levelColor returns the color of the given level
+func (t Theme) levelColor(level log.Level) int {
+	switch level {
+	case log.DebugLevel:
+		return t.Debug
+	case log.WarnLevel:
+		return t.Warn
+	case log.ErrorLevel, log.FatalLevel, log.PanicLevel:
+		return t.Error
+	default:
+		return t.Info
+	}
+}
+
+func themeNames() (names []string) {
+	for name := range Themes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func colorNamesList() (names []string) {
+	for name := range colorNames {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
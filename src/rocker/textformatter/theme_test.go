@@ -0,0 +1,104 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package textformatter
+
+import (
+	"bytes"
+	"testing"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTheme_Format(t *testing.T) {
+	tests := []struct {
+		theme string
+		level log.Level
+		code  string
+	}{
+		{"", log.InfoLevel, "\x1b[34mINFO\x1b[0m"},
+		{"default", log.ErrorLevel, "\x1b[31mERRO\x1b[0m"},
+		{"dark", log.InfoLevel, "\x1b[36mINFO\x1b[0m"},
+		{"light", log.WarnLevel, "\x1b[35mWARN\x1b[0m"},
+		{"light", log.DebugLevel, "\x1b[90mDEBU\x1b[0m"},
+		{"colorblind", log.ErrorLevel, "\x1b[35mERRO\x1b[0m"},
+	}
+
+	for _, test := range tests {
+		theme, err := ThemeByName(test.theme)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out := formatWithTheme(t, theme, test.level)
+		assert.Contains(t, out, test.code, "theme %q", test.theme)
+		assert.Contains(t, out, "\x1b["+test.code[2:4]+"mkey\x1b[0m=value", "theme %q", test.theme)
+	}
+}
+
+func TestTheme_ByNameUnknown(t *testing.T) {
+	_, err := ThemeByName("rainbow")
+	assert.EqualError(t, err, `Unknown color theme "rainbow", available themes: colorblind, dark, default, light`)
+}
+
+func TestTheme_WithEnv(t *testing.T) {
+	env := map[string]string{
+		"ROCKER_COLOR_INFO":  "cyan",
+		"ROCKER_COLOR_ERROR": "Magenta",
+	}
+
+	theme, err := DefaultTheme.WithEnv(func(key string) string { return env[key] })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, Theme{Debug: gray, Info: cyan, Warn: yellow, Error: magenta}, theme)
+	assert.Equal(t, blue, DefaultTheme.Info, "expected the default theme to stay intact")
+	assert.Contains(t, formatWithTheme(t, theme, log.InfoLevel), "\x1b[36mINFO\x1b[0m")
+}
+
+func TestTheme_WithEnvUnknownColor(t *testing.T) {
+	_, err := DefaultTheme.WithEnv(func(key string) string {
+		if key == "ROCKER_COLOR_WARN" {
+			return "orange"
+		}
+		return ""
+	})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "ROCKER_COLOR_WARN")
+}
+
+func formatWithTheme(t *testing.T, theme Theme, level log.Level) string {
+	var buf bytes.Buffer
+
+	logger := log.New()
+	logger.Out = &buf
+	logger.Level = log.DebugLevel
+	logger.Formatter = &TextFormatter{ForceColors: true, Theme: &theme}
+
+	entry := logger.WithField("key", "value")
+	switch level {
+	case log.DebugLevel:
+		entry.Debug("hello")
+	case log.WarnLevel:
+		entry.Warn("hello")
+	case log.ErrorLevel:
+		entry.Error("hello")
+	default:
+		entry.Info("hello")
+	}
+	return buf.String()
+}
@@ -0,0 +1,71 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package util
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMakeAbsolute_Home(t *testing.T) {
+	home := os.Getenv("HOME")
+	if home == "" {
+		t.Skip("HOME is not set")
+	}
+
+	result, err := MakeAbsolute("~/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, filepath.Join(home, "foo"), result)
+}
+
+func TestMakeAbsolute_NoEnv(t *testing.T) {
+	os.Setenv("ROCKER_TEST_DIR", "/tmp/rocker")
+	defer os.Unsetenv("ROCKER_TEST_DIR")
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Environment variables are left to the callers, see absolutePathFlag
+	result, err := MakeAbsolute("$ROCKER_TEST_DIR/cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, filepath.Join(wd, "$ROCKER_TEST_DIR/cache"), result)
+}
+
+func TestMakeAbsolute_Relative(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := MakeAbsolute("foo/../bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, filepath.Join(wd, "bar"), result)
+}
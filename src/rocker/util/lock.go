@@ -0,0 +1,114 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package util
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// lockPollInterval is how often a waiting FileLock tries to acquire the lock
+var lockPollInterval = 100 * time.Millisecond
+
+// ErrLocked is returned by FileLock.Lock if the lock is held by another
+// process and could not be acquired in time
+var ErrLocked = errors.New("lock is held by another process")
+
+// FileLock is an advisory lock on a file that can be used to exclude
+// concurrent runs of rocker on the same host. The lock is released by the
+// operating system if the process dies without releasing it.
+type FileLock struct {
+	path string
+	file *os.File
+}
+
+// NewFileLock returns a new FileLock on the file at the given path,
+// the file is created if it does not exist
+func NewFileLock(path string) *FileLock {
+	return &FileLock{path: path}
+}
+
+// Path returns the path of the lock file
+func (l *FileLock) Path() string {
+	return l.path
+}
+
+// Lock acquires the lock, waiting for it to be released by another process
+// for up to timeout; zero timeout means fail immediately if the lock is held,
+// negative timeout means wait forever
+func (l *FileLock) Lock(timeout time.Duration) error {
+	if l.file != nil {
+		return fmt.Errorf("Lock %s is already acquired", l.path)
+	}
+
+	file, err := openLockFile(l.path)
+	if err != nil {
+		return fmt.Errorf("Failed to open lock file %s, error: %s", l.path, err)
+	}
+
+	deadline := time.Now().Add(timeout)
+
+	for {
+		ok, err := tryLockFile(file)
+		if err != nil {
+			file.Close()
+			return fmt.Errorf("Failed to acquire lock %s, error: %s", l.path, err)
+		}
+		if ok {
+			l.file = file
+			return nil
+		}
+		if timeout >= 0 && !time.Now().Before(deadline) {
+			file.Close()
+			return ErrLocked
+		}
+		time.Sleep(lockPollInterval)
+	}
+}
+
+// openLockFile opens the lock file read-only, which is enough to lock it, so
+// the lock file made by another user in a shared directory can be used too
+func openLockFile(path string) (*os.File, error) {
+	file, err := os.Open(path)
+	if !os.IsNotExist(err) {
+		return file, err
+	}
+
+	file, err = os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_RDONLY, 0644)
+	if os.IsExist(err) {
+		// Made by another process in the meantime
+		return os.Open(path)
+	}
+	return file, err
+}
+
+// Unlock releases the lock
+func (l *FileLock) Unlock() error {
+	if l.file == nil {
+		return nil
+	}
+	file := l.file
+	l.file = nil
+
+	if err := unlockFile(file); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
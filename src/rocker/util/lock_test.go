@@ -0,0 +1,128 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package util
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileLock_MutualExclusion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rocker-lock-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var (
+		path   = filepath.Join(dir, "build.lock")
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		inside = 0
+		maxIn  = 0
+	)
+
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			lock := NewFileLock(path)
+			if err := lock.Lock(-1); err != nil {
+				t.Error(err)
+				return
+			}
+
+			mu.Lock()
+			inside++
+			if inside > maxIn {
+				maxIn = inside
+			}
+			mu.Unlock()
+
+			time.Sleep(200 * time.Millisecond)
+
+			mu.Lock()
+			inside--
+			mu.Unlock()
+
+			if err := lock.Unlock(); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+
+	wg.Wait()
+	assert.Equal(t, 1, maxIn, "expected only one holder of the lock at a time")
+}
+
+func TestFileLock_NoWait(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rocker-lock-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "build.lock")
+
+	first := NewFileLock(path)
+	if err := first.Lock(0); err != nil {
+		t.Fatal(err)
+	}
+
+	second := NewFileLock(path)
+	assert.Equal(t, ErrLocked, second.Lock(0))
+
+	started := time.Now()
+	assert.Equal(t, ErrLocked, second.Lock(300*time.Millisecond))
+	assert.True(t, time.Since(started) >= 300*time.Millisecond, "expected to wait for the timeout")
+
+	if err := first.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, second.Lock(0))
+	assert.NoError(t, second.Unlock())
+}
+
+func TestFileLock_ReadOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rocker-lock-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The lock file of another user is only readable
+	path := filepath.Join(dir, "build.lock")
+	if err := ioutil.WriteFile(path, []byte{}, 0444); err != nil {
+		t.Fatal(err)
+	}
+
+	lock := NewFileLock(path)
+	if err := lock.Lock(0); err != nil {
+		t.Fatal(err)
+	}
+	defer lock.Unlock()
+
+	_, err = lock.file.Write([]byte("x"))
+	assert.Error(t, err, "expected the lock file to be opened read-only")
+}
@@ -0,0 +1,14 @@
+// +build !linux,!darwin,!freebsd
+
+package util
+
+import "os"
+
+// Locking is not supported on this platform, the lock is always acquired
+func tryLockFile(file *os.File) (bool, error) {
+	return true, nil
+}
+
+func unlockFile(file *os.File) error {
+	return nil
+}
@@ -0,0 +1,113 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package util
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ExtractTar extracts the tar stream to the dest directory. Only directories,
+// regular files and symlinks are extracted, entries pointing outside of dest
+// are refused, so an archive cannot write anywhere else on the host.
+func ExtractTar(r io.Reader, dest string) error {
+	tr := tar.NewReader(r)
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		path := filepath.Join(dest, filepath.FromSlash(hdr.Name))
+		if path != dest && !strings.HasPrefix(path, dest+string(os.PathSeparator)) {
+			return fmt.Errorf("Tar entry %s points outside of %s", hdr.Name, dest)
+		}
+
+		// An earlier symlink entry could redirect the writes outside of dest
+		check := path
+		if hdr.Typeflag == tar.TypeSymlink {
+			check = filepath.Dir(path)
+		}
+		if err := NoSymlinks(dest, check); err != nil {
+			return err
+		}
+
+		mode := os.FileMode(hdr.Mode).Perm()
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(path, mode|0700); err != nil {
+				return err
+			}
+		case tar.TypeReg, tar.TypeRegA:
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return err
+			}
+			f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(f, tr)
+			f.Close()
+			if err != nil {
+				return err
+			}
+			os.Chtimes(path, hdr.ModTime, hdr.ModTime)
+		case tar.TypeSymlink:
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return err
+			}
+			if err := os.Symlink(hdr.Linkname, path); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// NoSymlinks returns an error if any existing component of path
+// under dest is a symlink
+func NoSymlinks(dest, path string) error {
+	rel, err := filepath.Rel(dest, path)
+	if err != nil || rel == "." {
+		return err
+	}
+
+	cur := dest
+	for _, part := range strings.Split(rel, string(os.PathSeparator)) {
+		cur = filepath.Join(cur, part)
+		fi, err := os.Lstat(cur)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("Path %s goes through the symlink %s", rel, cur)
+		}
+	}
+
+	return nil
+}
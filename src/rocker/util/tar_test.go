@@ -0,0 +1,118 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package util
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type tarEntry struct {
+	name     string
+	typeflag byte
+	content  string
+	linkname string
+}
+
+func makeTar(t *testing.T, entries []tarEntry) *bytes.Buffer {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for _, e := range entries {
+		hdr := &tar.Header{
+			Name:     e.name,
+			Typeflag: e.typeflag,
+			Mode:     0644,
+			Size:     int64(len(e.content)),
+			Linkname: e.linkname,
+		}
+		if e.typeflag == tar.TypeDir {
+			hdr.Mode = 0755
+		}
+		if e.typeflag != tar.TypeReg {
+			hdr.Size = 0
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+func TestExtractTar(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rocker-tar-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	archive := makeTar(t, []tarEntry{
+		{name: "src/", typeflag: tar.TypeDir},
+		{name: "src/main.go", typeflag: tar.TypeReg, content: "package main"},
+		{name: "Rockerfile", typeflag: tar.TypeReg, content: "FROM ubuntu"},
+		{name: "main.go", typeflag: tar.TypeSymlink, linkname: "src/main.go"},
+	})
+
+	if err := ExtractTar(archive, dir); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "main.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "package main", string(data))
+
+	data, err = ioutil.ReadFile(filepath.Join(dir, "Rockerfile"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "FROM ubuntu", string(data))
+}
+
+func TestExtractTar_Outside(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rocker-tar-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	err = ExtractTar(makeTar(t, []tarEntry{
+		{name: "../evil", typeflag: tar.TypeReg, content: "x"},
+	}), filepath.Join(dir, "context"))
+	assert.Error(t, err)
+
+	err = ExtractTar(makeTar(t, []tarEntry{
+		{name: "etc", typeflag: tar.TypeSymlink, linkname: dir},
+		{name: "etc/evil", typeflag: tar.TypeReg, content: "x"},
+	}), filepath.Join(dir, "context"))
+	assert.Error(t, err)
+
+	_, err = os.Stat(filepath.Join(dir, "evil"))
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,155 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package util
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/pkg/fileutils"
+)
+
+// Watcher reports changed files, every change is a path of a file that
+// was created, modified or removed
+type Watcher interface {
+	Changes() <-chan string
+	Close() error
+}
+
+// PollWatcher is a Watcher that finds changes by polling the modification
+// time and size of the files; it needs no OS support and works on any filesystem
+type PollWatcher struct {
+	interval time.Duration
+	roots    map[string][]string
+	stamps   map[string]fileStamp
+	changes  chan string
+	done     chan struct{}
+	mu       sync.Mutex
+	once     sync.Once
+}
+
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// NewPollWatcher makes a PollWatcher that scans the files every interval
+func NewPollWatcher(interval time.Duration) *PollWatcher {
+	return &PollWatcher{
+		interval: interval,
+		roots:    map[string][]string{},
+		changes:  make(chan string),
+		done:     make(chan struct{}),
+	}
+}
+
+// Add watches the file or, if path is a directory, all files in it recursively
+// except the ones matching the dockerignore-like excludes relative to path
+func (w *PollWatcher) Add(path string, excludes []string) error {
+	if _, err := os.Stat(path); err != nil {
+		return err
+	}
+	w.mu.Lock()
+	w.roots[path] = excludes
+	w.mu.Unlock()
+	return nil
+}
+
+// Changes starts watching and returns the channel of changed files
+func (w *PollWatcher) Changes() <-chan string {
+	w.once.Do(func() {
+		w.stamps = w.scan()
+		go w.poll()
+	})
+	return w.changes
+}
+
+// Close stops watching
+func (w *PollWatcher) Close() error {
+	close(w.done)
+	return nil
+}
+
+func (w *PollWatcher) poll() {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+		}
+
+		stamps := w.scan()
+		for _, path := range diffStamps(w.stamps, stamps) {
+			select {
+			case w.changes <- path:
+			case <-w.done:
+				return
+			}
+		}
+		w.stamps = stamps
+	}
+}
+
+// scan collects the stamps of all watched files, the files that
+// disappear during the scan are simply missing from the result
+func (w *PollWatcher) scan() map[string]fileStamp {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	stamps := map[string]fileStamp{}
+
+	for root, excludes := range w.roots {
+		filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return nil
+			}
+			if len(excludes) > 0 {
+				rel, err := filepath.Rel(root, path)
+				if err != nil {
+					return nil
+				}
+				if skip, err := fileutils.Matches(rel, excludes); err != nil || skip {
+					return nil
+				}
+			}
+			stamps[path] = fileStamp{info.ModTime(), info.Size()}
+			return nil
+		})
+	}
+
+	return stamps
+}
+
+// diffStamps returns the paths that were created, modified or removed
+func diffStamps(before, after map[string]fileStamp) (changed []string) {
+	for path, stamp := range after {
+		if prev, ok := before[path]; !ok || prev != stamp {
+			changed = append(changed, path)
+		}
+	}
+	for path := range before {
+		if _, ok := after[path]; !ok {
+			changed = append(changed, path)
+		}
+	}
+	return changed
+}
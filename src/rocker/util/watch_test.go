@@ -0,0 +1,78 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package util
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPollWatcher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rocker-watch-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	write := func(name, content string) {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("main.go", "package main")
+	write("debug.log", "")
+
+	w := NewPollWatcher(10 * time.Millisecond)
+	defer w.Close()
+
+	if err := w.Add(dir, []string{"*.log"}); err != nil {
+		t.Fatal(err)
+	}
+	changes := w.Changes()
+
+	// Excluded files do not trigger changes
+	write("debug.log", "some output")
+	write("main.go", "package main // changed")
+
+	select {
+	case path := <-changes:
+		assert.Equal(t, filepath.Join(dir, "main.go"), path)
+	case <-time.After(time.Second):
+		t.Fatal("Expected a change of main.go")
+	}
+
+	os.Remove(filepath.Join(dir, "main.go"))
+
+	select {
+	case path := <-changes:
+		assert.Equal(t, filepath.Join(dir, "main.go"), path)
+	case <-time.After(time.Second):
+		t.Fatal("Expected a removal of main.go")
+	}
+}
+
+func TestPollWatcher_AddMissing(t *testing.T) {
+	w := NewPollWatcher(time.Second)
+	defer w.Close()
+	assert.Error(t, w.Add("/nonexistent/rocker-watch-test", nil))
+}